@@ -0,0 +1,222 @@
+// Package agent is the message loop of a guest or host agent. Frames received on a connection are routed by their
+// type, the "type" metadata key, to the registered handlers, which run on a bounded worker pool. Heartbeats are
+// handled on the receive loop itself, so slow or crashing handlers never delay them.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+var ErrNoHandler = errors.New("no handler for the message type")
+var ErrHandlerPanic = errors.New("handler panicked")
+
+const (
+	// TypeKey is the metadata key holding the message type.
+	TypeKey = "type"
+
+	// HeartbeatType is the type of the heartbeat frames, they are never passed to handlers.
+	HeartbeatType = "heartbeat"
+)
+
+// Handler handles a message, replies are sent over the connection.
+type Handler func(ctx context.Context, conn frame.Conn, f frame.Frame) error
+
+// Options tune the agent, the zero value runs 8 workers with the default limits.
+type Options struct {
+	Workers int            // Size of the worker pool
+	Limits  ivshmem.Limits // MaxPending bounds the messages queued for the pool and for every message type
+
+	// OnError is called with the type of the message for the errors of handlers, including panics, and for the
+	// messages dropped because no handler exists or the queues are full.
+	OnError func(typ string, err error)
+
+	// OnHeartbeat is called on the receive loop for every heartbeat, it must not block.
+	OnHeartbeat func(f frame.Frame)
+}
+
+// Agent dispatches the messages of a connection to the handlers.
+type Agent struct {
+	conn frame.Conn
+	opts Options
+
+	mu     sync.RWMutex
+	routes map[string]*route
+
+	beatMu   sync.Mutex
+	lastBeat time.Time
+}
+
+// New returns an agent for the connection.
+func New(conn frame.Conn, opts Options) *Agent {
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+
+	if opts.Limits == (ivshmem.Limits{}) {
+		opts.Limits = ivshmem.DefaultLimits
+	}
+
+	return &Agent{conn: conn, opts: opts, routes: make(map[string]*route)}
+}
+
+// Handle registers the handler for the message type. At most limit messages of the type are handled at once, zero
+// means as many as there are workers. Registering a type again replaces its handler, also while the agent runs, the
+// messages already handled or queued then finish with the old one.
+func (a *Agent) Handle(typ string, h Handler, limit int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes[typ] = &route{typ: typ, handler: h, limit: limit}
+}
+
+// Unhandle removes the handler of the message type, while the agent runs. The messages of the type already being
+// handled finish, the queued ones are dropped with ErrNoHandler.
+func (a *Agent) Unhandle(typ string) bool {
+	a.mu.Lock()
+	r, ok := a.routes[typ]
+	delete(a.routes, typ)
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	r.mu.Lock()
+	r.removed = true
+	dropped := len(r.pending)
+	r.pending = nil
+	r.mu.Unlock()
+
+	for i := 0; i < dropped; i++ {
+		a.report(typ, ErrNoHandler)
+	}
+
+	return true
+}
+
+// Types returns the sorted message types having a handler.
+func (a *Agent) Types() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	types := make([]string, 0, len(a.routes))
+	for typ := range a.routes {
+		types = append(types, typ)
+	}
+
+	sort.Strings(types)
+	return types
+}
+
+// LastHeartbeat returns when the last heartbeat was received, the zero time if none was.
+func (a *Agent) LastHeartbeat() time.Time {
+	a.beatMu.Lock()
+	defer a.beatMu.Unlock()
+	return a.lastBeat
+}
+
+// Run receives and dispatches the messages until the connection fails or the context is done, then waits for the
+// running handlers. Like the connection itself, a blocked receive is only unblocked by closing the connection.
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := newPool(ctx, a, a.opts.Workers, a.opts.Limits)
+	defer p.stop()
+
+	for {
+		f, err := a.conn.Recv(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("receive: %w", err)
+		}
+
+		typ := f.Metadata.Get(TypeKey)
+		if typ == HeartbeatType {
+			a.heartbeat(f)
+			continue
+		}
+
+		a.mu.RLock()
+		r, ok := a.routes[typ]
+		a.mu.RUnlock()
+		if !ok {
+			a.report(typ, ErrNoHandler)
+			continue
+		}
+
+		if err := p.submit(job{route: r, frame: f}); err != nil {
+			a.report(typ, err)
+		}
+	}
+}
+
+// SendHeartbeats sends a heartbeat to the peer every interval until the context is done or a send fails. The peer
+// agent records them without involving the handlers, see LastHeartbeat and Options.OnHeartbeat.
+func (a *Agent) SendHeartbeats(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("%w: heartbeat interval %s", ivshmem.ErrInvalidArgument, interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f := frame.Frame{Metadata: frame.Metadata{TypeKey: HeartbeatType}}
+		if err := a.conn.Send(ctx, f); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("send heartbeat: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat records a heartbeat.
+func (a *Agent) heartbeat(f frame.Frame) {
+	a.beatMu.Lock()
+	a.lastBeat = time.Now()
+	a.beatMu.Unlock()
+
+	if a.opts.OnHeartbeat != nil {
+		a.opts.OnHeartbeat(f)
+	}
+}
+
+// call runs the handler, turning a panic into an error.
+func (a *Agent) call(ctx context.Context, r *route, f frame.Frame) {
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("%w: %v", ErrHandlerPanic, v)
+			}
+		}()
+
+		return r.handler(ctx, a.conn, f)
+	}()
+
+	if err != nil {
+		a.report(r.typ, err)
+	}
+}
+
+// report passes the error to the error callback.
+func (a *Agent) report(typ string, err error) {
+	if a.opts.OnError != nil {
+		a.opts.OnError(typ, err)
+	}
+}
@@ -0,0 +1,12 @@
+package agent
+
+import "errors"
+
+var ErrInvalidPlugin = errors.New("invalid plugin")
+var ErrPluginsUnsupported = errors.New("plugins are not supported on this platform")
+
+// PluginSymbol is the function a plugin exports to register its handlers, with the signature of RegisterFunc.
+const PluginSymbol = "Register"
+
+// RegisterFunc registers the handlers of a plugin with the agent.
+type RegisterFunc = func(a *Agent) error
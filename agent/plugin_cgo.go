@@ -0,0 +1,34 @@
+//go:build linux && cgo
+
+package agent
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// LoadPlugin opens the Go plugin (go build -buildmode=plugin) and calls its Register function, so a long lived agent
+// gains handlers without restarting and renegotiating the session. Go can't unload plugins, their handlers are
+// removed with Unhandle but the code stays loaded. Plugins need cgo, they are only loaded on linux.
+func (a *Agent) LoadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("open plugin: %w", err)
+	}
+
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPlugin, err)
+	}
+
+	register, ok := sym.(RegisterFunc)
+	if !ok {
+		return fmt.Errorf("%w: %s is a %T, expected a %T", ErrInvalidPlugin, PluginSymbol, sym, RegisterFunc(nil))
+	}
+
+	if err := register(a); err != nil {
+		return fmt.Errorf("register plugin: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !cgo
+
+package agent
+
+import "fmt"
+
+// LoadPlugin always fails with ErrPluginsUnsupported, plugins need cgo and are only loaded on linux.
+func (a *Agent) LoadPlugin(path string) error {
+	return fmt.Errorf("%w: %s", ErrPluginsUnsupported, path)
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+// route is a message type with its handler and its concurrency limit.
+type route struct {
+	typ     string
+	handler Handler
+	limit   int
+
+	mu      sync.Mutex
+	removed bool // Set by Unhandle, the queued messages are dropped
+	running int
+	pending []frame.Frame // Messages waiting for a running handler of the type to finish
+}
+
+// job is a message waiting for a worker.
+type job struct {
+	route *route
+	frame frame.Frame
+}
+
+// pool is the bounded set of workers running the handlers.
+type pool struct {
+	agent  *Agent
+	limits ivshmem.Limits
+	ctx    context.Context
+	jobs   chan job
+	wg     sync.WaitGroup
+}
+
+// newPool starts the workers.
+func newPool(ctx context.Context, a *Agent, workers int, limits ivshmem.Limits) *pool {
+	queue := limits.MaxPending
+	if queue <= 0 {
+		queue = workers
+	}
+
+	p := &pool{agent: a, limits: limits, ctx: ctx, jobs: make(chan job, queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// submit queues the job, it never blocks: a full queue drops the message, so the receive loop keeps handling the
+// heartbeats.
+func (p *pool) submit(j job) error {
+	select {
+	case p.jobs <- j:
+		return nil
+	default:
+		return fmt.Errorf("%w: worker queue full", ivshmem.ErrResourceExhausted)
+	}
+}
+
+// stop lets the workers finish the queued jobs and waits for them.
+func (p *pool) stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// work runs the jobs.
+func (p *pool) work() {
+	defer p.wg.Done()
+	for j := range p.jobs {
+		p.run(j)
+	}
+}
+
+// run handles the message and then the messages of the same type which queued up behind the limit meanwhile. A job
+// over the limit of its type is parked on the route instead of occupying the worker.
+func (p *pool) run(j job) {
+	r := j.route
+	r.mu.Lock()
+	if r.removed {
+		r.mu.Unlock()
+		p.agent.report(r.typ, ErrNoHandler)
+		return
+	}
+
+	if r.limit > 0 && r.running >= r.limit {
+		if err := p.limits.CheckPending(len(r.pending) + 1); err != nil {
+			r.mu.Unlock()
+			p.agent.report(r.typ, err)
+			return
+		}
+
+		r.pending = append(r.pending, j.frame)
+		r.mu.Unlock()
+		return
+	}
+
+	r.running++
+	r.mu.Unlock()
+
+	for f := j.frame; ; {
+		p.agent.call(p.ctx, r, f)
+
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			r.running--
+			r.mu.Unlock()
+			return
+		}
+
+		f = r.pending[0]
+		r.pending = r.pending[1:]
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,581 @@
+// Package arena manages the region as a heap of named blocks, so subsystems sharing one device allocate their memory
+// at runtime instead of agreeing on offsets out of band. An allocation table at the start of the region maps the
+// names to offsets, both sides allocate, look up and free blocks through it, and a ticket lock of the shmsync package
+// in the header keeps their changes apart.
+//
+// The arena doesn't track who uses a block: freeing a block the other side still uses hands its memory to the next
+// allocation. Agree on who frees what, or keep the blocks for the lifetime of the region.
+//
+// A block may be charged to an owner, a component sharing the arena, and SetQuotas caps the bytes every owner holds
+// so one misbehaving component can't exhaust the heap for the others. The owner is stored in the table as the CRC-32
+// of its name, so the quotas count the blocks of both sides.
+//
+// Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a peer initialized the arena
+// again, their blocks may have been handed out anew.
+//
+// Layout, all the values are little endian:
+//
+//	 0 magic (uint32)
+//	 4 version (uint32)
+//	 8 table entries (uint32)
+//	12 reserved (uint32)
+//	16 heap offset (uint64)
+//	24 heap size (uint64)
+//	32 lock, a shmsync.Mutex (8 bytes)
+//	40 generation, incremented by every allocation, free and compaction (uint32)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 allocation table: name (40 bytes), state (uint32), owner (uint32), offset (uint64), size (uint64)
+//	   heap
+//
+// Reserve a segment of type layout.TypeArena for the arena when the region has a layout.
+package arena
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/layout"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrInvalidName = errors.New("invalid block name")
+var ErrInvalidSize = errors.New("invalid block size")
+var ErrExists = errors.New("block already allocated")
+var ErrNoBlock = errors.New("no such block")
+var ErrTableFull = errors.New("allocation table full")
+var ErrStale = shmhdr.ErrStale
+
+// ErrQuotaExceeded is the error of the layout package, so one check covers the segments and the blocks.
+var ErrQuotaExceeded = layout.ErrQuotaExceeded
+
+const (
+	Magic      uint32 = 0x52415649 // "IVAR" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+	EntrySize         = 64
+
+	// MaxNameLength is the longest block name fitting into a table entry.
+	MaxNameLength = 40
+
+	// Align is the alignment of the blocks, a cache line.
+	Align = 64
+
+	// DefaultEntries is the size of the allocation table when the options don't set one.
+	DefaultEntries = 64
+)
+
+// Header field offsets.
+const (
+	offMagic      = 0
+	offVersion    = 4
+	offEntries    = 8
+	offHeapOffset = 16
+	offHeapSize   = 24
+	offLock       = 32
+	offGeneration = 40
+	offSession    = 44
+	offEpoch      = 60
+)
+
+// Table entry field offsets.
+const (
+	entName   = 0
+	entState  = 40
+	entOwner  = 44
+	entOffset = 48
+	entSize   = 56
+)
+
+// Entry states.
+const (
+	stateFree = iota
+	stateUsed
+)
+
+// LockTimeout is how long the calls wait for the other side to finish its change of the table.
+var LockTimeout = 5 * time.Second
+
+// Options size an arena.
+type Options struct {
+	Entries int // Blocks the table holds at most, DefaultEntries by default
+}
+
+// Block is an allocated block.
+type Block struct {
+	Name   string
+	Offset uint64 // From the start of the arena
+	Size   uint64
+}
+
+// Arena is a view of the arena stored in the region.
+type Arena struct {
+	mem        []byte
+	entries    uint32
+	heapOffset uint64
+	heapSize   uint64
+	lock       *shmsync.Mutex
+	generation *uint32
+	stamp      shmhdr.Stamp
+
+	quotasMu sync.Mutex
+	quotas   map[uint32]uint64 // Limits by the tag of the owner
+}
+
+// Init writes an empty arena into the region, the heap takes everything after the allocation table but the last
+// ivshmem.MarkerSize bytes, which hold the marker of the device. Only one side should call Init, before the others
+// call Open.
+func Init(mem []byte, opts Options) (*Arena, error) {
+	if opts.Entries <= 0 {
+		opts.Entries = DefaultEntries
+	}
+
+	heapOffset := (uint64(HeaderSize) + uint64(opts.Entries)*EntrySize + Align - 1) &^ (Align - 1)
+	if heapOffset+ivshmem.MarkerSize >= uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need more than %d bytes for the table of %d entries and the marker, have %d",
+			ErrRegionTooSmall, heapOffset+ivshmem.MarkerSize, opts.Entries, len(mem))
+	}
+
+	a, err := view(mem, uint32(opts.Entries), heapOffset, uint64(len(mem))-heapOffset-ivshmem.MarkerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := range mem[HeaderSize:heapOffset] {
+		mem[HeaderSize+i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offEntries:], a.entries)
+	binary.LittleEndian.PutUint64(mem[offHeapOffset:], a.heapOffset)
+	binary.LittleEndian.PutUint64(mem[offHeapSize:], a.heapSize)
+	shmsync.StoreUint64At(mem, offLock, 0)
+	atomic.StoreUint32(a.generation, 0)
+
+	shmhdr.Publish(mem, Magic)
+	return a, nil
+}
+
+// Open validates the header written by Init and returns the arena.
+func Open(mem []byte) (*Arena, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	entries := binary.LittleEndian.Uint32(mem[offEntries:])
+	heapOffset := binary.LittleEndian.Uint64(mem[offHeapOffset:])
+	heapSize := binary.LittleEndian.Uint64(mem[offHeapSize:])
+	if entries == 0 || heapOffset < HeaderSize+uint64(entries)*EntrySize || heapOffset%Align != 0 {
+		return nil, fmt.Errorf("%w: %d entries with the heap at %d", ErrInvalidHeader, entries, heapOffset)
+	}
+
+	if heapOffset > uint64(len(mem)) || heapSize > uint64(len(mem))-heapOffset {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, heapOffset+heapSize, len(mem))
+	}
+
+	a, err := view(mem, entries, heapOffset, heapSize)
+	if err != nil {
+		return nil, err
+	}
+
+	a.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return a, nil
+}
+
+// view returns the arena over the region.
+func view(mem []byte, entries uint32, heapOffset, heapSize uint64) (*Arena, error) {
+	// The lock and the offsets need 8 byte alignment, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	lock, err := shmsync.MutexAt(mem, offLock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Arena{
+		mem:        mem,
+		entries:    entries,
+		heapOffset: heapOffset,
+		heapSize:   heapSize,
+		lock:       lock,
+		generation: (*uint32)(unsafe.Pointer(&mem[offGeneration])),
+	}, nil
+}
+
+// Generation returns the number of allocations, frees and compactions so far, for caches of looked up blocks.
+func (a *Arena) Generation() uint32 {
+	return atomic.LoadUint32(a.generation)
+}
+
+// Session returns the ID of the initialization the arena was opened with.
+func (a *Arena) Session() shmhdr.Session {
+	return a.stamp.Session()
+}
+
+// Epoch returns the number of times the arena was initialized, when it was opened.
+func (a *Arena) Epoch() uint32 {
+	return a.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the arena again since it was opened, the view must be reopened then.
+func (a *Arena) Stale() bool {
+	return a.stamp.Check() != nil
+}
+
+// SetQuotas caps the bytes of the blocks charged to every owner, replacing the previous quotas. Owners missing from
+// the map are not limited. The quotas are checked by the side allocating, so give both sides the same ones.
+func (a *Arena) SetQuotas(quotas map[string]uint64) {
+	tagged := make(map[uint32]uint64, len(quotas))
+	for owner, limit := range quotas {
+		tagged[ownerTag(owner)] = limit
+	}
+
+	a.quotasMu.Lock()
+	defer a.quotasMu.Unlock()
+	a.quotas = tagged
+}
+
+// Usage returns the bytes of the blocks charged to the owner, by either side.
+func (a *Arena) Usage(owner string) (uint64, error) {
+	var used uint64
+	err := a.locked(func() error {
+		used = a.usage(ownerTag(owner))
+		return nil
+	})
+
+	return used, err
+}
+
+// Alloc allocates a block of the size under the name and returns its memory, zeroed. The block isn't charged to any
+// owner.
+func (a *Arena) Alloc(name string, size uint64) ([]byte, error) {
+	return a.AllocOwned("", name, size)
+}
+
+// AllocOwned is like Alloc, but charges the block to the owner. It fails with ErrQuotaExceeded, which also matches
+// ivshmem.ErrResourceExhausted, if the block would take the owner over its quota.
+func (a *Arena) AllocOwned(owner, name string, size uint64) ([]byte, error) {
+	if name == "" || len(name) > MaxNameLength {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	if size == 0 {
+		return nil, fmt.Errorf("%w: block %q of 0 bytes", ErrInvalidSize, name)
+	}
+
+	var block Block
+	err := a.locked(func() error {
+		if _, ok := a.find(name); ok {
+			return fmt.Errorf("%w: %q", ErrExists, name)
+		}
+
+		free, ok := uint32(0), false
+		for i := uint32(0); i < a.entries && !ok; i++ {
+			if a.state(i) == stateFree {
+				free, ok = i, true
+			}
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: %d entries: %w", ErrTableFull, a.entries, ivshmem.ErrResourceExhausted)
+		}
+
+		if err := a.checkQuota(owner, size); err != nil {
+			return err
+		}
+
+		offset, ok := a.fit(size)
+		if !ok {
+			return fmt.Errorf("no room for %d bytes in the heap of %d: %w", size, a.heapSize, ivshmem.ErrResourceExhausted)
+		}
+
+		block = Block{Name: name, Offset: offset, Size: size}
+		data := a.mem[offset : offset+size]
+		for i := range data {
+			data[i] = 0
+		}
+
+		entry := a.entry(free)
+		for i := range entry {
+			entry[i] = 0
+		}
+
+		copy(entry[entName:], name)
+		binary.LittleEndian.PutUint64(entry[entOffset:], offset)
+		binary.LittleEndian.PutUint64(entry[entSize:], size)
+		binary.LittleEndian.PutUint32(entry[entOwner:], ownerTag(owner))
+		binary.LittleEndian.PutUint32(entry[entState:], stateUsed)
+		atomic.AddUint32(a.generation, 1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.bytes(block)
+}
+
+// Lookup returns the memory of the block allocated under the name.
+func (a *Arena) Lookup(name string) ([]byte, error) {
+	var block Block
+	err := a.locked(func() error {
+		i, ok := a.find(name)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrNoBlock, name)
+		}
+
+		block = a.block(i)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a.bytes(block)
+}
+
+// Free frees the block allocated under the name, its memory must not be used anymore by either side.
+func (a *Arena) Free(name string) error {
+	return a.locked(func() error {
+		i, ok := a.find(name)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrNoBlock, name)
+		}
+
+		binary.LittleEndian.PutUint32(a.entry(i)[entState:], stateFree)
+		atomic.AddUint32(a.generation, 1)
+		return nil
+	})
+}
+
+// Blocks returns the allocated blocks, in the order of their offsets.
+func (a *Arena) Blocks() ([]Block, error) {
+	var blocks []Block
+	err := a.locked(func() error {
+		blocks = a.used()
+		return nil
+	})
+
+	return blocks, err
+}
+
+// Available returns the bytes of the heap not allocated, they may be split into holes too small for a block.
+func (a *Arena) Available() (uint64, error) {
+	var free uint64
+	err := a.locked(func() error {
+		free = a.heapSize
+		for _, b := range a.used() {
+			free -= b.Size
+		}
+
+		return nil
+	})
+
+	return free, err
+}
+
+// Compact moves the allocated blocks towards the start of the heap, keeping their order, so the holes left by freed
+// blocks merge into one at the end. It returns the number of blocks moved. The contents move along, but the memory
+// returned by Alloc and Lookup before doesn't: neither side may use it while Compact runs, and both must look the
+// blocks up again once Generation changes. Stop the users of the arena on both sides around the call.
+func (a *Arena) Compact() (int, error) {
+	moved := 0
+	err := a.locked(func() error {
+		type placed struct {
+			index uint32
+			block Block
+		}
+
+		var blocks []placed
+		for i := uint32(0); i < a.entries; i++ {
+			if a.state(i) == stateUsed {
+				blocks = append(blocks, placed{i, a.block(i)})
+			}
+		}
+
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i].block.Offset < blocks[j].block.Offset })
+		offset := a.heapOffset
+		for _, p := range blocks {
+			if _, err := a.bytes(p.block); err != nil {
+				return err
+			}
+
+			// Moving down never overwrites a block not moved yet, copy handles the overlap with the block itself
+			if p.block.Offset > offset {
+				copy(a.mem[offset:offset+p.block.Size], a.mem[p.block.Offset:p.block.Offset+p.block.Size])
+				binary.LittleEndian.PutUint64(a.entry(p.index)[entOffset:], offset)
+				moved++
+			}
+
+			offset = (offset + p.block.Size + Align - 1) &^ (Align - 1)
+		}
+
+		if moved > 0 {
+			atomic.AddUint32(a.generation, 1)
+		}
+
+		return nil
+	})
+
+	return moved, err
+}
+
+// locked runs the function holding the lock of the table.
+func (a *Arena) locked(f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), LockTimeout)
+	defer cancel()
+	if err := a.lock.Lock(ctx); err != nil {
+		return fmt.Errorf("lock the allocation table: %w", err)
+	}
+	defer a.lock.Unlock()
+
+	if err := a.stamp.Check(); err != nil {
+		return err
+	}
+
+	return f()
+}
+
+// checkQuota fails if size more bytes take the owner over its quota, the caller holds the lock.
+func (a *Arena) checkQuota(owner string, size uint64) error {
+	tag := ownerTag(owner)
+	a.quotasMu.Lock()
+	limit, ok := a.quotas[tag]
+	a.quotasMu.Unlock()
+	if !ok || owner == "" {
+		return nil
+	}
+
+	used := a.usage(tag)
+	if used+size < used || used+size > limit {
+		return fmt.Errorf("%w: owner %q holds %d bytes, %d more exceed the quota of %d: %w",
+			ErrQuotaExceeded, owner, used, size, limit, ivshmem.ErrResourceExhausted)
+	}
+
+	return nil
+}
+
+// usage sums the sizes of the blocks charged to the owner tag, the caller holds the lock.
+func (a *Arena) usage(tag uint32) uint64 {
+	var used uint64
+	for i := uint32(0); i < a.entries; i++ {
+		if a.state(i) == stateUsed && binary.LittleEndian.Uint32(a.entry(i)[entOwner:]) == tag {
+			used += binary.LittleEndian.Uint64(a.entry(i)[entSize:])
+		}
+	}
+
+	return used
+}
+
+// ownerTag returns the tag of the owner stored in the table, zero for no owner.
+func ownerTag(owner string) uint32 {
+	if owner == "" {
+		return 0
+	}
+
+	return crc32.ChecksumIEEE([]byte(owner))
+}
+
+// fit returns the lowest offset of the heap where size bytes don't overlap the allocated blocks.
+func (a *Arena) fit(size uint64) (uint64, bool) {
+	end := a.heapOffset + a.heapSize
+	offset := a.heapOffset
+	for _, b := range a.used() {
+		if offset+size <= b.Offset {
+			break
+		}
+
+		if blockEnd := b.Offset + b.Size; blockEnd > offset {
+			offset = (blockEnd + Align - 1) &^ (Align - 1)
+		}
+	}
+
+	return offset, offset <= end && size <= end-offset
+}
+
+// used returns the allocated blocks sorted by offset, the caller holds the lock.
+func (a *Arena) used() []Block {
+	var blocks []Block
+	for i := uint32(0); i < a.entries; i++ {
+		if a.state(i) == stateUsed {
+			blocks = append(blocks, a.block(i))
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Offset < blocks[j].Offset })
+	return blocks
+}
+
+// find returns the entry of the allocated block with the name, the caller holds the lock.
+func (a *Arena) find(name string) (uint32, bool) {
+	for i := uint32(0); i < a.entries; i++ {
+		if a.state(i) == stateUsed && a.name(i) == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// bytes returns the memory of the block, checking that a corrupted table doesn't point outside the heap.
+func (a *Arena) bytes(b Block) ([]byte, error) {
+	end := a.heapOffset + a.heapSize
+	if b.Offset < a.heapOffset || b.Offset > end || b.Size > end-b.Offset {
+		return nil, fmt.Errorf("%w: block %q out of bounds", ErrInvalidHeader, b.Name)
+	}
+
+	return a.mem[b.Offset : b.Offset+b.Size : b.Offset+b.Size], nil
+}
+
+// entry returns the table entry.
+func (a *Arena) entry(i uint32) []byte {
+	off := HeaderSize + uint64(i)*EntrySize
+	return a.mem[off : off+EntrySize]
+}
+
+// state returns the state of the table entry.
+func (a *Arena) state(i uint32) uint32 {
+	return binary.LittleEndian.Uint32(a.entry(i)[entState:])
+}
+
+// block returns the block described by the table entry.
+func (a *Arena) block(i uint32) Block {
+	entry := a.entry(i)
+	return Block{
+		Name:   a.name(i),
+		Offset: binary.LittleEndian.Uint64(entry[entOffset:]),
+		Size:   binary.LittleEndian.Uint64(entry[entSize:]),
+	}
+}
+
+// name returns the name of the block stored in the table entry.
+func (a *Arena) name(i uint32) string {
+	name := a.entry(i)[entName : entName+MaxNameLength]
+	for k, c := range name {
+		if c == 0 {
+			return string(name[:k])
+		}
+	}
+
+	return string(name)
+}
@@ -0,0 +1,182 @@
+package arena_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/arena"
+)
+
+// newPair returns the two sides of an arena over a fresh region.
+func newPair(t *testing.T, size int) (*arena.Arena, *arena.Arena) {
+	t.Helper()
+	mem := make([]byte, size)
+	a, err := arena.Init(mem, arena.Options{Entries: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := arena.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+func TestQuota(t *testing.T) {
+	a, b := newPair(t, 64<<10)
+	quotas := map[string]uint64{"video": 4096}
+	a.SetQuotas(quotas)
+	b.SetQuotas(quotas)
+
+	if _, err := a.AllocOwned("video", "frame0", 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other side sees the blocks charged by this one
+	_, err := b.AllocOwned("video", "frame1", 2000)
+	if !errors.Is(err, arena.ErrQuotaExceeded) || !errors.Is(err, ivshmem.ErrResourceExhausted) {
+		t.Fatalf("want ErrQuotaExceeded and ErrResourceExhausted, got %v", err)
+	}
+
+	// Other owners and blocks without an owner aren't limited
+	if _, err := b.AllocOwned("audio", "samples", 8192); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Alloc("scratch", 8192); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free("frame0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.AllocOwned("video", "frame1", 2000); err != nil {
+		t.Fatalf("after freeing: %v", err)
+	}
+
+	if used, err := a.Usage("video"); err != nil || used != 2000 {
+		t.Fatalf("want 2000 bytes used, got %d, %v", used, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	// The heap holds exactly the four blocks between the table of 8 entries and the marker
+	a, b := newPair(t, arena.HeaderSize+8*arena.EntrySize+4*4032+ivshmem.MarkerSize)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		mem, err := a.Alloc(name, 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range mem {
+			mem[i] = name[0]
+		}
+	}
+
+	if err := a.Free("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Alloc("large", 8000); !errors.Is(err, ivshmem.ErrResourceExhausted) {
+		t.Fatalf("fragmented heap: want ErrResourceExhausted, got %v", err)
+	}
+
+	generation := b.Generation()
+	if moved, err := b.Compact(); err != nil || moved != 2 {
+		t.Fatalf("want 2 blocks moved, got %d, %v", moved, err)
+	}
+
+	if b.Generation() == generation {
+		t.Error("the compaction didn't change the generation")
+	}
+
+	for _, name := range []string{"b", "d"} {
+		mem, err := a.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, c := range mem {
+			if c != name[0] {
+				t.Fatalf("block %s: byte %d is %q after the move", name, i, c)
+			}
+		}
+	}
+
+	// The freed space is now one hole, large enough for the block which didn't fit either of the two
+	if _, err := a.Alloc("large", 8000); err != nil {
+		t.Fatal(err)
+	}
+
+	if moved, err := a.Compact(); err != nil || moved != 0 {
+		t.Fatalf("compacted arena: want nothing moved, got %d, %v", moved, err)
+	}
+}
+
+func TestMarker(t *testing.T) {
+	mem := make([]byte, 16<<10)
+	if err := ivshmem.WriteMarker(mem, "guest-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := arena.Init(mem, arena.Options{Entries: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Filling the whole heap leaves the marker at the end of the region alone
+	free, err := a.Available()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := a.Alloc("all", free)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range block {
+		block[i] = 0xff
+	}
+
+	if tag, ok := ivshmem.ReadMarker(mem); !ok || tag != "guest-a" {
+		t.Errorf("want the marker %q, got %q, %v", "guest-a", tag, ok)
+	}
+}
+
+func TestStale(t *testing.T) {
+	mem := make([]byte, 64<<10)
+	if _, err := arena.Init(mem, arena.Options{Entries: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := arena.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.Alloc("frames", 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := arena.Init(mem, arena.Options{Entries: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fresh.Epoch() != old.Epoch()+1 || fresh.Session() == old.Session() {
+		t.Errorf("reinitialization kept epoch %d and session %s", fresh.Epoch(), fresh.Session())
+	}
+
+	if _, err := old.Lookup("frames"); !errors.Is(err, arena.ErrStale) {
+		t.Errorf("want ErrStale, got %v", err)
+	}
+}
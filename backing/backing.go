@@ -0,0 +1,259 @@
+// Package backing tells which host file backs the ivshmem device at which guest PCI location, so a host running many
+// VMs attaches the right Host mapper to the right guest. The answer comes from a running QEMU over QMP or from a
+// libvirt domain definition.
+package backing
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/qmp"
+)
+
+var ErrNoBackingFile = errors.New("device has no backing file")
+var ErrNotFound = errors.New("no device at the location")
+var ErrUnknownController = errors.New("no PCI controller with the index")
+
+// Binding ties an ivshmem device of a VM to the host file backing its memory.
+type Binding struct {
+	VM       string              // Name of the VM, if known
+	ID       string              // Device id (QEMU) or shared memory name (libvirt)
+	Location ivshmem.PCILocation // Location of the device as seen by the guest
+	Path     string              // Host file backing the memory, empty for doorbell devices served by ivshmem-server
+	Size     uint64
+}
+
+// FromQMP returns the bindings of the VM behind the QMP client.
+func FromQMP(ctx context.Context, vm string, c *qmp.Client) ([]Binding, error) {
+	devices, err := c.IvshmemDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]Binding, 0, len(devices))
+	for _, dev := range devices {
+		bindings = append(bindings, Binding{
+			VM:       vm,
+			ID:       dev.ID,
+			Location: ivshmem.NewPCILocation(dev.Bus, dev.Slot, dev.Function),
+			Path:     dev.MemPath,
+			Size:     dev.Size,
+		})
+	}
+
+	return bindings, nil
+}
+
+// address is a libvirt device address, the bus is the index of the PCI controller the device is plugged into.
+type address struct {
+	Type     string `xml:"type,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+}
+
+// controller is a libvirt controller, the PCI ones provide the buses.
+type controller struct {
+	Type   string `xml:"type,attr"`
+	Index  uint64 `xml:"index,attr"`
+	Model  string `xml:"model,attr"`
+	Target struct {
+		BusNr string `xml:"busNr,attr"`
+	} `xml:"target"`
+	Address address `xml:"address"`
+}
+
+// domain is the part of the libvirt domain XML describing the shared memory devices and the PCI controllers.
+type domain struct {
+	Name        string       `xml:"name"`
+	Controllers []controller `xml:"devices>controller"`
+	Shmems      []struct {
+		Name  string `xml:"name,attr"`
+		Model struct {
+			Type string `xml:"type,attr"`
+		} `xml:"model"`
+		Size struct {
+			Unit  string `xml:"unit,attr"`
+			Value uint64 `xml:",chardata"`
+		} `xml:"size"`
+		Server *struct {
+			Path string `xml:"path,attr"`
+		} `xml:"server"`
+		Address address `xml:"address"`
+	} `xml:"devices>shmem"`
+}
+
+// FromDomainXML returns the bindings of a libvirt domain, as printed by virsh dumpxml. Libvirt backs the memory of a
+// device without a server with /dev/shm/<name>.
+//
+// The bus of a libvirt address is the index of a controller, not the bus number the guest sees. The bus numbers are
+// derived from the controllers the way the firmware assigns them: the root bus is 0, the expander buses have the
+// number of their target and the bridges below a bus are numbered depth first, in the order of their slots.
+func FromDomainXML(r io.Reader) ([]Binding, error) {
+	var d domain
+	if err := xml.NewDecoder(r).Decode(&d); err != nil {
+		return nil, fmt.Errorf("decode domain: %w", err)
+	}
+
+	buses, err := busNumbers(d.Controllers)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]Binding, 0, len(d.Shmems))
+	for _, shm := range d.Shmems {
+		if shm.Address.Type != "" && shm.Address.Type != "pci" {
+			continue
+		}
+
+		size, err := scale(shm.Size.Value, shm.Size.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("shmem %s: %w", shm.Name, err)
+		}
+
+		var loc [3]uint64
+		for i, field := range []string{shm.Address.Bus, shm.Address.Slot, shm.Address.Function} {
+			if field == "" {
+				continue
+			}
+
+			if loc[i], err = strconv.ParseUint(field, 0, 8); err != nil {
+				return nil, fmt.Errorf("shmem %s: parse address: %w", shm.Name, err)
+			}
+		}
+
+		bus, ok := buses[loc[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: shmem %s is on controller %d", ErrUnknownController, shm.Name, loc[0])
+		}
+		loc[0] = bus
+
+		b := Binding{
+			VM:       d.Name,
+			ID:       shm.Name,
+			Location: ivshmem.NewPCILocation(uint8(loc[0]), uint8(loc[1]), uint8(loc[2])),
+			Size:     size,
+		}
+
+		if shm.Server == nil && shm.Model.Type != "ivshmem-doorbell" {
+			b.Path = filepath.Join("/dev/shm", shm.Name)
+		}
+
+		bindings = append(bindings, b)
+	}
+
+	return bindings, nil
+}
+
+// busNumbers maps the indexes of the PCI controllers to the guest bus numbers of their buses. The root controller
+// has index 0, a domain without any controllers only has that bus.
+func busNumbers(controllers []controller) (map[uint64]uint64, error) {
+	buses := map[uint64]uint64{0: 0}
+	children := make(map[uint64][]controller)
+	var roots []controller
+	for _, c := range controllers {
+		if c.Type != "pci" || c.Index == 0 {
+			continue
+		}
+
+		if c.Model == "pci-expander-bus" || c.Model == "pcie-expander-bus" {
+			if _, err := strconv.ParseUint(c.Target.BusNr, 0, 8); err != nil {
+				return nil, fmt.Errorf("%w: expander bus %d has no bus number: %w", ErrUnknownController, c.Index, err)
+			}
+
+			roots = append(roots, c)
+			continue
+		}
+
+		parent, err := strconv.ParseUint(c.Address.Bus, 0, 8)
+		if c.Address.Bus != "" && err != nil {
+			return nil, fmt.Errorf("controller %d: parse address: %w", c.Index, err)
+		}
+
+		children[parent] = append(children[parent], c)
+	}
+
+	for _, list := range children {
+		sort.Slice(list, func(i, j int) bool {
+			return slotOrder(list[i].Address) < slotOrder(list[j].Address)
+		})
+	}
+
+	// number assigns the bus number to the controller and the following ones to the bridges below it, returning the
+	// last one it assigned
+	var number func(index, bus uint64) uint64
+	number = func(index, bus uint64) uint64 {
+		buses[index] = bus
+		last := bus
+		for _, c := range children[index] {
+			if _, seen := buses[c.Index]; !seen {
+				last = number(c.Index, last+1)
+			}
+		}
+
+		return last
+	}
+
+	number(0, 0)
+	for _, c := range roots {
+		bus, _ := strconv.ParseUint(c.Target.BusNr, 0, 8)
+		number(c.Index, bus)
+	}
+
+	return buses, nil
+}
+
+// slotOrder returns the sort key of the slot and function of an address, unparsable fields sort first.
+func slotOrder(a address) uint64 {
+	slot, _ := strconv.ParseUint(a.Slot, 0, 8)
+	function, _ := strconv.ParseUint(a.Function, 0, 8)
+	return slot<<8 | function
+}
+
+// Find returns the binding of the device at the guest location.
+func Find(bindings []Binding, loc ivshmem.PCILocation) (Binding, error) {
+	for _, b := range bindings {
+		if b.Location == loc {
+			return b, nil
+		}
+	}
+
+	return Binding{}, fmt.Errorf("%w: %s", ErrNotFound, loc)
+}
+
+// scale converts a libvirt scaled integer to bytes, the default unit is bytes.
+func scale(value uint64, unit string) (uint64, error) {
+	var factor uint64
+	switch strings.ToLower(unit) {
+	case "", "b", "bytes":
+		factor = 1
+	case "k", "kib":
+		factor = 1 << 10
+	case "m", "mib":
+		factor = 1 << 20
+	case "g", "gib":
+		factor = 1 << 30
+	case "t", "tib":
+		factor = 1 << 40
+	case "kb":
+		factor = 1e3
+	case "mb":
+		factor = 1e6
+	case "gb":
+		factor = 1e9
+	case "tb":
+		factor = 1e12
+	default:
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+
+	return value * factor, nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package backing
+
+import (
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// NewHost returns a host mapper of the file backing the device.
+func (b Binding) NewHost() (*ivshmem.Host, error) {
+	if b.Path == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoBackingFile, b.ID)
+	}
+
+	return ivshmem.NewHost(b.Path)
+}
@@ -0,0 +1,97 @@
+package ivshmem
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Bandwidth is the copy bandwidth measured on a region, in bytes per second.
+type Bandwidth struct {
+	Read  float64
+	Write float64
+	Bytes int // Size of the measured window
+}
+
+// SelfTest measures the copy bandwidth of a region as it is opened and warns when it is far below what mapped memory
+// should reach, which is how accidentally uncached mappings show up. The window is read and written back unchanged,
+// a write by the other side during the test would be lost, so it must be scratch space reserved for the test: the
+// window has no default and a SelfTest without a Size fails.
+type SelfTest struct {
+	Offset int // Start of the scratch window
+	Size   int // Size of the scratch window, a few MiB give a stable measurement
+
+	// MinBandwidth is the read and write bandwidth under which the test warns, 500MB/s by default. Cached memory
+	// copies at several GB/s, uncached mappings at a few tens of MB/s.
+	MinBandwidth float64
+
+	// Logger receives the warning, the standard logger by default.
+	Logger *log.Logger
+}
+
+// MeasureBandwidth times reading the window of the memory into a buffer and writing it back. The window must not be
+// written by anybody else meanwhile.
+func MeasureBandwidth(mem []byte, off, size int) (Bandwidth, error) {
+	if off < 0 || size <= 0 {
+		return Bandwidth{}, fmt.Errorf("%w: window of %d bytes at offset %d", ErrInvalidArgument, size, off)
+	}
+
+	if off+size > len(mem) {
+		return Bandwidth{}, fmt.Errorf("%w: window of %d bytes at offset %d, region of %d", ErrRegionTooSmall, size, off,
+			len(mem))
+	}
+
+	window := mem[off : off+size]
+	buf := make([]byte, size)
+
+	// Fault the buffer in first, the page faults would dwarf the copy
+	copy(buf, window)
+
+	start := time.Now()
+	copy(buf, window)
+	read := time.Since(start)
+
+	start = time.Now()
+	copy(window, buf)
+	write := time.Since(start)
+
+	return Bandwidth{Read: rate(size, read), Write: rate(size, write), Bytes: size}, nil
+}
+
+// run measures the memory and logs a warning if it is slow.
+func (t SelfTest) run(mem []byte) (Bandwidth, error) {
+	if t.Size <= 0 {
+		return Bandwidth{}, fmt.Errorf("self-test: %w: no scratch window, set the size", ErrInvalidArgument)
+	}
+
+	bw, err := MeasureBandwidth(mem, t.Offset, t.Size)
+	if err != nil {
+		return bw, fmt.Errorf("self-test: %w", err)
+	}
+
+	threshold := t.MinBandwidth
+	if threshold == 0 {
+		threshold = 500e6
+	}
+
+	if bw.Read < threshold || bw.Write < threshold {
+		logger := t.Logger
+		if logger == nil {
+			logger = log.Default()
+		}
+
+		logger.Printf("ivshmem: region copies at %.0fMB/s read and %.0fMB/s write, below %.0fMB/s, the mapping may be uncached",
+			bw.Read/1e6, bw.Write/1e6, threshold/1e6)
+	}
+
+	return bw, nil
+}
+
+// rate returns the bytes per second of a copy.
+func rate(size int, d time.Duration) float64 {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+
+	return float64(size) / d.Seconds()
+}
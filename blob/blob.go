@@ -0,0 +1,300 @@
+// Package blob stores large objects in the shared memory region and counts the references the consumers hold to
+// them. The producer learns when every consumer released a blob and reuses its slot, which is what streaming
+// pipelines of large objects need without coordinating the frees by hand.
+//
+// Like a ring, the header carries a session ID and an epoch drawn by every Init, and the views fail with ErrStale once
+// a peer initialized the store again: the generations restart with it, so an old handle could match a new blob.
+package blob
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrTooLarge = errors.New("blob too large")
+var ErrFull = errors.New("no free blob slot")
+var ErrStaleHandle = errors.New("stale blob handle")
+var ErrCorrupted = errors.New("blob slot corrupted")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x4c425649 // "IVBL" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+
+	// SlotHeaderSize is the size of the bookkeeping in front of every slot.
+	SlotHeaderSize = 64
+
+	// DefaultWaitInterval is the polling interval of Wait when it isn't given one.
+	DefaultWaitInterval = time.Millisecond
+)
+
+// Header field offsets, all the values are little endian.
+const (
+	offMagic    = 0
+	offVersion  = 4
+	offSlots    = 8
+	offSlotSize = 12
+	offSession  = 44 // 16 bytes, see shmhdr.Stamp
+	offEpoch    = 60
+)
+
+// Slot header field offsets.
+const (
+	slotRefs       = 0 // Outstanding references, zero when the slot is free
+	slotGeneration = 4 // Bumped on every reuse, so old handles are detected
+	slotLength     = 8
+)
+
+// claimed marks a slot being filled by a producer.
+const claimed = ^uint32(0)
+
+// Handle refers to a stored blob, it is small enough to be passed to the consumers in a message.
+type Handle struct {
+	Slot       uint32
+	Generation uint32
+}
+
+// Store is a view of the blob slots stored in the region.
+type Store struct {
+	mem      []byte
+	slots    uint32
+	slotSize uint32
+	stamp    shmhdr.Stamp
+}
+
+// Init writes a fresh header into the region, splitting it into as many slots of the given payload size as fit.
+func Init(mem []byte, slotSize uint32) (*Store, error) {
+	slotSize = (slotSize + 7) &^ 7
+	stride := uint64(SlotHeaderSize) + uint64(slotSize)
+	if slotSize == 0 || uint64(len(mem)) < HeaderSize+stride {
+		return nil, fmt.Errorf("%w: need %d bytes for a single slot, have %d", ErrRegionTooSmall, HeaderSize+stride, len(mem))
+	}
+
+	slots := (uint64(len(mem)) - HeaderSize) / stride
+	if slots > uint64(claimed) {
+		slots = uint64(claimed)
+	}
+
+	s := &Store{mem: mem, slots: uint32(slots), slotSize: slotSize}
+	var err error
+	if s.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < s.slots; i++ {
+		atomic.StoreUint32(s.refs(i), 0)
+		atomic.StoreUint32(s.generation(i), 0)
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offSlots:], s.slots)
+	binary.LittleEndian.PutUint32(mem[offSlotSize:], s.slotSize)
+
+	shmhdr.Publish(mem, Magic)
+	return s, nil
+}
+
+// Open validates the header written by Init and returns the store.
+func Open(mem []byte) (*Store, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		mem:      mem,
+		slots:    binary.LittleEndian.Uint32(mem[offSlots:]),
+		slotSize: binary.LittleEndian.Uint32(mem[offSlotSize:]),
+		stamp:    shmhdr.LoadStamp(mem, offSession, offEpoch),
+	}
+
+	if need := HeaderSize + uint64(s.slots)*s.stride(); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	return s, nil
+}
+
+// Slots returns the number of blob slots.
+func (s Store) Slots() uint32 {
+	return s.slots
+}
+
+// Session returns the ID of the initialization the store was opened with.
+func (s Store) Session() shmhdr.Session {
+	return s.stamp.Session()
+}
+
+// Epoch returns the number of times the store was initialized, when it was opened.
+func (s Store) Epoch() uint32 {
+	return s.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the store again since it was opened, the view must be reopened then.
+func (s Store) Stale() bool {
+	return s.stamp.Check() != nil
+}
+
+// SlotSize returns the largest blob a slot holds.
+func (s Store) SlotSize() uint32 {
+	return s.slotSize
+}
+
+// Put copies the data into a free slot and hands out refs references to it, one for every consumer. The slot is
+// reused once all of them are released.
+func (s Store) Put(data []byte, refs uint32) (Handle, error) {
+	if uint64(len(data)) > uint64(s.slotSize) {
+		return Handle{}, fmt.Errorf("%w: %d bytes, a slot holds %d", ErrTooLarge, len(data), s.slotSize)
+	}
+
+	if refs == 0 || refs == claimed {
+		return Handle{}, fmt.Errorf("invalid reference count %d", refs)
+	}
+
+	if err := s.stamp.Check(); err != nil {
+		return Handle{}, err
+	}
+
+	for i := uint32(0); i < s.slots; i++ {
+		if !atomic.CompareAndSwapUint32(s.refs(i), 0, claimed) {
+			continue
+		}
+
+		gen := atomic.AddUint32(s.generation(i), 1)
+		copy(s.data(i), data)
+		binary.LittleEndian.PutUint64(s.header(i)[slotLength:], uint64(len(data)))
+		atomic.StoreUint32(s.refs(i), refs)
+		return Handle{Slot: i, Generation: gen}, nil
+	}
+
+	return Handle{}, ErrFull
+}
+
+// Get returns the blob, the memory stays valid until the reference is released. A length the slot can't hold, written
+// by a broken or malicious peer, fails with ErrCorrupted.
+func (s Store) Get(h Handle) ([]byte, error) {
+	if err := s.check(h); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint64(s.header(h.Slot)[slotLength:])
+	if length > uint64(s.slotSize) {
+		return nil, fmt.Errorf("%w: slot %d claims %d bytes, it holds %d", ErrCorrupted, h.Slot, length, s.slotSize)
+	}
+
+	return s.data(h.Slot)[:length:length], nil
+}
+
+// Retain adds a reference to the blob, for a consumer passing it on.
+func (s Store) Retain(h Handle) error {
+	return s.update(h, 1)
+}
+
+// Release drops a reference to the blob, the last one frees the slot for the producer.
+func (s Store) Release(h Handle) error {
+	return s.update(h, -1)
+}
+
+// Released reports whether every reference to the blob was released.
+func (s Store) Released(h Handle) bool {
+	if h.Slot >= s.slots {
+		return true
+	}
+
+	refs := atomic.LoadUint32(s.refs(h.Slot))
+	return refs == 0 || atomic.LoadUint32(s.generation(h.Slot)) != h.Generation
+}
+
+// Wait polls until every reference to the blob was released or the context is done. A non-positive interval means
+// DefaultWaitInterval.
+func (s Store) Wait(ctx context.Context, h Handle, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultWaitInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for !s.Released(h) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// update adds the delta to the reference count of a live blob.
+func (s Store) update(h Handle, delta int) error {
+	if err := s.check(h); err != nil {
+		return err
+	}
+
+	refs := s.refs(h.Slot)
+	for {
+		old := atomic.LoadUint32(refs)
+		if old == 0 || old == claimed || (delta > 0 && old == claimed-1) {
+			return fmt.Errorf("%w: slot %d has %d references", ErrStaleHandle, h.Slot, old)
+		}
+
+		if atomic.CompareAndSwapUint32(refs, old, uint32(int64(old)+int64(delta))) {
+			return nil
+		}
+	}
+}
+
+// check validates that the handle refers to the current contents of its slot.
+func (s Store) check(h Handle) error {
+	if err := s.stamp.Check(); err != nil {
+		return err
+	}
+
+	if h.Slot >= s.slots {
+		return fmt.Errorf("%w: slot %d of %d", ErrStaleHandle, h.Slot, s.slots)
+	}
+
+	if gen := atomic.LoadUint32(s.generation(h.Slot)); gen != h.Generation {
+		return fmt.Errorf("%w: slot %d was reused", ErrStaleHandle, h.Slot)
+	}
+
+	return nil
+}
+
+// stride returns the distance between two slots.
+func (s Store) stride() uint64 {
+	return SlotHeaderSize + uint64(s.slotSize)
+}
+
+// header returns the bookkeeping of the slot.
+func (s Store) header(slot uint32) []byte {
+	off := HeaderSize + uint64(slot)*s.stride()
+	return s.mem[off : off+SlotHeaderSize]
+}
+
+// data returns the payload area of the slot.
+func (s Store) data(slot uint32) []byte {
+	off := HeaderSize + uint64(slot)*s.stride() + SlotHeaderSize
+	return s.mem[off : off+uint64(s.slotSize)]
+}
+
+// refs returns the reference counter of the slot for atomic access.
+func (s Store) refs(slot uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.header(slot)[slotRefs]))
+}
+
+// generation returns the generation counter of the slot for atomic access.
+func (s Store) generation(slot uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.header(slot)[slotGeneration]))
+}
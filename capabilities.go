@@ -0,0 +1,30 @@
+package ivshmem
+
+// Capabilities are what a mapper or notifier provides with the driver and device it actually got, as opposed to
+// CurrentPlatform, which tells what the build could do with the right ones. Portable applications check them at
+// runtime, e.g. to poll when there are no interrupts.
+type Capabilities struct {
+	Features []Feature
+	Vectors  int // Interrupt vectors the device has, zero if there are none or the number is unknown
+}
+
+// Has reports whether the feature is available.
+func (c Capabilities) Has(feature Feature) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NotifierCapabilities returns the capabilities of the notifier. Notifiers without a Capabilities method are assumed
+// to ring and listen, which is what the interface promises.
+func NotifierCapabilities(n Notifier) Capabilities {
+	if c, ok := n.(interface{ Capabilities() Capabilities }); ok {
+		return c.Capabilities()
+	}
+
+	return Capabilities{Features: []Feature{FeatureDoorbell, FeatureInterrupts}}
+}
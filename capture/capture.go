@@ -0,0 +1,57 @@
+// Package capture provides a reference guest producer, which copies the guest screen into the framebuffer layout.
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/framebuffer"
+)
+
+var ErrUnsupported = errors.New("screen capture not supported in this build")
+var ErrTimeout = errors.New("no new frame")
+
+// Screen captures frames from the guest display.
+type Screen interface {
+	// Size returns the dimensions of the captured screen in pixels.
+	Size() (width, height uint32)
+
+	// Capture copies the next frame into the framebuffer. It returns ErrTimeout, without touching the pixels, if the
+	// screen didn't change in time.
+	Capture(fb *framebuffer.Framebuffer, timeout time.Duration) error
+
+	// Close releases the capture resources.
+	Close() error
+}
+
+// Run captures the screen into the shared memory region until the context is done. Every captured frame is published.
+func Run(ctx context.Context, mem []byte, screen Screen) error {
+	width, height := screen.Size()
+	fb, err := framebuffer.Init(mem, width, height, framebuffer.FormatBGRA)
+	if err != nil {
+		return fmt.Errorf("init framebuffer: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		fb.BeginFrame()
+		err := screen.Capture(fb, 100*time.Millisecond)
+		if errors.Is(err, ErrTimeout) {
+			fb.AbortFrame()
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("capture: %w", err)
+		}
+
+		fb.Publish()
+	}
+}
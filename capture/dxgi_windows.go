@@ -0,0 +1,287 @@
+//go:build windows && dxgi
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/framebuffer"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	d3dDriverTypeHardware = 1
+	d3d11SDKVersion       = 7
+	d3d11UsageStaging     = 3
+	d3d11CPUAccessRead    = 0x20000
+	d3d11MapRead          = 1
+	dxgiFormatB8G8R8A8    = 87
+)
+
+const (
+	dxgiErrorAccessLost  hresultError = 0x887A0026
+	dxgiErrorWaitTimeout hresultError = 0x887A0027
+)
+
+// Virtual table indices of the COM methods we call, counted from IUnknown::QueryInterface.
+const (
+	vtblQueryInterface             = 0
+	vtblRelease                    = 2
+	vtblDXGIDeviceGetAdapter       = 7
+	vtblDXGIAdapterEnumOutputs     = 7
+	vtblDXGIOutput1DuplicateOutput = 22
+	vtblDuplicationGetDesc         = 7
+	vtblDuplicationAcquireFrame    = 8
+	vtblDuplicationReleaseFrame    = 14
+	vtblDeviceCreateTexture2D      = 5
+	vtblContextMap                 = 14
+	vtblContextUnmap               = 15
+	vtblContextCopyResource        = 47
+)
+
+var (
+	d3d11             = &windows.LazyDLL{Name: "d3d11.dll", System: true}
+	d3d11CreateDevice = d3d11.NewProc("D3D11CreateDevice")
+
+	iidDXGIDevice     = windows.GUID{Data1: 0x54ec77fa, Data2: 0x1377, Data3: 0x44e6, Data4: [8]byte{0x8c, 0x32, 0x88, 0xfd, 0x5f, 0x44, 0xc8, 0x4c}}
+	iidDXGIOutput1    = windows.GUID{Data1: 0x00cddea8, Data2: 0x939b, Data3: 0x4b83, Data4: [8]byte{0xa3, 0x40, 0xa6, 0x85, 0x22, 0x66, 0x66, 0xcc}}
+	iidD3D11Texture2D = windows.GUID{Data1: 0x6f15aaf2, Data2: 0xd208, Data3: 0x4e89, Data4: [8]byte{0x9a, 0xb4, 0x48, 0x95, 0x35, 0xd3, 0x4f, 0x9c}}
+)
+
+// hresultError is a failed HRESULT returned by a COM call.
+type hresultError uint32
+
+// Error returns the HRESULT in the usual hex notation.
+func (e hresultError) Error() string {
+	return fmt.Sprintf("HRESULT %#x", uint32(e))
+}
+
+// comObject is a COM interface pointer, the object starts with a pointer to its virtual table.
+type comObject struct {
+	vtbl *[64]uintptr
+}
+
+// call invokes the method at the given virtual table index and returns its raw result.
+func (o *comObject) call(index int, args ...uintptr) uintptr {
+	r1, _, _ := syscall.SyscallN(o.vtbl[index], append([]uintptr{uintptr(unsafe.Pointer(o))}, args...)...)
+	return r1
+}
+
+// release decrements the reference count of the object.
+func (o *comObject) release() {
+	if o != nil {
+		o.call(vtblRelease)
+	}
+}
+
+// check converts a HRESULT to an error.
+func check(hr uintptr) error {
+	if int32(hr) < 0 {
+		return hresultError(uint32(hr))
+	}
+
+	return nil
+}
+
+// DXGI_OUTDUPL_DESC as returned by IDXGIOutputDuplication::GetDesc.
+type outduplDesc struct {
+	width            uint32
+	height           uint32
+	refreshRate      [2]uint32
+	format           uint32
+	scanlineOrdering uint32
+	scaling          uint32
+	rotation         uint32
+	inSystemMemory   int32
+}
+
+// DXGI_OUTDUPL_FRAME_INFO as filled by IDXGIOutputDuplication::AcquireNextFrame.
+type frameInfo struct {
+	lastPresentTime         int64
+	lastMouseUpdateTime     int64
+	accumulatedFrames       uint32
+	rectsCoalesced          int32
+	protectedContentMasked  int32
+	pointerPosition         [3]int32
+	totalMetadataBufferSize uint32
+	pointerShapeBufferSize  uint32
+}
+
+// D3D11_TEXTURE2D_DESC as used in ID3D11Device::CreateTexture2D.
+type texture2DDesc struct {
+	width          uint32
+	height         uint32
+	mipLevels      uint32
+	arraySize      uint32
+	format         uint32
+	sampleCount    uint32
+	sampleQuality  uint32
+	usage          uint32
+	bindFlags      uint32
+	cpuAccessFlags uint32
+	miscFlags      uint32
+}
+
+// D3D11_MAPPED_SUBRESOURCE as filled by ID3D11DeviceContext::Map.
+type mappedSubresource struct {
+	data       unsafe.Pointer
+	rowPitch   uint32
+	depthPitch uint32
+}
+
+// dxgiScreen captures the primary output using the DXGI desktop duplication API.
+type dxgiScreen struct {
+	device      *comObject
+	context     *comObject
+	duplication *comObject
+	staging     *comObject
+	width       uint32
+	height      uint32
+}
+
+// Open starts duplicating the first output of the default adapter.
+func Open() (Screen, error) {
+	if err := d3d11CreateDevice.Find(); err != nil {
+		return nil, fmt.Errorf("load d3d11: %w", err)
+	}
+
+	s := &dxgiScreen{}
+	var level uint32
+	hr, _, _ := syscall.SyscallN(
+		d3d11CreateDevice.Addr(), 0, d3dDriverTypeHardware, 0, 0, 0, 0, d3d11SDKVersion,
+		uintptr(unsafe.Pointer(&s.device)), uintptr(unsafe.Pointer(&level)), uintptr(unsafe.Pointer(&s.context)),
+	)
+	if err := check(hr); err != nil {
+		return nil, fmt.Errorf("create d3d11 device: %w", err)
+	}
+
+	if err := s.duplicate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	desc := texture2DDesc{
+		width:          s.width,
+		height:         s.height,
+		mipLevels:      1,
+		arraySize:      1,
+		format:         dxgiFormatB8G8R8A8,
+		sampleCount:    1,
+		usage:          d3d11UsageStaging,
+		cpuAccessFlags: d3d11CPUAccessRead,
+	}
+
+	hr = s.device.call(vtblDeviceCreateTexture2D, uintptr(unsafe.Pointer(&desc)), 0, uintptr(unsafe.Pointer(&s.staging)))
+	if err := check(hr); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("create staging texture: %w", err)
+	}
+
+	return s, nil
+}
+
+// duplicate walks device -> adapter -> output and starts the output duplication.
+func (s *dxgiScreen) duplicate() error {
+	var dxgiDevice, adapter, output, output1 *comObject
+	hr := s.device.call(vtblQueryInterface, uintptr(unsafe.Pointer(&iidDXGIDevice)), uintptr(unsafe.Pointer(&dxgiDevice)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("query dxgi device: %w", err)
+	}
+	defer dxgiDevice.release()
+
+	hr = dxgiDevice.call(vtblDXGIDeviceGetAdapter, uintptr(unsafe.Pointer(&adapter)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("get adapter: %w", err)
+	}
+	defer adapter.release()
+
+	hr = adapter.call(vtblDXGIAdapterEnumOutputs, 0, uintptr(unsafe.Pointer(&output)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("enum outputs: %w", err)
+	}
+	defer output.release()
+
+	hr = output.call(vtblQueryInterface, uintptr(unsafe.Pointer(&iidDXGIOutput1)), uintptr(unsafe.Pointer(&output1)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("query output1: %w", err)
+	}
+	defer output1.release()
+
+	hr = output1.call(vtblDXGIOutput1DuplicateOutput, uintptr(unsafe.Pointer(s.device)), uintptr(unsafe.Pointer(&s.duplication)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("duplicate output: %w", err)
+	}
+
+	var desc outduplDesc
+	s.duplication.call(vtblDuplicationGetDesc, uintptr(unsafe.Pointer(&desc)))
+	s.width, s.height = desc.width, desc.height
+	return nil
+}
+
+// Size returns the dimensions of the duplicated output.
+func (s *dxgiScreen) Size() (uint32, uint32) {
+	return s.width, s.height
+}
+
+// Capture copies the next desktop frame into the framebuffer.
+func (s *dxgiScreen) Capture(fb *framebuffer.Framebuffer, timeout time.Duration) error {
+	var info frameInfo
+	var resource *comObject
+	hr := s.duplication.call(vtblDuplicationAcquireFrame, uintptr(timeout.Milliseconds()), uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&resource)))
+	err := check(hr)
+	if errors.Is(err, dxgiErrorWaitTimeout) {
+		return ErrTimeout
+	}
+
+	if errors.Is(err, dxgiErrorAccessLost) {
+		return fmt.Errorf("desktop changed, reopen the capture: %w", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("acquire frame: %w", err)
+	}
+	defer s.duplication.call(vtblDuplicationReleaseFrame)
+	defer resource.release()
+
+	var texture *comObject
+	hr = resource.call(vtblQueryInterface, uintptr(unsafe.Pointer(&iidD3D11Texture2D)), uintptr(unsafe.Pointer(&texture)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("query texture: %w", err)
+	}
+	defer texture.release()
+
+	s.context.call(vtblContextCopyResource, uintptr(unsafe.Pointer(s.staging)), uintptr(unsafe.Pointer(texture)))
+
+	var mapped mappedSubresource
+	hr = s.context.call(vtblContextMap, uintptr(unsafe.Pointer(s.staging)), 0, d3d11MapRead, 0, uintptr(unsafe.Pointer(&mapped)))
+	if err := check(hr); err != nil {
+		return fmt.Errorf("map staging texture: %w", err)
+	}
+	defer s.context.call(vtblContextUnmap, uintptr(unsafe.Pointer(s.staging)), 0)
+
+	height := s.height
+	if fb.Height() < height {
+		height = fb.Height()
+	}
+
+	for y := uint32(0); y < height; y++ {
+		row := fb.Row(y)
+		src := unsafe.Slice((*byte)(unsafe.Add(mapped.data, uintptr(y)*uintptr(mapped.rowPitch))), s.width*4)
+		copy(row, src)
+	}
+
+	return nil
+}
+
+// Close releases the duplication and the d3d11 device.
+func (s *dxgiScreen) Close() error {
+	s.staging.release()
+	s.duplication.release()
+	s.context.release()
+	s.device.release()
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows || !dxgi
+
+package capture
+
+// Open returns ErrUnsupported, the DXGI producer is only built on windows with the dxgi build tag.
+func Open() (Screen, error) {
+	return nil, ErrUnsupported
+}
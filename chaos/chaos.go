@@ -0,0 +1,219 @@
+// Package chaos injects the failure modes of real ivshmem links (late, lost or duplicated interrupts, torn writes),
+// so applications can test their resilience without waiting for a flaky setup to show them.
+package chaos
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Config sets the probability of every fault, zero disables it.
+type Config struct {
+	Seed int64 // Seed of the random source, a fixed seed makes runs reproducible
+
+	DelayRate     float64       // Probability that an interrupt is delivered late
+	MaxDelay      time.Duration // Upper bound of the delay
+	DuplicateRate float64       // Probability that an interrupt is delivered twice
+	DropRate      float64       // Probability that an interrupt is lost
+	TruncateRate  float64       // Probability that a write lands only partially
+
+	// DuplicateDelay separates a duplicated interrupt from the original one, so the receiver sees it as an interrupt
+	// of its own instead of both coalescing. Zero means DefaultDuplicateDelay.
+	DuplicateDelay time.Duration
+}
+
+// DefaultDuplicateDelay is the delay of a duplicated interrupt when the config doesn't set one.
+const DefaultDuplicateDelay = time.Millisecond
+
+// Injector decides which operations fail, it is safe for concurrent use.
+type Injector struct {
+	cfg Config
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New returns a new fault injector.
+func New(cfg Config) *Injector {
+	return &Injector{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// Notifier wraps the notifier, so that both the rung and the received interrupts are subject to the faults.
+func (i *Injector) Notifier(n ivshmem.Notifier) ivshmem.Notifier {
+	return &notifier{next: n, inj: i}
+}
+
+// Writer wraps the writer, so that writes are randomly truncated: only a random prefix of the data lands, the rest of
+// the write is zeros. The write still reports success and keeps its length, like a frame in the region whose writer
+// crashed, or whose stores weren't visible yet, before the reader took it: the reader gets a frame of the right size
+// with a torn end instead of losing the framing of the stream.
+func (i *Injector) Writer(w io.Writer) io.Writer {
+	return &writer{next: w, inj: i}
+}
+
+// Conn wraps the write side of a connection like Writer, reads and Close go to the connection unchanged. Wrapping a
+// ring.Channel over a fake region gives frame.NewConn torn frames to deal with.
+func (i *Injector) Conn(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &conn{ReadWriteCloser: rwc, w: writer{next: rwc, inj: i}}
+}
+
+// Truncate returns a copy of the data with everything after a random cut zeroed, with the probability of
+// TruncateRate, the data itself otherwise.
+func (i *Injector) Truncate(data []byte) []byte {
+	if len(data) == 0 || !i.roll(i.cfg.TruncateRate) {
+		return data
+	}
+
+	torn := make([]byte, len(data))
+	copy(torn, data[:i.intn(len(data))])
+	return torn
+}
+
+// roll returns true with the given probability.
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rng.Float64() < rate
+}
+
+// intn returns a random number in [0, n).
+func (i *Injector) intn(n int) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rng.Intn(n)
+}
+
+// delay returns a random delay up to MaxDelay if the delay fault triggers, zero otherwise.
+func (i *Injector) delay() time.Duration {
+	if i.cfg.MaxDelay <= 0 || !i.roll(i.cfg.DelayRate) {
+		return 0
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return time.Duration(i.rng.Int63n(int64(i.cfg.MaxDelay)) + 1)
+}
+
+// duplicateDelay returns the delay of a duplicated interrupt.
+func (i *Injector) duplicateDelay() time.Duration {
+	if i.cfg.DuplicateDelay <= 0 {
+		return DefaultDuplicateDelay
+	}
+
+	return i.cfg.DuplicateDelay
+}
+
+// notifier is a Notifier with injected faults.
+type notifier struct {
+	next ivshmem.Notifier
+	inj  *Injector
+}
+
+// Notify rings the doorbell, possibly late, twice or not at all. Errors of delayed notifications are lost.
+func (n *notifier) Notify(peer, vector uint16) error {
+	if n.inj.roll(n.inj.cfg.DropRate) {
+		return nil
+	}
+
+	if d := n.inj.delay(); d > 0 {
+		time.AfterFunc(d, func() { n.ring(peer, vector) })
+		return nil
+	}
+
+	return n.ring(peer, vector)
+}
+
+// ring notifies the peer once, or twice if the duplicate fault triggers. The duplicate is rung after the duplicate
+// delay, rung right away it would merge with the first one in the pending interrupt of the peer.
+func (n *notifier) ring(peer, vector uint16) error {
+	if err := n.next.Notify(peer, vector); err != nil {
+		return err
+	}
+
+	if n.inj.roll(n.inj.cfg.DuplicateRate) {
+		time.AfterFunc(n.inj.duplicateDelay(), func() { n.next.Notify(peer, vector) })
+	}
+
+	return nil
+}
+
+// Capabilities returns the capabilities of the wrapped notifier.
+func (n *notifier) Capabilities() ivshmem.Capabilities {
+	return ivshmem.NotifierCapabilities(n.next)
+}
+
+// Listen relays the interrupts of the wrapped notifier, possibly late, twice or not at all. A duplicate is delivered
+// once the receiver took the original interrupt, or merges with the next real one, so the receiver wakes up twice.
+func (n *notifier) Listen(vector uint16) (<-chan struct{}, error) {
+	in, err := n.next.Listen(vector)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+		for range in {
+			if n.inj.roll(n.inj.cfg.DropRate) {
+				continue
+			}
+
+			time.Sleep(n.inj.delay())
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+
+			if !n.inj.roll(n.inj.cfg.DuplicateRate) {
+				continue
+			}
+
+			// Wait for room for the duplicate, the interrupts arriving meanwhile merge with it
+			for pending := true; pending; {
+				select {
+				case out <- struct{}{}:
+					pending = false
+				case _, ok := <-in:
+					if !ok {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// writer is an io.Writer with injected torn writes.
+type writer struct {
+	next io.Writer
+	inj  *Injector
+}
+
+// Write writes the data, or the data torn by Truncate.
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := w.next.Write(w.inj.Truncate(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// conn is a connection whose writes are torn.
+type conn struct {
+	io.ReadWriteCloser
+	w writer
+}
+
+// Write writes the data through the torn writer.
+func (c *conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
@@ -0,0 +1,90 @@
+package chaos_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/chaos"
+	"github.com/TypicalAM/ivshmem/frame"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+func TestDuplicateInterrupt(t *testing.T) {
+	a, b := ivshmem.NewLoopbackPair(4096)
+	inj := chaos.New(chaos.Config{DuplicateRate: 1})
+	events, err := inj.Notifier(b).Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Notify(1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The duplicate only arrives once the first interrupt was taken
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("interrupt %d never arrived", i+1)
+		}
+	}
+}
+
+func TestDuplicateNotify(t *testing.T) {
+	a, b := ivshmem.NewLoopbackPair(4096)
+	events, err := b.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inj := chaos.New(chaos.Config{DuplicateRate: 1})
+	if err := inj.Notifier(a).Notify(1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("interrupt %d never arrived", i+1)
+		}
+	}
+}
+
+func TestTornFrames(t *testing.T) {
+	fake := ivshmem.NewFake(8192)
+	if err := fake.Map(); err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := ring.InitChannel(fake.SharedMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guest, err := ring.OpenChannel(fake.SharedMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inj := chaos.New(chaos.Config{Seed: 1, TruncateRate: 1})
+	ctx := context.Background()
+	send := frame.NewConn(inj.Conn(host), ivshmem.Limits{})
+	interceptors := frame.Interceptors{Recv: []frame.RecvInterceptor{frame.RequireChecksum}}
+	recv := frame.Intercept(frame.NewConn(guest, ivshmem.Limits{}), interceptors)
+
+	// Every frame is torn but keeps its size, so the checksum catches each one
+	for i := 0; i < 10; i++ {
+		if err := send.Send(ctx, frame.Frame{Payload: []byte("a payload long enough to tear"), Checked: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := recv.Recv(ctx); !errors.Is(err, frame.ErrChecksum) && !errors.Is(err, frame.ErrMalformed) {
+			t.Fatalf("frame %d: want a checksum or malformed frame error, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrProtocol = errors.New("ivshmem-server protocol error")
+
+// serverProtocolVersion is the only version of the ivshmem-server protocol.
+const serverProtocolVersion = 0
+
+// Client is a peer of an ivshmem-server, like a doorbell device of a VM. It gets the shared memory and the eventfds
+// of every peer from the server, so besides mapping the memory like Host it rings and listens to doorbells, it
+// implements Notifier.
+type Client struct {
+	socketPath string
+	conn       *net.UnixConn
+	id         uint16
+	shm        *os.File
+	sharedMem  []byte
+	size       uint64
+	mapped     bool
+	released   bool // Set by Close, unlike closed which is also set when the server goes away
+
+	mu        sync.Mutex
+	peers     map[uint16][]*os.File // Eventfds of every vector of every peer, including this one
+	listeners map[uint16][]chan struct{}
+	closed    bool
+	done      chan struct{}
+}
+
+// NewClient connects to the ivshmem-server socket and receives the shared memory.
+func NewClient(socketPath string) (*Client, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("connect to server: %w", err)
+	}
+
+	c := &Client{
+		socketPath: socketPath,
+		conn:       conn,
+		peers:      make(map[uint16][]*os.File),
+		listeners:  make(map[uint16][]chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.receive()
+	return c, nil
+}
+
+// handshake reads the protocol version, the ID of this peer and the shared memory.
+func (c *Client) handshake() error {
+	version, fd, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	if version != serverProtocolVersion || fd >= 0 {
+		closeFD(fd)
+		return fmt.Errorf("%w: unsupported version %d", ErrProtocol, version)
+	}
+
+	id, fd, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	if id < 0 || id > 0xffff || fd >= 0 {
+		closeFD(fd)
+		return fmt.Errorf("%w: invalid peer id %d", ErrProtocol, id)
+	}
+
+	marker, fd, err := c.read()
+	if err != nil {
+		return err
+	}
+
+	if marker != -1 || fd < 0 {
+		closeFD(fd)
+		return fmt.Errorf("%w: expected the shared memory", ErrProtocol)
+	}
+
+	c.id = uint16(id)
+	c.shm = os.NewFile(uintptr(fd), c.socketPath)
+	return nil
+}
+
+// read returns the next message and its file descriptor, -1 if it has none.
+func (c *Client) read() (int64, int, error) {
+	var buf [8]byte
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := c.conn.ReadMsgUnix(buf[:], oob)
+	if err != nil {
+		return 0, -1, fmt.Errorf("read from server: %w", err)
+	}
+
+	fd := -1
+	if oobn > 0 {
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err == nil && len(msgs) > 0 {
+			if fds, err := unix.ParseUnixRights(&msgs[0]); err == nil && len(fds) > 0 {
+				fd = fds[0]
+				closeFDs(fds[1:])
+			}
+		}
+	}
+
+	if n != len(buf) {
+		closeFD(fd)
+		return 0, -1, fmt.Errorf("%w: short message of %d bytes", ErrProtocol, n)
+	}
+
+	return int64(binary.LittleEndian.Uint64(buf[:])), fd, nil
+}
+
+// receive tracks the peers coming and going until the connection fails.
+func (c *Client) receive() {
+	defer c.shutdown()
+	for {
+		id, fd, err := c.read()
+		if err != nil || id < 0 || id > 0xffff {
+			closeFD(fd)
+			return
+		}
+
+		peer := uint16(id)
+		c.mu.Lock()
+		// A message read while Close shuts the client down is dropped, the peers are gone
+		if c.closed {
+			c.mu.Unlock()
+			closeFD(fd)
+			return
+		}
+
+		if fd < 0 {
+			for _, f := range c.peers[peer] {
+				f.Close()
+			}
+
+			delete(c.peers, peer)
+			c.mu.Unlock()
+			continue
+		}
+
+		// The eventfds of a peer arrive in the order of its vectors
+		unix.SetNonblock(fd, true)
+		f := os.NewFile(uintptr(fd), "eventfd")
+		vector := uint16(len(c.peers[peer]))
+		c.peers[peer] = append(c.peers[peer], f)
+		if peer == c.id {
+			go c.forward(vector, f)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// forward wakes the listeners of the vector every time the eventfd is signaled.
+func (c *Client) forward(vector uint16, f *os.File) {
+	var buf [8]byte
+	for {
+		if _, err := f.Read(buf[:]); err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		for _, ch := range c.listeners[vector] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// shutdown closes the listener channels and the eventfds.
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	close(c.done)
+	for _, fds := range c.peers {
+		for _, f := range fds {
+			f.Close()
+		}
+	}
+
+	for _, chans := range c.listeners {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+
+	c.peers, c.listeners = nil, nil
+}
+
+// ID returns the peer ID the server gave this client.
+func (c *Client) ID() uint16 {
+	return c.id
+}
+
+// Peers returns the sorted IDs of the other peers known to the server.
+func (c *Client) Peers() []uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]uint16, 0, len(c.peers))
+	for id := range c.peers {
+		if id != c.id {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Notify rings the doorbell of the peer on the given vector.
+func (c *Client) Notify(peer, vector uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+
+	fds, ok := c.peers[peer]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownPeer, peer)
+	}
+
+	if int(vector) >= len(fds) {
+		return fmt.Errorf("%w: %d, peer %d has %d", ErrInvalidVector, vector, peer, len(fds))
+	}
+
+	// Eventfds take a native endian 64-bit increment
+	one := uint64(1)
+	if _, err := fds[vector].Write(unsafe.Slice((*byte)(unsafe.Pointer(&one)), 8)); err != nil {
+		return fmt.Errorf("ring peer %d: %w", peer, err)
+	}
+
+	return nil
+}
+
+// Listen returns a channel receiving the interrupts other peers send to this one on the vector. The channel is closed
+// when the client is closed or the server goes away.
+func (c *Client) Listen(vector uint16) (<-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	ch := make(chan struct{}, 1)
+	c.listeners[vector] = append(c.listeners[vector], ch)
+	return ch, nil
+}
+
+// Capabilities returns the doorbell and the interrupts, with the vectors the server gave this client.
+func (c *Client) Capabilities() Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Capabilities{Features: []Feature{FeatureDoorbell, FeatureInterrupts}, Vectors: len(c.peers[c.id])}
+}
+
+// Done returns a channel which is closed when the connection to the server is gone.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Map maps the shared memory into the program memory space.
+func (c *Client) Map() error {
+	if c.released {
+		return ErrClosed
+	}
+
+	if c.mapped {
+		return ErrAlreadyMapped
+	}
+
+	info, err := c.shm.Stat()
+	if err != nil {
+		return fmt.Errorf("stat shared memory: %w", err)
+	}
+
+	sharedMem, err := unix.Mmap(int(c.shm.Fd()), 0, int(info.Size()), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	c.sharedMem = sharedMem
+	c.size = uint64(info.Size())
+	c.mapped = true
+	return nil
+}
+
+// Unmap unmaps the shared memory.
+func (c *Client) Unmap() error {
+	if !c.mapped {
+		return ErrAlreadyUnmapped
+	}
+
+	err := unix.Munmap(c.sharedMem)
+	c.mapped, c.sharedMem = false, nil
+	if err != nil {
+		return fmt.Errorf("munmap: %w", err)
+	}
+
+	return nil
+}
+
+// sameFile returns ErrServerMismatch unless the shared memory of the server is the file at the path.
+func (c *Client) sameFile(path string) error {
+	shm, err := c.shm.Stat()
+	if err != nil {
+		return fmt.Errorf("stat server memory: %w", err)
+	}
+
+	file, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	if !os.SameFile(shm, file) {
+		return fmt.Errorf("%w: %s is not the memory of %s", ErrServerMismatch, path, c.socketPath)
+	}
+
+	return nil
+}
+
+// Size returns the size of the shared memory space.
+func (c *Client) Size() uint64 {
+	return c.size
+}
+
+// DevPath returns the path of the server socket.
+func (c *Client) DevPath() string {
+	return c.socketPath
+}
+
+// Mapped reports whether the shared memory is mapped.
+func (c *Client) Mapped() bool {
+	return c.mapped
+}
+
+// SharedMem returns the already mapped shared memory, panics if Map() didn't succeed or the memory was unmapped.
+func (c *Client) SharedMem() []byte {
+	if !c.mapped {
+		panic("tried to access non-mapped memory")
+	}
+
+	return c.sharedMem
+}
+
+// Sync makes sure the changes made to the shared memory are synced.
+func (c *Client) Sync() error {
+	if !c.mapped {
+		return ErrNotMapped
+	}
+
+	return unix.Msync(c.sharedMem, unix.MS_SYNC)
+}
+
+// Close unmaps the memory if it is mapped and disconnects from the server, which tells the other peers this one is
+// gone. Closing it twice fails with ErrClosed.
+func (c *Client) Close() error {
+	if c.released {
+		return ErrClosed
+	}
+
+	c.released = true
+	var err error
+	if c.mapped {
+		err = c.Unmap()
+	}
+
+	err = errors.Join(err, c.conn.Close())
+	c.shutdown()
+	return errors.Join(err, c.shm.Close())
+}
+
+// closeFD closes the file descriptor unless it is negative.
+func closeFD(fd int) {
+	if fd >= 0 {
+		unix.Close(fd)
+	}
+}
+
+// closeFDs closes the file descriptors.
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+var _ Mapper = (*Client)(nil)
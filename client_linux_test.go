@@ -0,0 +1,110 @@
+//go:build linux
+
+package ivshmem_test
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// serve accepts a single client, hands it the shared memory and then announces eventfds of a peer until the client
+// goes away.
+func serve(t *testing.T, l *net.UnixListener) {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	send := func(v int64, fd int) error {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		var oob []byte
+		if fd >= 0 {
+			oob = unix.UnixRights(fd)
+		}
+
+		_, _, err := conn.WriteMsgUnix(buf[:], oob, nil)
+		return err
+	}
+
+	shm, err := unix.MemfdCreate("ivshmem-test", 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer unix.Close(shm)
+
+	if err := unix.Ftruncate(shm, 4096); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if send(0, -1) != nil || send(1, -1) != nil || send(-1, shm) != nil {
+		return
+	}
+
+	for {
+		efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = send(2, efd)
+		unix.Close(efd)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// TestClientCloseWhileReceiving closes clients while the server floods them with eventfds, run it with -race.
+func TestClientCloseWhileReceiving(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		path := filepath.Join(t.TempDir(), "ivshmem.sock")
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve(t, l)
+		}()
+
+		c, err := ivshmem.NewClient(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Holding the lock now and then keeps the receiver waiting for it with a message in hand while Close runs
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.Peers()
+				}
+			}
+		}()
+
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		close(stop)
+
+		l.Close()
+		<-done
+	}
+}
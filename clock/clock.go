@@ -0,0 +1,117 @@
+// Package clock produces timestamps which can be compared across the VM boundary. Every side reads its own
+// monotonic clock and adds the offset to a reference peer (usually the host), estimated from ping exchanges the same
+// way NTP does. Heartbeats, traces and latency measurements stored in the shared memory should all use it, so their
+// timestamps mean the same thing on both sides.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// epoch anchors the monotonic readings of this process.
+var epoch = time.Now()
+
+// Timestamp is a point in time in nanoseconds on the shared timebase, it fits into a single 64 bit word of the
+// shared memory.
+type Timestamp int64
+
+// Sub returns the duration t-u.
+func (t Timestamp) Sub(u Timestamp) time.Duration {
+	return time.Duration(t - u)
+}
+
+// Add returns the timestamp t+d.
+func (t Timestamp) Add(d time.Duration) Timestamp {
+	return t + Timestamp(d)
+}
+
+// Local returns the reading of the local monotonic clock, without any offset. The reference peer stamps the pings
+// with it.
+func Local() Timestamp {
+	return Timestamp(time.Since(epoch))
+}
+
+// Sample is a single ping exchange: the local clock when sending (T0) and receiving the reply (T3), and the reference
+// clock when the peer received the ping (T1) and sent the reply (T2).
+type Sample struct {
+	T0, T1, T2, T3 Timestamp
+}
+
+// Offset returns the estimated offset of the reference clock to the local one.
+func (s Sample) Offset() time.Duration {
+	return (s.T1.Sub(s.T0) + s.T2.Sub(s.T3)) / 2
+}
+
+// Delay returns the round trip time of the exchange, excluding the time the peer took to reply. The smaller it is,
+// the more precise the offset.
+func (s Sample) Delay() time.Duration {
+	return s.T3.Sub(s.T0) - s.T2.Sub(s.T1)
+}
+
+// Clock translates the local monotonic clock into the shared timebase, it is safe for concurrent use. The zero value
+// is the reference clock of the link.
+type Clock struct {
+	mu      sync.RWMutex
+	offset  time.Duration
+	best    Sample
+	samples int
+	window  int
+}
+
+// New returns a clock which keeps the best of the last window samples, zero means 8.
+func New(window int) *Clock {
+	if window <= 0 {
+		window = 8
+	}
+
+	return &Clock{window: window}
+}
+
+// Now returns the current time on the shared timebase.
+func (c *Clock) Now() Timestamp {
+	return Local().Add(c.Offset())
+}
+
+// Offset returns the current offset to the reference clock.
+func (c *Clock) Offset() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset
+}
+
+// Update feeds a ping exchange into the estimate. The sample with the smallest delay wins, because the delay bounds
+// the error of its offset. Every window samples the best one is forgotten, so the clock follows the drift.
+func (c *Clock) Update(s Sample) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	window := c.window
+	if window <= 0 {
+		window = 8
+	}
+
+	if c.samples%window == 0 || s.Delay() <= c.best.Delay() {
+		c.best = s
+		c.offset = s.Offset()
+	}
+
+	c.samples++
+	return c.offset
+}
+
+// FromLocal translates a local monotonic reading into the shared timebase.
+func (c *Clock) FromLocal(t Timestamp) Timestamp {
+	return t.Add(c.Offset())
+}
+
+// Time returns the wall clock time of this side at which the clock read the shared timestamp, for showing the
+// timestamps of both sides to humans.
+func (c *Clock) Time(t Timestamp) time.Time {
+	return time.Now().Add(t.Sub(c.Now()))
+}
+
+// ToLocal translates a shared timestamp into a local monotonic reading.
+func (c *Clock) ToLocal(t Timestamp) Timestamp {
+	return t.Add(-c.Offset())
+}
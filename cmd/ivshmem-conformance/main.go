@@ -0,0 +1,31 @@
+// Command ivshmem-conformance checks the Go implementation against the conformance vectors, or writes the vectors
+// to a directory, for example to regenerate the golden files after a deliberate format change.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/TypicalAM/ivshmem/conformance"
+)
+
+func main() {
+	write := flag.String("write", "", "write the vectors into this directory instead of checking them")
+	flag.Parse()
+
+	if *write != "" {
+		if err := conformance.WriteFiles(*write); err != nil {
+			log.Fatalln("Failed to write the vectors:", err)
+		}
+
+		fmt.Println("Vectors written to", *write)
+		return
+	}
+
+	if err := conformance.Run(); err != nil {
+		log.Fatalln("Conformance check failed:\n", err)
+	}
+
+	fmt.Println("All vectors passed")
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+// Command ivshmem-devharness sets up an emulated ivshmem link in a directory and keeps it alive until interrupted.
+// Run it as a sidecar container sharing the directory with the containers under test, they attach with
+// devharness.Open. The paths are printed as environment assignments, so CI scripts can source them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TypicalAM/ivshmem/devharness"
+)
+
+func main() {
+	dir := flag.String("dir", "/dev/shm/ivshmem-harness", "directory shared with the peers")
+	size := flag.Uint64("size", 64<<20, "size of the shared memory in bytes, a power of two")
+	keep := flag.Bool("keep", false, "keep the shared memory file on exit")
+	flag.Parse()
+
+	h, err := devharness.New(*dir, *size)
+	if err != nil {
+		log.Fatalln("Failed to set up the harness:", err)
+	}
+
+	fmt.Printf("IVSHMEM_HARNESS_DIR=%s\n", h.Dir())
+	fmt.Printf("IVSHMEM_HARNESS_SHM=%s\n", h.ShmPath())
+	fmt.Printf("IVSHMEM_HARNESS_SIZE=%d\n", h.Size())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	if !*keep {
+		if err := h.Remove(); err != nil {
+			log.Fatalln("Failed to clean up the harness:", err)
+		}
+	}
+}
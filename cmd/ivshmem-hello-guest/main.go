@@ -0,0 +1,67 @@
+//go:build linux || windows
+
+// Command ivshmem-hello-guest reads the NUL terminated message written by ivshmem-hello-host from the start of the
+// shared memory. Together they smoke test the public API on both sides of the link.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+func main() {
+	device := flag.Int("device", 0, "index of the ivshmem device as returned by ListDevices")
+	list := flag.Bool("list", false, "only list the detected devices")
+	minSize := flag.Uint64("min-size", 0, "fail if the shared memory is smaller than this many bytes")
+	maxLen := flag.Int("max-length", 4096, "maximum length of the message")
+	flag.Parse()
+
+	devs, err := ivshmem.ListDevices()
+	if err != nil {
+		log.Fatalln("Cannot list devices:", err)
+	}
+
+	fmt.Println("Detected IVSHMEM devices:", devs)
+	if *list {
+		return
+	}
+
+	if *device < 0 || *device >= len(devs) {
+		log.Fatalf("Device index %d out of range, %d devices detected", *device, len(devs))
+	}
+
+	g, err := ivshmem.NewGuest(devs[*device])
+	if err != nil {
+		log.Fatalln("Cannot create guest:", err)
+	}
+
+	if err := g.Map(); err != nil {
+		log.Fatalln("Cannot map memory:", err)
+	}
+	defer g.Unmap()
+
+	fmt.Println("We are on:", g.System())
+	fmt.Println("Selected IVSHMEM device:", g.Location())
+	fmt.Println("Device path:", g.DevPath())
+	fmt.Println("Shared mem size (in MB):", g.Size()/1024/1024)
+
+	if g.Size() < *minSize {
+		log.Fatalf("Shared memory too small: %d bytes, need %d", g.Size(), *minSize)
+	}
+
+	mem := g.SharedMem()
+	if len(mem) > *maxLen {
+		mem = mem[:*maxLen]
+	}
+
+	end := bytes.IndexByte(mem, 0)
+	if end < 0 {
+		log.Fatalf("No message found in the first %d bytes", len(mem))
+	}
+
+	fmt.Println("Message from host:", string(mem[:end]))
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+// Command ivshmem-hello-host writes a NUL terminated message to the start of the shared memory file, for
+// ivshmem-hello-guest to read. Together they smoke test the public API on both sides of the link.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+func main() {
+	shmPath := flag.String("shm", "/dev/shm/my-little-shared-memory", "shared memory file backing the device")
+	msg := flag.String("message", "Hello example!", "message to write")
+	minSize := flag.Uint64("min-size", 0, "fail if the shared memory is smaller than this many bytes")
+	vm := flag.String("vm", os.Getenv("IVSHMEM_VM"), "name of the VM, prefixes the logs when one host serves several VMs")
+	flag.Parse()
+
+	if *vm != "" {
+		log.SetPrefix(*vm + ": ")
+	}
+
+	h, err := ivshmem.NewHost(*shmPath)
+	if err != nil {
+		log.Fatalln("Failed to attach to shmem file:", err)
+	}
+
+	if err := h.Map(); err != nil {
+		log.Fatalln("Failed to map memory from file:", err)
+	}
+	defer h.Unmap()
+
+	fmt.Println("Shared mem size (in MB):", h.Size()/1024/1024)
+	fmt.Println("Device path:", h.DevPath())
+
+	if h.Size() < *minSize {
+		log.Fatalf("Shared memory too small: %d bytes, need %d", h.Size(), *minSize)
+	}
+
+	if uint64(len(*msg)) >= h.Size() {
+		log.Fatalf("Message of %d bytes does not fit into %d bytes", len(*msg), h.Size())
+	}
+
+	mem := h.SharedMem()
+	n := copy(mem, *msg)
+	mem[n] = 0
+
+	if err := h.Sync(); err != nil {
+		log.Fatalln("Failed to flush the memory after writing:", err)
+	}
+	fmt.Println("Write successful")
+}
@@ -0,0 +1,58 @@
+// Command ivshmem-layout validates a JSON layout spec against a region size, prints the computed segments and
+// optionally generates the matching C header.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/TypicalAM/ivshmem/layout"
+)
+
+func main() {
+	specPath := flag.String("spec", "", "JSON layout spec")
+	size := flag.Uint64("size", 64<<20, "size of the region in bytes")
+	header := flag.String("header", "", "write a C header to this file")
+	prefix := flag.String("prefix", "IVSHMEM", "prefix of the C macros")
+	flag.Parse()
+
+	file, err := os.Open(*specPath)
+	if err != nil {
+		log.Fatalln("Failed to open the spec:", err)
+	}
+	defer file.Close()
+
+	spec, err := layout.ParseSpec(file)
+	if err != nil {
+		log.Fatalln("Failed to parse the spec:", err)
+	}
+
+	segments, err := spec.Plan(*size)
+	if err != nil {
+		log.Fatalln("Invalid layout:", err)
+	}
+
+	fmt.Printf("Layout version %d, %d segments\n", spec.Version, len(segments))
+	for _, seg := range segments {
+		fmt.Printf("  %-40s %-12s offset %#-10x size %d\n", seg.Name, seg.Type, seg.Offset, seg.Size)
+	}
+
+	if *header == "" {
+		return
+	}
+
+	out, err := os.Create(*header)
+	if err != nil {
+		log.Fatalln("Failed to create the header:", err)
+	}
+
+	if err := spec.WriteCHeader(out, *prefix, *size); err != nil {
+		log.Fatalln("Failed to write the header:", err)
+	}
+
+	if err := out.Close(); err != nil {
+		log.Fatalln("Failed to write the header:", err)
+	}
+}
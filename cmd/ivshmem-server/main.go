@@ -0,0 +1,40 @@
+//go:build linux
+
+// Command ivshmem-server serves the shared memory and the doorbell eventfds to ivshmem-doorbell devices, as a drop-in
+// for the C server shipped with QEMU:
+//
+//	-chardev socket,path=/tmp/ivshmem_socket,id=ivshmem -device ivshmem-doorbell,chardev=ivshmem,vectors=1
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TypicalAM/ivshmem/server"
+)
+
+func main() {
+	socket := flag.String("socket", "/tmp/ivshmem_socket", "unix socket the devices connect to")
+	shm := flag.String("shm", "/dev/shm/ivshmem", "shared memory file, created if needed")
+	size := flag.Uint64("size", 4<<20, "size of the shared memory in bytes, a power of two")
+	vectors := flag.Int("vectors", 1, "interrupt vectors per peer")
+	flag.Parse()
+
+	s, err := server.New(server.Config{SocketPath: *socket, ShmPath: *shm, Size: *size, Vectors: *vectors})
+	if err != nil {
+		log.Fatalln("Failed to start the server:", err)
+	}
+	defer s.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := s.Serve(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalln("Failed to serve:", err)
+	}
+}
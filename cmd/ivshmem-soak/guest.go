@@ -0,0 +1,23 @@
+//go:build linux || windows
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// newGuest opens the ivshmem device with the given index.
+func newGuest(device int) (region, error) {
+	devs, err := ivshmem.ListDevices()
+	if err != nil {
+		return nil, fmt.Errorf("list devices: %w", err)
+	}
+
+	if device < 0 || device >= len(devs) {
+		return nil, fmt.Errorf("device %d not found, %d available", device, len(devs))
+	}
+
+	return ivshmem.NewGuest(devs[device])
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+// newGuest fails, only linux and windows guests are supported.
+func newGuest(device int) (region, error) {
+	return nil, errors.New("guest mode is only supported on linux and windows")
+}
@@ -0,0 +1,10 @@
+//go:build linux
+
+package main
+
+import "github.com/TypicalAM/ivshmem"
+
+// newHost opens the shared memory file.
+func newHost(shmPath string) (region, error) {
+	return ivshmem.NewHost(shmPath)
+}
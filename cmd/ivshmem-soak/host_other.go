@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newHost fails, only linux hosts are supported.
+func newHost(shmPath string) (region, error) {
+	return nil, errors.New("host mode is only supported on linux")
+}
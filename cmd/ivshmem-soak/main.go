@@ -0,0 +1,133 @@
+// Command ivshmem-soak runs a producer/consumer workload over a shared memory region for as long as needed and
+// verifies every message with a sequence number and a checksum. It reports throughput, corruption and stalls, which
+// makes it usable for qualifying a hardware/driver combination before deploying on it.
+//
+// Run the producer on one side and the consumer on the other, or both in one process with -role loopback.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// region is the part of the Host and Guest API the soak test needs.
+type region interface {
+	Map() error
+	Unmap() error
+	SharedMem() []byte
+}
+
+func main() {
+	role := flag.String("role", "loopback", "producer, consumer or loopback")
+	shmPath := flag.String("shm", "", "shared memory file to use (host side)")
+	device := flag.Int("device", 0, "index of the ivshmem device as returned by ListDevices (guest side)")
+	slots := flag.Uint("slots", 64, "number of message slots")
+	slotSize := flag.Uint("slot-size", 64*1024, "size of a message slot in bytes")
+	duration := flag.Duration("duration", 0, "how long to run, zero means until interrupted")
+	report := flag.Duration("report", 10*time.Second, "interval between progress reports")
+	stall := flag.Duration("stall", 5*time.Second, "report a stall when no progress is made for this long")
+	seed := flag.Int64("seed", 1, "seed of the payload generator")
+	vm := flag.String("vm", os.Getenv("IVSHMEM_VM"), "name of the VM, prefixes the logs when one host serves several VMs")
+	flag.Parse()
+
+	if *slots == 0 || *slots > math.MaxUint32 {
+		usageError("-slots must be between 1 and %d", uint32(math.MaxUint32))
+	}
+
+	if *slotSize <= slotHeaderSize || *slotSize > math.MaxUint32 {
+		usageError("-slot-size must be between %d and %d, a slot holds a %d byte header and at least a byte of payload",
+			slotHeaderSize+1, uint32(math.MaxUint32), slotHeaderSize)
+	}
+
+	if *vm != "" {
+		log.SetPrefix(*vm + ": ")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	cfg := config{slots: uint32(*slots), slotSize: uint32(*slotSize), seed: *seed, report: *report, stall: *stall}
+	mem, cleanup, err := attach(*role, *shmPath, *device, cfg)
+	if err != nil {
+		log.Fatalln("Failed to attach:", err)
+	}
+	defer cleanup()
+
+	stats := newStats(*report)
+	switch *role {
+	case "producer":
+		err = produce(ctx, mem, cfg, stats)
+	case "consumer":
+		err = consume(ctx, mem, cfg, stats)
+	case "loopback":
+		errs := make(chan error, 1)
+		go func() { errs <- produce(ctx, mem, cfg, newStats(0)) }()
+		err = consume(ctx, mem, cfg, stats)
+		if perr := <-errs; err == nil {
+			err = perr
+		}
+	default:
+		log.Fatalln("Unknown role:", *role)
+	}
+
+	stats.print()
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		log.Fatalln("Soak test failed:", err)
+	}
+
+	if stats.corrupted > 0 {
+		log.Fatalln("Soak test found corrupted messages:", stats.corrupted)
+	}
+
+	fmt.Println("Soak test passed")
+}
+
+// usageError prints the error and the usage, and exits like the flag package does for invalid flags.
+func usageError(format string, args ...any) {
+	fmt.Fprintf(flag.CommandLine.Output(), format+"\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// attach maps the region used by the role.
+func attach(role, shmPath string, device int, cfg config) ([]byte, func(), error) {
+	if role == "loopback" && shmPath == "" {
+		return make([]byte, cfg.regionSize()), func() {}, nil
+	}
+
+	var r region
+	var err error
+	if shmPath != "" {
+		r, err = newHost(shmPath)
+	} else {
+		r, err = newGuest(device)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.Map(); err != nil {
+		return nil, nil, fmt.Errorf("map: %w", err)
+	}
+
+	if size := cfg.regionSize(); uint64(len(r.SharedMem())) < size {
+		r.Unmap()
+		return nil, nil, fmt.Errorf("region has %d bytes, the workload needs %d", len(r.SharedMem()), size)
+	}
+
+	return r.SharedMem(), func() { r.Unmap() }, nil
+}
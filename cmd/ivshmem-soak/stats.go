@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// stats tracks the progress of one side of the workload, it is only used by a single goroutine.
+type stats struct {
+	start     time.Time
+	last      time.Time
+	interval  time.Duration
+	messages  uint64
+	bytes     uint64
+	corrupted uint64
+	stalls    uint64
+}
+
+// newStats returns stats printing a report every interval, zero disables the reports.
+func newStats(interval time.Duration) *stats {
+	now := time.Now()
+	return &stats{start: now, last: now, interval: interval}
+}
+
+// add records a verified or written message.
+func (s *stats) add(size int) {
+	s.messages++
+	s.bytes += uint64(size)
+}
+
+// corrupt records a corrupted message.
+func (s *stats) corrupt(seq uint64, reason string) {
+	s.corrupted++
+	log.Printf("CORRUPTION: message %d: %s", seq, reason)
+}
+
+// stalled records that the peer made no progress for the given time.
+func (s *stats) stalled(d time.Duration) {
+	s.stalls++
+	log.Printf("STALL: no progress for %s", d.Round(time.Millisecond))
+}
+
+// tick prints a report if the interval elapsed.
+func (s *stats) tick() {
+	if s.interval == 0 || s.messages%256 != 0 || time.Since(s.last) < s.interval {
+		return
+	}
+
+	s.last = time.Now()
+	s.print()
+}
+
+// print writes the summary of the run so far.
+func (s *stats) print() {
+	elapsed := time.Since(s.start).Seconds()
+	fmt.Printf("%s%s: %d messages, %.1f MB, %.0f msg/s, %.1f MB/s, %d corrupted, %d stalls\n",
+		log.Prefix(), time.Since(s.start).Round(time.Second), s.messages, float64(s.bytes)/1e6,
+		float64(s.messages)/elapsed, float64(s.bytes)/1e6/elapsed, s.corrupted, s.stalls)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Region layout, all the values are little endian:
+//
+//	0   magic, slot count, slot size (uint32 each)
+//	64  number of produced messages (uint64)
+//	128 number of consumed messages (uint64)
+//	256 slots, each one being: sequence (uint64), payload length (uint32), crc32 (uint32), payload
+const (
+	soakMagic      = 0x4b414f53 // "SOAK"
+	offProduced    = 64
+	offConsumed    = 128
+	offSlots       = 256
+	slotHeaderSize = 16
+)
+
+// config describes the workload, both sides must use the same one.
+type config struct {
+	slots    uint32
+	slotSize uint32
+	seed     int64
+	report   time.Duration
+	stall    time.Duration
+}
+
+// regionSize returns the amount of shared memory the workload needs.
+func (c config) regionSize() uint64 {
+	return offSlots + uint64(c.slots)*uint64(c.slotSize)
+}
+
+// slot returns the memory of the slot used by the message with the given sequence number.
+func (c config) slot(mem []byte, seq uint64) []byte {
+	start := offSlots + (seq%uint64(c.slots))*uint64(c.slotSize)
+	return mem[start : start+uint64(c.slotSize)]
+}
+
+// counter returns the shared counter at the given offset.
+func counter(mem []byte, offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&mem[offset]))
+}
+
+// payload fills the buffer with the deterministic payload of the message and returns it.
+func (c config) payload(buf []byte, seq uint64) []byte {
+	rng := rand.New(rand.NewSource(c.seed ^ int64(seq)))
+	data := buf[:1+rng.Intn(len(buf))]
+	rng.Read(data)
+	return data
+}
+
+// produce initializes the region and writes messages until the context is done.
+func produce(ctx context.Context, mem []byte, cfg config, stats *stats) error {
+	binary.LittleEndian.PutUint32(mem[4:], cfg.slots)
+	binary.LittleEndian.PutUint32(mem[8:], cfg.slotSize)
+	atomic.StoreUint64(counter(mem, offProduced), 0)
+	atomic.StoreUint64(counter(mem, offConsumed), 0)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mem[0])), soakMagic)
+
+	buf := make([]byte, cfg.slotSize-slotHeaderSize)
+	for seq := uint64(0); ; seq++ {
+		err := waitFor(ctx, cfg.stall, stats, func() bool {
+			return seq-atomic.LoadUint64(counter(mem, offConsumed)) < uint64(cfg.slots)
+		})
+		if err != nil {
+			return err
+		}
+
+		data := cfg.payload(buf, seq)
+		slot := cfg.slot(mem, seq)
+		binary.LittleEndian.PutUint64(slot[0:], seq)
+		binary.LittleEndian.PutUint32(slot[8:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(slot[12:], crc32.ChecksumIEEE(data))
+		copy(slot[slotHeaderSize:], data)
+
+		atomic.StoreUint64(counter(mem, offProduced), seq+1)
+		stats.add(len(data))
+	}
+}
+
+// consume verifies messages until the context is done.
+func consume(ctx context.Context, mem []byte, cfg config, stats *stats) error {
+	err := waitFor(ctx, cfg.stall, stats, func() bool {
+		return atomic.LoadUint32((*uint32)(unsafe.Pointer(&mem[0]))) == soakMagic
+	})
+	if err != nil {
+		return fmt.Errorf("wait for producer: %w", err)
+	}
+
+	if slots, size := binary.LittleEndian.Uint32(mem[4:]), binary.LittleEndian.Uint32(mem[8:]); slots != cfg.slots || size != cfg.slotSize {
+		return fmt.Errorf("producer uses %d slots of %d bytes, we expect %d of %d", slots, size, cfg.slots, cfg.slotSize)
+	}
+
+	for seq := atomic.LoadUint64(counter(mem, offConsumed)); ; seq++ {
+		err := waitFor(ctx, cfg.stall, stats, func() bool {
+			return atomic.LoadUint64(counter(mem, offProduced)) > seq
+		})
+		if err != nil {
+			return err
+		}
+
+		slot := cfg.slot(mem, seq)
+		gotSeq := binary.LittleEndian.Uint64(slot[0:])
+		length := binary.LittleEndian.Uint32(slot[8:])
+		sum := binary.LittleEndian.Uint32(slot[12:])
+
+		switch {
+		case gotSeq != seq:
+			stats.corrupt(seq, fmt.Sprintf("slot holds sequence %d", gotSeq))
+		case length == 0 || length > cfg.slotSize-slotHeaderSize:
+			stats.corrupt(seq, fmt.Sprintf("invalid length %d", length))
+		case crc32.ChecksumIEEE(slot[slotHeaderSize:slotHeaderSize+length]) != sum:
+			stats.corrupt(seq, "checksum mismatch")
+		default:
+			stats.add(int(length))
+		}
+
+		atomic.StoreUint64(counter(mem, offConsumed), seq+1)
+	}
+}
+
+// waitFor spins until the condition holds, reporting a stall every time no progress is made for too long.
+func waitFor(ctx context.Context, stall time.Duration, stats *stats, cond func() bool) error {
+	start := time.Now()
+	for spins := 0; !cond(); spins++ {
+		if spins%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if stall > 0 && time.Since(start) > stall {
+				stats.stalled(time.Since(start))
+				start = time.Now()
+			}
+
+			time.Sleep(time.Microsecond)
+		}
+	}
+
+	stats.tick()
+	return nil
+}
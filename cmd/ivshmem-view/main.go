@@ -0,0 +1,120 @@
+//go:build linux
+
+// Command ivshmem-view attaches to a framebuffer stored in a shared memory file and writes the published frames as PNG
+// snapshots, or previews them in a true color terminal.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/framebuffer"
+)
+
+func main() {
+	shmPath := flag.String("shm", "/dev/shm/my-little-shared-memory", "path of the shared memory file")
+	out := flag.String("out", "frame-%d.png", "snapshot file name, %d is replaced with the frame sequence")
+	count := flag.Int("count", 1, "number of frames to capture, 0 means until interrupted")
+	interval := flag.Duration("interval", time.Second, "minimal time between two snapshots")
+	terminal := flag.Bool("terminal", false, "preview the frames in the terminal instead of writing files")
+	columns := flag.Int("columns", 80, "preview width in terminal columns")
+	strict := flag.Bool("strict", false, "stop with a diagnostic as soon as the producer breaks the framebuffer protocol")
+	vm := flag.String("vm", os.Getenv("IVSHMEM_VM"), "name of the VM, prefixes the logs when one host serves several VMs")
+	flag.Parse()
+
+	if *vm != "" {
+		log.SetPrefix(*vm + ": ")
+	}
+
+	h, err := ivshmem.NewHost(*shmPath)
+	if err != nil {
+		log.Fatalln("Failed to attach to shmem file:", err)
+	}
+
+	if err := h.Map(); err != nil {
+		log.Fatalln("Failed to map memory from file:", err)
+	}
+	defer h.Unmap()
+
+	open := framebuffer.Open
+	if *strict {
+		open = framebuffer.OpenStrict
+	}
+
+	fb, err := open(h.SharedMem())
+	if err != nil {
+		log.Fatalln("Failed to open the framebuffer:", err)
+	}
+
+	fmt.Printf("Framebuffer: %dx%d %s, stride %d\n", fb.Width(), fb.Height(), fb.Format(), fb.Stride())
+
+	var last uint64
+	for n := 0; *count == 0 || n < *count; {
+		img, seq, err := fb.Snapshot()
+		if err != nil && !errors.Is(err, framebuffer.ErrTornFrame) {
+			log.Fatalln("Failed to read the frame:", err)
+		}
+
+		// A torn frame is retried, like no frame published yet or none newer than the last one
+		if err != nil || seq == 0 || seq == last {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if *terminal {
+			preview(img, *columns)
+		} else if err := save(fmt.Sprintf(*out, seq), img); err != nil {
+			log.Fatalln("Failed to save the frame:", err)
+		}
+
+		last = seq
+		n++
+		time.Sleep(*interval)
+	}
+}
+
+// save writes the image as a PNG file.
+func save(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		return fmt.Errorf("encode png: %w", err)
+	}
+
+	fmt.Println("Saved", path)
+	return file.Close()
+}
+
+// preview draws a downscaled image using half blocks, two image rows per terminal line.
+func preview(img *image.RGBA, columns int) {
+	bounds := img.Bounds()
+	scale := float64(bounds.Dx()) / float64(columns)
+	rows := int(float64(bounds.Dy()) / scale / 2)
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for row := 0; row < rows; row++ {
+		for col := 0; col < columns; col++ {
+			x := int(float64(col) * scale)
+			top := img.RGBAAt(x, int(float64(row*2)*scale))
+			bottom := img.RGBAAt(x, int(float64(row*2+1)*scale))
+			fmt.Fprintf(&sb, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+
+		sb.WriteString("\x1b[0m\n")
+	}
+
+	fmt.Print(sb.String())
+}
@@ -0,0 +1,137 @@
+//go:build linux
+
+// Command ivshmemctl inspects a shared memory file from the host, without disturbing the peers using it.
+//
+// Commands:
+//
+//	errors        print the errors recorded by the peers into the error log segment
+//	fingerprint   print the layout hash and version, the channels and whether the peer is alive, the first thing to
+//	              collect when a link doesn't come up
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/errlog"
+	"github.com/TypicalAM/ivshmem/fingerprint"
+	"github.com/TypicalAM/ivshmem/layout"
+)
+
+func main() {
+	shmPath := flag.String("shm", "/dev/shm/my-little-shared-memory", "path of the shared memory file")
+	segment := flag.String("segment", errlog.Segment, "name of the error log segment")
+	sample := flag.Duration("sample", fingerprint.DefaultSample, "how long the fingerprint watches the counters")
+	asJSON := flag.Bool("json", false, "print the fingerprint as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] errors|fingerprint\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	h, err := ivshmem.NewHost(*shmPath)
+	if err != nil {
+		log.Fatalln("Failed to attach to shmem file:", err)
+	}
+
+	if err := h.Map(); err != nil {
+		log.Fatalln("Failed to map memory from file:", err)
+	}
+	defer h.Close()
+
+	switch flag.Arg(0) {
+	case "errors":
+		printErrors(h.SharedMem(), *segment)
+	case "fingerprint":
+		printFingerprint(h.SharedMem(), *sample, *asJSON)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// printErrors prints the entries of the error log stored in the segment.
+func printErrors(mem []byte, segment string) {
+	l, err := layout.Open(mem)
+	if err != nil {
+		log.Fatalln("Failed to open the layout:", err)
+	}
+
+	seg, err := l.Bytes(segment)
+	if err != nil {
+		log.Fatalln("Failed to find the error log:", err)
+	}
+
+	errs, err := errlog.Open(seg)
+	if err != nil {
+		log.Fatalln("Failed to open the error log:", err)
+	}
+
+	entries := errs.Entries()
+	fmt.Printf("%d errors recorded, showing the last %d\n", errs.Recorded(), len(entries))
+	for _, e := range entries {
+		fmt.Printf("#%-6d %s %-12s %s\n", e.Sequence, e.Time.Format("2006-01-02 15:04:05.000"), e.Source, e.Message)
+	}
+}
+
+// printFingerprint prints the fingerprint of the region.
+func printFingerprint(mem []byte, sample time.Duration, asJSON bool) {
+	r, err := fingerprint.Take(mem, fingerprint.Options{Sample: sample})
+	if err != nil {
+		log.Fatalln("Failed to fingerprint the region:", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			log.Fatalln("Failed to encode the fingerprint:", err)
+		}
+		return
+	}
+
+	fmt.Printf("hash        %s\n", r.Hash)
+	fmt.Printf("size        %d bytes\n", r.Size)
+	fmt.Printf("layout      version %d, generation %d\n", r.LayoutVersion, r.Generation)
+	if r.Stale {
+		fmt.Println("            changed while sampling, run again")
+	}
+
+	switch {
+	case !r.Peer.Heartbeat:
+		fmt.Println("peer        unknown, no heartbeat segment")
+	case r.Peer.Alive:
+		fmt.Printf("peer        alive, heartbeat %d\n", r.Peer.Counter)
+	default:
+		fmt.Printf("peer        silent, heartbeat %d\n", r.Peer.Counter)
+	}
+
+	fmt.Printf("segments    %d\n", len(r.Channels))
+	for _, ch := range r.Channels {
+		state := "idle"
+		switch {
+		case ch.Error != "":
+			state = "broken: " + ch.Error
+		case ch.Format == "":
+			state = "unrecognized"
+		case ch.Active:
+			state = "active"
+		}
+
+		fmt.Printf("  %-16s %-12s %#010x %10d  %-8s %s", ch.Name, ch.Type, ch.Offset, ch.Size, ch.Format, state)
+		if ch.Detail != "" {
+			fmt.Printf(", %s", ch.Detail)
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,149 @@
+package ivshmem
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+var ErrNoCommonCodec = errors.New("no common codec")
+var ErrCodecExists = errors.New("codec already registered")
+
+// Codec serializes the values exchanged by the message layers.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"json": jsonCodec{},
+		"gob":  gobCodec{},
+		"raw":  rawCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available under the name, so the peers can agree on it with NegotiateCodec. The name
+// mustn't contain a comma, the handshake separates the names with them.
+func RegisterCodec(name string, codec Codec) error {
+	if name == "" || strings.Contains(name, ",") || codec == nil {
+		return fmt.Errorf("%w: empty name, name with a comma or nil codec", ErrUnknownCodec)
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[name]; ok {
+		return fmt.Errorf("%w: %s", ErrCodecExists, name)
+	}
+
+	codecs[name] = codec
+	return nil
+}
+
+// LookupCodec returns the codec registered under the name.
+func LookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+
+	return codec, nil
+}
+
+// Codecs returns the sorted names of the registered codecs.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NegotiateCodec picks the first codec of the local preference list which the remote side supports and which is
+// registered here. The rpc package runs it in the handshake of every connection, see rpc.Client.Handshake.
+func NegotiateCodec(local, remote []string) (string, Codec, error) {
+	supported := make(map[string]bool, len(remote))
+	for _, name := range remote {
+		supported[name] = true
+	}
+
+	for _, name := range local {
+		if !supported[name] {
+			continue
+		}
+
+		if codec, err := LookupCodec(name); err == nil {
+			return name, codec, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("%w: local %v, remote %v", ErrNoCommonCodec, local, remote)
+}
+
+// jsonCodec uses encoding/json.
+type jsonCodec struct{}
+
+// Marshal implements Codec.
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// gobCodec uses encoding/gob, every message is a self contained gob stream.
+type gobCodec struct{}
+
+// Marshal implements Codec.
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements Codec.
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// rawCodec passes byte slices through untouched.
+type rawCodec struct{}
+
+// Marshal implements Codec, v must be a []byte.
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("raw codec needs []byte, got %T", v)
+	}
+
+	return data, nil
+}
+
+// Unmarshal implements Codec, v must be a *[]byte.
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	dst, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec needs *[]byte, got %T", v)
+	}
+
+	*dst = append((*dst)[:0], data...)
+	return nil
+}
@@ -0,0 +1,310 @@
+// Package config shares a small typed configuration structure through the shared memory region. One side (usually
+// the host) stores new versions of it, the other side (usually the guest agent) watches it with OnChange, which pushes
+// settings like the bitrate or the log level without an RPC round trip. Every Init draws a new session and bumps the
+// epoch, the views fail with ErrStale once a peer initialized the configuration again, the version numbers restart
+// then.
+package config
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrBusy = errors.New("configuration kept changing while reading it")
+var ErrTooLarge = errors.New("configuration too large")
+var ErrEmpty = errors.New("no configuration stored yet")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x46435649 // "IVCF" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+)
+
+// Header field offsets, all the values are little endian.
+const (
+	offMagic    = 0
+	offVersion  = 4
+	offSequence = 8 // Odd while an update is being written, twice the configuration version otherwise
+	offLength   = 16
+	offSession  = 44
+	offEpoch    = 60
+)
+
+// readRetries bounds the attempts to read a consistent configuration while the writer keeps updating it.
+const readRetries = 1000
+
+// Options customize a configuration segment, the zero value uses JSON and polls every 100ms.
+type Options struct {
+	Codec    ivshmem.Codec // Encoding of the configuration, JSON if nil
+	Interval time.Duration // How often OnChange polls for updates
+
+	// Notifier is rung on Peer and Vector by Store and listened to by OnChange, which then picks up the updates right
+	// away instead of on the next poll.
+	Notifier ivshmem.Notifier
+	Peer     uint16
+	Vector   uint16
+
+	// OnError is called by OnChange for the versions which couldn't be loaded, once per version, and for a notifier
+	// which couldn't be listened to. It must not block.
+	OnError func(err error)
+}
+
+// Config is a view of a configuration of type T stored in the region.
+type Config[T any] struct {
+	mem   []byte
+	opts  Options
+	stamp shmhdr.Stamp
+}
+
+// Init writes a fresh header into the region and returns the configuration. It is called by the writer.
+func Init[T any](mem []byte, opts Options) (*Config[T], error) {
+	if len(mem) < HeaderSize {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	c, err := newConfig[T](mem, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offLength:], 0)
+	atomic.StoreUint64(c.sequencePtr(), 0)
+
+	shmhdr.Publish(mem, Magic)
+	return c, nil
+}
+
+// Open validates the header written by Init and returns the configuration.
+func Open[T any](mem []byte, opts Options) (*Config[T], error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	c, err := newConfig[T](mem, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return c, nil
+}
+
+// newConfig checks the alignment of the region and fills in the default options.
+func newConfig[T any](mem []byte, opts Options) (*Config[T], error) {
+	// The sequence is accessed with 64 bit atomics, which need 8 byte alignment on 32 bit platforms
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	if opts.Codec == nil {
+		codec, err := ivshmem.LookupCodec("json")
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Codec = codec
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+
+	return &Config[T]{mem: mem, opts: opts}, nil
+}
+
+// Store publishes a new version of the configuration and returns its number. There must be a single writer.
+func (c *Config[T]) Store(v T) (uint64, error) {
+	data, err := c.opts.Codec.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("encode configuration: %w", err)
+	}
+
+	if len(data) > len(c.mem)-HeaderSize {
+		return 0, fmt.Errorf("%w: %d bytes, the segment holds %d", ErrTooLarge, len(data), len(c.mem)-HeaderSize)
+	}
+
+	if err := c.stamp.Check(); err != nil {
+		return 0, err
+	}
+
+	seq := atomic.AddUint64(c.sequencePtr(), 1)
+	binary.LittleEndian.PutUint32(c.mem[offLength:], uint32(len(data)))
+	copy(c.mem[HeaderSize:], data)
+	atomic.StoreUint64(c.sequencePtr(), seq+1)
+
+	if c.opts.Notifier != nil {
+		if err := c.opts.Notifier.Notify(c.opts.Peer, c.opts.Vector); err != nil {
+			return (seq + 1) / 2, fmt.Errorf("notify peer: %w", err)
+		}
+	}
+
+	return (seq + 1) / 2, nil
+}
+
+// Load returns the current configuration and its version number, ErrEmpty if none was stored yet. It backs off while
+// the writer is busy and fails with ErrBusy if it never gets a consistent copy, or with ErrStale once the
+// configuration was initialized again.
+func (c *Config[T]) Load() (T, uint64, error) {
+	var v T
+	var b shmsync.Backoff
+	for i := 0; i < readRetries; i++ {
+		if i > 0 {
+			b.Wait()
+		}
+
+		if err := c.stamp.Check(); err != nil {
+			return v, 0, err
+		}
+
+		before := atomic.LoadUint64(c.sequencePtr())
+		if before%2 != 0 {
+			continue
+		}
+
+		if before == 0 {
+			return v, 0, ErrEmpty
+		}
+
+		length := binary.LittleEndian.Uint32(c.mem[offLength:])
+		if uint64(length) > uint64(len(c.mem)-HeaderSize) {
+			if atomic.LoadUint64(c.sequencePtr()) != before {
+				continue
+			}
+
+			return v, 0, fmt.Errorf("%w: length %d, the segment holds %d", ErrInvalidHeader, length, len(c.mem)-HeaderSize)
+		}
+
+		data := make([]byte, length)
+		copy(data, c.mem[HeaderSize:])
+		if atomic.LoadUint64(c.sequencePtr()) != before {
+			continue
+		}
+
+		// A peer initializing the configuration again resets the sequence, the copy may belong to the new session
+		if err := c.stamp.Check(); err != nil {
+			return v, 0, err
+		}
+
+		if err := c.opts.Codec.Unmarshal(data, &v); err != nil {
+			return v, 0, fmt.Errorf("decode configuration: %w", err)
+		}
+
+		return v, before / 2, nil
+	}
+
+	return v, 0, ErrBusy
+}
+
+// Session returns the ID of the initialization the configuration was opened with.
+func (c *Config[T]) Session() shmhdr.Session {
+	return c.stamp.Session()
+}
+
+// Epoch returns the number of times the configuration was initialized, when it was opened.
+func (c *Config[T]) Epoch() uint32 {
+	return c.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the configuration again since it was opened, the view must be reopened
+// then.
+func (c *Config[T]) Stale() bool {
+	return c.stamp.Check() != nil
+}
+
+// Version returns the number of the current configuration version, zero if none was stored yet.
+func (c *Config[T]) Version() uint64 {
+	return atomic.LoadUint64(c.sequencePtr()) / 2
+}
+
+// OnChange returns a channel receiving the configuration every time a new version is stored, starting with the
+// current one if there is any. Versions stored in quick succession may be coalesced into the latest one. A version
+// which can't be decoded is skipped and passed to Options.OnError, a busy writer is retried on the next poll. The
+// channel is closed when the context is done, or after ErrStale is passed to Options.OnError once a peer initialized
+// the configuration again: the version numbers restart then, the view must be reopened to follow them.
+func (c *Config[T]) OnChange(ctx context.Context) <-chan T {
+	ch := make(chan T)
+	var wake <-chan struct{}
+	if c.opts.Notifier != nil {
+		var err error
+		if wake, err = c.opts.Notifier.Listen(c.opts.Vector); err != nil {
+			c.report(fmt.Errorf("listen for updates, polling only: %w", err))
+		}
+	}
+
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(c.opts.Interval)
+		defer ticker.Stop()
+
+		var seen uint64
+		for {
+			if err := c.stamp.Check(); err != nil {
+				c.report(err)
+				return
+			}
+
+			if current := c.Version(); current != seen {
+				v, version, err := c.Load()
+				switch {
+				case errors.Is(err, ErrBusy):
+				case errors.Is(err, ErrStale):
+					continue // Reported by the check above
+				case err != nil:
+					// Reported once, the version stays broken until the next Store
+					seen = current
+					c.report(fmt.Errorf("load version %d: %w", current, err))
+				case version != seen:
+					seen = version
+					select {
+					case ch <- v:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case _, ok := <-wake:
+				if !ok {
+					wake = nil
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// report passes the error to the error callback.
+func (c *Config[T]) report(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// sequencePtr returns the sequence field for atomic access.
+func (c *Config[T]) sequencePtr() *uint64 {
+	return (*uint64)(unsafe.Pointer(&c.mem[offSequence]))
+}
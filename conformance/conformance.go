@@ -0,0 +1,128 @@
+// Package conformance publishes byte level test vectors of the shared memory formats. Run verifies the Go
+// implementation against them, WriteFiles dumps them so implementations in other languages can do the same.
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Case is a single test vector: the raw bytes found at the start of a region and what a reader must make of them.
+type Case struct {
+	Name    string            // Unique name within the suite
+	Size    uint64            // Size of the region, the bytes after Bytes are zero
+	Bytes   []byte            // Raw bytes at the start of the region
+	Err     error             // Error a conforming reader reports, nil if the region is valid
+	Fields  map[string]uint64 // Decoded fields of a valid region
+	Strings map[string]string // Decoded textual fields of a valid region
+}
+
+// Suite is the set of cases describing a single version of a format.
+type Suite struct {
+	Format  string
+	Version uint32
+	Cases   []Case
+
+	check func(Case) error // Runs the Go implementation against a case
+}
+
+// Suites returns the vectors of all the formats.
+func Suites() []Suite {
+	return []Suite{framebufferSuite(), frameSuiteV1(), frameSuite(), ringSuite(), muxSuite(), layoutSuite(), lgmpSuite()}
+}
+
+// Run checks the Go implementation against every case and the cases against the golden files, returning all the mismatches.
+func Run() error {
+	errs := []error{checkGolden()}
+	for _, suite := range Suites() {
+		for _, c := range suite.Cases {
+			if err := suite.check(c); err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: %w", suite.Format, c.Name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// manifestEntry is the JSON representation of a case, the raw bytes are stored next to it.
+type manifestEntry struct {
+	Name    string            `json:"name"`
+	File    string            `json:"file"`
+	Size    uint64            `json:"size"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]uint64 `json:"fields,omitempty"`
+	Strings map[string]string `json:"strings,omitempty"`
+}
+
+// WriteFiles writes every case as <dir>/<format>/v<version>/<name>.bin together with a manifest.json per format version.
+func WriteFiles(dir string) error {
+	for _, suite := range Suites() {
+		formatDir := filepath.Join(dir, suite.dir())
+		if err := os.MkdirAll(formatDir, 0o755); err != nil {
+			return fmt.Errorf("create dir: %w", err)
+		}
+
+		for _, c := range suite.Cases {
+			if err := os.WriteFile(filepath.Join(formatDir, c.Name+".bin"), c.Bytes, 0o644); err != nil {
+				return fmt.Errorf("write case: %w", err)
+			}
+		}
+
+		data, err := suite.manifest()
+		if err != nil {
+			return fmt.Errorf("marshal manifest: %w", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(formatDir, "manifest.json"), data, 0o644); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// dir returns the path of the suite files relative to the vector root.
+func (s Suite) dir() string {
+	return fmt.Sprintf("%s/v%d", s.Format, s.Version)
+}
+
+// manifest returns the JSON manifest describing the cases of the suite.
+func (s Suite) manifest() ([]byte, error) {
+	manifest := make([]manifestEntry, len(s.Cases))
+	for i, c := range s.Cases {
+		manifest[i] = manifestEntry{Name: c.Name, File: c.Name + ".bin", Size: c.Size, Fields: c.Fields, Strings: c.Strings}
+		if c.Err != nil {
+			manifest[i].Error = c.Err.Error()
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// region returns the full region described by the case.
+func (c Case) region() []byte {
+	mem := make([]byte, c.Size)
+	copy(mem, c.Bytes)
+	return mem
+}
+
+// le builds little endian bytes out of (width, value) pairs, width being 1, 2, 4 or 8.
+func le(pairs ...uint64) []byte {
+	var out []byte
+	for i := 0; i < len(pairs); i += 2 {
+		for b := uint64(0); b < pairs[i]; b++ {
+			out = append(out, byte(pairs[i+1]>>(8*b)))
+		}
+	}
+
+	return out
+}
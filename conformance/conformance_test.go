@@ -0,0 +1,41 @@
+package conformance
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestVectors(t *testing.T) {
+	for _, suite := range Suites() {
+		suite := suite
+		t.Run(fmt.Sprintf("%s/v%d", suite.Format, suite.Version), func(t *testing.T) {
+			for _, c := range suite.Cases {
+				c := c
+				t.Run(c.Name, func(t *testing.T) {
+					if err := suite.check(c); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	if err := checkGolden(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaseNamesUnique(t *testing.T) {
+	for _, suite := range Suites() {
+		seen := make(map[string]bool)
+		for _, c := range suite.Cases {
+			if seen[c.Name] {
+				t.Errorf("%s: duplicate case %q", suite.dir(), c.Name)
+			}
+
+			seen[c.Name] = true
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+// frameBytes concatenates a frame header with the raw metadata area and payload.
+func frameBytes(payloadLen, mdLen, flags uint64, md, payload string) []byte {
+	return append(le(4, payloadLen, 2, mdLen, 2, flags), md+payload...)
+}
+
+// checkedFrameBytes is frameBytes with the checksum flag and trailer.
+func checkedFrameBytes(payloadLen, mdLen uint64, md, payload string) []byte {
+	b := frameBytes(payloadLen, mdLen, frame.FlagChecksum, md, payload)
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// frameSuiteV1 describes the first version of the message frame format, whose frames are still valid.
+func frameSuiteV1() Suite {
+	md := "\x06tenant\x01a\x08trace-id\x100af7651916cd43dd"
+	return Suite{
+		Format:  "frame",
+		Version: 1,
+		Cases: []Case{
+			{
+				Name:   "empty",
+				Size:   8,
+				Bytes:  frameBytes(0, 0, 0, "", ""),
+				Fields: map[string]uint64{"payload_length": 0, "metadata_entries": 0},
+			},
+			{
+				Name:    "payload-only",
+				Size:    13,
+				Bytes:   frameBytes(5, 0, 0, "", "hello"),
+				Fields:  map[string]uint64{"payload_length": 5, "metadata_entries": 0},
+				Strings: map[string]string{"payload": "hello"},
+			},
+			{
+				Name:    "metadata",
+				Size:    uint64(8 + len(md) + 4),
+				Bytes:   frameBytes(4, uint64(len(md)), 0, md, "ping"),
+				Fields:  map[string]uint64{"payload_length": 4, "metadata_entries": 2},
+				Strings: map[string]string{"payload": "ping", "metadata.tenant": "a", "metadata.trace-id": "0af7651916cd43dd"},
+			},
+			{
+				Name:  "truncated-payload",
+				Size:  12,
+				Bytes: frameBytes(10, 0, 0, "", "ping"),
+				Err:   frame.ErrMalformed,
+			},
+			{
+				Name:  "reserved-set",
+				Size:  8,
+				Bytes: frameBytes(0, 0, 1, "", ""),
+				Err:   frame.ErrMalformed,
+			},
+			{
+				Name:  "metadata-overrun",
+				Size:  15,
+				Bytes: frameBytes(0, 7, 0, "\x06tenant", ""),
+				Err:   frame.ErrMalformed,
+			},
+			{
+				Name:  "metadata-too-large",
+				Size:  8,
+				Bytes: frameBytes(0, 2000, 0, "", ""),
+				Err:   frame.ErrMalformed,
+			},
+		},
+		check: checkFrame,
+	}
+}
+
+// frameSuite describes the message frame format with the checksums.
+func frameSuite() Suite {
+	md := "\x06tenant\x01a\x08trace-id\x100af7651916cd43dd"
+	checked := checkedFrameBytes(4, uint64(len(md)), md, "ping")
+	corrupted := append([]byte(nil), checked...)
+	corrupted[len(corrupted)-5] ^= 0x20
+	return Suite{
+		Format:  "frame",
+		Version: frame.Version,
+		Cases: []Case{
+			{
+				Name:    "unchecked",
+				Size:    13,
+				Bytes:   frameBytes(5, 0, 0, "", "hello"),
+				Fields:  map[string]uint64{"payload_length": 5, "metadata_entries": 0, "checksum": 0},
+				Strings: map[string]string{"payload": "hello"},
+			},
+			{
+				Name:   "checked-empty",
+				Size:   12,
+				Bytes:  checkedFrameBytes(0, 0, "", ""),
+				Fields: map[string]uint64{"payload_length": 0, "metadata_entries": 0, "checksum": 1},
+			},
+			{
+				Name:    "checked-metadata",
+				Size:    uint64(len(checked)),
+				Bytes:   checked,
+				Fields:  map[string]uint64{"payload_length": 4, "metadata_entries": 2, "checksum": 1},
+				Strings: map[string]string{"payload": "ping", "metadata.tenant": "a", "metadata.trace-id": "0af7651916cd43dd"},
+			},
+			{
+				Name:  "corrupted-payload",
+				Size:  uint64(len(corrupted)),
+				Bytes: corrupted,
+				Err:   frame.ErrChecksum,
+			},
+			{
+				Name:  "torn-checksum",
+				Size:  uint64(len(checked) - 2),
+				Bytes: checked[:len(checked)-2],
+				Err:   frame.ErrMalformed,
+			},
+			{
+				Name:  "unknown-flags",
+				Size:  8,
+				Bytes: frameBytes(0, 0, 2, "", ""),
+				Err:   frame.ErrMalformed,
+			},
+		},
+		check: checkFrame,
+	}
+}
+
+// checkFrame decodes the case and, for the valid ones, encodes the decoded frame again and compares the bytes.
+func checkFrame(c Case) error {
+	f, n, err := frame.Decode(c.region(), ivshmem.Limits{})
+	if c.Err != nil {
+		if !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	if n != len(c.Bytes) {
+		return fmt.Errorf("decoded %d bytes, want %d", n, len(c.Bytes))
+	}
+
+	got := map[string]uint64{"payload_length": uint64(len(f.Payload)), "metadata_entries": uint64(len(f.Metadata))}
+	if f.Checked {
+		got["checksum"] = 1
+	}
+
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	for name, want := range c.Strings {
+		value := string(f.Payload)
+		if key, ok := strings.CutPrefix(name, "metadata."); ok {
+			value = f.Metadata.Get(key)
+		}
+
+		if value != want {
+			return fmt.Errorf("field %s: want %q, got %q", name, want, value)
+		}
+	}
+
+	encoded, err := frame.Append(nil, f)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+
+	if !bytes.Equal(encoded, c.Bytes) {
+		return fmt.Errorf("encoded frame mismatch:\nwant %x\ngot  %x", c.Bytes, encoded)
+	}
+
+	return nil
+}
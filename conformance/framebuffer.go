@@ -0,0 +1,129 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem/framebuffer"
+)
+
+// framebufferHeader builds a 64 byte framebuffer header of the first epoch with a zero session.
+func framebufferHeader(magic, version, format, width, height, stride, dataOffset, sequence uint64) []byte {
+	hdr := le(4, magic, 4, version, 4, format, 4, width, 4, height, 4, stride, 4, dataOffset, 4, 1, 8, sequence)
+	return append(hdr, make([]byte, 64-len(hdr))...)
+}
+
+// framebufferSuite describes the framebuffer header. The encoded cases assume 4 KiB pages. The session is random, the
+// vectors keep it zero and the encoding check clears it before comparing.
+func framebufferSuite() Suite {
+	return Suite{
+		Format:  "framebuffer",
+		Version: framebuffer.Version,
+		Cases: []Case{
+			{
+				Name:   "bgra-640x480",
+				Size:   4096 + 2560*480,
+				Bytes:  framebufferHeader(0x42465649, 2, 1, 640, 480, 2560, 4096, 0),
+				Fields: map[string]uint64{"format": 1, "width": 640, "height": 480, "stride": 2560, "sequence": 0},
+			},
+			{
+				Name:   "rgba-1x1-published",
+				Size:   4096 + 256,
+				Bytes:  framebufferHeader(0x42465649, 2, 2, 1, 1, 256, 4096, 7),
+				Fields: map[string]uint64{"format": 2, "width": 1, "height": 1, "stride": 256, "sequence": 7},
+			},
+			{
+				Name:  "bad-magic",
+				Size:  4096 + 256,
+				Bytes: framebufferHeader(0x49564642, 2, 1, 1, 1, 256, 4096, 0),
+				Err:   framebuffer.ErrInvalidMagic,
+			},
+			{
+				Name:  "future-version",
+				Size:  4096 + 256,
+				Bytes: framebufferHeader(0x42465649, 3, 1, 1, 1, 256, 4096, 0),
+				Err:   framebuffer.ErrUnsupportedVersion,
+			},
+			{
+				Name:  "unknown-format",
+				Size:  4096 + 256,
+				Bytes: framebufferHeader(0x42465649, 2, 9, 1, 1, 256, 4096, 0),
+				Err:   framebuffer.ErrInvalidHeader,
+			},
+			{
+				Name:  "unaligned-stride",
+				Size:  4096 + 2560*2,
+				Bytes: framebufferHeader(0x42465649, 2, 1, 640, 2, 2600, 4096, 0),
+				Err:   framebuffer.ErrInvalidHeader,
+			},
+			{
+				Name:  "unaligned-data",
+				Size:  4096 + 256,
+				Bytes: framebufferHeader(0x42465649, 2, 1, 1, 1, 256, 64, 0),
+				Err:   framebuffer.ErrInvalidHeader,
+			},
+			{
+				Name:  "empty-frame",
+				Size:  4096 + 256,
+				Bytes: framebufferHeader(0x42465649, 2, 1, 0, 1, 256, 4096, 0),
+				Err:   framebuffer.ErrInvalidHeader,
+			},
+			{
+				Name:  "truncated-region",
+				Size:  4096 + 2560*479,
+				Bytes: framebufferHeader(0x42465649, 2, 1, 640, 480, 2560, 4096, 0),
+				Err:   framebuffer.ErrRegionTooSmall,
+			},
+		},
+		check: checkFramebuffer,
+	}
+}
+
+// checkFramebuffer decodes the case and, for the valid ones, encodes the same frame and compares the bytes.
+func checkFramebuffer(c Case) error {
+	fb, err := framebuffer.Open(c.region())
+	if c.Err != nil {
+		if !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	got := map[string]uint64{
+		"format":   uint64(fb.Format()),
+		"width":    uint64(fb.Width()),
+		"height":   uint64(fb.Height()),
+		"stride":   uint64(fb.Stride()),
+		"sequence": fb.Sequence(),
+	}
+
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	mem := make([]byte, c.Size)
+	fb, err = framebuffer.Init(mem, uint32(c.Fields["width"]), uint32(c.Fields["height"]), framebuffer.Format(c.Fields["format"]))
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	for i := uint64(0); i < c.Fields["sequence"]; i++ {
+		fb.Publish()
+	}
+
+	// The session is random
+	copy(mem[48:64], make([]byte, 16))
+	if !bytes.Equal(mem[:framebuffer.HeaderSize], c.Bytes) {
+		return fmt.Errorf("encoded header mismatch:\nwant %x\ngot  %x", c.Bytes, mem[:framebuffer.HeaderSize])
+	}
+
+	return nil
+}
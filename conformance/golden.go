@@ -0,0 +1,52 @@
+package conformance
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+)
+
+// golden holds the committed vectors of every format version, see WriteFiles. Directories of older versions are
+// kept around, so a format change always shows up as a new directory in review instead of silently rewritten bytes.
+//
+//go:embed golden
+var golden embed.FS
+
+// checkGolden compares the current vectors with the committed golden files.
+func checkGolden() error {
+	var errs []error
+	for _, suite := range Suites() {
+		dir := path.Join("golden", suite.dir())
+		manifest, err := fs.ReadFile(golden, path.Join(dir, "manifest.json"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: missing golden files, regenerate them with WriteFiles: %w", suite.dir(), err))
+			continue
+		}
+
+		want, err := suite.manifest()
+		if err != nil {
+			return fmt.Errorf("marshal manifest: %w", err)
+		}
+
+		if !bytes.Equal(manifest, want) {
+			errs = append(errs, fmt.Errorf("%s: manifest differs from the golden one", suite.dir()))
+		}
+
+		for _, c := range suite.Cases {
+			data, err := fs.ReadFile(golden, path.Join(dir, c.Name+".bin"))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s/%s: missing golden file: %w", suite.dir(), c.Name, err))
+				continue
+			}
+
+			if !bytes.Equal(data, c.Bytes) {
+				errs = append(errs, fmt.Errorf("%s/%s: bytes differ from the golden file", suite.dir(), c.Name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,145 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/TypicalAM/ivshmem/layout"
+)
+
+// layoutEntry builds a 64 byte segment table entry.
+func layoutEntry(name string, typ, offset, size uint64) []byte {
+	entry := append([]byte(name), make([]byte, layout.MaxNameLength-len(name))...)
+	return append(entry, le(4, typ, 4, 0, 8, offset, 8, size)...)
+}
+
+// layoutBytes builds the header and the segment table, the checksum is computed over the entries unless crc is set.
+func layoutBytes(magic, version, layoutVersion, regionSize uint64, crc *uint64, entries ...[]byte) []byte {
+	table := bytes.Join(entries, nil)
+	sum := uint64(crc32.ChecksumIEEE(table))
+	if crc != nil {
+		sum = *crc
+	}
+
+	hdr := le(4, magic, 2, version, 2, 0, 4, layoutVersion, 4, uint64(len(entries)), 8, regionSize, 4, sum, 4, 0)
+	hdr = append(hdr, make([]byte, layout.HeaderSize-len(hdr))...)
+	return append(hdr, table...)
+}
+
+// layoutSuite describes the layout header and segment table.
+func layoutSuite() Suite {
+	ring := layoutEntry("ring", uint64(layout.TypeRing), 192, 4096)
+	frames := layoutEntry("frames", uint64(layout.TypeFramebuffer), 4288, 8192)
+	badCRC := uint64(0xdeadbeef)
+	return Suite{
+		Format:  "layout",
+		Version: uint32(layout.Version),
+		Cases: []Case{
+			{
+				Name:  "two-segments",
+				Size:  16384,
+				Bytes: layoutBytes(0x594c5649, 1, 3, 16384, nil, ring, frames),
+				Fields: map[string]uint64{
+					"version": 3, "segments": 2,
+					"ring.offset": 192, "ring.size": 4096, "frames.offset": 4288, "frames.size": 8192,
+				},
+				Strings: map[string]string{"ring.type": "ring", "frames.type": "framebuffer"},
+			},
+			{
+				Name:   "no-segments",
+				Size:   4096,
+				Bytes:  layoutBytes(0x594c5649, 1, 0, 4096, nil),
+				Fields: map[string]uint64{"version": 0, "segments": 0},
+			},
+			{
+				Name:  "initializing",
+				Size:  4096,
+				Bytes: layoutBytes(0x54494e49, 1, 0, 4096, nil),
+				Err:   layout.ErrInvalidMagic,
+			},
+			{
+				Name:  "future-version",
+				Size:  4096,
+				Bytes: layoutBytes(0x594c5649, 2, 0, 4096, nil),
+				Err:   layout.ErrUnsupportedVersion,
+			},
+			{
+				Name:  "region-size-mismatch",
+				Size:  16384,
+				Bytes: layoutBytes(0x594c5649, 1, 3, 8192, nil, ring),
+				Err:   layout.ErrInvalidHeader,
+			},
+			{
+				Name:  "table-checksum",
+				Size:  16384,
+				Bytes: layoutBytes(0x594c5649, 1, 3, 16384, &badCRC, ring),
+				Err:   layout.ErrInvalidHeader,
+			},
+			{
+				Name:  "segment-past-region",
+				Size:  8192,
+				Bytes: layoutBytes(0x594c5649, 1, 3, 8192, nil, layoutEntry("frames", uint64(layout.TypeFramebuffer), 128, 8192)),
+				Err:   layout.ErrInvalidHeader,
+			},
+			{
+				Name:  "segment-over-table",
+				Size:  8192,
+				Bytes: layoutBytes(0x594c5649, 1, 3, 8192, nil, layoutEntry("ring", uint64(layout.TypeRing), 64, 64)),
+				Err:   layout.ErrInvalidHeader,
+			},
+		},
+		check: checkLayout,
+	}
+}
+
+// checkLayout opens the layout of the case and, for the valid ones, initializes a region with the same segments and
+// compares the bytes. The valid vectors pack the segments with DefaultAlign, like a spec without alignments.
+func checkLayout(c Case) error {
+	l, err := layout.Open(c.region())
+	if c.Err != nil {
+		if !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	got := map[string]uint64{"version": uint64(l.Version()), "segments": uint64(len(l.Segments()))}
+	gotStrings := map[string]string{}
+	spec := layout.Spec{Version: l.Version()}
+	for _, seg := range l.Segments() {
+		got[seg.Name+".offset"] = seg.Offset
+		got[seg.Name+".size"] = seg.Size
+		gotStrings[seg.Name+".type"] = seg.Type.String()
+		spec.Segments = append(spec.Segments, layout.SegmentSpec{Name: seg.Name, Type: seg.Type, Size: seg.Size})
+	}
+
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	for name, want := range c.Strings {
+		if gotStrings[name] != want {
+			return fmt.Errorf("field %s: want %q, got %q", name, want, gotStrings[name])
+		}
+	}
+
+	mem := make([]byte, c.Size)
+	if _, err := layout.Initialize(mem, spec); err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	if !bytes.Equal(mem[:len(c.Bytes)], c.Bytes) {
+		return fmt.Errorf("encoded layout mismatch:\nwant %x\ngot  %x", c.Bytes, mem[:len(c.Bytes)])
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/lgmp"
+)
+
+// The queue of the lgmp vectors, as added by the encoding check.
+const (
+	lgmpQueue    = 1
+	lgmpMessages = 3
+	lgmpMaxTime  = 150 * time.Millisecond
+)
+
+// lgmpQueueHeader builds a queue header without subscribers or messages.
+func lgmpQueueHeader(id, slots, maxTime, ring uint64) []byte {
+	hdr := le(4, id, 4, slots, 4, 0, 4, maxTime)
+	hdr = append(hdr, make([]byte, 440-len(hdr))...)
+	hdr = append(hdr, le(4, ring)...)
+	return append(hdr, make([]byte, lgmp.QueueHeaderSize-len(hdr))...)
+}
+
+// lgmpHeader builds the header of a region with the queues, the rest of the MaxQueues headers zeroed, followed by
+// the user data. The session and the timestamp are zero.
+func lgmpHeader(magic, version, numQueues uint64, udata string, queues ...[]byte) []byte {
+	hdr := le(4, magic, 4, version, 4, 0, 4, 0, 8, 0, 4, numQueues, 4, 0)
+	for _, q := range queues {
+		hdr = append(hdr, q...)
+	}
+
+	hdr = append(hdr, make([]byte, 32+lgmp.MaxQueues*lgmp.QueueHeaderSize-len(hdr))...)
+	hdr = append(hdr, le(4, uint64(len(udata)))...)
+	return append(hdr, udata...)
+}
+
+// lgmpSuite describes the header of the region and of its queues. It pins the layout this implementation reads out of
+// headers.h of LGMP, the vectors weren't captured from a real Looking Glass host. The session and the timestamp change
+// with every host, the vectors keep them zero and the encoding check clears them before comparing.
+func lgmpSuite() Suite {
+	// The message ring is allocated right after the user data, aligned to lgmp.Align
+	frameQueue := lgmpQueueHeader(lgmpQueue, lgmpMessages+1, uint64(lgmpMaxTime/time.Millisecond), 2304)
+
+	return Suite{
+		Format:  "lgmp",
+		Version: lgmp.Version,
+		Cases: []Case{
+			{
+				Name:    "one-queue",
+				Size:    4096,
+				Bytes:   lgmpHeader(0x504d474c, 10, 1, "KVMFRhdr", frameQueue),
+				Fields:  map[string]uint64{"udata-size": 8},
+				Strings: map[string]string{"udata": "KVMFRhdr"},
+			},
+			{
+				Name:  "no-queues",
+				Size:  4096,
+				Bytes: lgmpHeader(0x504d474c, 10, 0, ""),
+				Err:   lgmp.ErrNoQueue,
+			},
+			{
+				Name:  "bad-magic",
+				Size:  4096,
+				Bytes: lgmpHeader(0x4c474d50, 10, 1, "KVMFRhdr", frameQueue),
+				Err:   lgmp.ErrInvalidMagic,
+			},
+			{
+				Name:  "old-version",
+				Size:  4096,
+				Bytes: lgmpHeader(0x504d474c, 9, 1, "KVMFRhdr", frameQueue),
+				Err:   lgmp.ErrUnsupportedVersion,
+			},
+			{
+				Name:  "too-many-queues",
+				Size:  4096,
+				Bytes: lgmpHeader(0x504d474c, 10, lgmp.MaxQueues+1, "KVMFRhdr", frameQueue),
+				Err:   lgmp.ErrInvalidHeader,
+			},
+			{
+				Name:  "ring-past-region",
+				Size:  4096,
+				Bytes: lgmpHeader(0x504d474c, 10, 1, "KVMFRhdr", lgmpQueueHeader(lgmpQueue, 4, 150, 4088)),
+				Err:   lgmp.ErrInvalidHeader,
+			},
+			{
+				Name:  "udata-past-region",
+				Size:  4096,
+				Bytes: append(lgmpHeader(0x504d474c, 10, 1, "", frameQueue)[:lgmp.HeaderSize-4], le(4, 4096-lgmp.HeaderSize+1)...),
+				Err:   lgmp.ErrInvalidHeader,
+			},
+			{
+				Name:  "truncated-region",
+				Size:  lgmp.HeaderSize - 1,
+				Bytes: le(4, 0x504d474c, 4, 10),
+				Err:   lgmp.ErrRegionTooSmall,
+			},
+		},
+		check: checkLGMP,
+	}
+}
+
+// checkLGMP opens the region as a client and subscribes to the queue. For the valid cases it then writes the same
+// header as a host and compares the bytes.
+func checkLGMP(c Case) error {
+	client, err := lgmp.NewClient(c.region())
+	if err == nil {
+		_, err = client.Subscribe(lgmpQueue)
+	}
+
+	if c.Err != nil {
+		if !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	udata := client.UData()
+	got := map[string]uint64{"udata-size": uint64(len(udata))}
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	if want := c.Strings["udata"]; string(udata) != want {
+		return fmt.Errorf("field udata: want %q, got %q", want, udata)
+	}
+
+	mem := make([]byte, c.Size)
+	host, err := lgmp.NewHost(mem, udata)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	if _, err := host.AddQueue(lgmpQueue, lgmpMessages, lgmpMaxTime); err != nil {
+		return fmt.Errorf("add queue: %w", err)
+	}
+
+	if err := host.Process(); err != nil {
+		return fmt.Errorf("process: %w", err)
+	}
+
+	// The session and the timestamp change with every host
+	copy(mem[8:12], make([]byte, 4))
+	copy(mem[16:24], make([]byte, 8))
+	if !bytes.Equal(mem[:len(c.Bytes)], c.Bytes) {
+		return fmt.Errorf("encoded header mismatch:\nwant %x\ngot  %x", c.Bytes, mem[:len(c.Bytes)])
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/mux"
+)
+
+// muxTimeout is how long checkMux waits for a session to act on the frames of a case.
+const muxTimeout = 5 * time.Second
+
+// muxFrame builds a multiplexer frame.
+func muxFrame(typ, id uint64, payload string) []byte {
+	return append(le(1, typ, 1, 0, 2, 0, 4, id, 4, uint64(len(payload))), payload...)
+}
+
+// muxFrames concatenates frames.
+func muxFrames(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+// muxSuite describes the frames of the stream multiplexer, as the server side reads them. Open is type 1, data 2,
+// close 3 and window 4.
+func muxSuite() Suite {
+	return Suite{
+		Format:  "mux",
+		Version: 1,
+		Cases: []Case{
+			{
+				Name:    "open-data-close",
+				Size:    41,
+				Bytes:   muxFrames(muxFrame(1, 1, ""), muxFrame(2, 1, "hello"), muxFrame(3, 1, "")),
+				Fields:  map[string]uint64{"stream_id": 1, "payload_length": 5},
+				Strings: map[string]string{"payload": "hello"},
+			},
+			{
+				Name:   "open-close",
+				Size:   24,
+				Bytes:  muxFrames(muxFrame(1, 1, ""), muxFrame(3, 1, "")),
+				Fields: map[string]uint64{"stream_id": 1, "payload_length": 0},
+			},
+			{
+				Name:  "unknown-type",
+				Size:  12,
+				Bytes: muxFrame(9, 1, ""),
+				Err:   mux.ErrProtocol,
+			},
+			{
+				Name:  "oversized-frame",
+				Size:  12,
+				Bytes: le(1, 2, 1, 0, 2, 0, 4, 1, 4, mux.MaxFrameSize+1),
+				Err:   mux.ErrProtocol,
+			},
+			{
+				Name:  "short-window",
+				Size:  26,
+				Bytes: muxFrames(muxFrame(1, 1, ""), muxFrame(4, 1, "\x00\x10")),
+				Err:   mux.ErrProtocol,
+			},
+			{
+				Name:  "server-parity",
+				Size:  12,
+				Bytes: muxFrame(1, 2, ""),
+				Err:   mux.ErrProtocol,
+			},
+			{
+				Name:  "opened-twice",
+				Size:  24,
+				Bytes: muxFrames(muxFrame(1, 1, ""), muxFrame(1, 1, "")),
+				Err:   mux.ErrProtocol,
+			},
+		},
+		check: checkMux,
+	}
+}
+
+// checkMux feeds the frames of the case to a server session. For the valid cases it reads the stream the frames open
+// and carry, then lets a client session open, write and close a stream the same way and compares the frames.
+func checkMux(c Case) error {
+	conn := newVectorConn(c.Bytes)
+	s := mux.Server(conn, "conformance")
+	defer s.Close()
+
+	if c.Err != nil {
+		select {
+		case <-s.Done():
+		case <-time.After(muxTimeout):
+			return fmt.Errorf("want error %q, the session kept running", c.Err)
+		}
+
+		if err := s.Err(); !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	st, err := s.AcceptStream()
+	if err != nil {
+		return fmt.Errorf("accept: %w", err)
+	}
+
+	payload, err := io.ReadAll(st)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	got := map[string]uint64{"stream_id": uint64(st.ID()), "payload_length": uint64(len(payload))}
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	if want := c.Strings["payload"]; string(payload) != want {
+		return fmt.Errorf("field payload: want %q, got %q", want, payload)
+	}
+
+	out := newVectorConn(nil)
+	client := mux.Client(out, "conformance")
+	defer client.Close()
+
+	cst, err := client.Open()
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	if len(payload) > 0 {
+		if _, err := cst.Write(payload); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	if err := cst.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if encoded := out.written(); !bytes.Equal(encoded, c.Bytes) {
+		return fmt.Errorf("encoded frames mismatch:\nwant %x\ngot  %x", c.Bytes, encoded)
+	}
+
+	return nil
+}
+
+// vectorConn is a connection reading the bytes of a case, then blocking until it is closed, and recording the writes.
+type vectorConn struct {
+	r         io.Reader
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+// newVectorConn returns a connection reading the bytes.
+func newVectorConn(b []byte) *vectorConn {
+	return &vectorConn{r: bytes.NewReader(b), closed: make(chan struct{})}
+}
+
+// Read reads the bytes of the case, at their end it blocks until the connection is closed.
+func (c *vectorConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		<-c.closed
+	}
+
+	return n, err
+}
+
+// Write records the bytes.
+func (c *vectorConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+// Close unblocks the reads.
+func (c *vectorConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// written returns the bytes written so far.
+func (c *vectorConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.out.Bytes()...)
+}
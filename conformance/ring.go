@@ -0,0 +1,178 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// ringHeader builds a 192 byte ring header with a zero session.
+func ringHeader(magic, version, capacity, epoch, head, tail uint64) []byte {
+	hdr := le(4, magic, 4, version, 8, capacity)
+	hdr = append(hdr, make([]byte, 16)...)
+	hdr = append(hdr, le(4, epoch)...)
+	hdr = append(hdr, make([]byte, 64-len(hdr))...)
+	hdr = append(hdr, le(8, head)...)
+	hdr = append(hdr, make([]byte, 128-len(hdr))...)
+	hdr = append(hdr, le(8, tail)...)
+	return append(hdr, make([]byte, ring.HeaderSize-len(hdr))...)
+}
+
+// ringBytes is a ring header followed by the data area, the messages laid out from position zero.
+func ringBytes(capacity uint64, msgs ...string) []byte {
+	var data []byte
+	for _, msg := range msgs {
+		data = append(data, le(4, uint64(len(msg)))...)
+		data = append(data, msg...)
+	}
+
+	return append(ringHeader(0x47525649, 2, capacity, 1, 0, uint64(len(data))), data...)
+}
+
+// ringSuite describes the ring header and the messages in its data area. The session is random, the vectors keep it
+// zero and the encoding check clears it before comparing.
+func ringSuite() Suite {
+	// A message whose header sits in the last 4 bytes of a 16 byte data area and whose body wraps to the start
+	wrapped := ringHeader(0x47525649, 2, 16, 1, 12, 24)
+	wrapped = append(wrapped, "abcdefgh"...)
+	wrapped = append(wrapped, make([]byte, 4)...)
+	wrapped = append(wrapped, le(4, 8)...)
+
+	return Suite{
+		Format:  "ring",
+		Version: ring.Version,
+		Cases: []Case{
+			{
+				Name:   "empty",
+				Size:   ring.HeaderSize + 64,
+				Bytes:  ringBytes(64),
+				Fields: map[string]uint64{"capacity": 64, "epoch": 1, "waiting": 0},
+			},
+			{
+				Name:    "message",
+				Size:    ring.HeaderSize + 64,
+				Bytes:   ringBytes(64, "hello"),
+				Fields:  map[string]uint64{"capacity": 64, "epoch": 1, "waiting": 9},
+				Strings: map[string]string{"message": "hello"},
+			},
+			{
+				Name:    "wrapped",
+				Size:    ring.HeaderSize + 16,
+				Bytes:   wrapped,
+				Fields:  map[string]uint64{"capacity": 16, "epoch": 1, "waiting": 12},
+				Strings: map[string]string{"message": "abcdefgh"},
+			},
+			{
+				Name:  "bad-magic",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x49565247, 2, 64, 1, 0, 0),
+				Err:   ring.ErrInvalidMagic,
+			},
+			{
+				Name:  "old-version",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x47525649, 1, 64, 1, 0, 0),
+				Err:   ring.ErrUnsupportedVersion,
+			},
+			{
+				Name:  "capacity-not-power-of-two",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x47525649, 2, 48, 1, 0, 0),
+				Err:   ring.ErrCorrupted,
+			},
+			{
+				Name:  "capacity-past-region",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x47525649, 2, 128, 1, 0, 0),
+				Err:   ring.ErrRegionTooSmall,
+			},
+			{
+				Name:  "message-past-tail",
+				Size:  ring.HeaderSize + 64,
+				Bytes: append(ringHeader(0x47525649, 2, 64, 1, 0, 9), le(4, 100)...),
+				Err:   ring.ErrCorrupted,
+			},
+			{
+				Name:  "waiting-past-capacity",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x47525649, 2, 64, 1, 0, 65),
+				Err:   ring.ErrCorrupted,
+			},
+			{
+				Name:  "partial-message-header",
+				Size:  ring.HeaderSize + 64,
+				Bytes: ringHeader(0x47525649, 2, 64, 1, 0, 3),
+				Err:   ring.ErrCorrupted,
+			},
+		},
+		check: checkRing,
+	}
+}
+
+// checkRing opens the ring of the case and receives its first message. For the valid cases starting at position zero
+// it also initializes a ring, sends the same message and compares the bytes.
+func checkRing(c Case) error {
+	r, err := ring.Open(c.region())
+	var msg []byte
+	var waiting int
+	var head uint64
+	if err == nil {
+		waiting, head = r.Len(), r.Consumed()
+		msg, _, err = r.TryRecv(nil)
+	}
+
+	if c.Err != nil {
+		if !errors.Is(err, c.Err) {
+			return fmt.Errorf("want error %q, got %v", c.Err, err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	got := map[string]uint64{
+		"capacity": uint64(r.Capacity()),
+		"epoch":    uint64(r.Epoch()),
+		"waiting":  uint64(waiting),
+	}
+
+	for name, want := range c.Fields {
+		if got[name] != want {
+			return fmt.Errorf("field %s: want %d, got %d", name, want, got[name])
+		}
+	}
+
+	if want := c.Strings["message"]; string(msg) != want {
+		return fmt.Errorf("field message: want %q, got %q", want, msg)
+	}
+
+	// Only the rings written from position zero are encoded again
+	if head != 0 {
+		return nil
+	}
+
+	mem := make([]byte, c.Size)
+	w, err := ring.Init(mem)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	if len(msg) > 0 {
+		if _, err := w.TrySend(msg); err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+	}
+
+	// The session is random
+	copy(mem[16:32], make([]byte, 16))
+	if !bytes.Equal(mem[:len(c.Bytes)], c.Bytes) {
+		return fmt.Errorf("encoded ring mismatch:\nwant %x\ngot  %x", c.Bytes, mem[:len(c.Bytes)])
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+// Package devharness emulates an ivshmem link without QEMU: a shared memory file plays the device memory and unix
+// datagram sockets play the doorbells. Both sides of the link can run in separate containers as long as they share
+// the harness directory (a volume mounted on /dev/shm works), which lets CI pipelines run full protocol integration
+// tests.
+package devharness
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+const shmFile = "ivshmem"
+
+var ErrInvalidSize = errors.New("invalid size")
+
+// Harness is an emulated ivshmem device living in a directory.
+type Harness struct {
+	dir  string
+	size uint64
+}
+
+// New creates the shared memory file of the given size in the directory. A file left over by an earlier run is
+// reused if it has the same size, otherwise it is cleared and resized.
+func New(dir string, size uint64) (*Harness, error) {
+	if size == 0 || size&(size-1) != 0 {
+		return nil, fmt.Errorf("%w: %d is not a power of two", ErrInvalidSize, size)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create harness directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, shmFile), os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("create shared memory file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat shared memory file: %w", err)
+	}
+
+	if info.Size() != int64(size) {
+		// The contents laid out for another size would only confuse the peers, start from zeroes
+		if err := file.Truncate(0); err != nil {
+			return nil, fmt.Errorf("clear shared memory file: %w", err)
+		}
+
+		if err := file.Truncate(int64(size)); err != nil {
+			return nil, fmt.Errorf("resize shared memory file: %w", err)
+		}
+	}
+
+	return &Harness{dir: dir, size: size}, nil
+}
+
+// Open attaches to a harness created by New, usually in another container.
+func Open(dir string) (*Harness, error) {
+	info, err := os.Stat(filepath.Join(dir, shmFile))
+	if err != nil {
+		return nil, fmt.Errorf("stat shared memory file: %w", err)
+	}
+
+	return &Harness{dir: dir, size: uint64(info.Size())}, nil
+}
+
+// Dir returns the harness directory.
+func (h Harness) Dir() string {
+	return h.dir
+}
+
+// Size returns the size of the shared memory.
+func (h Harness) Size() uint64 {
+	return h.size
+}
+
+// ShmPath returns the path of the shared memory file, the same as the -object memory-backend-file path in QEMU.
+func (h Harness) ShmPath() string {
+	return filepath.Join(h.dir, shmFile)
+}
+
+// Host returns a host mapper of the shared memory file.
+func (h Harness) Host() (*ivshmem.Host, error) {
+	return ivshmem.NewHost(h.ShmPath())
+}
+
+// Peer binds the doorbell of the peer with the given ID, the returned notifier rings the other peers of the harness.
+func (h Harness) Peer(id uint16) (*Doorbell, error) {
+	return newDoorbell(h.dir, id)
+}
+
+// Remove deletes the shared memory file and the doorbell sockets, the directory itself is kept.
+func (h Harness) Remove() error {
+	socks, err := filepath.Glob(filepath.Join(h.dir, "peer-*.sock"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, path := range append(socks, h.ShmPath()) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package devharness
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Vectors is the number of interrupt vectors of every emulated peer.
+const Vectors = 16
+
+// Doorbell is the emulated doorbell of one peer, it implements ivshmem.Notifier. Every rung interrupt is a two byte
+// datagram carrying the vector, sent to the socket of the target peer.
+type Doorbell struct {
+	id   uint16
+	dir  string
+	conn *net.UnixConn
+
+	mu        sync.Mutex
+	listeners map[uint16][]chan struct{}
+	closed    bool
+}
+
+// newDoorbell binds the socket of the peer, a stale socket from a crashed run is replaced.
+func newDoorbell(dir string, id uint16) (*Doorbell, error) {
+	path := socketPath(dir, id)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("bind doorbell: %w", err)
+	}
+
+	d := &Doorbell{id: id, dir: dir, conn: conn, listeners: make(map[uint16][]chan struct{})}
+	go d.receive()
+	return d, nil
+}
+
+// ID returns the peer ID of the doorbell.
+func (d *Doorbell) ID() uint16 {
+	return d.id
+}
+
+// Notify rings the doorbell of the peer on the given vector. A peer which is not up yet misses the interrupt, like
+// it would on a real device.
+func (d *Doorbell) Notify(peer, vector uint16) error {
+	if vector >= Vectors {
+		return fmt.Errorf("%w: %d, the harness has %d vectors", ivshmem.ErrInvalidVector, vector, Vectors)
+	}
+
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return ivshmem.ErrClosed
+	}
+
+	msg := binary.LittleEndian.AppendUint16(nil, vector)
+	addr := &net.UnixAddr{Name: socketPath(d.dir, peer), Net: "unixgram"}
+	if _, err := d.conn.WriteToUnix(msg, addr); err != nil {
+		return fmt.Errorf("ring peer %d: %w", peer, err)
+	}
+
+	return nil
+}
+
+// Listen returns a channel receiving the interrupts on the vector.
+func (d *Doorbell) Listen(vector uint16) (<-chan struct{}, error) {
+	if vector >= Vectors {
+		return nil, fmt.Errorf("%w: %d, the harness has %d vectors", ivshmem.ErrInvalidVector, vector, Vectors)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ivshmem.ErrClosed
+	}
+
+	ch := make(chan struct{}, 1)
+	d.listeners[vector] = append(d.listeners[vector], ch)
+	return ch, nil
+}
+
+// Close unbinds the doorbell and closes the listener channels.
+func (d *Doorbell) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ivshmem.ErrClosed
+	}
+
+	d.closed = true
+	for _, chans := range d.listeners {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+
+	d.listeners = nil
+	d.mu.Unlock()
+
+	err := d.conn.Close()
+	if rmErr := os.Remove(socketPath(d.dir, d.id)); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = errors.Join(err, rmErr)
+	}
+
+	return err
+}
+
+// receive wakes the listeners of every incoming vector until the socket is closed.
+func (d *Doorbell) receive() {
+	buf := make([]byte, 2)
+	for {
+		n, _, err := d.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+
+		if n != len(buf) {
+			continue
+		}
+
+		vector := binary.LittleEndian.Uint16(buf)
+		d.mu.Lock()
+		for _, ch := range d.listeners[vector] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// socketPath returns the doorbell socket of the peer.
+func socketPath(dir string, id uint16) string {
+	return filepath.Join(dir, fmt.Sprintf("peer-%d.sock", id))
+}
@@ -0,0 +1,285 @@
+// Package doublebuf exchanges snapshots of state, like the status of a device or the metadata of a scene, through two
+// buffers in the shared memory region. The producer writes the next snapshot into the back buffer while consumers
+// read the front one, and publishing flips them with a single counter. Consumers always get a complete snapshot:
+// the producer marks the buffer it starts writing, and a consumer whose copy raced with it retries.
+//
+// Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a peer initialized the buffer
+// again, the generations restart then.
+//
+// Layout, all the values are little endian:
+//
+//	 0 magic (uint32)
+//	 4 version (uint32)
+//	 8 buffer size (uint64)
+//	16 published generation, the front buffer is generation % 2 (uint64)
+//	24 writing generation, the snapshot the producer is writing (uint64)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 the two buffers, every one padded to 64 bytes
+//
+// Write and Read copy the snapshots with atomic stores and loads of whole words, so they run clean under the race
+// detector even with both sides in one process. Filling the buffer returned by Back instead races with the consumers'
+// copy by design, like any seqlock, and the race detector reports it.
+package doublebuf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrTooLarge = errors.New("snapshot too large")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x42445649 // "IVDB" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+
+	// Align is the alignment of the buffers.
+	Align = 64
+)
+
+// Header field offsets.
+const (
+	offMagic     = 0
+	offVersion   = 4
+	offSize      = 8
+	offPublished = 16
+	offWriting   = 24
+	offSession   = 44
+	offEpoch     = 60
+)
+
+// PollInterval is how often Read checks again after its copy raced with the producer.
+var PollInterval = time.Millisecond
+
+// Buffer is a view of the double buffer stored in the region. There is a single producer, used by one goroutine, and
+// any number of consumers.
+type Buffer struct {
+	mem       []byte
+	size      uint64
+	published *uint64
+	writing   *uint64
+	stamp     shmhdr.Stamp
+}
+
+// Size returns the bytes the double buffer needs for snapshots of the size.
+func Size(size int) uint64 {
+	return HeaderSize + 2*stride(uint64(size))
+}
+
+// Init writes a fresh header into the region, with an all zero snapshot published. It is called by the producer.
+func Init(mem []byte, size int) (*Buffer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: snapshots of %d bytes", ErrInvalidHeader, size)
+	}
+
+	b, err := view(mem, uint64(size))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := range mem[HeaderSize:Size(size)] {
+		mem[HeaderSize+i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint64(mem[offSize:], b.size)
+	atomic.StoreUint64(b.published, 0)
+	atomic.StoreUint64(b.writing, 0)
+
+	shmhdr.Publish(mem, Magic)
+	return b, nil
+}
+
+// Open validates the header written by Init and returns the double buffer.
+func Open(mem []byte) (*Buffer, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint64(mem[offSize:])
+	if size == 0 || size > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: snapshots of %d bytes", ErrInvalidHeader, size)
+	}
+
+	b, err := view(mem, size)
+	if err != nil {
+		return nil, err
+	}
+
+	b.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return b, nil
+}
+
+// view returns the double buffer over the region.
+func view(mem []byte, size uint64) (*Buffer, error) {
+	if need := HeaderSize + 2*stride(size); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	// 64-bit atomics need 8 byte alignment on 32-bit platforms, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	return &Buffer{
+		mem:       mem,
+		size:      size,
+		published: (*uint64)(unsafe.Pointer(&mem[offPublished])),
+		writing:   (*uint64)(unsafe.Pointer(&mem[offWriting])),
+	}, nil
+}
+
+// Session returns the ID of the initialization the buffer was opened with.
+func (b *Buffer) Session() shmhdr.Session {
+	return b.stamp.Session()
+}
+
+// Epoch returns the number of times the buffer was initialized, when it was opened.
+func (b *Buffer) Epoch() uint32 {
+	return b.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the buffer again since it was opened, the view must be reopened then.
+func (b *Buffer) Stale() bool {
+	return b.stamp.Check() != nil
+}
+
+// Len returns the size of the snapshots.
+func (b *Buffer) Len() int {
+	return int(b.size)
+}
+
+// Generation returns the number of snapshots published so far.
+func (b *Buffer) Generation() uint64 {
+	return atomic.LoadUint64(b.published)
+}
+
+// Back marks the back buffer as being written and returns it, holding the last snapshot but one. The producer fills
+// it in and calls Publish; calling Back again before that returns the same buffer.
+func (b *Buffer) Back() []byte {
+	return b.buffer(b.mark())
+}
+
+// mark marks the back buffer as being written and returns the generation it will hold.
+func (b *Buffer) mark() uint64 {
+	next := atomic.LoadUint64(b.published) + 1
+	atomic.StoreUint64(b.writing, next)
+
+	// The writes into the buffer must not move before the mark
+	shmsync.Fence()
+	return next
+}
+
+// Publish flips the buffers, making the back buffer the front one, and returns the generation of the new snapshot.
+func (b *Buffer) Publish() uint64 {
+	return atomic.AddUint64(b.published, 1)
+}
+
+// Write publishes p as the next snapshot, the rest of the buffer is zeroed.
+func (b *Buffer) Write(p []byte) (uint64, error) {
+	if uint64(len(p)) > b.size {
+		return 0, fmt.Errorf("%w: %d bytes into %d", ErrTooLarge, len(p), b.size)
+	}
+
+	if err := b.stamp.Check(); err != nil {
+		return 0, err
+	}
+
+	words := b.words(b.mark())
+	for i := range words {
+		var w uint64
+		if off := 8 * i; off < len(p) {
+			copy(wordBytes(&w), p[off:])
+		}
+
+		atomic.StoreUint64(&words[i], w)
+	}
+
+	return b.Publish(), nil
+}
+
+// TryRead copies the front snapshot into dst, which must be as long as the snapshots, and returns its generation. It
+// returns false when the producer started overwriting the buffer during the copy, or the buffer is stale.
+func (b *Buffer) TryRead(dst []byte) (uint64, bool) {
+	gen := atomic.LoadUint64(b.published)
+	if uint64(len(dst)) > b.size {
+		dst = dst[:b.size]
+	}
+
+	words := b.words(gen)
+	for i := 0; 8*i < len(dst); i++ {
+		w := atomic.LoadUint64(&words[i])
+		copy(dst[8*i:], wordBytes(&w))
+	}
+
+	// The copy must be finished before the mark is checked
+	shmsync.Fence()
+
+	// The producer overwrites this buffer once it marks the generation after the next one
+	return gen, atomic.LoadUint64(b.writing) <= gen+1 && !b.Stale()
+}
+
+// Read copies the front snapshot into dst, which must be as long as the snapshots, retrying while it races with the
+// producer, and returns its generation. It fails when the context is done first, or with ErrStale once a peer
+// initialized the buffer again.
+func (b *Buffer) Read(ctx context.Context, dst []byte) (uint64, error) {
+	if uint64(len(dst)) < b.size {
+		return 0, fmt.Errorf("%w: %d bytes into %d", ErrTooLarge, b.size, len(dst))
+	}
+
+	for {
+		if gen, ok := b.TryRead(dst); ok {
+			return gen, nil
+		}
+
+		if err := b.stamp.Check(); err != nil {
+			return 0, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// buffer returns the buffer holding the snapshot of the generation.
+func (b *Buffer) buffer(gen uint64) []byte {
+	off := HeaderSize + (gen%2)*stride(b.size)
+	return b.mem[off : off+b.size : off+b.size]
+}
+
+// words returns the buffer holding the snapshot of the generation as words, including its padding.
+func (b *Buffer) words(gen uint64) []uint64 {
+	off := HeaderSize + (gen%2)*stride(b.size)
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b.mem[off])), stride(b.size)/8)
+}
+
+// wordBytes returns the bytes of the word in memory order.
+func wordBytes(w *uint64) []byte {
+	return (*[8]byte)(unsafe.Pointer(w))[:]
+}
+
+// stride returns the size of a buffer with its padding.
+func stride(size uint64) uint64 {
+	return (size + Align - 1) &^ (Align - 1)
+}
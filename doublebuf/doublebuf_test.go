@@ -0,0 +1,123 @@
+package doublebuf_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/doublebuf"
+)
+
+// newPair returns the producer and a consumer view of a double buffer for snapshots of the size.
+func newPair(t *testing.T, size int) (*doublebuf.Buffer, *doublebuf.Buffer) {
+	t.Helper()
+	mem := make([]byte, doublebuf.Size(size))
+	producer, err := doublebuf.Init(mem, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := doublebuf.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return producer, consumer
+}
+
+func TestRoundTrip(t *testing.T) {
+	producer, consumer := newPair(t, 13)
+	if _, err := producer.Write([]byte("a long snapshot")); !errors.Is(err, doublebuf.ErrTooLarge) {
+		t.Fatalf("want ErrTooLarge, got %v", err)
+	}
+
+	for i, snapshot := range []string{"first", "second one", "third"} {
+		gen, err := producer.Write([]byte(snapshot))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, consumer.Len())
+		if read, err := consumer.Read(context.Background(), got); err != nil || read != gen {
+			t.Fatalf("snapshot %d: want generation %d, got %d, %v", i, gen, read, err)
+		}
+
+		// The rest of the buffer is zeroed, even where the snapshot before the last one was longer
+		want := make([]byte, consumer.Len())
+		copy(want, snapshot)
+		if !bytes.Equal(got, want) {
+			t.Errorf("snapshot %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+// TestConcurrent reads snapshots while the producer writes them, run it with -race.
+func TestConcurrent(t *testing.T) {
+	const size, snapshots, consumers = 4096, 2000, 4
+	mem := make([]byte, doublebuf.Size(size))
+	producer, err := doublebuf.Init(mem, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	errs := make(chan error, consumers)
+	var wg sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		consumer, err := doublebuf.Open(mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snapshot := make([]byte, size)
+			var last uint64
+			for {
+				gen, err := consumer.Read(ctx, snapshot)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				// Every snapshot is a single byte repeated, a torn one mixes two of them
+				if want := bytes.Repeat(snapshot[:1], size); !bytes.Equal(snapshot, want) {
+					errs <- errors.New("torn snapshot")
+					return
+				}
+
+				if gen < last {
+					errs <- errors.New("generation went backwards")
+					return
+				}
+
+				last = gen
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < snapshots; i++ {
+		if _, err := producer.Write(bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,85 @@
+//go:build windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+var ErrDriverTooOld = errors.New("driver too old")
+
+// driverClassKey is where the driver keys returned by SPDRP_DRIVER live.
+const driverClassKey = `SYSTEM\CurrentControlSet\Control\Class\`
+
+// DriverVersion is the version of the ivshmem driver bound to the device, as shown in the device manager.
+// The zero value means the version couldn't be determined.
+type DriverVersion [4]uint16
+
+// ParseDriverVersion parses the dotted version string, for example "100.85.104.20800".
+func ParseDriverVersion(version string) (DriverVersion, error) {
+	var v DriverVersion
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	if len(parts) != 4 {
+		return v, fmt.Errorf("invalid driver version: %s", version)
+	}
+
+	for i, part := range parts {
+		num, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return v, fmt.Errorf("parse version part: %w", err)
+		}
+
+		v[i] = uint16(num)
+	}
+
+	return v, nil
+}
+
+// String returns the dotted version string.
+func (v DriverVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+}
+
+// Known returns true if the version could be determined.
+func (v DriverVersion) Known() bool {
+	return v != DriverVersion{}
+}
+
+// Less returns true if the version is older than the other one.
+func (v DriverVersion) Less(other DriverVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+
+	return false
+}
+
+// DriverVersion returns the version of the bound ivshmem driver, the zero value if it couldn't be determined. It is
+// informational: no driver release notes document which version introduced which IOCTL, so the features are detected
+// by the IOCTLs failing, like Listen reporting ErrDriverTooOld when the driver refuses the vectored event registration.
+func (g Guest) DriverVersion() DriverVersion {
+	return g.devData.driverVersion
+}
+
+// queryDriverVersion reads the DriverVersion value of the driver key returned by SPDRP_DRIVER.
+func queryDriverVersion(driverKey string) (DriverVersion, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, driverClassKey+driverKey, registry.QUERY_VALUE)
+	if err != nil {
+		return DriverVersion{}, fmt.Errorf("open driver key: %w", err)
+	}
+	defer key.Close()
+
+	raw, _, err := key.GetStringValue("DriverVersion")
+	if err != nil {
+		return DriverVersion{}, fmt.Errorf("read driver version: %w", err)
+	}
+
+	return ParseDriverVersion(raw)
+}
@@ -0,0 +1,310 @@
+// Package errlog records the last protocol errors of both sides into a debug segment of the shared memory region, so
+// the failures of one side can be read from the other one, or with ivshmemctl, when its logs are out of reach.
+//
+// The log is a ring of fixed size entries overwritten oldest first. Writers claim an entry by incrementing the write
+// counter, so both sides and any number of goroutines record concurrently. Every entry carries the sequence number it
+// was claimed with, which is cleared while the entry is written, so readers skip the entries being overwritten. The
+// log is for diagnostics: when more than a whole lap of errors is recorded at once, an entry may mix two of them.
+// Every Init draws a new session and bumps the epoch, the views of the previous session record and read nothing
+// anymore, they must be reopened.
+//
+// Layout, all the values are little endian:
+//
+//	 0 magic (uint32)
+//	 4 version (uint32)
+//	 8 entries (uint32)
+//	12 entry size (uint32)
+//	16 write counter (uint64)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 entries: sequence (uint64), time on the shared timebase of the clock package (int64), source length
+//	   (uint8), message length (uint16), source, message
+package errlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/clock"
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x4c455649 // "IVEL" when read as little endian bytes
+	Version    uint32 = 3
+	HeaderSize        = 64
+
+	// DefaultEntrySize fits the source and a message of a couple of lines.
+	DefaultEntrySize = 256
+
+	// EntryHeaderSize is the size of the fixed fields in front of the source and the message.
+	EntryHeaderSize = 19
+
+	// Segment is the conventional name of the layout segment holding the log.
+	Segment = "errors"
+)
+
+// Header field offsets.
+const (
+	offMagic     = 0
+	offVersion   = 4
+	offEntries   = 8
+	offEntrySize = 12
+	offCounter   = 16
+	offSession   = 44
+	offEpoch     = 60
+)
+
+// Entry field offsets.
+const (
+	entSequence   = 0
+	entTime       = 8
+	entSourceLen  = 16
+	entMessageLen = 17
+)
+
+// Entry is a recorded error.
+type Entry struct {
+	Sequence uint64          // Position in the log, starting at one
+	Stamp    clock.Timestamp // When the error was recorded, on the shared timebase
+	Time     time.Time       // The stamp on the wall clock of the reader
+	Source   string          // Who recorded it, like "guest" or the name of a channel
+	Message  string
+}
+
+// Log is a view of the error log stored in the segment.
+type Log struct {
+	mem       []byte
+	entries   uint32
+	entrySize uint32
+	counter   *uint64
+	clock     *clock.Clock
+	stamp     shmhdr.Stamp
+}
+
+// Init writes a fresh header into the segment and splits it into as many entries of the given size as fit, zero
+// means DefaultEntrySize.
+func Init(mem []byte, entrySize uint32) (*Log, error) {
+	if entrySize == 0 {
+		entrySize = DefaultEntrySize
+	}
+
+	entrySize = (entrySize + 7) &^ 7
+	if entrySize < EntryHeaderSize+8 || uint64(len(mem)) < HeaderSize+uint64(entrySize) {
+		return nil, fmt.Errorf("%w: need %d bytes for a single entry, have %d", ErrRegionTooSmall, HeaderSize+uint64(entrySize), len(mem))
+	}
+
+	entries := (uint64(len(mem)) - HeaderSize) / uint64(entrySize)
+	if entries > 1<<20 {
+		entries = 1 << 20
+	}
+
+	l, err := view(mem, uint32(entries), entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < l.entries; i++ {
+		atomic.StoreUint64(l.sequence(uint64(i)), 0)
+	}
+
+	atomic.StoreUint64(l.counter, 0)
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offEntries:], l.entries)
+	binary.LittleEndian.PutUint32(mem[offEntrySize:], l.entrySize)
+
+	shmhdr.Publish(mem, Magic)
+	return l, nil
+}
+
+// Open validates the header written by Init and returns the log.
+func Open(mem []byte) (*Log, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	entries := binary.LittleEndian.Uint32(mem[offEntries:])
+	entrySize := binary.LittleEndian.Uint32(mem[offEntrySize:])
+	if entries == 0 || entrySize < EntryHeaderSize+8 || entrySize%8 != 0 {
+		return nil, fmt.Errorf("%w: %d entries of %d bytes", ErrInvalidHeader, entries, entrySize)
+	}
+
+	if need := HeaderSize + uint64(entries)*uint64(entrySize); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	l, err := view(mem, entries, entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	l.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return l, nil
+}
+
+// view returns the log over the segment.
+func view(mem []byte, entries, entrySize uint32) (*Log, error) {
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the segment must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	counter := (*uint64)(unsafe.Pointer(&mem[offCounter]))
+	return &Log{mem: mem, entries: entries, entrySize: entrySize, counter: counter, clock: new(clock.Clock)}, nil
+}
+
+// SetClock makes the log stamp the entries and convert the stamps with the clock, synchronized to the reference
+// peer, so the errors of both sides share a timebase. Without it this side is the reference.
+func (l *Log) SetClock(c *clock.Clock) {
+	l.clock = c
+}
+
+// Session returns the ID of the initialization the log was opened with.
+func (l *Log) Session() shmhdr.Session {
+	return l.stamp.Session()
+}
+
+// Epoch returns the number of times the log was initialized, when it was opened.
+func (l *Log) Epoch() uint32 {
+	return l.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the log again since it was opened, the view must be reopened then.
+func (l *Log) Stale() bool {
+	return l.stamp.Check() != nil
+}
+
+// Capacity returns the number of entries kept before the oldest ones are overwritten.
+func (l *Log) Capacity() int {
+	return int(l.entries)
+}
+
+// Recorded returns the number of errors recorded since the log was initialized, including the overwritten ones.
+func (l *Log) Recorded() uint64 {
+	return atomic.LoadUint64(l.counter)
+}
+
+// Record stores the error, truncating the source and the message to fit the entry. Nil errors are ignored.
+func (l *Log) Record(source string, err error) {
+	if err == nil {
+		return
+	}
+
+	l.RecordMessage(source, err.Error())
+}
+
+// RecordMessage stores a message, truncating the source and the message to fit the entry. A stale log drops it, the
+// entries of the new session may have another size.
+func (l *Log) RecordMessage(source, msg string) {
+	if l.Stale() {
+		return
+	}
+
+	seq := atomic.AddUint64(l.counter, 1)
+	index := (seq - 1) % uint64(l.entries)
+	entry := l.entry(index)
+
+	// Readers skip the entry until its sequence is published again
+	atomic.StoreUint64(l.sequence(index), 0)
+
+	if len(source) > 0xff {
+		source = source[:0xff]
+	}
+
+	room := int(l.entrySize) - EntryHeaderSize - len(source)
+	if room < 0 {
+		source, room = source[:int(l.entrySize)-EntryHeaderSize], 0
+	}
+
+	if room > 0xffff {
+		room = 0xffff
+	}
+
+	if len(msg) > room {
+		msg = msg[:room]
+	}
+
+	binary.LittleEndian.PutUint64(entry[entTime:], uint64(l.clock.Now()))
+	entry[entSourceLen] = uint8(len(source))
+	binary.LittleEndian.PutUint16(entry[entMessageLen:], uint16(len(msg)))
+	copy(entry[EntryHeaderSize:], source)
+	copy(entry[EntryHeaderSize+len(source):], msg)
+	atomic.StoreUint64(l.sequence(index), seq)
+}
+
+// Entries returns the recorded errors, oldest first. Entries being written concurrently are left out, a stale log
+// returns none.
+func (l *Log) Entries() []Entry {
+	if l.Stale() {
+		return nil
+	}
+
+	var entries []Entry
+	for i := uint64(0); i < uint64(l.entries); i++ {
+		if e, ok := l.read(i); ok {
+			entries = append(entries, e)
+		}
+	}
+
+	// The entries copied while a peer initialized the log again may belong to either session
+	if l.Stale() {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Sequence < entries[j].Sequence })
+	return entries
+}
+
+// read copies the entry out, false if it is empty or was overwritten while being read.
+func (l *Log) read(index uint64) (Entry, bool) {
+	seq := atomic.LoadUint64(l.sequence(index))
+	if seq == 0 {
+		return Entry{}, false
+	}
+
+	buf := make([]byte, l.entrySize)
+	copy(buf, l.entry(index))
+	if atomic.LoadUint64(l.sequence(index)) != seq {
+		return Entry{}, false
+	}
+
+	sourceLen := int(buf[entSourceLen])
+	msgLen := int(binary.LittleEndian.Uint16(buf[entMessageLen:]))
+	if EntryHeaderSize+sourceLen+msgLen > len(buf) {
+		return Entry{}, false
+	}
+
+	stamp := clock.Timestamp(binary.LittleEndian.Uint64(buf[entTime:]))
+	return Entry{
+		Sequence: seq,
+		Stamp:    stamp,
+		Time:     l.clock.Time(stamp),
+		Source:   string(buf[EntryHeaderSize : EntryHeaderSize+sourceLen]),
+		Message:  string(buf[EntryHeaderSize+sourceLen : EntryHeaderSize+sourceLen+msgLen]),
+	}, true
+}
+
+// entry returns the memory of the entry.
+func (l *Log) entry(index uint64) []byte {
+	off := HeaderSize + index*uint64(l.entrySize)
+	return l.mem[off : off+uint64(l.entrySize)]
+}
+
+// sequence returns the sequence number of the entry for atomic access.
+func (l *Log) sequence(index uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&l.entry(index)[entSequence]))
+}
@@ -0,0 +1,140 @@
+//go:build windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// IVSHMEM_EVENT as used in IOCTL_IVSHMEM_REGISTER_EVENT.
+type ivshmemEvent struct {
+	vector     uint16
+	event      windows.Handle
+	singleShot bool
+}
+
+// listeners tracks the interrupt events registered by a guest. It is shared by the copies of the Guest value, so
+// Unmap tears down the listeners registered through any of them.
+type listeners struct {
+	mu   sync.Mutex
+	stop windows.Handle // Manual reset event waking every listener on teardown, zero until the first listener
+	wg   sync.WaitGroup
+}
+
+// Listen returns a channel receiving the interrupts on the MSI vector. Interrupts arriving while a value is still
+// pending are coalesced. The channel is closed by Unmap.
+func (g Guest) Listen(vector uint16) (<-chan struct{}, error) {
+	return g.listen(vector, false)
+}
+
+// ListenOnce is like Listen, but the channel receives a single interrupt and is closed right after it.
+func (g Guest) ListenOnce(vector uint16) (<-chan struct{}, error) {
+	return g.listen(vector, true)
+}
+
+// Notify rings the doorbell of the peer, together with Listen it makes the guest a Notifier.
+func (g Guest) Notify(peer, vector uint16) error {
+	return g.RingDoorbell(peer, vector)
+}
+
+// listen registers an event for the vector with the driver and forwards its signals to a channel.
+func (g Guest) listen(vector uint16, once bool) (<-chan struct{}, error) {
+	if !g.mapped {
+		return nil, ErrNotMapped
+	}
+
+	if vector >= g.vectors {
+		return nil, fmt.Errorf("%w: %d, the device has %d", ErrInvalidVector, vector, g.vectors)
+	}
+
+	g.events.mu.Lock()
+	defer g.events.mu.Unlock()
+	if g.events.stop == 0 {
+		stop, err := windows.CreateEvent(nil, 1, 0, nil)
+		if err != nil {
+			return nil, fmt.Errorf("create teardown event: %w", err)
+		}
+
+		g.events.stop = stop
+	}
+
+	// Persistent registrations need an auto reset event, so every interrupt wakes the listener exactly once
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create event: %w", err)
+	}
+
+	reg := ivshmemEvent{vector: vector, event: event, singleShot: once}
+	err = g.handle.use(func() error {
+		return windows.DeviceIoControl(g.devHandle, IoctlRegisterEvent, (*byte)(unsafe.Pointer(&reg)),
+			uint32(unsafe.Sizeof(reg)), nil, 0, nil, nil)
+	})
+	if err != nil {
+		windows.CloseHandle(event)
+		if refusedStructure(err) {
+			return nil, fmt.Errorf("%w: the driver %s refused the vectored event registration: %v", ErrDriverTooOld,
+				g.devData.driverVersion, err)
+		}
+
+		return nil, fmt.Errorf("register event for vector %d: %w", vector, err)
+	}
+
+	ch := make(chan struct{}, 1)
+	g.events.wg.Add(1)
+	go g.events.forward(event, ch, once)
+	return ch, nil
+}
+
+// refusedStructure reports whether the driver failed an IOCTL because it doesn't know the request or its input
+// structure, rather than because of the device state.
+func refusedStructure(err error) bool {
+	return errors.Is(err, windows.ERROR_INVALID_PARAMETER) || errors.Is(err, windows.ERROR_INVALID_FUNCTION) ||
+		errors.Is(err, windows.ERROR_NOT_SUPPORTED) || errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER)
+}
+
+// forward waits for the event and wakes the channel until the teardown.
+func (l *listeners) forward(event windows.Handle, ch chan struct{}, once bool) {
+	defer l.wg.Done()
+	defer close(ch)
+	defer windows.CloseHandle(event)
+
+	handles := []windows.Handle{event, l.stop}
+	for {
+		woken, err := windows.WaitForMultipleObjects(handles, false, windows.INFINITE)
+		if err != nil || woken != windows.WAIT_OBJECT_0 {
+			return
+		}
+
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+
+		if once {
+			return
+		}
+	}
+}
+
+// close wakes every listener, waits for them to close their channels and releases the teardown event.
+func (l *listeners) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == 0 {
+		return nil
+	}
+
+	if err := windows.SetEvent(l.stop); err != nil {
+		return fmt.Errorf("stop listeners: %w", err)
+	}
+
+	l.wg.Wait()
+	err := windows.CloseHandle(l.stop)
+	l.stop = 0
+	return err
+}
@@ -0,0 +1,51 @@
+//go:build windows && dxgi
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/capture"
+)
+
+func main() {
+	devs, err := ivshmem.ListDevices()
+	if err != nil {
+		log.Fatalln("Cannot list devices:", err)
+	}
+
+	if len(devs) == 0 {
+		log.Fatalln("No IVSHMEM devices found")
+	}
+
+	g, err := ivshmem.NewGuest(devs[0])
+	if err != nil {
+		log.Fatalln("Cannot create guest:", err)
+	}
+
+	if err := g.Map(); err != nil {
+		log.Fatalln("Cannot map memory:", err)
+	}
+	defer g.Unmap()
+
+	screen, err := capture.Open()
+	if err != nil {
+		log.Fatalln("Cannot open the screen:", err)
+	}
+	defer screen.Close()
+
+	width, height := screen.Size()
+	fmt.Printf("Capturing %dx%d into %s\n", width, height, g.Location())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := capture.Run(ctx, g.SharedMem(), screen); err != nil && ctx.Err() == nil {
+		log.Fatalln("Capture failed:", err)
+	}
+}
@@ -0,0 +1,105 @@
+package ivshmem
+
+import "sync"
+
+// Fake is a Mapper backed by a plain byte slice, for unit testing shared memory protocols without a device or a VM.
+// It follows the state rules of the real mappers: mapping twice returns ErrAlreadyMapped, unmapping twice returns
+// ErrAlreadyUnmapped and SharedMem panics while unmapped. The memory keeps its contents across remaps, like a device.
+type Fake struct {
+	mem []byte
+
+	mu     sync.Mutex
+	mapped bool
+	closed bool
+}
+
+// NewFake creates a fake mapper of the given size, unmapped like the mappers returned by NewHost and NewGuest.
+func NewFake(size uint64) *Fake {
+	return &Fake{mem: make([]byte, size)}
+}
+
+// Map maps the memory.
+func (f *Fake) Map() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+
+	if f.mapped {
+		return ErrAlreadyMapped
+	}
+
+	f.mapped = true
+	return nil
+}
+
+// Unmap unmaps the memory.
+func (f *Fake) Unmap() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.mapped {
+		return ErrAlreadyUnmapped
+	}
+
+	f.mapped = false
+	return nil
+}
+
+// Size returns the size of the memory.
+func (f *Fake) Size() uint64 {
+	return uint64(len(f.mem))
+}
+
+// Mapped reports whether the memory is mapped.
+func (f *Fake) Mapped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mapped
+}
+
+// SharedMem returns the mapped memory, panics if Map() didn't succeed.
+func (f *Fake) SharedMem() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.mapped {
+		panic("tried to access non-mapped memory")
+	}
+
+	return f.mem
+}
+
+// Sync does nothing, the memory isn't backed by anything, but fails if it isn't mapped.
+func (f *Fake) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.mapped {
+		return ErrNotMapped
+	}
+
+	return nil
+}
+
+// DevPath returns a placeholder path, fakes have no device.
+func (f *Fake) DevPath() string {
+	return "fake"
+}
+
+// Capabilities returns no features, the fake only maps memory.
+func (f *Fake) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// Close unmaps the memory if it is mapped, the fake can't be mapped again.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+
+	f.mapped, f.closed = false, true
+	return nil
+}
+
+var _ Mapper = (*Fake)(nil)
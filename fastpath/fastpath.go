@@ -0,0 +1,44 @@
+// Package fastpath holds the hot loops which pure Go can't make fast enough: the spin wait hint (PAUSE) and the
+// non-temporal copies which stream frames into the region without evicting the cache. The default build is pure Go
+// and only falls back to plain loops and copy. Building with the ivshmem_cgo tag (and cgo enabled) on amd64 or 386
+// switches to the C intrinsics:
+//
+//	go build -tags ivshmem_cgo ./...
+package fastpath
+
+import "unsafe"
+
+// ntThreshold is the size under which a non-temporal copy isn't worth it, the data would still be in the cache when
+// the reader comes.
+const ntThreshold = 256 << 10
+
+// Pause hints the CPU that the caller is spin waiting n times, which saves power and frees the pipeline for the
+// sibling hyperthread.
+func Pause(n int) {
+	if n > 0 {
+		pause(n)
+	}
+}
+
+// Copy copies src into dst like the copy builtin, overlapping slices included. Large copies bypass the cache with
+// non-temporal stores when the fast path is built in, which suits writes into the region the other side reads later,
+// like frames. Overlapping copies always take the copy builtin, the non-temporal stores don't handle overlap.
+func Copy(dst, src []byte) int {
+	n := len(src)
+	if len(dst) < n {
+		n = len(dst)
+	}
+
+	if n < ntThreshold || overlap(dst[:n], src[:n]) {
+		return copy(dst, src)
+	}
+
+	copyNT(dst[:n], src[:n])
+	return n
+}
+
+// overlap reports whether the non-empty slices share memory.
+func overlap(a, b []byte) bool {
+	pa, pb := uintptr(unsafe.Pointer(&a[0])), uintptr(unsafe.Pointer(&b[0]))
+	return pa < pb+uintptr(len(b)) && pb < pa+uintptr(len(a))
+}
@@ -0,0 +1,62 @@
+//go:build ivshmem_cgo && cgo && (amd64 || 386)
+
+package fastpath
+
+/*
+#include <stdint.h>
+#include <string.h>
+#include <emmintrin.h>
+
+static void ivshmem_pause(int n) {
+	for (int i = 0; i < n; i++) {
+		_mm_pause();
+	}
+}
+
+// ivshmem_copy_nt streams the aligned middle of the copy past the cache, the edges go through memcpy.
+static void ivshmem_copy_nt(void *dst, const void *src, size_t n) {
+	uint8_t *d = dst;
+	const uint8_t *s = src;
+	size_t head = (16 - ((uintptr_t)d & 15)) & 15;
+	if (head > n) {
+		head = n;
+	}
+
+	memcpy(d, s, head);
+	d += head;
+	s += head;
+	n -= head;
+
+	for (; n >= 64; n -= 64, d += 64, s += 64) {
+		__m128i a = _mm_loadu_si128((const __m128i *)(s));
+		__m128i b = _mm_loadu_si128((const __m128i *)(s + 16));
+		__m128i c = _mm_loadu_si128((const __m128i *)(s + 32));
+		__m128i e = _mm_loadu_si128((const __m128i *)(s + 48));
+		_mm_stream_si128((__m128i *)(d), a);
+		_mm_stream_si128((__m128i *)(d + 16), b);
+		_mm_stream_si128((__m128i *)(d + 32), c);
+		_mm_stream_si128((__m128i *)(d + 48), e);
+	}
+
+	memcpy(d, s, n);
+
+	// Non-temporal stores are weakly ordered, the fence makes them visible before whatever publishes the data
+	_mm_sfence();
+}
+*/
+import "C"
+
+import "unsafe"
+
+// Enabled tells whether the cgo fast paths are built in.
+const Enabled = true
+
+// pause runs the PAUSE instruction n times.
+func pause(n int) {
+	C.ivshmem_pause(C.int(n))
+}
+
+// copyNT copies with non-temporal stores, the slices have the same non zero length.
+func copyNT(dst, src []byte) {
+	C.ivshmem_copy_nt(unsafe.Pointer(&dst[0]), unsafe.Pointer(&src[0]), C.size_t(len(dst)))
+}
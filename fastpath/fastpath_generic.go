@@ -0,0 +1,24 @@
+//go:build !ivshmem_cgo || !cgo || !(amd64 || 386)
+
+package fastpath
+
+// Enabled tells whether the cgo fast paths are built in.
+const Enabled = false
+
+// pause busy loops, without the hint the loop is all pure Go can do.
+func pause(n int) {
+	for i := 0; i < n; i++ {
+		spin()
+	}
+}
+
+// spin is an empty call which keeps the pause loop from being optimized away, without sharing state between the
+// spinning goroutines.
+//
+//go:noinline
+func spin() {}
+
+// copyNT falls back to a regular copy.
+func copyNT(dst, src []byte) {
+	copy(dst, src)
+}
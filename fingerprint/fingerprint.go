@@ -0,0 +1,210 @@
+// Package fingerprint describes a region in one shot: a hash of the layout header and segment table, the layout
+// version, the channels living in the segments and whether the peers are alive. Two sides agreeing on the layout
+// report the same hash, so comparing the fingerprints taken on the host and in the guest is the first step of
+// debugging a link which doesn't come up. ivshmemctl fingerprint prints it.
+//
+// Channels are recognized by the magic of the formats of this module (ring, journal, pubsub and errlog) whatever type
+// their segment is declared with. Liveness is judged by watching the counters for a moment: a channel whose counters
+// move is in use, and a peer is alive when the counter of the heartbeat segment ticks.
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/errlog"
+	"github.com/TypicalAM/ivshmem/journal"
+	"github.com/TypicalAM/ivshmem/layout"
+	"github.com/TypicalAM/ivshmem/pubsub"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// HeartbeatSegment is the layout segment starting with the heartbeat counter of the peer, for the applications which
+// beat through the shared memory rather than with agent messages.
+const HeartbeatSegment = "heartbeat"
+
+// DefaultSample is how long the counters are watched by default.
+const DefaultSample = 250 * time.Millisecond
+
+// Formats of the channels.
+const (
+	FormatRing    = "ring"
+	FormatJournal = "journal"
+	FormatPubSub  = "pubsub"
+	FormatErrLog  = "errlog"
+)
+
+// Options tune a fingerprint.
+type Options struct {
+	// Sample is how long the counters are watched to tell live channels and peers apart from dead ones,
+	// DefaultSample by default. A negative value doesn't watch them at all.
+	Sample time.Duration
+}
+
+// Report is the fingerprint of a region.
+type Report struct {
+	Hash          string    `json:"hash"` // Hex SHA-256 of the layout header and segment table
+	Size          uint64    `json:"size"`
+	LayoutVersion uint32    `json:"layout_version"`
+	Generation    uint32    `json:"generation"`
+	Stale         bool      `json:"stale"` // The layout changed while the fingerprint was taken
+	Channels      []Channel `json:"channels"`
+	Peer          Peer      `json:"peer"`
+}
+
+// Channel describes a segment of the layout.
+type Channel struct {
+	Name   string      `json:"name"`
+	Type   layout.Type `json:"type"`
+	Offset uint64      `json:"offset"`
+	Size   uint64      `json:"size"`
+	Format string      `json:"format,omitempty"` // Empty unless the segment holds a recognized and valid format
+	Error  string      `json:"error,omitempty"`  // Why a segment with a known magic failed to open
+	Detail string      `json:"detail,omitempty"` // Counters of the format, for humans
+	Active bool        `json:"active"`           // The counters moved while sampling
+}
+
+// Peer is the liveness of the peer incrementing the heartbeat counter.
+type Peer struct {
+	Heartbeat bool   `json:"heartbeat"` // The layout has a heartbeat segment
+	Counter   uint64 `json:"counter"`
+	Alive     bool   `json:"alive"` // The counter moved while sampling
+}
+
+// Take fingerprints the region, which must start with a layout. It watches the counters for opts.Sample before it
+// returns.
+func Take(mem []byte, opts Options) (*Report, error) {
+	if opts.Sample == 0 {
+		opts.Sample = DefaultSample
+	}
+
+	l, err := layout.Open(mem)
+	if err != nil {
+		return nil, fmt.Errorf("open layout: %w", err)
+	}
+
+	segments := l.Segments()
+	table := layout.HeaderSize + len(segments)*layout.EntrySize
+	sum := sha256.Sum256(mem[:table])
+	r := &Report{
+		Hash:          hex.EncodeToString(sum[:]),
+		Size:          uint64(len(mem)),
+		LayoutVersion: l.Version(),
+		Generation:    l.Generation(),
+	}
+
+	probes := make([]func() uint64, len(segments))
+	for i, seg := range segments {
+		r.Channels = append(r.Channels, Channel{Name: seg.Name, Type: seg.Type, Offset: seg.Offset, Size: seg.Size})
+		probes[i] = probe(&r.Channels[i], mem[seg.Offset:seg.Offset+seg.Size])
+	}
+
+	heartbeat := func() uint64 { return 0 }
+	if seg, err := l.Bytes(HeartbeatSegment); err == nil && len(seg) >= 8 {
+		heartbeat = func() uint64 { return loadUint64(seg) }
+		r.Peer.Heartbeat = true
+	}
+
+	before := make([]uint64, len(probes))
+	for i, p := range probes {
+		if p != nil {
+			before[i] = p()
+		}
+	}
+	beat := heartbeat()
+
+	if opts.Sample > 0 {
+		time.Sleep(opts.Sample)
+	}
+
+	for i, p := range probes {
+		if p != nil {
+			r.Channels[i].Active = p() != before[i]
+		}
+	}
+
+	r.Peer.Counter = heartbeat()
+	r.Peer.Alive = r.Peer.Heartbeat && r.Peer.Counter != beat
+	r.Stale = l.Stale()
+	return r, nil
+}
+
+// probe recognizes the format stored in the segment, fills in the channel and returns a reader of the counter which
+// moves while the channel is used. It returns nil when the format is unknown or the segment too small.
+func probe(ch *Channel, seg []byte) func() uint64 {
+	if len(seg) < 4 || uintptr(unsafe.Pointer(&seg[0]))%8 != 0 {
+		return nil
+	}
+
+	var (
+		format  string
+		err     error
+		counter func() uint64
+	)
+	switch magic := atomic.LoadUint32((*uint32)(unsafe.Pointer(&seg[0]))); magic {
+	case ring.Magic:
+		format = FormatRing
+		var r *ring.Ring
+		if r, err = ring.Open(seg); err == nil {
+			ch.Detail = fmt.Sprintf("epoch %d, %d of %d bytes pending", r.Epoch(), r.Len(), r.Capacity())
+			counter = func() uint64 { return r.Produced() + r.Consumed() }
+		}
+	case journal.Magic:
+		format = FormatJournal
+		var j *journal.Journal
+		if j, err = journal.Open(seg); err == nil {
+			ch.Detail = fmt.Sprintf("%d records, writers %q", j.Sequence(), j.Writers())
+			counter = j.Sequence
+		}
+	case pubsub.Magic:
+		format = FormatPubSub
+		var b *pubsub.Bus
+		if b, err = pubsub.Open(seg); err == nil {
+			ch.Detail = fmt.Sprintf("topics %q", b.Topics())
+			counter = func() uint64 { return published(b) }
+		}
+	case errlog.Magic:
+		format = FormatErrLog
+		var l *errlog.Log
+		if l, err = errlog.Open(seg); err == nil {
+			ch.Detail = fmt.Sprintf("%d errors recorded", l.Recorded())
+			counter = l.Recorded
+		}
+	default:
+		return nil
+	}
+
+	if err != nil {
+		ch.Error = fmt.Sprintf("%s: %v", format, err)
+		return nil
+	}
+
+	ch.Format = format
+	return counter
+}
+
+// published returns the messages published to all the topics of the bus.
+func published(b *pubsub.Bus) uint64 {
+	var n uint64
+	for _, name := range b.Topics() {
+		if t, err := b.Lookup(name); err == nil {
+			n += t.Published()
+		}
+	}
+
+	return n
+}
+
+// loadUint64 reads the counter at the start of the segment, atomically when it is aligned.
+func loadUint64(seg []byte) uint64 {
+	if uintptr(unsafe.Pointer(&seg[0]))%8 == 0 {
+		return atomic.LoadUint64((*uint64)(unsafe.Pointer(&seg[0])))
+	}
+
+	return binary.LittleEndian.Uint64(seg)
+}
@@ -0,0 +1,326 @@
+//go:build linux
+
+// Package fleet lets a single host daemon serve many VMs. It keeps a Host mapping per VM, keyed by the VM name, runs
+// the per VM setup (opening the channels the application talks over) and watches the heartbeat of every guest agent,
+// reporting the lifecycle through callbacks.
+//
+// The heartbeats are the heartbeat messages of the agent package: the setup runs an agent.Agent for the VM with
+// OnHeartbeat calling VM.Beat, the guest agent sends them with Agent.SendHeartbeats.
+package fleet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/qmp"
+)
+
+var ErrExists = errors.New("vm already managed")
+var ErrUnknownVM = errors.New("unknown vm")
+
+// EnvName is the environment variable passing the VM name to the tools started for a VM, see VM.Environ.
+const EnvName = "IVSHMEM_VM"
+
+// Options tune the orchestrator, the zero value checks the heartbeats every second and declares an agent lost after
+// three seconds without a beat.
+type Options struct {
+	Interval time.Duration // How often the heartbeats are checked
+	Timeout  time.Duration // How long the agent of a running VM may go without a beat before it is lost
+}
+
+// Callbacks are invoked on the lifecycle events of the VMs, any of them may be nil. They run on the goroutine
+// causing the event and must not call back into the orchestrator.
+type Callbacks struct {
+	Attached func(vm *VM)            // The region is mapped and set up
+	Detached func(vm *VM, err error) // The VM was removed, err is the error of closing its resources
+	Lost     func(vm *VM)            // The agent stopped beating while the VM runs
+	Restored func(vm *VM)            // The agent beats again
+}
+
+// SetupFunc opens the per VM resources, like the channels, over the mapped region. They are closed on detach.
+type SetupFunc func(ctx context.Context, vm *VM) (io.Closer, error)
+
+// VM is a virtual machine served by the orchestrator.
+type VM struct {
+	name    string
+	host    *ivshmem.Host
+	monitor *qmp.Monitor
+	res     io.Closer
+
+	beats atomic.Uint64 // Heartbeats received, counted by Beat
+
+	mu      sync.Mutex // Keeps a removed VM from being checked
+	removed bool
+	seen    uint64    // Heartbeats counted at the last check
+	beatAt  time.Time // When the deadline of the next heartbeat started
+	lost    atomic.Bool
+}
+
+// Name returns the name of the VM.
+func (vm *VM) Name() string {
+	return vm.name
+}
+
+// Host returns the mapping of the region of the VM.
+func (vm *VM) Host() *ivshmem.Host {
+	return vm.host
+}
+
+// Resources returns what the setup function opened, nil if there was none.
+func (vm *VM) Resources() io.Closer {
+	return vm.res
+}
+
+// Labels returns the labels naming the VM and its region in logs and metrics, needed once several regions are served
+// from one process.
+func (vm *VM) Labels() map[string]string {
+	return map[string]string{"vm": vm.name, "region": filepath.Base(vm.host.DevPath())}
+}
+
+// Logger returns a logger writing like the base one, with the lines prefixed by the VM name.
+func (vm *VM) Logger(base *log.Logger) *log.Logger {
+	return log.New(base.Writer(), base.Prefix()+vm.name+": ", base.Flags())
+}
+
+// Environ returns the environment variables naming the VM, for the host tools started on its behalf.
+func (vm *VM) Environ() []string {
+	return []string{EnvName + "=" + vm.name}
+}
+
+// Beat records a heartbeat of the agent of the VM, pass it to the OnHeartbeat option of the agent running for the VM.
+// It never blocks.
+func (vm *VM) Beat() {
+	vm.beats.Add(1)
+}
+
+// Lost tells whether the agent of the VM stopped beating.
+func (vm *VM) Lost() bool {
+	return vm.lost.Load()
+}
+
+// Orchestrator manages the VMs, it is safe for concurrent use.
+type Orchestrator struct {
+	opts  Options
+	cb    Callbacks
+	setup SetupFunc
+
+	mu  sync.Mutex
+	vms map[string]*VM
+}
+
+// New returns an orchestrator running the setup function for every added VM, nil for none.
+func New(setup SetupFunc, cb Callbacks, opts Options) *Orchestrator {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+
+	return &Orchestrator{opts: opts, cb: cb, setup: setup, vms: make(map[string]*VM)}
+}
+
+// Add maps the shared memory file of the VM and runs the setup. The monitor is optional, with it a paused or stopped
+// VM isn't reported as lost, and the heartbeat deadline starts over once it runs again.
+func (o *Orchestrator) Add(ctx context.Context, name, shmPath string, monitor *qmp.Monitor) (*VM, error) {
+	o.mu.Lock()
+	if _, ok := o.vms[name]; ok {
+		o.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrExists, name)
+	}
+
+	// Reserve the name, so the slow part runs unlocked
+	o.vms[name] = &VM{name: name}
+	o.mu.Unlock()
+
+	vm, err := o.attach(ctx, name, shmPath, monitor)
+	o.mu.Lock()
+	if err != nil {
+		delete(o.vms, name)
+	} else {
+		o.vms[name] = vm
+	}
+	o.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("attach %s: %w", name, err)
+	}
+
+	if o.cb.Attached != nil {
+		o.cb.Attached(vm)
+	}
+
+	return vm, nil
+}
+
+// attach maps the region and opens the resources.
+func (o *Orchestrator) attach(ctx context.Context, name, shmPath string, monitor *qmp.Monitor) (*VM, error) {
+	host, err := ivshmem.NewHost(shmPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := host.Map(); err != nil {
+		return nil, err
+	}
+
+	vm := &VM{name: name, host: host, monitor: monitor, beatAt: time.Now()}
+	if o.setup == nil {
+		return vm, nil
+	}
+
+	res, err := o.setup(ctx, vm)
+	if err != nil {
+		host.Unmap()
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+
+	vm.res = res
+	return vm, nil
+}
+
+// Remove closes the resources of the VM and unmaps its region.
+func (o *Orchestrator) Remove(name string) error {
+	o.mu.Lock()
+	vm, ok := o.vms[name]
+	if !ok || vm.host == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownVM, name)
+	}
+
+	delete(o.vms, name)
+	o.mu.Unlock()
+
+	return o.detach(vm)
+}
+
+// detach releases the VM and reports it.
+func (o *Orchestrator) detach(vm *VM) error {
+	vm.mu.Lock()
+	vm.removed = true
+	vm.mu.Unlock()
+
+	var err error
+	if vm.res != nil {
+		err = vm.res.Close()
+	}
+
+	err = errors.Join(err, vm.host.Unmap())
+	if o.cb.Detached != nil {
+		o.cb.Detached(vm, err)
+	}
+
+	return err
+}
+
+// Get returns the VM with the name.
+func (o *Orchestrator) Get(name string) (*VM, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	vm, ok := o.vms[name]
+	if !ok || vm.host == nil {
+		return nil, false
+	}
+
+	return vm, true
+}
+
+// Names returns the sorted names of the managed VMs.
+func (o *Orchestrator) Names() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	names := make([]string, 0, len(o.vms))
+	for name, vm := range o.vms {
+		if vm.host != nil {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Run watches the heartbeats until the context is done.
+func (o *Orchestrator) Run(ctx context.Context) error {
+	ticker := time.NewTicker(o.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			o.check(now)
+		}
+	}
+}
+
+// check looks for the VMs whose agent didn't beat since the previous check for longer than the timeout. The time a VM
+// spends paused, suspended or stopped doesn't count, its agent couldn't beat.
+func (o *Orchestrator) check(now time.Time) {
+	o.mu.Lock()
+	vms := make([]*VM, 0, len(o.vms))
+	for _, vm := range o.vms {
+		if vm.host != nil {
+			vms = append(vms, vm)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, vm := range vms {
+		vm.mu.Lock()
+		if vm.removed {
+			vm.mu.Unlock()
+			continue
+		}
+
+		beat := vm.beats.Load()
+		running := vm.monitor == nil || vm.monitor.PeerState() == qmp.PeerRunning
+		moved := beat != vm.seen
+		if moved || !running {
+			vm.seen, vm.beatAt = beat, now
+		}
+
+		stalled := now.Sub(vm.beatAt) >= o.opts.Timeout
+		vm.mu.Unlock()
+
+		if moved && vm.lost.Swap(false) && o.cb.Restored != nil {
+			o.cb.Restored(vm)
+		}
+
+		if stalled && !vm.lost.Swap(true) && o.cb.Lost != nil {
+			o.cb.Lost(vm)
+		}
+	}
+}
+
+// Close removes every VM.
+func (o *Orchestrator) Close() error {
+	o.mu.Lock()
+	vms := make([]*VM, 0, len(o.vms))
+	for name, vm := range o.vms {
+		if vm.host != nil {
+			vms = append(vms, vm)
+			delete(o.vms, name)
+		}
+	}
+	o.mu.Unlock()
+
+	var errs []error
+	for _, vm := range vms {
+		if err := o.detach(vm); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", vm.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,51 @@
+package frame
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Conn sends and receives whole frames.
+type Conn interface {
+	Send(ctx context.Context, f Frame) error
+	Recv(ctx context.Context) (Frame, error)
+}
+
+// streamConn frames messages over a byte stream.
+type streamConn struct {
+	rw     io.ReadWriter
+	limits ivshmem.Limits
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+}
+
+// NewConn returns a Conn framing messages over the byte stream. The context is only checked before every operation,
+// a blocked stream is unblocked by closing it.
+func NewConn(rw io.ReadWriter, limits ivshmem.Limits) Conn {
+	return &streamConn{rw: rw, limits: limits}
+}
+
+// Send writes the frame.
+func (c *streamConn) Send(ctx context.Context, f Frame) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return Write(c.rw, f)
+}
+
+// Recv reads the next frame.
+func (c *streamConn) Recv(ctx context.Context) (Frame, error) {
+	if err := ctx.Err(); err != nil {
+		return Frame{}, err
+	}
+
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	return Read(c.rw, c.limits)
+}
@@ -0,0 +1,202 @@
+// Package frame defines the message framing used on top of the shared memory transports. Every frame carries a small
+// metadata area of user key/values (trace IDs, tenant IDs) next to the payload, so middleware can attach context to
+// messages without touching the payload format.
+//
+// Wire format, all the values are little endian:
+//
+//	0 payload length (uint32)
+//	4 metadata length in bytes (uint16)
+//	6 flags (uint16), zero in version 1
+//	8 metadata: entries of key length (uint8), key, value length (uint8), value, sorted by key
+//	  payload
+//	  CRC32-C of everything before it (uint32), only with FlagChecksum
+//
+// Version 2 added the checksum, a version 1 reader refuses the checksummed frames instead of misreading them. The
+// checksum catches the frames torn by a peer which crashed halfway through writing them, or garbage left in the
+// region by an unclean shutdown, before the payload reaches the application.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+var ErrMetadataTooLarge = errors.New("metadata too large")
+var ErrMalformed = errors.New("malformed frame")
+var ErrChecksum = errors.New("frame checksum mismatch")
+
+const (
+	Version    = 2
+	HeaderSize = 8
+
+	// FlagChecksum marks a frame followed by its checksum.
+	FlagChecksum = 1
+
+	// ChecksumSize is the size of the checksum trailer.
+	ChecksumSize = 4
+
+	// MaxMetadataSize is the size of the metadata area, keeping it small keeps the per frame overhead predictable.
+	MaxMetadataSize = 1024
+
+	// maxPayloadSize is the largest payload whose frame size still fits an int on 32 bit platforms.
+	maxPayloadSize = math.MaxInt32 - MaxMetadataSize - ChecksumSize
+)
+
+// castagnoli is the CRC32-C table, the polynomial with hardware support on amd64 and arm64.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Frame is a single message.
+type Frame struct {
+	Metadata Metadata
+	Payload  []byte
+
+	// Checked makes Append add a checksum to the frame, Read sets it when the frame had a valid one.
+	Checked bool
+}
+
+// Append appends the encoded frame to dst.
+func Append(dst []byte, f Frame) ([]byte, error) {
+	md, err := f.Metadata.encode()
+	if err != nil {
+		return dst, err
+	}
+
+	if uint64(len(f.Payload)) > 0xffffffff {
+		return dst, fmt.Errorf("%w: payload of %d bytes", ivshmem.ErrResourceExhausted, len(f.Payload))
+	}
+
+	var flags uint16
+	if f.Checked {
+		flags |= FlagChecksum
+	}
+
+	start := len(dst)
+	var hdr [HeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(f.Payload)))
+	binary.LittleEndian.PutUint16(hdr[4:], uint16(len(md)))
+	binary.LittleEndian.PutUint16(hdr[6:], flags)
+	dst = append(dst, hdr[:]...)
+	dst = append(dst, md...)
+	dst = append(dst, f.Payload...)
+	if f.Checked {
+		dst = binary.LittleEndian.AppendUint32(dst, crc32.Checksum(dst[start:], castagnoli))
+	}
+
+	return dst, nil
+}
+
+// Write encodes the frame into w with a single write.
+func Write(w io.Writer, f Frame) error {
+	buf, err := Append(nil, f)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// Read decodes the next frame from r. Payloads larger than the message size limit are refused before allocating,
+// without a limit the one of ivshmem.DefaultLimits applies, since the length comes from the peer.
+func Read(r io.Reader, limits ivshmem.Limits) (Frame, error) {
+	var hdr [HeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+
+	payloadLen := binary.LittleEndian.Uint32(hdr[0:])
+	mdLen := binary.LittleEndian.Uint16(hdr[4:])
+	flags := binary.LittleEndian.Uint16(hdr[6:])
+	if mdLen > MaxMetadataSize || flags&^FlagChecksum != 0 {
+		return Frame{}, fmt.Errorf("%w: metadata length %d, flags %#x", ErrMalformed, mdLen, flags)
+	}
+
+	limit := limits.MaxMessageSize
+	if limit <= 0 {
+		limit = ivshmem.DefaultLimits.MaxMessageSize
+	}
+
+	if limit <= 0 || limit > maxPayloadSize {
+		limit = maxPayloadSize
+	}
+
+	// Compared before the conversion, which would turn a huge length negative on 32 bit platforms
+	if payloadLen > uint32(limit) {
+		err := fmt.Errorf("%w: payload of %d bytes over the limit of %d", ivshmem.ErrResourceExhausted, payloadLen, limit)
+		return Frame{}, err
+	}
+
+	checked := flags&FlagChecksum != 0
+	size := int(mdLen) + int(payloadLen)
+	if checked {
+		size += ChecksumSize
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Frame{}, fmt.Errorf("read frame body: %w", noEOF(err))
+	}
+
+	if checked {
+		body := buf[:size-ChecksumSize]
+		sum := crc32.Update(crc32.Checksum(hdr[:], castagnoli), castagnoli, body)
+		if want := binary.LittleEndian.Uint32(buf[size-ChecksumSize:]); sum != want {
+			return Frame{}, fmt.Errorf("%w: %#08x, the frame says %#08x", ErrChecksum, sum, want)
+		}
+
+		buf = body
+	}
+
+	md, err := decodeMetadata(buf[:mdLen])
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Metadata: md, Payload: buf[mdLen:], Checked: checked}, nil
+}
+
+// Decode decodes a single frame from the buffer and returns the number of bytes it took.
+func Decode(buf []byte, limits ivshmem.Limits) (Frame, int, error) {
+	r := &countingReader{buf: buf}
+	f, err := Read(r, limits)
+	if err != nil {
+		return Frame{}, 0, noEOF(err)
+	}
+
+	return f, r.off, nil
+}
+
+// countingReader reads from a buffer and remembers how much was read.
+type countingReader struct {
+	buf []byte
+	off int
+}
+
+// Read implements io.Reader.
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.off >= len(r.buf) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// noEOF turns an unexpected end of data into a malformed frame error.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrMalformed)
+	}
+
+	return err
+}
@@ -0,0 +1,155 @@
+package frame_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+// roundTripFrames are encoded and decoded again by the round trip tests.
+var roundTripFrames = []struct {
+	name  string
+	frame frame.Frame
+}{
+	{"empty", frame.Frame{}},
+	{"payload", frame.Frame{Payload: []byte("hello")}},
+	{"metadata", frame.Frame{Metadata: frame.Metadata{"tenant": "a", "trace-id": "0af7651916cd43dd"}, Payload: []byte("ping")}},
+	{"checked", frame.Frame{Payload: []byte("hello"), Checked: true}},
+	{"checked-empty", frame.Frame{Checked: true}},
+	{"binary", frame.Frame{Metadata: frame.Metadata{"k": "\x00\xff"}, Payload: bytes.Repeat([]byte{0, 1, 0xfe, 0xff}, 1000)}},
+}
+
+func TestAppendDecode(t *testing.T) {
+	for _, tc := range roundTripFrames {
+		f := tc.frame
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := frame.Append([]byte("prefix"), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, n, err := frame.Decode(buf[len("prefix"):], ivshmem.Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != len(buf)-len("prefix") {
+				t.Errorf("decoded %d bytes, encoded %d", n, len(buf)-len("prefix"))
+			}
+
+			assertFrame(t, got, f)
+		})
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	for _, tc := range roundTripFrames {
+		if err := frame.Write(&buf, tc.frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range roundTripFrames {
+		got, err := frame.Read(&buf, ivshmem.Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFrame(t, got, tc.frame)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after reading every frame", buf.Len())
+	}
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	conn := frame.NewConn(&buf, ivshmem.Limits{})
+	want := roundTripFrames[2].frame
+	if err := conn.Send(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := conn.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFrame(t, got, want)
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	buf, err := frame.Append(nil, frame.Frame{Payload: []byte("hello"), Checked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range buf {
+		corrupted := append([]byte(nil), buf...)
+		corrupted[i] ^= 0x01
+		// Clearing the checksum flag leaves the trailer undecoded instead
+		if _, n, err := frame.Decode(corrupted, ivshmem.Limits{}); err == nil && n == len(corrupted) {
+			t.Errorf("flipping a bit of byte %d went unnoticed", i)
+		}
+	}
+
+	for n := 0; n < len(buf); n++ {
+		if _, _, err := frame.Decode(buf[:n], ivshmem.Limits{}); !errors.Is(err, frame.ErrMalformed) {
+			t.Errorf("frame truncated to %d bytes: want ErrMalformed, got %v", n, err)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	buf, err := frame.Append(nil, frame.Frame{Payload: make([]byte, 100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = frame.Decode(buf, ivshmem.Limits{MaxMessageSize: 99})
+	if !errors.Is(err, ivshmem.ErrResourceExhausted) {
+		t.Fatalf("want ErrResourceExhausted, got %v", err)
+	}
+
+	// Without a limit the default one still refuses a header announcing 4 GiB
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if _, _, err := frame.Decode(huge, ivshmem.Limits{}); !errors.Is(err, ivshmem.ErrResourceExhausted) {
+		t.Fatalf("zero limits: want ErrResourceExhausted, got %v", err)
+	}
+}
+
+func TestMetadataTooLarge(t *testing.T) {
+	md := frame.Metadata{}
+	for i := 0; i < 10; i++ {
+		md.Set(string(rune('a'+i))+string(bytes.Repeat([]byte{'k'}, 200)), "v")
+	}
+
+	if _, err := frame.Append(nil, frame.Frame{Metadata: md}); !errors.Is(err, frame.ErrMetadataTooLarge) {
+		t.Fatalf("want ErrMetadataTooLarge, got %v", err)
+	}
+}
+
+// assertFrame compares the decoded frame with the encoded one, an empty payload or metadata decodes to either form.
+func assertFrame(t *testing.T, got, want frame.Frame) {
+	t.Helper()
+	if !bytes.Equal(got.Payload, want.Payload) {
+		t.Errorf("payload: want %q, got %q", want.Payload, got.Payload)
+	}
+
+	if len(got.Metadata) != 0 || len(want.Metadata) != 0 {
+		if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+			t.Errorf("metadata: want %v, got %v", want.Metadata, got.Metadata)
+		}
+	}
+
+	if got.Checked != want.Checked {
+		t.Errorf("checked: want %v, got %v", want.Checked, got.Checked)
+	}
+}
@@ -0,0 +1,96 @@
+package frame
+
+import (
+	"context"
+	"fmt"
+)
+
+// SendFunc sends a frame, it is the next step of a send interceptor chain.
+type SendFunc func(ctx context.Context, f Frame) error
+
+// RecvFunc receives a frame, it is the next step of a receive interceptor chain.
+type RecvFunc func(ctx context.Context) (Frame, error)
+
+// SendInterceptor runs around every Send, it may inspect or replace the frame, and decides whether to call next.
+type SendInterceptor func(ctx context.Context, f Frame, next SendFunc) error
+
+// RecvInterceptor runs around every Recv, it calls next to get the frame and may inspect, replace or reject it.
+type RecvInterceptor func(ctx context.Context, next RecvFunc) (Frame, error)
+
+// Interceptors are the chains wrapped around a Conn, the first interceptor is the outermost one.
+type Interceptors struct {
+	Send []SendInterceptor
+	Recv []RecvInterceptor
+}
+
+// Intercept returns a Conn running the interceptors around the operations of c, so logging, metrics, encryption or
+// validation can be plugged in without touching the Conn implementation.
+func Intercept(c Conn, interceptors Interceptors) Conn {
+	send := SendFunc(c.Send)
+	for i := len(interceptors.Send) - 1; i >= 0; i-- {
+		interceptor, next := interceptors.Send[i], send
+		send = func(ctx context.Context, f Frame) error {
+			return interceptor(ctx, f, next)
+		}
+	}
+
+	recv := RecvFunc(c.Recv)
+	for i := len(interceptors.Recv) - 1; i >= 0; i-- {
+		interceptor, next := interceptors.Recv[i], recv
+		recv = func(ctx context.Context) (Frame, error) {
+			return interceptor(ctx, next)
+		}
+	}
+
+	return &interceptedConn{send: send, recv: recv}
+}
+
+// interceptedConn is a Conn with the interceptor chains baked in.
+type interceptedConn struct {
+	send SendFunc
+	recv RecvFunc
+}
+
+// Send runs the send chain.
+func (c *interceptedConn) Send(ctx context.Context, f Frame) error {
+	return c.send(ctx, f)
+}
+
+// Recv runs the receive chain.
+func (c *interceptedConn) Recv(ctx context.Context) (Frame, error) {
+	return c.recv(ctx)
+}
+
+// PropagateMetadata is a send interceptor attaching the metadata stored in the context (see NewContext) to the
+// frame. Keys already set on the frame win.
+func PropagateMetadata(ctx context.Context, f Frame, next SendFunc) error {
+	md, ok := FromContext(ctx)
+	if !ok || len(md) == 0 {
+		return next(ctx, f)
+	}
+
+	merged := md.Clone()
+	for k, v := range f.Metadata {
+		merged[k] = v
+	}
+
+	f.Metadata = merged
+	return next(ctx, f)
+}
+
+// Checksum is a send interceptor adding a checksum to every frame, see Frame.Checked.
+func Checksum(ctx context.Context, f Frame, next SendFunc) error {
+	f.Checked = true
+	return next(ctx, f)
+}
+
+// RequireChecksum is a receive interceptor refusing the frames without a checksum with ErrChecksum, for links where
+// both sides send them.
+func RequireChecksum(ctx context.Context, next RecvFunc) (Frame, error) {
+	f, err := next(ctx)
+	if err == nil && !f.Checked {
+		return Frame{}, fmt.Errorf("%w: frame without a checksum", ErrChecksum)
+	}
+
+	return f, err
+}
@@ -0,0 +1,107 @@
+package frame
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Metadata are the user key/values carried by a frame. Keys and values are at most 255 bytes long and the encoded
+// entries must fit in MaxMetadataSize.
+type Metadata map[string]string
+
+// Get returns the value of the key, an empty string if it isn't set.
+func (m Metadata) Get(key string) string {
+	return m[key]
+}
+
+// Set sets the value of the key, allocating the map if needed.
+func (m *Metadata) Set(key, value string) {
+	if *m == nil {
+		*m = make(Metadata)
+	}
+
+	(*m)[key] = value
+}
+
+// Clone returns a copy of the metadata.
+func (m Metadata) Clone() Metadata {
+	if m == nil {
+		return nil
+	}
+
+	clone := make(Metadata, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+
+	return clone
+}
+
+// encode returns the metadata area, the entries are sorted by key so the encoding is deterministic.
+func (m Metadata) encode() ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, 64)
+	for _, key := range keys {
+		value := m[key]
+		if len(key) == 0 || len(key) > 255 || len(value) > 255 {
+			return nil, fmt.Errorf("%w: entry %q is %d+%d bytes long", ErrMetadataTooLarge, key, len(key), len(value))
+		}
+
+		buf = append(buf, byte(len(key)))
+		buf = append(buf, key...)
+		buf = append(buf, byte(len(value)))
+		buf = append(buf, value...)
+	}
+
+	if len(buf) > MaxMetadataSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d fit", ErrMetadataTooLarge, len(buf), MaxMetadataSize)
+	}
+
+	return buf, nil
+}
+
+// decodeMetadata parses the metadata area.
+func decodeMetadata(buf []byte) (Metadata, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	m := make(Metadata)
+	for len(buf) > 0 {
+		keyLen := int(buf[0])
+		if keyLen == 0 || len(buf) < 2+keyLen {
+			return nil, fmt.Errorf("%w: bad metadata key", ErrMalformed)
+		}
+
+		key := string(buf[1 : 1+keyLen])
+		valueLen := int(buf[1+keyLen])
+		if len(buf) < 2+keyLen+valueLen {
+			return nil, fmt.Errorf("%w: bad metadata value of %q", ErrMalformed, key)
+		}
+
+		m[key] = string(buf[2+keyLen : 2+keyLen+valueLen])
+		buf = buf[2+keyLen+valueLen:]
+	}
+
+	return m, nil
+}
+
+// contextKey is the key of the metadata stored in a context.
+type contextKey struct{}
+
+// NewContext returns a context carrying the metadata, to be attached to the frames sent on behalf of the context.
+func NewContext(ctx context.Context, m Metadata) context.Context {
+	return context.WithValue(ctx, contextKey{}, m)
+}
+
+// FromContext returns the metadata stored in the context.
+func FromContext(ctx context.Context) (Metadata, bool) {
+	m, ok := ctx.Value(contextKey{}).(Metadata)
+	return m, ok
+}
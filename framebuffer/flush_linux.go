@@ -0,0 +1,28 @@
+//go:build linux
+
+package framebuffer
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// flushRange syncs the pages backing the memory range, msync requires the start to be page aligned.
+func flushRange(mem []byte) error {
+	if len(mem) == 0 {
+		return nil
+	}
+
+	page := uintptr(os.Getpagesize())
+	skew := int(uintptr(unsafe.Pointer(&mem[0])) & (page - 1))
+	start := unsafe.Add(unsafe.Pointer(&mem[0]), -skew)
+
+	if err := unix.Msync(unsafe.Slice((*byte)(start), skew+len(mem)), unix.MS_SYNC); err != nil {
+		return fmt.Errorf("msync: %w", err)
+	}
+
+	return nil
+}
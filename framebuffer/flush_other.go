@@ -0,0 +1,8 @@
+//go:build !linux
+
+package framebuffer
+
+// flushRange is a no-op, the guest mappings are coherent on the supported platforms.
+func flushRange(mem []byte) error {
+	return nil
+}
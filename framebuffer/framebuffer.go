@@ -0,0 +1,307 @@
+// Package framebuffer lays out a single video frame inside the shared memory region. A producer (usually the guest)
+// writes pixels between BeginFrame and Publish, a consumer (usually the host) reads them without any intermediate
+// copies and retries a snapshot which raced with the producer. Every Init draws a new session and bumps the epoch, the
+// views fail with ErrStale once a peer initialized the framebuffer again, the sequence numbers restart then.
+package framebuffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x42465649 // "IVFB" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+
+	// StrideAlignment is the alignment of every row in bytes. It satisfies GL_UNPACK_ALIGNMENT as well as the
+	// usual Vulkan optimalBufferCopyRowPitchAlignment, so rows can be uploaded without repacking.
+	StrideAlignment = 256
+
+	// PageSize is the minimal alignment of the pixel data relative to the start of the region.
+	PageSize = 4096
+)
+
+// Header field offsets, all the values are little endian.
+const (
+	offMagic      = 0
+	offVersion    = 4
+	offFormat     = 8
+	offWidth      = 12
+	offHeight     = 16
+	offStride     = 20
+	offDataOffset = 24
+	offEpoch      = 28
+	offSequence   = 32
+	offWriting    = 40
+	offSession    = 48
+)
+
+// Format describes the layout of a single pixel.
+type Format uint32
+
+const (
+	FormatBGRA Format = iota + 1
+	FormatRGBA
+)
+
+// String returns the name of the pixel format.
+func (f Format) String() string {
+	switch f {
+	case FormatBGRA:
+		return "BGRA"
+	case FormatRGBA:
+		return "RGBA"
+	default:
+		return fmt.Sprintf("Format(%d)", uint32(f))
+	}
+}
+
+// BytesPerPixel returns the size of a single pixel in bytes, zero if the format is unknown.
+func (f Format) BytesPerPixel() int {
+	switch f {
+	case FormatBGRA, FormatRGBA:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Framebuffer is a view of a frame stored in the shared memory region.
+type Framebuffer struct {
+	mem        []byte
+	format     Format
+	width      uint32
+	height     uint32
+	stride     uint32
+	dataOffset uint32
+
+	strict       bool
+	lastSequence uint64
+	stamp        shmhdr.Stamp
+}
+
+// Size returns the amount of bytes a region needs to hold a frame of the given dimensions.
+func Size(width, height uint32, format Format) uint64 {
+	return uint64(dataOffset()) + stride64(width, format)*uint64(height)
+}
+
+// Init writes a fresh header into the region and returns the framebuffer. It is called by the producer.
+func Init(mem []byte, width, height uint32, format Format) (*Framebuffer, error) {
+	if format.BytesPerPixel() == 0 {
+		return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidHeader, format)
+	}
+
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("%w: empty frame %dx%d", ErrInvalidHeader, width, height)
+	}
+
+	if stride64(width, format) > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: %d pixels wide rows overflow the stride", ErrInvalidHeader, width)
+	}
+
+	if size := Size(width, height, format); uint64(len(mem)) < size {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, size, len(mem))
+	}
+
+	fb := &Framebuffer{
+		mem:        mem,
+		format:     format,
+		width:      width,
+		height:     height,
+		stride:     stride(width, format),
+		dataOffset: dataOffset(),
+	}
+
+	var err error
+	if fb.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offFormat:], uint32(format))
+	binary.LittleEndian.PutUint32(mem[offWidth:], width)
+	binary.LittleEndian.PutUint32(mem[offHeight:], height)
+	binary.LittleEndian.PutUint32(mem[offStride:], fb.stride)
+	binary.LittleEndian.PutUint32(mem[offDataOffset:], fb.dataOffset)
+	atomic.StoreUint64(fb.sequencePtr(), 0)
+	atomic.StoreUint64(fb.writingPtr(), 0)
+
+	shmhdr.Publish(mem, Magic)
+	return fb, nil
+}
+
+// Open validates the header written by the producer and returns the framebuffer. It is called by the consumer.
+func Open(mem []byte) (*Framebuffer, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	fb := &Framebuffer{
+		mem:        mem,
+		format:     Format(binary.LittleEndian.Uint32(mem[offFormat:])),
+		width:      binary.LittleEndian.Uint32(mem[offWidth:]),
+		height:     binary.LittleEndian.Uint32(mem[offHeight:]),
+		stride:     binary.LittleEndian.Uint32(mem[offStride:]),
+		dataOffset: binary.LittleEndian.Uint32(mem[offDataOffset:]),
+	}
+
+	if bpp := fb.format.BytesPerPixel(); bpp == 0 {
+		return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidHeader, fb.format)
+	}
+
+	if fb.width == 0 || fb.height == 0 {
+		return nil, fmt.Errorf("%w: empty frame %dx%d", ErrInvalidHeader, fb.width, fb.height)
+	}
+
+	row := uint64(fb.width) * uint64(fb.format.BytesPerPixel())
+	if uint64(fb.stride) < row || fb.stride%StrideAlignment != 0 {
+		return nil, fmt.Errorf("%w: bad stride %d for width %d", ErrInvalidHeader, fb.stride, fb.width)
+	}
+
+	if fb.dataOffset < HeaderSize || fb.dataOffset%PageSize != 0 {
+		return nil, fmt.Errorf("%w: bad data offset %d", ErrInvalidHeader, fb.dataOffset)
+	}
+
+	if end := uint64(fb.dataOffset) + uint64(fb.stride)*uint64(fb.height); uint64(len(mem)) < end {
+		return nil, fmt.Errorf("%w: frame ends at %d, region has %d bytes", ErrRegionTooSmall, end, len(mem))
+	}
+
+	fb.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return fb, nil
+}
+
+// Session returns the ID of the initialization the framebuffer was opened with.
+func (f *Framebuffer) Session() shmhdr.Session {
+	return f.stamp.Session()
+}
+
+// Epoch returns the number of times the framebuffer was initialized, when it was opened.
+func (f *Framebuffer) Epoch() uint32 {
+	return f.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the framebuffer again since it was opened, the view must be reopened then.
+func (f *Framebuffer) Stale() bool {
+	return f.stamp.Check() != nil
+}
+
+// Width returns the frame width in pixels.
+func (f *Framebuffer) Width() uint32 {
+	return f.width
+}
+
+// Height returns the frame height in pixels.
+func (f *Framebuffer) Height() uint32 {
+	return f.height
+}
+
+// Stride returns the distance between two rows in bytes, it is always a multiple of StrideAlignment.
+func (f *Framebuffer) Stride() uint32 {
+	return f.stride
+}
+
+// Format returns the pixel format.
+func (f *Framebuffer) Format() Format {
+	return f.format
+}
+
+// Pixels returns the pixel data, including the row padding. The returned slice aliases the shared memory.
+func (f *Framebuffer) Pixels() []byte {
+	return f.mem[f.dataOffset : uint64(f.dataOffset)+uint64(f.stride)*uint64(f.height)]
+}
+
+// Row returns the pixels of a single row, without the padding, nil if y is past the last row.
+func (f *Framebuffer) Row(y uint32) []byte {
+	if y >= f.height {
+		return nil
+	}
+
+	start := uint64(f.dataOffset) + uint64(y)*uint64(f.stride)
+	return f.mem[start : start+uint64(f.width)*uint64(f.format.BytesPerPixel())]
+}
+
+// Sequence returns the number of the last published frame.
+func (f *Framebuffer) Sequence() uint64 {
+	return atomic.LoadUint64(f.sequencePtr())
+}
+
+// BeginFrame marks the pixel data as being written, Snapshot fails with ErrTornFrame until Publish or AbortFrame. A
+// producer writing the pixels in place calls it before touching them, calling it again before Publish does nothing.
+// A stale framebuffer is left alone, the counters belong to the new session.
+func (f *Framebuffer) BeginFrame() {
+	if f.Stale() {
+		return
+	}
+
+	if w := atomic.LoadUint64(f.writingPtr()); w%2 == 0 {
+		atomic.StoreUint64(f.writingPtr(), w+1)
+	}
+}
+
+// AbortFrame ends a BeginFrame which didn't change the pixel data, the last published frame stays valid.
+func (f *Framebuffer) AbortFrame() {
+	if f.Stale() {
+		return
+	}
+
+	if w := atomic.LoadUint64(f.writingPtr()); w%2 == 1 {
+		atomic.StoreUint64(f.writingPtr(), w+1)
+	}
+}
+
+// Publish marks the current pixel data as a complete frame and returns its sequence number. It ends the write begun by
+// BeginFrame. A stale framebuffer publishes nothing and returns zero.
+func (f *Framebuffer) Publish() uint64 {
+	if f.Stale() {
+		return 0
+	}
+
+	seq := atomic.AddUint64(f.sequencePtr(), 1)
+	f.AbortFrame()
+	return seq
+}
+
+// sequencePtr returns the pointer to the frame sequence counter.
+func (f *Framebuffer) sequencePtr() *uint64 {
+	return (*uint64)(unsafe.Pointer(&f.mem[offSequence]))
+}
+
+// writingPtr returns the pointer to the write counter, odd while a frame is being written.
+func (f *Framebuffer) writingPtr() *uint64 {
+	return (*uint64)(unsafe.Pointer(&f.mem[offWriting]))
+}
+
+// stride returns the aligned row size for the given width, Init makes sure it fits.
+func stride(width uint32, format Format) uint32 {
+	return uint32(stride64(width, format))
+}
+
+// stride64 returns the aligned row size for the given width without overflowing.
+func stride64(width uint32, format Format) uint64 {
+	row := uint64(width) * uint64(format.BytesPerPixel())
+	return (row + StrideAlignment - 1) &^ (StrideAlignment - 1)
+}
+
+// dataOffset returns the page aligned offset of the pixel data.
+func dataOffset() uint32 {
+	page := PageSize
+	if os.Getpagesize() > page {
+		page = os.Getpagesize()
+	}
+
+	return uint32((HeaderSize + page - 1) &^ (page - 1))
+}
@@ -0,0 +1,37 @@
+package framebuffer
+
+import "unsafe"
+
+// Texture describes the pixel data in the form expected by texture upload calls (glTexSubImage2D,
+// vkCmdCopyBufferToImage with VK_EXT_external_memory_host), so the renderer can read straight from shared memory.
+type Texture struct {
+	Ptr    unsafe.Pointer // Page aligned if the region itself is mapped at a page boundary
+	Size   int            // Size of the pixel data in bytes, a multiple of the row stride
+	Width  int
+	Height int
+	Stride int // Distance between rows in bytes, a multiple of StrideAlignment
+	Format Format
+}
+
+// RowLength returns the stride in pixels, as expected by GL_UNPACK_ROW_LENGTH and bufferRowLength.
+func (t Texture) RowLength() int {
+	return t.Stride / t.Format.BytesPerPixel()
+}
+
+// Texture returns the description of the pixel data for zero-copy uploads. The pointer stays valid until the region is unmapped.
+func (f *Framebuffer) Texture() Texture {
+	pixels := f.Pixels()
+	return Texture{
+		Ptr:    unsafe.Pointer(&pixels[0]),
+		Size:   len(pixels),
+		Width:  int(f.width),
+		Height: int(f.height),
+		Stride: int(f.stride),
+		Format: f.format,
+	}
+}
+
+// Flush makes sure the pixel data written by this side is visible to the other one, without syncing the whole region.
+func (f *Framebuffer) Flush() error {
+	return flushRange(f.Pixels())
+}
@@ -0,0 +1,59 @@
+package framebuffer
+
+import (
+	"errors"
+	"image"
+	"sync/atomic"
+)
+
+var ErrTornFrame = errors.New("frame changed while reading")
+
+// Snapshot copies the last published frame into an RGBA image and returns it with its sequence number. It follows the
+// seqlock protocol of BeginFrame: it returns ErrTornFrame if the producer was writing a frame when the copy started or
+// began or published one during it, the caller should just retry. It returns ErrStale once a peer initialized the
+// framebuffer again, the view must be reopened then.
+func (f *Framebuffer) Snapshot() (*image.RGBA, uint64, error) {
+	if err := f.stamp.Check(); err != nil {
+		return nil, 0, err
+	}
+
+	if f.strict {
+		if err := f.Verify(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	writing := atomic.LoadUint64(f.writingPtr())
+	if writing%2 == 1 {
+		return nil, 0, ErrTornFrame
+	}
+
+	seq := f.Sequence()
+	img := image.NewRGBA(image.Rect(0, 0, int(f.width), int(f.height)))
+	for y := uint32(0); y < f.height; y++ {
+		dst := img.Pix[int(y)*img.Stride:]
+		copy(dst, f.Row(y))
+		if f.format == FormatBGRA {
+			for x := 0; x < int(f.width)*4; x += 4 {
+				dst[x], dst[x+2] = dst[x+2], dst[x]
+			}
+		}
+	}
+
+	if f.Sequence() != seq || atomic.LoadUint64(f.writingPtr()) != writing {
+		return nil, 0, ErrTornFrame
+	}
+
+	// A peer initializing the framebuffer again resets the counters, the copy may belong to the new session
+	if err := f.stamp.Check(); err != nil {
+		return nil, 0, err
+	}
+
+	if f.strict {
+		if err := f.Verify(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return img, seq, nil
+}
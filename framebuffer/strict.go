@@ -0,0 +1,79 @@
+package framebuffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrProtocolViolation = errors.New("protocol violation")
+
+// ViolationError describes a header invariant broken by the peer.
+type ViolationError struct {
+	Field  string // Name of the offending header field
+	Offset int    // Offset of the field in the region
+	Detail string // What exactly went wrong
+}
+
+// Error returns the diagnostic message.
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("%s: header field %s at offset %d %s", ErrProtocolViolation, e.Field, e.Offset, e.Detail)
+}
+
+// Unwrap allows matching the error with ErrProtocolViolation.
+func (e *ViolationError) Unwrap() error {
+	return ErrProtocolViolation
+}
+
+// OpenStrict is like Open, but the framebuffer keeps verifying the header written by the peer. Snapshot returns
+// a *ViolationError instead of possibly corrupt pixels once the peer breaks the protocol.
+func OpenStrict(mem []byte) (*Framebuffer, error) {
+	fb, err := Open(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	fb.strict = true
+	fb.lastSequence = fb.Sequence()
+	return fb, nil
+}
+
+// Verify checks that the header still describes the frame seen when opening it and that the frame sequence never
+// goes backwards. It is not safe for concurrent use.
+func (f *Framebuffer) Verify() error {
+	fields := []struct {
+		name   string
+		offset int
+		want   uint32
+	}{
+		{"magic", offMagic, Magic},
+		{"version", offVersion, Version},
+		{"format", offFormat, uint32(f.format)},
+		{"width", offWidth, f.width},
+		{"height", offHeight, f.height},
+		{"stride", offStride, f.stride},
+		{"data offset", offDataOffset, f.dataOffset},
+	}
+
+	for _, field := range fields {
+		if got := binary.LittleEndian.Uint32(f.mem[field.offset:]); got != field.want {
+			return &ViolationError{
+				Field:  field.name,
+				Offset: field.offset,
+				Detail: fmt.Sprintf("changed from %d to %d after attach", field.want, got),
+			}
+		}
+	}
+
+	seq := f.Sequence()
+	if seq < f.lastSequence {
+		return &ViolationError{
+			Field:  "sequence",
+			Offset: offSequence,
+			Detail: fmt.Sprintf("went backwards from %d to %d", f.lastSequence, seq),
+		}
+	}
+
+	f.lastSequence = seq
+	return nil
+}
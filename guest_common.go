@@ -3,12 +3,27 @@ package ivshmem
 import (
 	"errors"
 	"fmt"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
 )
 
 var ErrCannotFindDevice = errors.New("cannot find device")
 var ErrAlreadyMapped = errors.New("already mapped")
 var ErrAlreadyUnmapped = errors.New("already unmapped")
 var ErrNotMapped = errors.New("not mapped yet")
+var ErrInvalidVector = errors.New("invalid interrupt vector")
+var ErrClosed = errors.New("closed")
+var ErrAccessDenied = errors.New("access denied")
+var ErrInvalidArgument = errors.New("invalid argument")
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+
+// DeviceInfo contains the details of an ivshmem device.
+type DeviceInfo struct {
+	Location   PCILocation
+	Profile    DeviceProfile
+	NUMANode   int // NUMA node the device is attached to, -1 if unknown
+	IOMMUGroup int // IOMMU group of the device, -1 if it isn't in any or it is unknown
+}
 
 // PCILocation contains info about the location of the device.
 type PCILocation struct {
@@ -36,3 +51,8 @@ func (p PCILocation) Device() uint8 {
 func (p PCILocation) Function() uint8 {
 	return p.function
 }
+
+// NewPCILocation returns the location of a device known from elsewhere, e.g. the VM configuration on the host.
+func NewPCILocation(bus, device, function uint8) PCILocation {
+	return PCILocation{bus: bus, device: device, function: function}
+}
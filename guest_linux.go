@@ -3,18 +3,28 @@
 package ivshmem
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
 
 const (
-	PCI_PATH       = "/sys/bus/pci/devices"
+	PCI_PATH = "/sys/bus/pci/devices"
+
+	// DEVICE_PATHS_ENV lists extra PCI device directories considered during discovery, separated by commas since the
+	// PCI addresses already contain colons.
+	DEVICE_PATHS_ENV = "IVSHMEM_DEVICE_PATHS"
+
+	// Deprecated: devices are matched using the registered profiles, see QEMUProfile.
 	IVSHMEM_VENDOR = "0x1af4" // Red Hat, Inc.
+	// Deprecated: devices are matched using the registered profiles, see QEMUProfile.
 	IVSHMEM_DEVICE = "0x1110" // Inter-VM shared memory
 )
 
@@ -27,7 +37,7 @@ func ListDevices() ([]PCILocation, error) {
 
 	result := make([]PCILocation, 0)
 	for _, dev := range devices {
-		loc, err := convertLocation(dev)
+		loc, err := convertLocation(dev.name)
 		if err != nil {
 			fmt.Println(err)
 			continue
@@ -99,61 +109,90 @@ func convertLocation(locationDescription string) (*PCILocation, error) {
 // Guest allows to map a shared memory region.
 type Guest struct {
 	loc       PCILocation
+	devDir    string
 	devPath   string
 	mapped    bool
+	closed    bool
 	sharedMem []byte
 	size      uint64
+	profile   DeviceProfile
+	regs      *registers // Mapped by MapRegisters, nil otherwise
+	irq       *uio
+	progress  *mapProgress // Set by MapGuest
 }
 
 // NewGuest returns a new Guest based on the PCI location.
 func NewGuest(location PCILocation) (*Guest, error) {
+	return newGuest(location, nil)
+}
+
+// newGuest returns a new Guest recording its progress.
+func newGuest(location PCILocation, progress *mapProgress) (*Guest, error) {
+	progress.enter(StepEnumerate, "list the PCI devices in sysfs")
+	dev, err := findDevice(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Guest{
+		loc:      location,
+		devDir:   dev.dir,
+		devPath:  devicePath(dev.dir, fmt.Sprintf("resource%d", dev.profile.MemoryBAR)),
+		profile:  dev.profile,
+		irq:      &uio{},
+		progress: progress,
+	}, nil
+}
+
+// findDevice returns the ivshmem device at the location.
+func findDevice(location PCILocation) (*pciDevice, error) {
 	devices, err := listIvshmemPCIRaw()
 	if err != nil {
 		return nil, fmt.Errorf("get raw devices: %w", err)
 	}
 
-	var found bool
-	var idx = -1
-	for i, dev := range devices {
-		loc, err := convertLocation(dev)
+	for _, dev := range devices {
+		loc, err := convertLocation(dev.name)
 		if err != nil {
 			return nil, fmt.Errorf("convert location: %w", err)
 		}
 
 		if *loc == location {
-			found = true
-			idx = i
+			return &dev, nil
 		}
 	}
 
-	if !found {
-		return nil, ErrCannotFindDevice
-	}
+	return nil, ErrCannotFindDevice
+}
 
-	path := fmt.Sprintf("%s/%s/%s", PCI_PATH, devices[idx], "resource2")
-	return &Guest{
-		loc:     location,
-		devPath: path,
-	}, nil
+// devicePath returns the path of a sysfs file of the PCI device.
+func devicePath(dir, file string) string {
+	return filepath.Join(dir, file)
 }
 
 // Map maps the memory into the program address space.
 func (g *Guest) Map() error {
+	if g.closed {
+		return ErrClosed
+	}
+
 	if g.mapped {
 		return ErrAlreadyMapped
 	}
 
+	g.progress.enter(StepOpen, "open "+g.devPath)
 	stat, err := os.Stat(g.devPath)
 	if err != nil {
-		return fmt.Errorf("get size: %w", err)
+		return fmt.Errorf("get size: %w", checkDenied("stat", g.devPath, err))
 	}
 
 	file, err := os.OpenFile(g.devPath, os.O_RDWR, 0o600)
 	if err != nil {
-		return fmt.Errorf("open device file: %w", err)
+		return fmt.Errorf("open device file: %w", checkDenied("open", g.devPath, err))
 	}
 	defer file.Close()
 
+	g.progress.enter(StepMmap, fmt.Sprintf("map %d bytes", stat.Size()))
 	sharedMem, err := unix.Mmap(int(file.Fd()), 0, int(stat.Size()), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
@@ -165,20 +204,91 @@ func (g *Guest) Map() error {
 	return nil
 }
 
-// Unmap unmaps the memory.
-func (g Guest) Unmap() error {
+// Unmap unmaps the memory and the registers and closes the uio device, the registers have to be mapped again by
+// MapRegisters before ringing the doorbell.
+func (g *Guest) Unmap() error {
 	if !g.mapped {
 		return ErrAlreadyUnmapped
 	}
 
+	var errs []error
 	if err := unix.Munmap(g.sharedMem); err != nil {
-		return fmt.Errorf("munmap: %w", err)
+		errs = append(errs, fmt.Errorf("munmap: %w", err))
+	}
+	g.mapped, g.sharedMem = false, nil
+
+	if g.regs != nil {
+		errs = append(errs, g.regs.unmap())
+		g.regs = nil
+	}
+
+	if err := g.irq.close(); err != nil {
+		errs = append(errs, fmt.Errorf("close uio device: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close unmaps the memory and the registers if they are mapped, and closes the uio device. The guest can't be mapped
+// again, closing it twice fails with ErrClosed.
+func (g *Guest) Close() error {
+	if g.closed {
+		return ErrClosed
+	}
+
+	g.closed = true
+	if g.mapped {
+		return g.Unmap()
+	}
+
+	var err error
+	if g.regs != nil {
+		err = g.regs.unmap()
+		g.regs = nil
 	}
 
-	g.mapped = false
+	return errors.Join(err, g.irq.close())
+}
+
+// MapRegisters also maps the register BAR (resource0) of the device, enabling RingDoorbell and IVPosition. Only the
+// ivshmem-doorbell device has a meaningful doorbell, on ivshmem-plain the registers exist but ring nobody.
+func (g *Guest) MapRegisters() error {
+	if g.closed {
+		return ErrClosed
+	}
+
+	if g.regs != nil {
+		return fmt.Errorf("registers: %w", ErrAlreadyMapped)
+	}
+
+	regs, err := mapRegisters(devicePath(g.devDir, "resource0"))
+	if err != nil {
+		return fmt.Errorf("map registers: %w", err)
+	}
+
+	g.regs = regs
 	return nil
 }
 
+// RingDoorbell interrupts the peer on the given MSI vector, the registers have to be mapped by MapRegisters.
+func (g *Guest) RingDoorbell(peerID, vector uint16) error {
+	if g.regs == nil {
+		return fmt.Errorf("registers: %w", ErrNotMapped)
+	}
+
+	g.regs.write(regDoorbell, uint32(peerID)<<16|uint32(vector))
+	return nil
+}
+
+// IVPosition returns the peer ID of this guest, the registers have to be mapped by MapRegisters.
+func (g *Guest) IVPosition() (uint16, error) {
+	if g.regs == nil {
+		return 0, fmt.Errorf("registers: %w", ErrNotMapped)
+	}
+
+	return uint16(g.regs.read(regIVPosition)), nil
+}
+
 // System returns the guest system type.
 func (g Guest) System() string {
 	return "Linux"
@@ -194,7 +304,12 @@ func (g Guest) DevPath() string {
 	return g.devPath
 }
 
-// SharedMem returns the shared memory region. Panics if the shared memory isn't mapped yet.
+// Mapped reports whether the shared memory is mapped.
+func (g Guest) Mapped() bool {
+	return g.mapped
+}
+
+// SharedMem returns the shared memory region. Panics if the shared memory isn't mapped yet or was unmapped.
 func (g Guest) SharedMem() []byte {
 	if !g.mapped {
 		panic("tried to access unmapped memory")
@@ -208,49 +323,218 @@ func (g Guest) Location() PCILocation {
 	return g.loc
 }
 
+// Profile returns the profile the device was discovered with.
+func (g Guest) Profile() DeviceProfile {
+	return g.profile
+}
+
+// Capabilities returns what the device and its driver binding provide: the registers if the device has a register
+// BAR, the doorbell once they are mapped by MapRegisters on a device with MSI vectors, and the interrupts if the
+// device is bound to a uio driver.
+func (g Guest) Capabilities() Capabilities {
+	var c Capabilities
+	if irqs, err := os.ReadDir(devicePath(g.devDir, "msi_irqs")); err == nil {
+		c.Vectors = len(irqs)
+	}
+
+	if _, err := os.Stat(devicePath(g.devDir, "resource0")); err == nil {
+		c.Features = append(c.Features, FeatureRegisters)
+	}
+
+	if g.regs != nil && c.Vectors > 0 {
+		c.Features = append(c.Features, FeatureDoorbell)
+	}
+
+	if matches, _ := filepath.Glob(devicePath(g.devDir, "uio/uio*")); len(matches) > 0 {
+		c.Features = append(c.Features, FeatureInterrupts)
+	}
+
+	return c
+}
+
 // Sync makes sure the changes made to the shared memory are synced.
 func (g Guest) Sync() error {
+	if !g.mapped {
+		return ErrNotMapped
+	}
+
 	return unix.Msync(g.sharedMem, unix.MS_SYNC)
 }
 
-// listIvshmemPCIRaw returns the ivshmem PCI names as seen in PCI_PATH.
-func listIvshmemPCIRaw() ([]string, error) {
-	entry, err := os.ReadDir(PCI_PATH)
-	if err != nil {
-		return nil, fmt.Errorf("read pci dir: %w", err)
+// Info returns the device details read from sysfs, so polling threads can be pinned near the device and VFIO users
+// can reason about the IOMMU group membership.
+func (g Guest) Info() (DeviceInfo, error) {
+	info := DeviceInfo{Location: g.loc, Profile: g.profile, NUMANode: -1, IOMMUGroup: -1}
+
+	data, err := os.ReadFile(devicePath(g.devDir, "numa_node"))
+	if err != nil && !os.IsNotExist(err) {
+		return info, fmt.Errorf("read numa node: %w", checkDenied("read", devicePath(g.devDir, "numa_node"), err))
 	}
 
-	devices := make([]string, 0)
-	for _, test := range entry {
-		if len(test.Name()) == 12 && len(strings.Split(test.Name(), ":")) == 3 {
-			devices = append(devices, test.Name())
+	if err == nil {
+		node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return info, fmt.Errorf("parse numa node: %w", err)
 		}
+
+		info.NUMANode = node
 	}
 
-	ivshmemDevices := make([]string, 0)
-	for _, dev := range devices {
-		data, err := os.ReadFile(fmt.Sprintf("%s/%s/%s", PCI_PATH, dev, "vendor"))
+	// iommu_group is a symlink to /sys/kernel/iommu_groups/<group>
+	target, err := os.Readlink(devicePath(g.devDir, "iommu_group"))
+	if err != nil && !os.IsNotExist(err) {
+		return info, fmt.Errorf("read iommu group: %w", checkDenied("readlink", devicePath(g.devDir, "iommu_group"), err))
+	}
+
+	if err == nil {
+		group, err := strconv.Atoi(filepath.Base(target))
 		if err != nil {
-			return nil, fmt.Errorf("vendor read: %w", err)
+			return info, fmt.Errorf("parse iommu group: %w", err)
+		}
+
+		info.IOMMUGroup = group
+	}
+
+	return info, nil
+}
+
+// pciDevice is an ivshmem device as seen in sysfs.
+type pciDevice struct {
+	name    string // PCI address, for example "0000:08:01.0"
+	dir     string // sysfs directory of the device
+	profile DeviceProfile
+}
+
+var (
+	devicePathsMu sync.Mutex
+	devicePaths   []string
+)
+
+// AddDevicePath makes discovery consider the PCI device directory, for example a bind mount of
+// /sys/bus/pci/devices/0000:08:01.0 inside a container where the rest of sysfs isn't visible. The directory (or the
+// symlink target) must be named after the PCI address. The paths in the IVSHMEM_DEVICE_PATHS environment variable
+// are considered as well.
+func AddDevicePath(dir string) {
+	devicePathsMu.Lock()
+	defer devicePathsMu.Unlock()
+	devicePaths = append(devicePaths, dir)
+}
+
+// extraDevicePaths returns the explicitly provided device directories.
+func extraDevicePaths() []string {
+	devicePathsMu.Lock()
+	defer devicePathsMu.Unlock()
+
+	paths := append([]string(nil), devicePaths...)
+	for _, path := range strings.Split(os.Getenv(DEVICE_PATHS_ENV), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// listIvshmemPCIRaw returns the PCI devices matching one of the registered profiles. It scans PCI_PATH, skipping
+// the devices whose ids can't be read, and then the explicitly provided device directories, skipping the ones which
+// can't be resolved unless no device was found at all.
+func listIvshmemPCIRaw() ([]pciDevice, error) {
+	extra := extraDevicePaths()
+	minimal := minimalAccess.Load()
+	if minimal && len(extra) == 0 {
+		return nil, fmt.Errorf("minimal access mode needs device paths, see AddDevicePath: %w", ErrCannotFindDevice)
+	}
+
+	var entry []os.DirEntry
+	if !minimal {
+		var err error
+		entry, err = os.ReadDir(PCI_PATH)
+		if err != nil && len(extra) == 0 {
+			return nil, fmt.Errorf("read pci dir: %w", checkDenied("list", PCI_PATH, err))
+		}
+	}
+
+	ivshmemDevices := make([]pciDevice, 0)
+	seen := make(map[string]bool)
+	for _, test := range entry {
+		if len(test.Name()) != 12 || len(strings.Split(test.Name(), ":")) != 3 {
+			continue
 		}
 
-		vendorName := strings.TrimSpace(string(data))
-		if vendorName != IVSHMEM_VENDOR {
+		dir := filepath.Join(PCI_PATH, test.Name())
+		profile, ok, err := identifyDevice(dir)
+		if err != nil || !ok {
 			continue
 		}
 
-		data, err = os.ReadFile(fmt.Sprintf("%s/%s/%s", PCI_PATH, dev, "device"))
+		seen[test.Name()] = true
+		ivshmemDevices = append(ivshmemDevices, pciDevice{name: test.Name(), dir: dir, profile: profile})
+	}
+
+	// One stale path mustn't hide the other devices, the errors only matter when nothing was found
+	var skipped []error
+	for _, dir := range extra {
+		resolved, err := filepath.EvalSymlinks(dir)
 		if err != nil {
-			return nil, fmt.Errorf("device read: %w", err)
+			skipped = append(skipped, fmt.Errorf("resolve device path: %w", err))
+			continue
 		}
 
-		deviceName := strings.TrimSpace(string(data))
-		if deviceName != IVSHMEM_DEVICE {
+		name := filepath.Base(resolved)
+		if seen[name] {
 			continue
 		}
 
-		ivshmemDevices = append(ivshmemDevices, dev)
+		// The user pointed us at the device, so unreadable ids only mean a restricted mount
+		profile, ok := QEMUProfile, true
+		if !minimal {
+			if p, matched, err := identifyDevice(dir); err == nil {
+				profile, ok = p, matched
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		seen[name] = true
+		ivshmemDevices = append(ivshmemDevices, pciDevice{name: name, dir: dir, profile: profile})
+	}
+
+	if len(ivshmemDevices) == 0 && len(skipped) != 0 {
+		return nil, errors.Join(skipped...)
 	}
 
 	return ivshmemDevices, nil
 }
+
+// identifyDevice reads the ids of the device in the directory and returns the matching profile.
+func identifyDevice(dir string) (DeviceProfile, bool, error) {
+	vendorID, err := readID(devicePath(dir, "vendor"))
+	if err != nil {
+		return DeviceProfile{}, false, fmt.Errorf("vendor read: %w", err)
+	}
+
+	deviceID, err := readID(devicePath(dir, "device"))
+	if err != nil {
+		return DeviceProfile{}, false, fmt.Errorf("device read: %w", err)
+	}
+
+	profile, ok := matchProfile(vendorID, deviceID)
+	return profile, ok, nil
+}
+
+// readID reads a hex PCI ID (for example "0x1af4") from a sysfs file.
+func readID(path string) (uint16, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("parse id: %w", err)
+	}
+
+	return uint16(id), nil
+}
@@ -17,29 +17,20 @@ import (
 
 var ErrInvalidHandle = errors.New("invalid handle")
 
-// CTL_CODE(FILE_DEVICE_UNKNOWN, 0x800 to 0x805, METHOD_BUFFERED, FILE_ANY_ACCESS).
-const (
-	ioctlIvshmemRequestPeerID = 2236416
-	ioctlIvshmemRequestSize   = 2236420
-	ioctlIvshmemRequestMmap   = 2236424
-	ioctlIvshmemReleaseMmap   = 2236428
-	ioctlIvshmemRingDoorbell  = 2236432
-	ioctlIvshmemRegisterEvent = 2236436
-)
-
 var (
-	ivshmemGUID                            = windows.GUID{Data1: 0xdf576976, Data2: 0x569d, Data3: 0x4672, Data4: [8]byte{0x95, 0xa0, 0xf5, 0x7e, 0x4e, 0xa0, 0xb2, 0x10}} // Allows us to find devices recognized by the ivshmem driver (df576976-569d-4672-95a0-f57e4ea0b210)
-	writeCombined                    uint8 = 2                                                                                                                             // cache mode for ioctlIvshmemRequestMmap
-	setupapi                               = &windows.LazyDLL{Name: "setupapi.dll", System: true}                                                                          // Since we're loading lazily, we need not worry about DDL panics
-	setupDiEnumDeviceInterfaces            = setupapi.NewProc("SetupDiEnumDeviceInterfaces")
-	setupDiGetDeviceInterfaceDetailW       = setupapi.NewProc("SetupDiGetDeviceInterfaceDetailW")
+	writeCombined                    = CacheWriteCombined                                   // Cache mode for IoctlRequestMmap
+	setupapi                         = &windows.LazyDLL{Name: "setupapi.dll", System: true} // Since we're loading lazily, we need not worry about DDL panics
+	setupDiEnumDeviceInterfaces      = setupapi.NewProc("SetupDiEnumDeviceInterfaces")
+	setupDiGetDeviceInterfaceDetailW = setupapi.NewProc("SetupDiGetDeviceInterfaceDetailW")
 )
 
 // deviceData is some basic device data, can be used to determine the device details.
 type deviceData struct {
-	loc     PCILocation
-	devInfo windows.DevInfoData
-	busAddr uint64
+	loc           PCILocation
+	devInfo       windows.DevInfoData
+	busAddr       uint64
+	driverVersion DriverVersion
+	profile       DeviceProfile
 }
 
 // SP_DEVICE_INTERFACE_DATA as used in SetupDiEnumDeviceInterfaces.
@@ -58,9 +49,15 @@ type ivshmemMmap struct {
 	vectors     uint16
 }
 
+// IVSHMEM_RING as used in IOCTL_IVSHMEM_RING_DOORBELL.
+type ivshmemRing struct {
+	peerID uint16
+	vector uint16
+}
+
 // ListDevices lists the available ivshmem devices by their locations.
 func ListDevices() ([]PCILocation, error) {
-	devInfoSet, err := windows.SetupDiGetClassDevsEx(&ivshmemGUID, "", 0, windows.DIGCF_PRESENT|windows.DIGCF_DEVICEINTERFACE, 0, "")
+	devInfoSet, err := windows.SetupDiGetClassDevsEx(&interfaceGUID, "", 0, windows.DIGCF_PRESENT|windows.DIGCF_DEVICEINTERFACE, 0, "")
 	if err != nil {
 		return nil, fmt.Errorf("device info set: %w", err)
 	}
@@ -83,16 +80,27 @@ func ListDevices() ([]PCILocation, error) {
 type Guest struct {
 	devPath   string
 	mapped    bool
+	closed    bool
 	sharedMem []byte
 	size      uint64
+	vectors   uint16
 
 	devHandle windows.Handle
 	devData   deviceData
+	events    *listeners
+	handle    *handleState
+	progress  *mapProgress // Set by MapGuest
 }
 
 // NewGuest returns a new memory mapper.
 func NewGuest(location PCILocation) (*Guest, error) {
-	devInfoSet, err := windows.SetupDiGetClassDevsEx(&ivshmemGUID, "", 0, windows.DIGCF_PRESENT|windows.DIGCF_DEVICEINTERFACE, 0, "")
+	return newGuest(location, nil)
+}
+
+// newGuest returns a new memory mapper recording its progress.
+func newGuest(location PCILocation, progress *mapProgress) (*Guest, error) {
+	progress.enter(StepEnumerate, "SetupDiGetClassDevsEx")
+	devInfoSet, err := windows.SetupDiGetClassDevsEx(&interfaceGUID, "", 0, windows.DIGCF_PRESENT|windows.DIGCF_DEVICEINTERFACE, 0, "")
 	if err != nil {
 		return nil, fmt.Errorf("device info set: %w", err)
 	}
@@ -116,29 +124,43 @@ func NewGuest(location PCILocation) (*Guest, error) {
 		return nil, ErrCannotFindDevice
 	}
 
+	progress.enter(StepOpen, "open the device interface")
 	handle, path, err := establishHandle(devInfoSet, ivshmemDevices[idx])
 	if err != nil {
 		return nil, fmt.Errorf("establish handle: %w", err)
 	}
 
-	return &Guest{devHandle: *handle, devPath: path, devData: ivshmemDevices[idx]}, nil
+	return &Guest{
+		devHandle: *handle,
+		devPath:   path,
+		devData:   ivshmemDevices[idx],
+		events:    &listeners{},
+		handle:    &handleState{},
+		progress:  progress,
+	}, nil
 }
 
 // Map maps the memory into the program address space.
 func (g *Guest) Map() error {
+	if g.closed || g.handle.released() {
+		return ErrClosed
+	}
+
 	if g.mapped {
 		return ErrAlreadyMapped
 	}
 
+	g.progress.enter(StepIoctl, "IOCTL_IVSHMEM_REQUEST_SIZE")
 	var ivshmemSize uint64
-	err := windows.DeviceIoControl(g.devHandle, ioctlIvshmemRequestSize, nil, 0,
+	err := windows.DeviceIoControl(g.devHandle, IoctlRequestSize, nil, 0,
 		(*byte)(unsafe.Pointer(&ivshmemSize)), uint32(unsafe.Sizeof(ivshmemSize)), nil, nil)
 	if err != nil {
 		return fmt.Errorf("get ivshmem size: %w", err)
 	}
 
+	g.progress.enter(StepIoctl, "IOCTL_IVSHMEM_REQUEST_MMAP")
 	memMap := ivshmemMmap{}
-	err = windows.DeviceIoControl(g.devHandle, ioctlIvshmemRequestMmap, (*byte)(unsafe.Pointer(&writeCombined)),
+	err = windows.DeviceIoControl(g.devHandle, IoctlRequestMmap, (*byte)(unsafe.Pointer(&writeCombined)),
 		uint32(unsafe.Sizeof(writeCombined)), (*byte)(unsafe.Pointer(&memMap)), uint32(unsafe.Sizeof(memMap)), nil, nil)
 	if err != nil {
 		return fmt.Errorf("map ivshmem: %w", err)
@@ -146,30 +168,90 @@ func (g *Guest) Map() error {
 
 	g.sharedMem = unsafe.Slice((*byte)(memMap.ptr), ivshmemSize)
 	g.size = ivshmemSize
+	g.vectors = memMap.vectors
 	g.mapped = true
 	return nil
 }
 
-// Unmap unmaps the memory and releases the device handles.
-func (g Guest) Unmap() error {
+// Unmap unmaps the memory, closes the listener channels and releases the device handles. The guest can't be mapped
+// again, the handle is gone.
+func (g *Guest) Unmap() error {
 	if !g.mapped {
 		return ErrAlreadyUnmapped
 	}
 
-	err := windows.DeviceIoControl(g.devHandle, ioctlIvshmemReleaseMmap, nil, 0, nil, 0, nil, nil)
-	if err != nil {
-		return fmt.Errorf("release ivshmem: %w", err)
+	g.mapped, g.sharedMem = false, nil
+	var errs []error
+	if err := g.events.close(); err != nil {
+		errs = append(errs, err)
 	}
 
-	err = windows.CloseHandle(g.devHandle)
+	err := g.handle.use(func() error {
+		return windows.DeviceIoControl(g.devHandle, IoctlReleaseMmap, nil, 0, nil, 0, nil, nil)
+	})
 	if err != nil {
+		errs = append(errs, fmt.Errorf("release ivshmem: %w", err))
+	}
+
+	if err := g.handle.close(g.devHandle); err != nil {
+		errs = append(errs, fmt.Errorf("close handle: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close unmaps the memory if it is mapped and releases the device handle. Closing it twice fails with ErrClosed.
+func (g *Guest) Close() error {
+	if g.closed {
+		return ErrClosed
+	}
+
+	g.closed = true
+	if g.mapped {
+		return g.Unmap()
+	}
+
+	// A no-op if Unmap released the handle already
+	if err := g.handle.close(g.devHandle); err != nil {
 		return fmt.Errorf("close handle: %w", err)
 	}
 
-	g.mapped = false
 	return nil
 }
 
+// RingDoorbell interrupts the peer on the given MSI vector, the memory has to be mapped by this guest.
+func (g Guest) RingDoorbell(peerID, vector uint16) error {
+	if !g.mapped {
+		return ErrNotMapped
+	}
+
+	ring := ivshmemRing{peerID: peerID, vector: vector}
+	err := g.handle.use(func() error {
+		return windows.DeviceIoControl(g.devHandle, IoctlRingDoorbell, (*byte)(unsafe.Pointer(&ring)),
+			uint32(unsafe.Sizeof(ring)), nil, 0, nil, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("ring doorbell: %w", err)
+	}
+
+	return nil
+}
+
+// PeerID returns the peer number of this guest, which other peers use to ring its doorbell. It is zero unless the
+// device is a doorbell device connected to ivshmem-server.
+func (g Guest) PeerID() (uint16, error) {
+	var peerID uint16
+	err := g.handle.use(func() error {
+		return windows.DeviceIoControl(g.devHandle, IoctlRequestPeerID, nil, 0,
+			(*byte)(unsafe.Pointer(&peerID)), uint32(unsafe.Sizeof(peerID)), nil, nil)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("get peer id: %w", err)
+	}
+
+	return peerID, nil
+}
+
 // System returns the guest system type.
 func (g Guest) System() string {
 	return "Windows"
@@ -180,12 +262,22 @@ func (g Guest) Size() uint64 {
 	return g.size
 }
 
+// Vectors returns the number of MSI-X vectors of the device, which can be listened to once the memory is mapped.
+func (g Guest) Vectors() uint16 {
+	return g.vectors
+}
+
 // DevPath returns the device path.
 func (g Guest) DevPath() string {
 	return g.devPath
 }
 
-// SharedMem returns the shared memory region. Panics if the shared memory isn't mapped yet.
+// Mapped reports whether the shared memory is mapped.
+func (g Guest) Mapped() bool {
+	return g.mapped
+}
+
+// SharedMem returns the shared memory region. Panics if the shared memory isn't mapped yet or was unmapped.
 func (g Guest) SharedMem() []byte {
 	if !g.mapped {
 		panic("tried to access unmapped memory")
@@ -199,9 +291,38 @@ func (g Guest) Location() PCILocation {
 	return g.devData.loc
 }
 
+// Info returns the device details. The NUMA node and IOMMU group are not exposed by the driver and always unknown.
+func (g Guest) Info() (DeviceInfo, error) {
+	return DeviceInfo{Location: g.devData.loc, Profile: g.devData.profile, NUMANode: -1, IOMMUGroup: -1}, nil
+}
+
+// Profile returns the profile the device was validated with.
+func (g Guest) Profile() DeviceProfile {
+	return g.devData.profile
+}
+
+// Capabilities returns what the driver and the device provide. The vectors are reported by the driver when mapping,
+// so before Map only the cache modes and the page statistics are known.
+func (g Guest) Capabilities() Capabilities {
+	c := Capabilities{Features: []Feature{FeatureCacheModes, FeaturePageStats}, Vectors: int(g.vectors)}
+	if !g.mapped || g.vectors == 0 {
+		return c
+	}
+
+	// Drivers refusing the vectored event registration only show when Listen tries it
+	c.Features = append(c.Features, FeatureDoorbell, FeatureInterrupts)
+	return c
+}
+
 // Sync makes sure the changes made to the shared memory are synced.
 func (g Guest) Sync() error {
-	return windows.Fsync(g.devHandle)
+	if !g.mapped {
+		return ErrNotMapped
+	}
+
+	return g.handle.use(func() error {
+		return windows.Fsync(g.devHandle)
+	})
 }
 
 // setupDiCall is a helper function to call SetupDi* functions.
@@ -253,10 +374,32 @@ func getIvshmemDevices(devInfoSet windows.DevInfo) ([]deviceData, error) {
 			return nil, fmt.Errorf("convert location: %w", err)
 		}
 
+		// Devices bound to the driver which don't match a registered profile are skipped, an unreadable
+		// hardware id is not a reason to lose the device though
+		profile := QEMUProfile
+		if hardwareIDs, err := windows.SetupDiGetDeviceRegistryProperty(devInfoSet, devInfoData, windows.SPDRP_HARDWAREID); err == nil {
+			if ids, ok := hardwareIDs.([]string); ok && len(ids) > 0 {
+				if vendorID, deviceID, ok := parseHardwareID(ids[0]); ok {
+					if profile, ok = matchProfile(vendorID, deviceID); !ok {
+						devIndex++
+						continue
+					}
+				}
+			}
+		}
+
+		// The version is only used to explain missing features, so a failed lookup is not fatal
+		var driverVersion DriverVersion
+		if driverKey, err := windows.SetupDiGetDeviceRegistryProperty(devInfoSet, devInfoData, windows.SPDRP_DRIVER); err == nil {
+			driverVersion, _ = queryDriverVersion(driverKey.(string))
+		}
+
 		devInfoDatas = append(devInfoDatas, deviceData{
-			loc:     *location,
-			busAddr: uint64(busNumberRaw.(uint32))<<32 | uint64(busAddressRaw.(uint32)),
-			devInfo: *devInfoData,
+			loc:           *location,
+			busAddr:       uint64(busNumberRaw.(uint32))<<32 | uint64(busAddressRaw.(uint32)),
+			devInfo:       *devInfoData,
+			driverVersion: driverVersion,
+			profile:       profile,
 		})
 
 		devIndex++
@@ -273,7 +416,7 @@ func establishHandle(devInfoSet windows.DevInfo, device deviceData) (*windows.Ha
 	devInterfaceData.cbSize = uint32(unsafe.Sizeof(devInterfaceData))
 	errno := setupDiCall(
 		setupDiEnumDeviceInterfaces, uintptr(devInfoSet), uintptr(unsafe.Pointer(&device.devInfo)),
-		uintptr(unsafe.Pointer(&ivshmemGUID)), 0, uintptr(unsafe.Pointer(&devInterfaceData)),
+		uintptr(unsafe.Pointer(&interfaceGUID)), 0, uintptr(unsafe.Pointer(&devInterfaceData)),
 	)
 
 	if errno != 0 {
@@ -315,6 +458,10 @@ func establishHandle(devInfoSet windows.DevInfo, device deviceData) (*windows.Ha
 		devicePath, windows.GENERIC_READ|windows.GENERIC_WRITE, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
 		nil, windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0,
 	)
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return nil, "", fmt.Errorf("%w: this account can't open the device, run GrantDeviceAccess for it once as an administrator: %w", ErrAccessDenied, err)
+	}
+
 	if err != nil {
 		return nil, "", fmt.Errorf("create file: %w", err)
 	}
@@ -343,6 +490,24 @@ func utf16PtrToString(ptr *uint16) string {
 	return windows.UTF16ToString(unsafe.Slice(ptr, length))
 }
 
+// parseHardwareID extracts the vendor and device IDs from a PCI hardware id, for example "PCI\VEN_1AF4&DEV_1110&SUBSYS_11001AF4&REV_01".
+func parseHardwareID(hardwareID string) (uint16, uint16, bool) {
+	var vendorID, deviceID uint64
+	var vendorOK, deviceOK bool
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(hardwareID), `PCI\`), "&") {
+		var err error
+		if hex, found := strings.CutPrefix(part, "VEN_"); found {
+			vendorID, err = strconv.ParseUint(hex, 16, 16)
+			vendorOK = err == nil
+		} else if hex, found := strings.CutPrefix(part, "DEV_"); found {
+			deviceID, err = strconv.ParseUint(hex, 16, 16)
+			deviceOK = err == nil
+		}
+	}
+
+	return uint16(vendorID), uint16(deviceID), vendorOK && deviceOK
+}
+
 // convertLocation converts the location description as given by SetupDiGetDeviceRegistryProperty to a PCILocation. Expected format: "PCI bus 4, device 1, function 0".
 func convertLocation(windowsLocation string) (*PCILocation, error) {
 	parts := strings.Fields(windowsLocation)
@@ -0,0 +1,197 @@
+// Package health exposes the state of the shared memory links of a host daemon over HTTP, so it plugs into existing
+// monitoring (Kubernetes probes, load balancers, Prometheus blackbox checks) with one line:
+//
+//	http.Handle("/healthz", checker)
+//
+// The handler answers with a JSON report, with status 200 while every region is mapped and every peer alive and 503
+// otherwise.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// DefaultPeerTimeout is how long a peer may stay silent before it is reported dead.
+const DefaultPeerTimeout = 10 * time.Second
+
+// Report is the state of every link registered with a checker.
+type Report struct {
+	Healthy  bool            `json:"healthy"`
+	Regions  []RegionStatus  `json:"regions"`
+	Peers    []PeerStatus    `json:"peers"`
+	Channels []ChannelStatus `json:"channels"`
+}
+
+// RegionStatus is the state of a shared memory region.
+type RegionStatus struct {
+	Name   string `json:"name"`
+	Mapped bool   `json:"mapped"`
+	Size   uint64 `json:"size"`
+}
+
+// PeerStatus is the liveness of a peer, judged by the last time it was heard from.
+type PeerStatus struct {
+	Name     string    `json:"name"`
+	Alive    bool      `json:"alive"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ChannelStats are the counters of a channel over the region, in the unit of the channel, bytes for a ring.
+type ChannelStats struct {
+	Sent     uint64 `json:"sent"`     // Written into the channel since it was initialized
+	Received uint64 `json:"received"` // Read out of the channel since it was initialized
+	Pending  int    `json:"pending"`  // Bytes or messages waiting to be read
+	Capacity int    `json:"capacity"` // Zero if unbounded or unknown
+}
+
+// ChannelStatus are the counters of a named channel.
+type ChannelStatus struct {
+	Name string `json:"name"`
+	ChannelStats
+}
+
+// Options customize a checker.
+type Options struct {
+	// PeerTimeout is how long a peer may stay silent before it is reported dead, DefaultPeerTimeout by default.
+	PeerTimeout time.Duration
+}
+
+// Checker collects the state of the registered regions, peers and channels. It is an http.Handler.
+type Checker struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	regions  map[string]ivshmem.Region
+	peers    map[string]func() time.Time
+	channels map[string]func() ChannelStats
+}
+
+// New creates a checker with nothing registered, which reports healthy.
+func New(opts Options) *Checker {
+	if opts.PeerTimeout <= 0 {
+		opts.PeerTimeout = DefaultPeerTimeout
+	}
+
+	return &Checker{
+		timeout:  opts.PeerTimeout,
+		regions:  make(map[string]ivshmem.Region),
+		peers:    make(map[string]func() time.Time),
+		channels: make(map[string]func() ChannelStats),
+	}
+}
+
+// AddRegion reports the region as mapped until it is closed.
+func (c *Checker) AddRegion(name string, r ivshmem.Region) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.regions[name] = r
+}
+
+// AddPeer reports the peer as alive while lastSeen is recent, like the LastHeartbeat method of an agent. lastSeen is
+// called for every report, without the checker locked.
+func (c *Checker) AddPeer(name string, lastSeen func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[name] = lastSeen
+}
+
+// AddChannel reports the counters of the channel, stats is called for every report, without the checker locked.
+func (c *Checker) AddChannel(name string, stats func() ChannelStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channels[name] = stats
+}
+
+// RingStats returns the stats of a ring for AddChannel: the bytes written and read through it, message headers
+// included, the bytes waiting in it and its capacity.
+func RingStats(r *ring.Ring) func() ChannelStats {
+	return func() ChannelStats {
+		// The consumer may move between the loads, read it first so the pending bytes never come out negative
+		received := r.Consumed()
+		sent := r.Produced()
+		return ChannelStats{Sent: sent, Received: received, Pending: int(sent - received), Capacity: r.Capacity()}
+	}
+}
+
+// Remove unregisters the regions, peers and channels with the given name.
+func (c *Checker) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.regions, name)
+	delete(c.peers, name)
+	delete(c.channels, name)
+}
+
+// Report returns the current state, sorted by name.
+func (c *Checker) Report() Report {
+	// The callbacks run unlocked, a slow one must not block the registrations and the other reports
+	c.mu.Lock()
+	regions := make(map[string]ivshmem.Region, len(c.regions))
+	for name, r := range c.regions {
+		regions[name] = r
+	}
+
+	peers := make(map[string]func() time.Time, len(c.peers))
+	for name, lastSeen := range c.peers {
+		peers[name] = lastSeen
+	}
+
+	channels := make(map[string]func() ChannelStats, len(c.channels))
+	for name, stats := range c.channels {
+		channels[name] = stats
+	}
+	c.mu.Unlock()
+
+	now := time.Now()
+	report := Report{
+		Healthy:  true,
+		Regions:  make([]RegionStatus, 0, len(regions)),
+		Peers:    make([]PeerStatus, 0, len(peers)),
+		Channels: make([]ChannelStatus, 0, len(channels)),
+	}
+
+	for name, r := range regions {
+		status := RegionStatus{Name: name, Mapped: r.Bytes() != nil, Size: r.Size()}
+		report.Healthy = report.Healthy && status.Mapped
+		report.Regions = append(report.Regions, status)
+	}
+
+	for name, lastSeen := range peers {
+		seen := lastSeen()
+		status := PeerStatus{Name: name, LastSeen: seen, Alive: !seen.IsZero() && now.Sub(seen) <= c.timeout}
+		report.Healthy = report.Healthy && status.Alive
+		report.Peers = append(report.Peers, status)
+	}
+
+	for name, stats := range channels {
+		report.Channels = append(report.Channels, ChannelStatus{Name: name, ChannelStats: stats()})
+	}
+
+	sort.Slice(report.Regions, func(i, j int) bool { return report.Regions[i].Name < report.Regions[j].Name })
+	sort.Slice(report.Peers, func(i, j int) bool { return report.Peers[i].Name < report.Peers[j].Name })
+	sort.Slice(report.Channels, func(i, j int) bool { return report.Channels[i].Name < report.Channels[j].Name })
+	return report
+}
+
+// ServeHTTP writes the report as JSON, with status 503 if it isn't healthy.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := c.Report()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,246 @@
+// Package heatmap samples the offsets an application reads and writes in the shared memory region and turns them
+// into heatmaps, which show the hot structures worth moving to dedicated cache lines or pages. It only sees the
+// accesses it is told about, so it is meant for tuning sessions rather than production builds.
+package heatmap
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrOutOfBounds = errors.New("access out of bounds")
+
+const (
+	CacheLine = 64   // Granularity separating false sharing between cache lines
+	Page      = 4096 // Granularity for placing structures on dedicated pages
+)
+
+// Recorder counts the sampled accesses per bucket of the region, it is safe for concurrent use.
+type Recorder struct {
+	size        uint64
+	granularity uint64
+	every       uint64
+	seen        atomic.Uint64
+	reads       []atomic.Uint64
+	writes      []atomic.Uint64
+}
+
+// NewRecorder returns a recorder for a region of the given size, counting in buckets of granularity bytes. Only every
+// n-th access is recorded to keep the overhead low, 1 records all of them.
+func NewRecorder(size, granularity, every uint64) *Recorder {
+	if granularity == 0 {
+		granularity = CacheLine
+	}
+
+	if every == 0 {
+		every = 1
+	}
+
+	buckets := (size + granularity - 1) / granularity
+	return &Recorder{
+		size:        size,
+		granularity: granularity,
+		every:       every,
+		reads:       make([]atomic.Uint64, buckets),
+		writes:      make([]atomic.Uint64, buckets),
+	}
+}
+
+// RecordRead records a read of n bytes at the offset.
+func (r *Recorder) RecordRead(off, n uint64) {
+	r.record(r.reads, off, n)
+}
+
+// RecordWrite records a write of n bytes at the offset.
+func (r *Recorder) RecordWrite(off, n uint64) {
+	r.record(r.writes, off, n)
+}
+
+// Memory returns a view of the region which records every access made through it.
+func (r *Recorder) Memory(mem []byte) *Memory {
+	return &Memory{mem: mem, rec: r}
+}
+
+// Snapshot returns the counts recorded so far.
+func (r *Recorder) Snapshot() Heatmap {
+	h := Heatmap{Granularity: r.granularity, Reads: make([]uint64, len(r.reads)), Writes: make([]uint64, len(r.writes))}
+	for i := range r.reads {
+		h.Reads[i] = r.reads[i].Load()
+		h.Writes[i] = r.writes[i].Load()
+	}
+
+	return h
+}
+
+// Reset clears the counts.
+func (r *Recorder) Reset() {
+	for i := range r.reads {
+		r.reads[i].Store(0)
+		r.writes[i].Store(0)
+	}
+}
+
+// record counts the access in every bucket it touches, if it is sampled.
+func (r *Recorder) record(counts []atomic.Uint64, off, n uint64) {
+	if r.every > 1 && r.seen.Add(1)%r.every != 0 {
+		return
+	}
+
+	if n == 0 || off >= r.size {
+		return
+	}
+
+	end := off + n
+	if end > r.size || end < off {
+		end = r.size
+	}
+
+	for b := off / r.granularity; b <= (end-1)/r.granularity; b++ {
+		counts[b].Add(1)
+	}
+}
+
+// Memory records the accesses made through its ReadAt and WriteAt methods.
+type Memory struct {
+	mem []byte
+	rec *Recorder
+}
+
+// ReadAt implements io.ReaderAt.
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.mem)) {
+		return 0, fmt.Errorf("%w: offset %d", ErrOutOfBounds, off)
+	}
+
+	n := copy(p, m.mem[off:])
+	m.rec.RecordRead(uint64(off), uint64(n))
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m.mem)) {
+		return 0, fmt.Errorf("%w: %d bytes at offset %d", ErrOutOfBounds, len(p), off)
+	}
+
+	n := copy(m.mem[off:], p)
+	m.rec.RecordWrite(uint64(off), uint64(n))
+	return n, nil
+}
+
+// Heatmap holds the access counts per bucket.
+type Heatmap struct {
+	Granularity uint64
+	Reads       []uint64
+	Writes      []uint64
+}
+
+// Bucket is a single bucket of a heatmap.
+type Bucket struct {
+	Offset uint64
+	Reads  uint64
+	Writes uint64
+}
+
+// Hottest returns up to n buckets with the most accesses, the most accessed first. It returns nil for n below one.
+func (h Heatmap) Hottest(n int) []Bucket {
+	if n <= 0 {
+		return nil
+	}
+
+	var buckets []Bucket
+	for i := range h.Reads {
+		if h.Reads[i]+h.Writes[i] > 0 {
+			buckets = append(buckets, Bucket{Offset: uint64(i) * h.Granularity, Reads: h.Reads[i], Writes: h.Writes[i]})
+		}
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].Reads+buckets[i].Writes > buckets[j].Reads+buckets[j].Writes
+	})
+
+	if len(buckets) > n {
+		buckets = buckets[:n]
+	}
+
+	return buckets
+}
+
+// WriteCSV writes the non-empty buckets as offset,reads,writes rows, for plotting elsewhere.
+func (h Heatmap) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"offset", "reads", "writes"}); err != nil {
+		return err
+	}
+
+	for i := range h.Reads {
+		if h.Reads[i]+h.Writes[i] == 0 {
+			continue
+		}
+
+		row := []string{
+			strconv.FormatUint(uint64(i)*h.Granularity, 10),
+			strconv.FormatUint(h.Reads[i], 10),
+			strconv.FormatUint(h.Writes[i], 10),
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// shades maps the relative heat of a bucket to a character.
+const shades = " .:-=+*#%@"
+
+// WriteText draws the heatmap as text, width buckets per line. Hot buckets which are both read and written are marked
+// with a W, they are the first candidates for a cache line of their own.
+func (h Heatmap) WriteText(w io.Writer, width int) error {
+	if width <= 0 {
+		width = 64
+	}
+
+	var max uint64
+	for i := range h.Reads {
+		if total := h.Reads[i] + h.Writes[i]; total > max {
+			max = total
+		}
+	}
+
+	var b strings.Builder
+	for i := range h.Reads {
+		if i%width == 0 {
+			if i > 0 {
+				b.WriteByte('\n')
+			}
+			fmt.Fprintf(&b, "%#010x ", uint64(i)*h.Granularity)
+		}
+
+		total := h.Reads[i] + h.Writes[i]
+		switch {
+		case total == 0:
+			b.WriteByte(shades[0])
+		case h.Reads[i] > 0 && h.Writes[i] > 0 && total*2 > max:
+			b.WriteByte('W')
+		default:
+			b.WriteByte(shades[1+(total*uint64(len(shades)-2))/max])
+		}
+	}
+	b.WriteByte('\n')
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -3,18 +3,24 @@
 package ivshmem
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"golang.org/x/sys/unix"
 )
 
+var ErrNoDoorbell = errors.New("no doorbell attached")
+var ErrServerMismatch = errors.New("the server shares another memory file")
+
 // Host represents the host machine, it maps the shared memory.
 type Host struct {
 	shmPath   string
 	sharedMem []byte
 	size      uint64
 	mapped    bool
+	closed    bool
+	doorbell  *Client // Set by AttachServer
 }
 
 // NewHost creates a new host mapper.
@@ -28,6 +34,14 @@ func NewHost(shmPath string) (*Host, error) {
 
 // Map maps the shared memory into the program memory space.
 func (h *Host) Map() error {
+	if h.closed {
+		return ErrClosed
+	}
+
+	if h.mapped {
+		return ErrAlreadyMapped
+	}
+
 	file, err := os.OpenFile(h.shmPath, os.O_RDWR, 0o600)
 	if err != nil {
 		return fmt.Errorf("open device file: %w", err)
@@ -52,15 +66,106 @@ func (h *Host) Map() error {
 	return nil
 }
 
-// Unmap unmaps the shared memory.
-func (h Host) Unmap() error {
+// Unmap unmaps the shared memory and detaches from the ivshmem-server.
+func (h *Host) Unmap() error {
+	if !h.mapped {
+		return ErrAlreadyUnmapped
+	}
+
+	var errs []error
 	if err := unix.Munmap(h.sharedMem); err != nil {
-		return fmt.Errorf("munmap: %w", err)
+		errs = append(errs, fmt.Errorf("munmap: %w", err))
+	}
+	h.mapped, h.sharedMem = false, nil
+
+	if h.doorbell != nil {
+		if err := h.doorbell.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("detach from server: %w", err))
+		}
+		h.doorbell = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close unmaps the shared memory if it is mapped and detaches from the ivshmem-server. The host can't be mapped
+// again, closing it twice fails with ErrClosed.
+func (h *Host) Close() error {
+	if h.closed {
+		return ErrClosed
+	}
+
+	h.closed = true
+	if h.mapped {
+		return h.Unmap()
+	}
+
+	if h.doorbell != nil {
+		err := h.doorbell.Close()
+		h.doorbell = nil
+		return err
 	}
 
 	return nil
 }
 
+// AttachServer joins the ivshmem-server serving the shared memory file as a peer, which gives the host a doorbell:
+// Notify and Listen then go through the eventfds handed out by the server. It fails with ErrServerMismatch when the
+// memory the server hands out isn't the file of the host, the doorbells would then ring the peers of another region.
+func (h *Host) AttachServer(socketPath string) error {
+	if h.doorbell != nil {
+		return fmt.Errorf("doorbell: %w", ErrAlreadyMapped)
+	}
+
+	c, err := NewClient(socketPath)
+	if err != nil {
+		return err
+	}
+
+	if err := c.sameFile(h.shmPath); err != nil {
+		return errors.Join(err, c.Close())
+	}
+
+	h.doorbell = c
+	return nil
+}
+
+// PeerID returns the peer ID the ivshmem-server gave this host.
+func (h Host) PeerID() (uint16, error) {
+	if h.doorbell == nil {
+		return 0, ErrNoDoorbell
+	}
+
+	return h.doorbell.ID(), nil
+}
+
+// Notify rings the doorbell of the peer on the given vector, by writing its eventfd.
+func (h Host) Notify(peer, vector uint16) error {
+	if h.doorbell == nil {
+		return ErrNoDoorbell
+	}
+
+	return h.doorbell.Notify(peer, vector)
+}
+
+// Listen returns a channel receiving the interrupts on the vector, read from the eventfd of this host.
+func (h Host) Listen(vector uint16) (<-chan struct{}, error) {
+	if h.doorbell == nil {
+		return nil, ErrNoDoorbell
+	}
+
+	return h.doorbell.Listen(vector)
+}
+
+// Capabilities returns the doorbell and the interrupts once the host is attached to an ivshmem-server, nothing before.
+func (h Host) Capabilities() Capabilities {
+	if h.doorbell == nil {
+		return Capabilities{}
+	}
+
+	return h.doorbell.Capabilities()
+}
+
 // Size returns the size of the shared memory space.
 func (h Host) Size() uint64 {
 	return h.size
@@ -71,7 +176,12 @@ func (h Host) DevPath() string {
 	return h.shmPath
 }
 
-// SharedMem returns the already mapped shared memory, panics if Map() didn't succeed.
+// Mapped reports whether the shared memory is mapped.
+func (h Host) Mapped() bool {
+	return h.mapped
+}
+
+// SharedMem returns the already mapped shared memory, panics if Map() didn't succeed or the memory was unmapped.
 func (h Host) SharedMem() []byte {
 	if !h.mapped {
 		panic("tried to access non-mapped memory")
@@ -82,5 +192,9 @@ func (h Host) SharedMem() []byte {
 
 // Sync makes sure the changes made to the shared memory are synced.
 func (h Host) Sync() error {
+	if !h.mapped {
+		return ErrNotMapped
+	}
+
 	return unix.Msync(h.sharedMem, unix.MS_SYNC)
 }
@@ -0,0 +1,290 @@
+// Package input relays keyboard and mouse events across the shared memory region, for remote control: a host tool
+// injects events into a guest agent which replays them, or a guest agent captures them for the host. The events are
+// fixed size records carried in the slots of a ring.Queue, so any number of goroutines on either side can send and
+// receive them.
+//
+// Event layout, all the values are little endian:
+//
+//	 0 type (uint8)
+//	 1 flags (uint8)
+//	 2 code: the key or the button (uint16)
+//	 4 value: 1 pressed, 0 released (int32)
+//	 8 x: the relative motion, the absolute position or the horizontal wheel (int32)
+//	12 y: the relative motion, the absolute position or the vertical wheel (int32)
+//	16 time in unix nanoseconds (int64)
+//
+// Key codes are the Linux evdev ones (KEY_A is 30), which every platform has a table for. Absolute positions are
+// scaled to 0 to AbsoluteMax on both axes, like a USB tablet, so they don't depend on the resolution of either side.
+// Wheel movement is in detents.
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+var ErrInvalidEvent = errors.New("invalid event")
+
+const (
+	// EventSize is the size of an encoded event.
+	EventSize = 24
+
+	// AbsoluteMax is the largest absolute coordinate, the right or bottom edge of the screen.
+	AbsoluteMax = 32767
+)
+
+// Event field offsets.
+const (
+	evType  = 0
+	evFlags = 1
+	evCode  = 2
+	evValue = 4
+	evX     = 8
+	evY     = 12
+	evTime  = 16
+)
+
+// Type is the kind of an event.
+type Type uint8
+
+const (
+	TypeKey      Type = iota + 1 // A key pressed or released, Code and Value
+	TypeButton                   // A mouse button pressed or released, Code and Value
+	TypeMotion                   // Relative mouse motion, X and Y
+	TypeAbsolute                 // Absolute pointer position, X and Y
+	TypeWheel                    // Wheel movement, X and Y
+)
+
+// String returns the name of the type.
+func (t Type) String() string {
+	switch t {
+	case TypeKey:
+		return "key"
+	case TypeButton:
+		return "button"
+	case TypeMotion:
+		return "motion"
+	case TypeAbsolute:
+		return "absolute"
+	case TypeWheel:
+		return "wheel"
+	default:
+		return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+}
+
+// Mouse buttons, the codes of TypeButton events.
+const (
+	ButtonLeft uint16 = iota
+	ButtonRight
+	ButtonMiddle
+	ButtonBack
+	ButtonForward
+)
+
+// Flags of an event.
+const (
+	// FlagRepeat marks a key event generated by autorepeat, the receiver may drop it and repeat on its own.
+	FlagRepeat uint8 = 1 << iota
+)
+
+// Event is a keyboard or mouse event.
+type Event struct {
+	Type  Type
+	Flags uint8
+	Code  uint16
+	Value int32
+	X, Y  int32
+	Time  time.Time
+}
+
+// Key returns the event of the evdev key pressed or released.
+func Key(code uint16, pressed bool) Event {
+	return Event{Type: TypeKey, Code: code, Value: boolValue(pressed), Time: time.Now()}
+}
+
+// Button returns the event of the mouse button pressed or released.
+func Button(button uint16, pressed bool) Event {
+	return Event{Type: TypeButton, Code: button, Value: boolValue(pressed), Time: time.Now()}
+}
+
+// Motion returns the event of the mouse moving by dx and dy.
+func Motion(dx, dy int32) Event {
+	return Event{Type: TypeMotion, X: dx, Y: dy, Time: time.Now()}
+}
+
+// Absolute returns the event of the pointer moving to x and y, between 0 and AbsoluteMax.
+func Absolute(x, y int32) Event {
+	return Event{Type: TypeAbsolute, X: x, Y: y, Time: time.Now()}
+}
+
+// Wheel returns the event of the wheel scrolling dx detents horizontally and dy vertically.
+func Wheel(dx, dy int32) Event {
+	return Event{Type: TypeWheel, X: dx, Y: dy, Time: time.Now()}
+}
+
+// boolValue returns the value of a pressed or released event.
+func boolValue(pressed bool) int32 {
+	if pressed {
+		return 1
+	}
+
+	return 0
+}
+
+// Pressed reports whether the key or button event is a press.
+func (e Event) Pressed() bool {
+	return e.Value != 0
+}
+
+// String returns the event like "key 30 pressed" or "motion 4,-2".
+func (e Event) String() string {
+	switch e.Type {
+	case TypeKey, TypeButton:
+		state := "released"
+		if e.Pressed() {
+			state = "pressed"
+		}
+
+		return fmt.Sprintf("%s %d %s", e.Type, e.Code, state)
+	default:
+		return fmt.Sprintf("%s %d,%d", e.Type, e.X, e.Y)
+	}
+}
+
+// Validate checks the event is of a known type and an absolute position is in range.
+func (e Event) Validate() error {
+	switch e.Type {
+	case TypeKey, TypeButton, TypeMotion, TypeWheel:
+	case TypeAbsolute:
+		if e.X < 0 || e.X > AbsoluteMax || e.Y < 0 || e.Y > AbsoluteMax {
+			return fmt.Errorf("%w: absolute position %d,%d", ErrInvalidEvent, e.X, e.Y)
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidEvent, e.Type)
+	}
+
+	return nil
+}
+
+// Append appends the encoded event to dst.
+func (e Event) Append(dst []byte) []byte {
+	var b [EventSize]byte
+	b[evType] = uint8(e.Type)
+	b[evFlags] = e.Flags
+	binary.LittleEndian.PutUint16(b[evCode:], e.Code)
+	binary.LittleEndian.PutUint32(b[evValue:], uint32(e.Value))
+	binary.LittleEndian.PutUint32(b[evX:], uint32(e.X))
+	binary.LittleEndian.PutUint32(b[evY:], uint32(e.Y))
+
+	var ts int64
+	if !e.Time.IsZero() {
+		ts = e.Time.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(b[evTime:], uint64(ts))
+	return append(dst, b[:]...)
+}
+
+// Decode decodes and validates an event encoded by Append.
+func Decode(b []byte) (Event, error) {
+	if len(b) != EventSize {
+		return Event{}, fmt.Errorf("%w: %d bytes, want %d", ErrInvalidEvent, len(b), EventSize)
+	}
+
+	e := Event{
+		Type:  Type(b[evType]),
+		Flags: b[evFlags],
+		Code:  binary.LittleEndian.Uint16(b[evCode:]),
+		Value: int32(binary.LittleEndian.Uint32(b[evValue:])),
+		X:     int32(binary.LittleEndian.Uint32(b[evX:])),
+		Y:     int32(binary.LittleEndian.Uint32(b[evY:])),
+	}
+
+	if ts := int64(binary.LittleEndian.Uint64(b[evTime:])); ts != 0 {
+		e.Time = time.Unix(0, ts)
+	}
+
+	return e, e.Validate()
+}
+
+// Relay is a view of the event queue stored in the region.
+type Relay struct {
+	q *ring.Queue
+}
+
+// Init writes a fresh event queue into the region, as many events as fit. Only one side should call Init, before the
+// other one calls Open.
+func Init(mem []byte) (*Relay, error) {
+	q, err := ring.InitQueue(mem, EventSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Relay{q: q}, nil
+}
+
+// Open opens the event queue written by Init.
+func Open(mem []byte) (*Relay, error) {
+	q, err := ring.OpenQueue(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.SlotSize() < EventSize {
+		return nil, fmt.Errorf("%w: slots of %d bytes hold no event", ErrInvalidEvent, q.SlotSize())
+	}
+
+	return &Relay{q: q}, nil
+}
+
+// Len returns the number of events waiting.
+func (r *Relay) Len() int {
+	return r.q.Len()
+}
+
+// TrySend queues the event, it returns false if the queue is full.
+func (r *Relay) TrySend(e Event) (bool, error) {
+	if err := e.Validate(); err != nil {
+		return false, err
+	}
+
+	return r.q.TryPush(e.Append(make([]byte, 0, EventSize)))
+}
+
+// Send queues the event, waiting for room until the context is done. Input is only useful while it's fresh, pass a
+// context with a short deadline rather than queueing behind a receiver which went away.
+func (r *Relay) Send(ctx context.Context, e Event) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	return r.q.Push(ctx, e.Append(make([]byte, 0, EventSize)))
+}
+
+// TryReceive returns the oldest event, it returns false if the queue is empty. Events which fail to decode are
+// returned as an error after they were taken from the queue, so the next call continues with the event after them.
+func (r *Relay) TryReceive() (Event, bool, error) {
+	msg, ok, err := r.q.TryPop(make([]byte, 0, EventSize))
+	if !ok || err != nil {
+		return Event{}, ok, err
+	}
+
+	e, err := Decode(msg)
+	return e, true, err
+}
+
+// Receive waits for an event, or until the context is done, and returns it. Like TryReceive, an event which fails to
+// decode is consumed and returned as an error.
+func (r *Relay) Receive(ctx context.Context) (Event, error) {
+	msg, err := r.q.Pop(ctx, make([]byte, 0, EventSize))
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Decode(msg)
+}
@@ -0,0 +1,47 @@
+package shmhdr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+var ErrRegionTooSmall = errors.New("region too small")
+var ErrInvalidMagic = errors.New("invalid magic")
+var ErrUnsupportedVersion = errors.New("unsupported version")
+
+// Every header starts with its magic and its version, both little endian uint32.
+const (
+	offMagic   = 0
+	offVersion = 4
+)
+
+// Publish stores the magic of a header whose other fields are written. The magic goes last, so the other sides never
+// see a half written header.
+func Publish(mem []byte, magic uint32) {
+	atomic.StoreUint32(magicPtr(mem), magic)
+}
+
+// Check checks the region holds a header of size bytes published with the magic and of the version.
+func Check(mem []byte, size int, magic, version uint32) error {
+	if len(mem) < size {
+		return fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, size, len(mem))
+	}
+
+	if got := atomic.LoadUint32(magicPtr(mem)); got != magic {
+		return fmt.Errorf("%w: %#x", ErrInvalidMagic, got)
+	}
+
+	if got := binary.LittleEndian.Uint32(mem[offVersion:]); got != version {
+		return fmt.Errorf("%w: %d, want %d", ErrUnsupportedVersion, got, version)
+	}
+
+	return nil
+}
+
+// magicPtr returns the magic of the header for atomic access.
+func magicPtr(mem []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[offMagic]))
+}
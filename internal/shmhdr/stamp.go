@@ -0,0 +1,100 @@
+// Package shmhdr holds the pieces shared by the headers of the formats laid out in the region.
+package shmhdr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+var ErrStale = errors.New("reinitialized by a peer")
+
+// Session identifies one initialization of a structure, it is a random UUID.
+type Session [16]byte
+
+// String returns the session in the UUID notation.
+func (s Session) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], s[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], s[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], s[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], s[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], s[10:])
+	return string(buf[:])
+}
+
+// Stamp is the session and the epoch a view was opened with. Every initialization of the header draws a new session
+// and increments the epoch, so a view whose stamp no longer matches the header must not trust what it read from the
+// structure anymore: the peer restarted and reset it. The header holds the 16 byte session at one offset and the
+// 4 byte aligned epoch (uint32) at another, the magic is the first uint32 of the header.
+type Stamp struct {
+	mem        []byte
+	sessionOff int
+	epochOff   int
+	session    Session
+	epoch      uint32
+}
+
+// NewStamp starts a new session in the header, bumping the epoch of the previous initialization if the magic shows
+// there was one. The epoch is stored first, so the views of the previous session turn stale before anything else of
+// the header changes.
+func NewStamp(mem []byte, magic uint32, sessionOff, epochOff int) (Stamp, error) {
+	s := Stamp{mem: mem, sessionOff: sessionOff, epochOff: epochOff, epoch: 1}
+	if atomic.LoadUint32((*uint32)(unsafe.Pointer(&mem[0]))) == magic {
+		s.epoch = atomic.LoadUint32(s.epochPtr()) + 1
+	}
+
+	if _, err := rand.Read(s.session[:]); err != nil {
+		return Stamp{}, fmt.Errorf("generate session: %w", err)
+	}
+
+	s.session[6] = s.session[6]&0x0f | 0x40 // Version 4
+	s.session[8] = s.session[8]&0x3f | 0x80 // Variant 10
+
+	atomic.StoreUint32(s.epochPtr(), s.epoch)
+	copy(mem[sessionOff:sessionOff+len(s.session)], s.session[:])
+	return s, nil
+}
+
+// LoadStamp reads the stamp of an initialized header.
+func LoadStamp(mem []byte, sessionOff, epochOff int) Stamp {
+	s := Stamp{mem: mem, sessionOff: sessionOff, epochOff: epochOff}
+	s.epoch = atomic.LoadUint32(s.epochPtr())
+	copy(s.session[:], mem[sessionOff:])
+	return s
+}
+
+// Session returns the session the view was opened with.
+func (s *Stamp) Session() Session {
+	return s.session
+}
+
+// Epoch returns the epoch the view was opened with.
+func (s *Stamp) Epoch() uint32 {
+	return s.epoch
+}
+
+// Check returns ErrStale if the header was initialized again since the stamp was taken.
+func (s *Stamp) Check() error {
+	if epoch := atomic.LoadUint32(s.epochPtr()); epoch != s.epoch {
+		return fmt.Errorf("%w: epoch %d, the view has %d", ErrStale, epoch, s.epoch)
+	}
+
+	if string(s.mem[s.sessionOff:s.sessionOff+len(s.session)]) != string(s.session[:]) {
+		return fmt.Errorf("%w: session changed", ErrStale)
+	}
+
+	return nil
+}
+
+// epochPtr returns the epoch field for atomic access.
+func (s *Stamp) epochPtr() *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.mem[s.epochOff]))
+}
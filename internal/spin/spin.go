@@ -0,0 +1,33 @@
+// Package spin waits on a peer which can't wake us any other way than by changing the memory polled.
+package spin
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/fastpath"
+)
+
+// Backoff spins for a while, then yields and finally sleeps with a growing delay, for waiting on the peer which can't
+// wake us any other way. The zero value starts spinning, reset it to the zero value once the peer made progress.
+type Backoff struct {
+	attempt int
+}
+
+// Wait waits a bit longer than the previous call.
+func (b *Backoff) Wait() {
+	b.attempt++
+	switch {
+	case b.attempt < 64:
+		fastpath.Pause(b.attempt)
+	case b.attempt < 128:
+		runtime.Gosched()
+	default:
+		delay := time.Duration(b.attempt-127) * time.Microsecond
+		if delay > time.Millisecond {
+			delay = time.Millisecond
+		}
+
+		time.Sleep(delay)
+	}
+}
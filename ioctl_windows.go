@@ -0,0 +1,117 @@
+//go:build windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+// interfaceGUID is the device interface class of the ivshmem driver, the Setup API calls take it by pointer.
+var interfaceGUID = windows.GUID{Data1: 0xdf576976, Data2: 0x569d, Data3: 0x4672, Data4: [8]byte{0x95, 0xa0, 0xf5, 0x7e, 0x4e, 0xa0, 0xb2, 0x10}}
+
+// InterfaceGUID returns the device interface class of the ivshmem driver, df576976-569d-4672-95a0-f57e4ea0b210. It
+// finds the devices with SetupDiGetClassDevs.
+func InterfaceGUID() windows.GUID {
+	return interfaceGUID
+}
+
+// Arguments of CtlCode, as defined by the Windows DDK.
+const (
+	FileDeviceUnknown = 0x22
+	MethodBuffered    = 0
+	FileAnyAccess     = 0
+)
+
+// CtlCode builds an IOCTL code like the CTL_CODE macro of the Windows DDK.
+func CtlCode(deviceType, function, method, access uint32) uint32 {
+	return deviceType<<16 | access<<14 | function<<2 | method
+}
+
+// IOCTL codes of the ivshmem driver, CTL_CODE(FILE_DEVICE_UNKNOWN, 0x800 to 0x805, METHOD_BUFFERED, FILE_ANY_ACCESS).
+const (
+	IoctlRequestPeerID = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x800<<2 | MethodBuffered // Out: the peer ID (uint16)
+	IoctlRequestSize   = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x801<<2 | MethodBuffered // Out: the memory size (uint64)
+	IoctlRequestMmap   = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x802<<2 | MethodBuffered // In: a CacheMode, out: IVSHMEM_MMAP
+	IoctlReleaseMmap   = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x803<<2 | MethodBuffered // Unmaps the memory of the handle
+	IoctlRingDoorbell  = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x804<<2 | MethodBuffered // In: IVSHMEM_RING
+	IoctlRegisterEvent = FileDeviceUnknown<<16 | FileAnyAccess<<14 | 0x805<<2 | MethodBuffered // In: IVSHMEM_EVENT
+)
+
+// CacheMode is the caching of the memory mapped by IoctlRequestMmap, IVSHMEM_CACHE_* of the driver.
+type CacheMode uint8
+
+const (
+	CacheNonCached     CacheMode = 0
+	CacheCached        CacheMode = 1
+	CacheWriteCombined CacheMode = 2 // Used by Map, fast for streaming writes like frames
+)
+
+// IoControl sends a raw IOCTL to the driver, for driver features the library doesn't model yet. The input and output
+// buffers are passed as is, the driver fills out like the fixed size structs of its own IOCTLs. The device handle stays
+// open for the whole call, Unmap waits for running calls and IoControl fails with ErrInvalidHandle afterwards.
+func (g Guest) IoControl(code uint32, in, out []byte) error {
+	var inPtr, outPtr *byte
+	if len(in) > 0 {
+		inPtr = &in[0]
+	}
+
+	if len(out) > 0 {
+		outPtr = &out[0]
+	}
+
+	var returned uint32
+	err := g.handle.use(func() error {
+		return windows.DeviceIoControl(g.devHandle, code, inPtr, uint32(len(in)), outPtr, uint32(len(out)), &returned,
+			nil)
+	})
+	if errors.Is(err, ErrInvalidHandle) {
+		return err
+	}
+
+	if err != nil {
+		return fmt.Errorf("ioctl %#x: %w", code, err)
+	}
+
+	return nil
+}
+
+// handleState guards the device handle against being closed under the calls using it. It is shared by the copies of
+// the Guest value.
+type handleState struct {
+	mu     sync.RWMutex
+	closed bool
+}
+
+// use runs the function with the handle kept open, it fails with ErrInvalidHandle once the handle is closed.
+func (s *handleState) use(call func() error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrInvalidHandle
+	}
+
+	return call()
+}
+
+// released reports whether the handle was closed.
+func (s *handleState) released() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// close marks the handle closed once the running calls are done and closes it.
+func (s *handleState) close(h windows.Handle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	return windows.CloseHandle(h)
+}
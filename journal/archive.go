@@ -0,0 +1,248 @@
+package journal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Default archive settings.
+const (
+	DefaultMaxFileSize = 64 << 20
+	DefaultMaxFiles    = 8
+	DefaultHighWater   = 0.75
+	DefaultLowWater    = 0.25
+)
+
+// Archive stores the records of a journal in rotating text files on the host, one line per record:
+//
+//	2006-01-02T15:04:05.000000000Z07:00 sequence "writer" "data"
+//
+// The writer name and the data are Go quoted strings, see strconv.Unquote, so records carrying newlines or other
+// control characters can't forge lines of their own. A single trailing newline of the data, as written by a
+// log.Logger, is left out.
+//
+// The current file is Path, full files are renamed to Path.1, Path.2 and so on, the oldest beyond MaxFiles are
+// removed. While the archive falls behind or can't write, it throttles the journal, see Journal.Throttled.
+type Archive struct {
+	Path        string
+	MaxFileSize int64   // Size after which the file is rotated, DefaultMaxFileSize if zero
+	MaxFiles    int     // Rotated files kept, DefaultMaxFiles if zero
+	HighWater   float64 // Backlog throttling the writers, DefaultHighWater if zero
+	LowWater    float64 // Backlog releasing them again, DefaultLowWater if zero
+
+	// OnError is called with the errors of the files, the archive retries after RetryInterval.
+	OnError       func(err error)
+	RetryInterval time.Duration // A second if zero
+
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+}
+
+// Run archives the records of the reader until the context is done or reading the journal fails. The records are
+// flushed to the file whenever the journal has no more waiting.
+func (a *Archive) Run(ctx context.Context, r *Reader) error {
+	a.defaults()
+	defer a.close()
+	defer r.journal.SetThrottled(false)
+
+	for {
+		rec, ok, err := r.Poll()
+		if err != nil {
+			return err
+		}
+
+		a.throttle(r)
+		if !ok {
+			if err := a.flush(); err != nil {
+				a.fail(ctx, r, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(PollInterval):
+			}
+
+			continue
+		}
+
+		// The record which failed is retried until the file works again, the lines still buffered at the time are lost
+		for {
+			err := a.write(rec)
+			if err == nil {
+				break
+			}
+
+			if err := a.fail(ctx, r, err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// defaults fills in the zero settings.
+func (a *Archive) defaults() {
+	if a.MaxFileSize <= 0 {
+		a.MaxFileSize = DefaultMaxFileSize
+	}
+
+	if a.MaxFiles <= 0 {
+		a.MaxFiles = DefaultMaxFiles
+	}
+
+	if a.HighWater <= 0 {
+		a.HighWater = DefaultHighWater
+	}
+
+	if a.LowWater <= 0 {
+		a.LowWater = DefaultLowWater
+	}
+
+	if a.RetryInterval <= 0 {
+		a.RetryInterval = time.Second
+	}
+}
+
+// throttle asks the writers to slow down while the backlog is high.
+func (a *Archive) throttle(r *Reader) {
+	switch backlog := r.Backlog(); {
+	case backlog >= a.HighWater:
+		r.journal.SetThrottled(true)
+	case backlog <= a.LowWater:
+		r.journal.SetThrottled(false)
+	}
+}
+
+// fail reports the error, throttles the writers and waits before the retry.
+func (a *Archive) fail(ctx context.Context, r *Reader, err error) error {
+	if a.OnError != nil {
+		a.OnError(err)
+	}
+
+	a.close()
+	r.journal.SetThrottled(true)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(a.RetryInterval):
+		return nil
+	}
+}
+
+// write appends the record to the current file, rotating it first if it is full.
+func (a *Archive) write(rec Record) error {
+	if a.file != nil && a.size >= a.MaxFileSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+
+	data := rec.Data
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+
+	line := make([]byte, 0, 64+len(rec.Writer)+len(data))
+	line = rec.Time.AppendFormat(line, time.RFC3339Nano)
+	line = append(line, ' ')
+	line = strconv.AppendUint(line, rec.Seq, 10)
+	line = append(line, ' ')
+	line = strconv.AppendQuote(line, rec.Writer)
+	line = append(line, ' ')
+	line = strconv.AppendQuote(line, string(data))
+	line = append(line, '\n')
+
+	n, err := a.buf.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", a.Path, err)
+	}
+
+	return nil
+}
+
+// open opens the current file for appending.
+func (a *Archive) open() error {
+	file, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat archive: %w", err)
+	}
+
+	a.file, a.buf, a.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// rotate closes the current file and shifts the rotated ones, dropping the oldest.
+func (a *Archive) rotate() error {
+	if err := a.close(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(a.rotated(a.MaxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove oldest archive: %w", err)
+	}
+
+	for i := a.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("rotate archive: %w", err)
+		}
+	}
+
+	if err := os.Rename(a.Path, a.rotated(1)); err != nil {
+		return fmt.Errorf("rotate archive: %w", err)
+	}
+
+	return nil
+}
+
+// rotated returns the path of the nth rotated file.
+func (a *Archive) rotated(n int) string {
+	return filepath.Clean(a.Path) + "." + strconv.Itoa(n)
+}
+
+// flush writes the buffered lines to the file.
+func (a *Archive) flush() error {
+	if a.buf == nil {
+		return nil
+	}
+
+	if err := a.buf.Flush(); err != nil {
+		return fmt.Errorf("flush %s: %w", a.Path, err)
+	}
+
+	return nil
+}
+
+// close flushes and closes the current file.
+func (a *Archive) close() error {
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.flush()
+	if cerr := a.file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("close %s: %w", a.Path, cerr)
+	}
+
+	a.file, a.buf = nil, nil
+	return err
+}
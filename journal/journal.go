@@ -0,0 +1,373 @@
+// Package journal is a log several writers append to at once without a global lock, like the components of a guest
+// logging into one region for the host to collect. Every writer gets a lane of its own, a ring of the ring package,
+// and stamps its records with a number taken from a shared counter. The reader merges the lanes back into that order.
+//
+// Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a peer initialized the
+// journal again, the sequence counter restarts then.
+//
+// Layout, all the values are little endian:
+//
+//	0 magic (uint32)
+//	4 version (uint32)
+//	8 lanes (uint32)
+//	12 lane size (uint32)
+//	16 sequence counter (uint64)
+//	24 throttle, non zero while the reader asks the writers to slow down (uint32)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 lane table: state (uint32), appending, non zero while the writer appends a record (uint32), writer name (56 bytes)
+//	   lanes, every one a ring.Ring of lane size bytes
+//
+// Records are ring messages of the sequence number (uint64), the time on the shared timebase of the clock package
+// (int64) and the data.
+// Reserve a segment of type layout.TypeJournal for the journal so every side finds it.
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/clock"
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrInvalidName = errors.New("invalid writer name")
+var ErrNoLane = errors.New("no free lane")
+var ErrLaneFull = errors.New("lane full")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x4c4a5649 // "IVJL" when read as little endian bytes
+	Version    uint32 = 4
+	HeaderSize        = 64
+	EntrySize         = 64
+
+	// RecordHeaderSize is the size of the sequence number and time in front of the data of a record.
+	RecordHeaderSize = 16
+
+	// MaxNameLength is the longest writer name fitting into a lane table entry.
+	MaxNameLength = 56
+
+	// MinLaneSize is the smallest lane, lanes are rounded up to a multiple of it.
+	MinLaneSize = 1024
+)
+
+// Header field offsets.
+const (
+	offMagic    = 0
+	offVersion  = 4
+	offLanes    = 8
+	offLaneSize = 12
+	offSequence = 16
+	offThrottle = 24
+	offSession  = 44
+	offEpoch    = 60
+)
+
+// Lane table entry field offsets.
+const (
+	entState     = 0
+	entAppending = 4
+	entName      = 8
+)
+
+// Lane states.
+const (
+	stateFree = iota
+	stateClaimed
+	stateReady
+)
+
+// Options size a journal.
+type Options struct {
+	Lanes    int // Writers the journal holds at most
+	LaneSize int // Bytes of every lane, including its ring header
+}
+
+// Journal is a view of the journal stored in the region.
+type Journal struct {
+	mem      []byte
+	lanes    uint32
+	laneSize uint32
+	sequence *uint64
+	throttle *uint32
+	clock    *clock.Clock
+	stamp    shmhdr.Stamp
+}
+
+// Init writes a fresh journal with empty lanes into the region. Only one side should call Init, before the others
+// call Open.
+func Init(mem []byte, opts Options) (*Journal, error) {
+	if opts.Lanes <= 0 || opts.LaneSize <= 0 {
+		return nil, fmt.Errorf("%w: %d lanes of %d bytes", ErrInvalidHeader, opts.Lanes, opts.LaneSize)
+	}
+
+	laneSize := (uint64(opts.LaneSize) + MinLaneSize - 1) / MinLaneSize * MinLaneSize
+	if laneSize > 0xffffffff {
+		return nil, fmt.Errorf("%w: lanes of %d bytes", ErrInvalidHeader, opts.LaneSize)
+	}
+
+	j := &Journal{mem: mem, lanes: uint32(opts.Lanes), laneSize: uint32(laneSize), clock: new(clock.Clock)}
+	if need := j.size(); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	var err error
+	if j.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	j.sequence = (*uint64)(unsafe.Pointer(&mem[offSequence]))
+	j.throttle = (*uint32)(unsafe.Pointer(&mem[offThrottle]))
+	for i := uint32(0); i < j.lanes; i++ {
+		entry := j.entry(i)
+		for k := range entry {
+			entry[k] = 0
+		}
+
+		if _, err := ring.Init(j.lane(i)); err != nil {
+			return nil, fmt.Errorf("init lane %d: %w", i, err)
+		}
+	}
+
+	atomic.StoreUint64(j.sequence, 0)
+	atomic.StoreUint32(j.throttle, 0)
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offLanes:], j.lanes)
+	binary.LittleEndian.PutUint32(mem[offLaneSize:], j.laneSize)
+
+	shmhdr.Publish(mem, Magic)
+	return j, nil
+}
+
+// Open validates the header written by Init and returns the journal.
+func Open(mem []byte) (*Journal, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		mem:      mem,
+		lanes:    binary.LittleEndian.Uint32(mem[offLanes:]),
+		laneSize: binary.LittleEndian.Uint32(mem[offLaneSize:]),
+		sequence: (*uint64)(unsafe.Pointer(&mem[offSequence])),
+		throttle: (*uint32)(unsafe.Pointer(&mem[offThrottle])),
+		clock:    new(clock.Clock),
+		stamp:    shmhdr.LoadStamp(mem, offSession, offEpoch),
+	}
+
+	if j.lanes == 0 || j.laneSize < MinLaneSize || j.laneSize%MinLaneSize != 0 {
+		return nil, fmt.Errorf("%w: %d lanes of %d bytes", ErrInvalidHeader, j.lanes, j.laneSize)
+	}
+
+	if need := j.size(); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	return j, nil
+}
+
+// Session returns the ID of the initialization the journal was opened with.
+func (j *Journal) Session() shmhdr.Session {
+	return j.stamp.Session()
+}
+
+// Epoch returns the number of times the journal was initialized, when it was opened.
+func (j *Journal) Epoch() uint32 {
+	return j.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the journal again since it was opened, the view must be reopened then.
+func (j *Journal) Stale() bool {
+	return j.stamp.Check() != nil
+}
+
+// Writers returns the names of the writers which claimed a lane, in lane order.
+func (j *Journal) Writers() []string {
+	var names []string
+	for i := uint32(0); i < j.lanes; i++ {
+		if atomic.LoadUint32(j.state(i)) == stateReady {
+			names = append(names, j.name(i))
+		}
+	}
+
+	return names
+}
+
+// Sequence returns the number of records written so far.
+func (j *Journal) Sequence() uint64 {
+	return atomic.LoadUint64(j.sequence)
+}
+
+// Throttled reports whether the reader asked the writers to slow down, because it falls behind or can't store the
+// records. Writers should then drop their less important records or log less often, before their lanes fill up.
+func (j *Journal) Throttled() bool {
+	return atomic.LoadUint32(j.throttle) != 0
+}
+
+// SetThrottled tells the writers whether to slow down, it is called by the reader.
+func (j *Journal) SetThrottled(throttled bool) {
+	var v uint32
+	if throttled {
+		v = 1
+	}
+
+	atomic.StoreUint32(j.throttle, v)
+}
+
+// Writer claims a lane for the writer and returns it. A writer coming back after a restart gets its lane again, with
+// its records the reader didn't get to yet; only one writer of a name may run at a time.
+func (j *Journal) Writer(name string) (*Writer, error) {
+	if name == "" || len(name) > MaxNameLength {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	if err := j.stamp.Check(); err != nil {
+		return nil, err
+	}
+
+	lane, ok := j.find(name)
+	if !ok {
+		for i := uint32(0); i < j.lanes && !ok; i++ {
+			if atomic.CompareAndSwapUint32(j.state(i), stateFree, stateClaimed) {
+				copy(j.entry(i)[entName:], name)
+				atomic.StoreUint32(j.state(i), stateReady)
+				lane, ok = i, true
+			}
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %d lanes", ErrNoLane, j.lanes)
+	}
+
+	r, err := ring.Open(j.lane(lane))
+	if err != nil {
+		return nil, fmt.Errorf("open lane %d: %w", lane, err)
+	}
+
+	// A writer which died halfway through an append left the flag set
+	appending := j.appending(lane)
+	atomic.StoreUint32(appending, 0)
+	return &Writer{journal: j, name: name, ring: r, appending: appending}, nil
+}
+
+// find returns the lane claimed by the writer.
+func (j *Journal) find(name string) (uint32, bool) {
+	for i := uint32(0); i < j.lanes; i++ {
+		if atomic.LoadUint32(j.state(i)) == stateReady && j.name(i) == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// size returns the bytes the journal needs.
+func (j *Journal) size() uint64 {
+	return HeaderSize + uint64(j.lanes)*(EntrySize+uint64(j.laneSize))
+}
+
+// entry returns the lane table entry.
+func (j *Journal) entry(lane uint32) []byte {
+	off := HeaderSize + uint64(lane)*EntrySize
+	return j.mem[off : off+EntrySize]
+}
+
+// state returns the state of the lane for atomic access.
+func (j *Journal) state(lane uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&j.entry(lane)[entState]))
+}
+
+// appending returns the appending flag of the lane for atomic access.
+func (j *Journal) appending(lane uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&j.entry(lane)[entAppending]))
+}
+
+// name returns the name of the writer stored in the lane table entry.
+func (j *Journal) name(lane uint32) string {
+	name := j.entry(lane)[entName:]
+	for i, c := range name {
+		if c == 0 {
+			return string(name[:i])
+		}
+	}
+
+	return string(name)
+}
+
+// lane returns the memory of the lane ring.
+func (j *Journal) lane(lane uint32) []byte {
+	off := HeaderSize + uint64(j.lanes)*EntrySize + uint64(lane)*uint64(j.laneSize)
+	return j.mem[off : off+uint64(j.laneSize)]
+}
+
+// Writer appends records to its lane, it is used by a single goroutine.
+type Writer struct {
+	journal   *Journal
+	name      string
+	ring      *ring.Ring
+	appending *uint32
+	buf       []byte
+}
+
+// SetClock makes the writers stamp the records and the reader convert the stamps with the clock, synchronized to the
+// reference peer, so the records of both sides share a timebase. Without it this side is the reference. Call it
+// before creating the writers and the reader.
+func (j *Journal) SetClock(c *clock.Clock) {
+	j.clock = c
+}
+
+// Name returns the name of the writer.
+func (w *Writer) Name() string {
+	return w.name
+}
+
+// Append writes the record and returns its sequence number. It doesn't wait for the reader, a full lane fails with
+// ErrLaneFull and the record is not numbered.
+func (w *Writer) Append(data []byte) (uint64, error) {
+	if err := w.journal.stamp.Check(); err != nil {
+		return 0, err
+	}
+
+	// Only this writer fills the lane, so the room checked here doesn't shrink before the send
+	if w.ring.Free() < ring.MessageHeaderSize+RecordHeaderSize+len(data) {
+		return 0, fmt.Errorf("%w: %d bytes free of %d", ErrLaneFull, w.ring.Free(), w.ring.Capacity())
+	}
+
+	// The flag covers taking the number until the record is in the lane, so the reader never takes a number for lost
+	// while its record may still show up
+	atomic.StoreUint32(w.appending, 1)
+	defer atomic.StoreUint32(w.appending, 0)
+
+	seq := atomic.AddUint64(w.journal.sequence, 1)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf[:0], seq)
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(w.journal.clock.Now()))
+	w.buf = append(w.buf, data...)
+	if _, err := w.ring.TrySend(w.buf); err != nil {
+		return seq, fmt.Errorf("send record: %w", err)
+	}
+
+	return seq, nil
+}
+
+// Write appends p as a record, so a writer can back a log.Logger.
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := w.Append(p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,192 @@
+package journal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/clock"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// GapTimeout is how long the reader waits for a record missing from the sequence while a writer is still appending,
+// before reading past it. It only passes when a writer stalls or dies halfway through an append, records showing up
+// later are returned late, out of order.
+var GapTimeout = time.Second
+
+// PollInterval is how often a waiting reader checks the lanes for new records.
+var PollInterval = time.Millisecond
+
+// Record is an entry of the journal.
+type Record struct {
+	Seq    uint64
+	Stamp  clock.Timestamp // When the record was appended, on the shared timebase
+	Time   time.Time       // The stamp on the wall clock of the reader
+	Writer string
+	Data   []byte
+}
+
+// Reader reads the records of all the lanes in the order of their sequence numbers. A number missing from the
+// sequence is waited for while any writer is appending, it is lost once they all moved past it. There is a single
+// reader of a journal, used by a single goroutine.
+type Reader struct {
+	journal *Journal
+	lanes   []readerLane
+	next    uint64    // Sequence number of the next record, zero before the first one
+	gap     time.Time // When the reader started waiting for the next record, zero when not waiting
+	lost    uint64
+}
+
+// readerLane is the consumer side of a lane.
+type readerLane struct {
+	ring *ring.Ring // Nil until a writer claims the lane
+	name string
+	head *Record // Oldest record received from the lane and not returned yet
+}
+
+// NewReader returns the reader of the journal.
+func NewReader(j *Journal) *Reader {
+	return &Reader{journal: j, lanes: make([]readerLane, j.lanes)}
+}
+
+// Lost returns the number of records skipped because they never showed up, their writers died after numbering them.
+func (r *Reader) Lost() uint64 {
+	return r.lost
+}
+
+// Backlog returns how full the fullest lane is, from 0 to 1.
+func (r *Reader) Backlog() float64 {
+	var backlog float64
+	for _, lane := range r.lanes {
+		if lane.ring == nil {
+			continue
+		}
+
+		if b := float64(lane.ring.Len()) / float64(lane.ring.Capacity()); b > backlog {
+			backlog = b
+		}
+	}
+
+	return backlog
+}
+
+// Poll returns the next record, it returns false if there is none yet.
+func (r *Reader) Poll() (Record, bool, error) {
+	if err := r.journal.stamp.Check(); err != nil {
+		return Record{}, false, err
+	}
+
+	var next *readerLane
+	appending := false
+	for i := range r.lanes {
+		// Loaded before receiving: a writer done appending has its record in the lane by then, and one starting
+		// later takes a number past every record already seen
+		if atomic.LoadUint32(r.journal.appending(uint32(i))) != 0 {
+			appending = true
+		}
+
+		lane := &r.lanes[i]
+		if err := r.fill(uint32(i), lane); err != nil {
+			return Record{}, false, err
+		}
+
+		if lane.head != nil && (next == nil || lane.head.Seq < next.head.Seq) {
+			next = lane
+		}
+	}
+
+	if next == nil {
+		return Record{}, false, nil
+	}
+
+	rec := *next.head
+	switch {
+	case rec.Seq < r.next:
+		// The reader gave up waiting for the record, it is returned late, out of order
+		if r.lost > 0 {
+			r.lost--
+		}
+	case r.next != 0 && rec.Seq > r.next:
+		// Every lane is past the missing records unless a writer is still appending one of them
+		if appending {
+			if r.gap.IsZero() {
+				r.gap = time.Now()
+			}
+
+			if time.Since(r.gap) < GapTimeout {
+				return Record{}, false, nil
+			}
+		}
+
+		r.lost += rec.Seq - r.next
+		fallthrough
+	default:
+		r.next = rec.Seq + 1
+	}
+
+	next.head = nil
+	r.gap = time.Time{}
+	return rec, true, nil
+}
+
+// Next waits for the next record, or until the context is done.
+func (r *Reader) Next(ctx context.Context) (Record, error) {
+	for {
+		rec, ok, err := r.Poll()
+		if err != nil || ok {
+			return rec, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Record{}, ctx.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// fill receives the oldest record of the lane unless one is already waiting.
+func (r *Reader) fill(index uint32, lane *readerLane) error {
+	if lane.head != nil {
+		return nil
+	}
+
+	if lane.ring == nil {
+		if atomic.LoadUint32(r.journal.state(index)) != stateReady {
+			return nil
+		}
+
+		rg, err := ring.Open(r.journal.lane(index))
+		if err != nil {
+			return fmt.Errorf("open lane %d: %w", index, err)
+		}
+
+		lane.ring, lane.name = rg, r.journal.name(index)
+	}
+
+	msg, ok, err := lane.ring.TryRecv(nil)
+	if err != nil {
+		return fmt.Errorf("receive from lane %d: %w", index, err)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	if len(msg) < RecordHeaderSize {
+		return fmt.Errorf("%w: record of %d bytes in lane %d", ring.ErrCorrupted, len(msg), index)
+	}
+
+	stamp := clock.Timestamp(binary.LittleEndian.Uint64(msg[8:]))
+	lane.head = &Record{
+		Seq:    binary.LittleEndian.Uint64(msg),
+		Stamp:  stamp,
+		Time:   r.journal.clock.Time(stamp),
+		Writer: lane.name,
+		Data:   msg[RecordHeaderSize:],
+	}
+
+	return nil
+}
@@ -0,0 +1,398 @@
+// Package kv is a small key-value store in the shared memory region, for the configuration and status values both
+// sides share without designing a layout of their own. It is a hash table of fixed size buckets with open addressing:
+// keys and values have a maximum size chosen at Init, and the table never grows.
+//
+// Every bucket is a shmsync.SeqLock, so readers on either side never block and never see a value torn by a concurrent
+// write. Writers of both sides take the ticket lock in the header, so there is one writer at a time. Deleted keys
+// leave a tombstone which later insertions reuse; entries never move, so a reader probing the table doesn't miss a key
+// which isn't being changed. Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a
+// peer initialized the store again.
+//
+// Layout, all the values are little endian:
+//
+//	 0 magic (uint32)
+//	 4 version (uint32)
+//	 8 buckets (uint32)
+//	12 key size (uint32)
+//	16 value size (uint32)
+//	20 keys stored (uint32)
+//	24 writer lock, a shmsync.Mutex (8 bytes)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 buckets: sequence (uint32), reserved (uint32), state (uint32), key length (uint32), value length (uint32),
+//	   reserved (uint32), key, value, padded to 8 bytes
+//
+// Reserve a segment of type layout.TypeKV for the store so every side finds it.
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrKeyTooLong = errors.New("key too long")
+var ErrValueTooLong = errors.New("value too long")
+var ErrFull = errors.New("store full")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x564b5649 // "IVKV" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+
+	// BucketHeaderSize is the size of the fields in front of the key of a bucket.
+	BucketHeaderSize = 24
+)
+
+// Header field offsets.
+const (
+	offMagic     = 0
+	offVersion   = 4
+	offBuckets   = 8
+	offKeySize   = 12
+	offValueSize = 16
+	offCount     = 20
+	offLock      = 24
+	offSession   = 44
+	offEpoch     = 60
+)
+
+// Bucket field offsets, relative to the data of the bucket seqlock which starts 8 bytes into the bucket.
+const (
+	bktState    = 0
+	bktKeyLen   = 4
+	bktValueLen = 8
+	bktKey      = 16
+)
+
+// Bucket states.
+const (
+	stateEmpty = iota
+	stateUsed
+	stateDeleted
+)
+
+// LockTimeout is how long the calls wait for the writer of the other side, or for a bucket it is writing.
+var LockTimeout = 5 * time.Second
+
+// Options size a store.
+type Options struct {
+	Buckets   int // Keys the store holds at most, keep it well above the keys stored so the probes stay short
+	KeySize   int // Longest key in bytes
+	ValueSize int // Longest value in bytes
+}
+
+// Store is a view of the key-value store stored in the region.
+type Store struct {
+	mem       []byte
+	buckets   uint32
+	keySize   uint32
+	valueSize uint32
+	stride    uint64
+	count     *uint32
+	lock      *shmsync.Mutex
+	seqlocks  []*shmsync.SeqLock
+	stamp     shmhdr.Stamp
+}
+
+// Init writes an empty store into the region. Only one side should call Init, before the others call Open.
+func Init(mem []byte, opts Options) (*Store, error) {
+	if opts.Buckets <= 0 || opts.KeySize <= 0 || opts.ValueSize < 0 ||
+		uint64(opts.KeySize)+uint64(opts.ValueSize) > 1<<30 {
+		return nil, fmt.Errorf("%w: %d buckets of %d byte keys and %d byte values", ErrInvalidHeader, opts.Buckets,
+			opts.KeySize, opts.ValueSize)
+	}
+
+	s, err := view(mem, uint32(opts.Buckets), uint32(opts.KeySize), uint32(opts.ValueSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := range mem[HeaderSize:s.size()] {
+		mem[HeaderSize+i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offBuckets:], s.buckets)
+	binary.LittleEndian.PutUint32(mem[offKeySize:], s.keySize)
+	binary.LittleEndian.PutUint32(mem[offValueSize:], s.valueSize)
+	atomic.StoreUint32(s.count, 0)
+	shmsync.StoreUint64At(mem, offLock, 0)
+
+	shmhdr.Publish(mem, Magic)
+	return s, nil
+}
+
+// Open validates the header written by Init and returns the store.
+func Open(mem []byte) (*Store, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	buckets := binary.LittleEndian.Uint32(mem[offBuckets:])
+	keySize := binary.LittleEndian.Uint32(mem[offKeySize:])
+	valueSize := binary.LittleEndian.Uint32(mem[offValueSize:])
+	if buckets == 0 || keySize == 0 || uint64(keySize)+uint64(valueSize) > 1<<30 {
+		return nil, fmt.Errorf("%w: %d buckets of %d byte keys and %d byte values", ErrInvalidHeader, buckets, keySize, valueSize)
+	}
+
+	s, err := view(mem, buckets, keySize, valueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return s, nil
+}
+
+// view returns the store over the region.
+func view(mem []byte, buckets, keySize, valueSize uint32) (*Store, error) {
+	s := &Store{
+		mem:       mem,
+		buckets:   buckets,
+		keySize:   keySize,
+		valueSize: valueSize,
+		stride:    (BucketHeaderSize + uint64(keySize) + uint64(valueSize) + 7) &^ 7,
+	}
+
+	if need := s.size(); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	// The lock and the sequences need aligned words, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	var err error
+	if s.lock, err = shmsync.MutexAt(mem, offLock); err != nil {
+		return nil, err
+	}
+
+	s.count = (*uint32)(unsafe.Pointer(&mem[offCount]))
+	s.seqlocks = make([]*shmsync.SeqLock, buckets)
+	for i := range s.seqlocks {
+		off := HeaderSize + uint64(i)*s.stride
+		if s.seqlocks[i], err = shmsync.SeqLockAt(mem, int(off), int(s.stride-8)); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Session returns the ID of the initialization the store was opened with.
+func (s *Store) Session() shmhdr.Session {
+	return s.stamp.Session()
+}
+
+// Epoch returns the number of times the store was initialized, when it was opened.
+func (s *Store) Epoch() uint32 {
+	return s.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the store again since it was opened, the view must be reopened then.
+func (s *Store) Stale() bool {
+	return s.stamp.Check() != nil
+}
+
+// Len returns the number of keys stored.
+func (s *Store) Len() int {
+	return int(atomic.LoadUint32(s.count))
+}
+
+// Get returns a copy of the value stored under the key, false if there is none.
+func (s *Store) Get(key string) ([]byte, bool, error) {
+	buf := make([]byte, s.stride-8)
+	start := s.hash(key)
+	for i := uint32(0); i < s.buckets; i++ {
+		b := (start + i) % s.buckets
+		if err := s.read(b, buf); err != nil {
+			return nil, false, err
+		}
+
+		switch state, k, v := s.decode(buf); {
+		case state == stateEmpty:
+			return nil, false, nil
+		case state == stateUsed && k == key:
+			return append([]byte(nil), v...), true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// Set stores the value under the key, replacing the previous one.
+func (s *Store) Set(key string, value []byte) error {
+	if key == "" || len(key) > int(s.keySize) {
+		return fmt.Errorf("%w: %d bytes, at most %d fit", ErrKeyTooLong, len(key), s.keySize)
+	}
+
+	if len(value) > int(s.valueSize) {
+		return fmt.Errorf("%w: %d bytes, at most %d fit", ErrValueTooLong, len(value), s.valueSize)
+	}
+
+	return s.locked(func() error {
+		b, found, ok := s.find(key)
+		if !ok {
+			return fmt.Errorf("%w: %d keys in %d buckets: %w", ErrFull, s.Len(), s.buckets, ivshmem.ErrResourceExhausted)
+		}
+
+		s.seqlocks[b].Update(func(data []byte) {
+			binary.LittleEndian.PutUint32(data[bktState:], stateUsed)
+			binary.LittleEndian.PutUint32(data[bktKeyLen:], uint32(len(key)))
+			binary.LittleEndian.PutUint32(data[bktValueLen:], uint32(len(value)))
+			copy(data[bktKey:], key)
+			copy(data[bktKey+s.keySize:], value)
+		})
+
+		if !found {
+			atomic.AddUint32(s.count, 1)
+		}
+		return nil
+	})
+}
+
+// Delete removes the key, it reports whether it was stored.
+func (s *Store) Delete(key string) (bool, error) {
+	var deleted bool
+	err := s.locked(func() error {
+		b, found, _ := s.find(key)
+		if !found {
+			return nil
+		}
+
+		s.seqlocks[b].Update(func(data []byte) {
+			binary.LittleEndian.PutUint32(data[bktState:], stateDeleted)
+		})
+		atomic.AddUint32(s.count, ^uint32(0))
+		deleted = true
+		return nil
+	})
+
+	return deleted, err
+}
+
+// Range calls the function with every key and a copy of its value, in bucket order, until it returns false. Keys
+// changed meanwhile may be missed or seen twice.
+func (s *Store) Range(f func(key string, value []byte) bool) error {
+	buf := make([]byte, s.stride-8)
+	for b := uint32(0); b < s.buckets; b++ {
+		if err := s.read(b, buf); err != nil {
+			return err
+		}
+
+		if state, k, v := s.decode(buf); state == stateUsed && !f(k, append([]byte(nil), v...)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// find returns the bucket holding the key, or the bucket to insert it into and false. The last result is false when
+// the key isn't stored and there is no room for it. The caller holds the writer lock, so the buckets are read
+// directly.
+func (s *Store) find(key string) (uint32, bool, bool) {
+	start := s.hash(key)
+	insert, ok := uint32(0), false
+	for i := uint32(0); i < s.buckets; i++ {
+		b := (start + i) % s.buckets
+		state, k, _ := s.decode(s.bucket(b))
+		switch {
+		case state == stateUsed && k == key:
+			return b, true, true
+		case state == stateEmpty:
+			if !ok {
+				insert, ok = b, true
+			}
+			return insert, false, ok
+		case state == stateDeleted && !ok:
+			insert, ok = b, true
+		}
+	}
+
+	return insert, false, ok
+}
+
+// read copies a consistent snapshot of the bucket data into buf, it fails with ErrStale if the snapshot may belong to
+// a later initialization.
+func (s *Store) read(b uint32, buf []byte) error {
+	if _, ok := s.seqlocks[b].TryRead(buf); !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), LockTimeout)
+		defer cancel()
+		if _, err := s.seqlocks[b].Read(ctx, buf); err != nil {
+			return fmt.Errorf("read bucket %d: %w", b, err)
+		}
+	}
+
+	return s.stamp.Check()
+}
+
+// decode returns the state, key and value of the bucket data, clamping corrupted lengths.
+func (s *Store) decode(data []byte) (uint32, string, []byte) {
+	keyLen := binary.LittleEndian.Uint32(data[bktKeyLen:])
+	if keyLen > s.keySize {
+		keyLen = s.keySize
+	}
+
+	valueLen := binary.LittleEndian.Uint32(data[bktValueLen:])
+	if valueLen > s.valueSize {
+		valueLen = s.valueSize
+	}
+
+	value := data[bktKey+s.keySize:]
+	return binary.LittleEndian.Uint32(data[bktState:]), string(data[bktKey : bktKey+keyLen]), value[:valueLen]
+}
+
+// locked runs the function holding the writer lock.
+func (s *Store) locked(f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), LockTimeout)
+	defer cancel()
+	if err := s.lock.Lock(ctx); err != nil {
+		return fmt.Errorf("lock the store: %w", err)
+	}
+	defer s.lock.Unlock()
+
+	if err := s.stamp.Check(); err != nil {
+		return err
+	}
+
+	return f()
+}
+
+// hash returns the first bucket to probe for the key.
+func (s *Store) hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % s.buckets
+}
+
+// size returns the bytes the store needs.
+func (s *Store) size() uint64 {
+	return HeaderSize + uint64(s.buckets)*s.stride
+}
+
+// bucket returns the data of the bucket seqlock.
+func (s *Store) bucket(b uint32) []byte {
+	off := HeaderSize + uint64(b)*s.stride + 8
+	return s.mem[off : off+s.stride-8]
+}
@@ -0,0 +1,33 @@
+package kvmfr
+
+import (
+	"fmt"
+	"image"
+)
+
+// Image copies the pixel data of an 8 bit per channel frame into an RGBA image, the rotation is not applied. Frames
+// of the other types fail with ErrInvalidFrame, use Data for them.
+func (f Frame) Image(msg []byte) (*image.RGBA, error) {
+	if f.Type != FrameTypeBGRA && f.Type != FrameTypeRGBA {
+		return nil, fmt.Errorf("%w: can't convert %s", ErrInvalidFrame, f.Type)
+	}
+
+	data, err := f.Data(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(f.DataWidth), int(f.DataHeight)))
+	row := int(f.DataWidth) * 4
+	for y := 0; y < int(f.DataHeight); y++ {
+		dst := img.Pix[y*img.Stride : y*img.Stride+row]
+		copy(dst, data[y*int(f.Pitch):])
+		if f.Type == FrameTypeBGRA {
+			for x := 0; x < row; x += 4 {
+				dst[x], dst[x+2] = dst[x+2], dst[x]
+			}
+		}
+	}
+
+	return img, nil
+}
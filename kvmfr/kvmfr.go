@@ -0,0 +1,447 @@
+// Package kvmfr parses the KVMFR structures the Looking Glass host application writes into the ivshmem region: the
+// header describing the host, the frame headers with the pixel data following them and the cursor shapes. It follows
+// the KVMFR.h of Looking Glass B6 (KVMFR version 19), older or newer hosts are refused with ErrUnsupportedVersion.
+//
+// Looking Glass carries the KVMFR structures over LGMP: the header is the user data of the LGMP header at the start
+// of the region and every frame and cursor update is the memory of an LGMP message. Open finds the header in the
+// region on its own; the frames and cursors are parsed from the message memory the LGMP client hands out.
+//
+// The host is a guest application, so everything is read through the untrusted package and copied out.
+package kvmfr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem/untrusted"
+)
+
+var ErrNotFound = errors.New("kvmfr header not found")
+var ErrUnsupportedVersion = errors.New("unsupported kvmfr version")
+var ErrInvalidFrame = errors.New("invalid frame")
+var ErrIncomplete = errors.New("frame not completely written")
+
+const (
+	// Magic starts the KVMFR header.
+	Magic = "KVMFR---"
+
+	// Version is the KVMFR version this package understands.
+	Version uint32 = 19
+
+	// HeaderSize is the size of the KVMFR header in front of its records.
+	HeaderSize = 48
+
+	// FrameHeaderSize is the size of the frame header, KVMFRFrame.
+	FrameHeaderSize = 1084
+
+	// CursorHeaderSize is the size of the cursor header, KVMFRCursor, the shape follows it.
+	CursorHeaderSize = 24
+
+	// MaxDamageRects is the number of damage rectangles a frame header has room for.
+	MaxDamageRects = 64
+
+	// searchSize is how far into the region Open looks for the header, the LGMP header in front of it is smaller.
+	searchSize = 64 << 10
+
+	// maxRecords caps the records parsed from the header.
+	maxRecords = 64
+
+	// maxHostVersion is the size of the host version string.
+	maxHostVersion = 32
+)
+
+// LGMP queue IDs the host posts to.
+const (
+	QueuePointer uint32 = 1 // Cursor updates, ParseCursor
+	QueueFrame   uint32 = 2 // Frames, ParseFrame
+)
+
+// KVMFR header field offsets, the records follow the header packed.
+const (
+	hdrMagic    = 0
+	hdrVersion  = 8
+	hdrHostVer  = 12
+	hdrFeatures = 44
+)
+
+// Frame header field offsets.
+const (
+	frmFormatVer    = 0
+	frmSerial       = 4
+	frmType         = 8
+	frmScreenWidth  = 12
+	frmScreenHeight = 16
+	frmDataWidth    = 20
+	frmDataHeight   = 24
+	frmFrameWidth   = 28
+	frmFrameHeight  = 32
+	frmRotation     = 36
+	frmStride       = 40
+	frmPitch        = 44
+	frmOffset       = 48
+	frmDamageCount  = 52
+	frmDamageRects  = 56
+	frmFlags        = 1080
+)
+
+// Cursor header field offsets.
+const (
+	curX      = 0
+	curY      = 2
+	curType   = 4
+	curHX     = 8
+	curHY     = 9
+	curWidth  = 12
+	curHeight = 16
+	curPitch  = 20
+)
+
+// FrameType is the pixel format of a frame.
+type FrameType uint32
+
+const (
+	FrameTypeInvalid FrameType = iota
+	FrameTypeBGRA
+	FrameTypeRGBA
+	FrameTypeRGBA10
+	FrameTypeRGBA16F
+)
+
+// String returns the name of the frame type.
+func (t FrameType) String() string {
+	switch t {
+	case FrameTypeBGRA:
+		return "BGRA"
+	case FrameTypeRGBA:
+		return "RGBA"
+	case FrameTypeRGBA10:
+		return "RGBA10"
+	case FrameTypeRGBA16F:
+		return "RGBA16F"
+	default:
+		return fmt.Sprintf("FrameType(%d)", uint32(t))
+	}
+}
+
+// BytesPerPixel returns the size of a pixel, zero if the type is unknown.
+func (t FrameType) BytesPerPixel() int {
+	switch t {
+	case FrameTypeBGRA, FrameTypeRGBA, FrameTypeRGBA10:
+		return 4
+	case FrameTypeRGBA16F:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// Rotation is the rotation of a frame in degrees, clockwise.
+type Rotation uint32
+
+const (
+	Rotation0 Rotation = iota
+	Rotation90
+	Rotation180
+	Rotation270
+)
+
+// Frame flags.
+const (
+	FrameFlagBlockScreensaver  = 0x1
+	FrameFlagRequestActivation = 0x2
+	FrameFlagTruncated         = 0x4
+)
+
+// Features of the host.
+const (
+	FeatureSetCursorPos = 0x1
+)
+
+// Record types of the header.
+const (
+	RecordVDIMap = 1
+	RecordOSInfo = 2
+)
+
+// Record is an extension record of the header.
+type Record struct {
+	Type uint8
+	Data []byte
+}
+
+// Header describes the host application.
+type Header struct {
+	Version     uint32
+	HostVersion string
+	Features    uint32
+	Records     []Record
+}
+
+// OSInfo returns the operating system of the guest from the OS info record, false if the host sent none. The kinds
+// are 0 Linux, 1 BSD, 2 macOS, 3 Windows and 4 other.
+func (h Header) OSInfo() (kind uint8, name string, ok bool) {
+	for _, r := range h.Records {
+		if r.Type != RecordOSInfo || len(r.Data) == 0 {
+			continue
+		}
+
+		name := r.Data[1:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+
+		return r.Data[0], string(name), true
+	}
+
+	return 0, "", false
+}
+
+// Rect is a damaged rectangle of a frame.
+type Rect struct {
+	X, Y, Width, Height uint32
+}
+
+// Frame is the header of a frame.
+type Frame struct {
+	FormatVersion uint32 // Changes when the format or size of the frames changes
+	Serial        uint32
+	Type          FrameType
+	ScreenWidth   uint32
+	ScreenHeight  uint32
+	DataWidth     uint32 // Size of the pixel data
+	DataHeight    uint32
+	FrameWidth    uint32 // Size of the frame once unpacked
+	FrameHeight   uint32
+	Rotation      Rotation
+	Stride        uint32 // Pixels per row
+	Pitch         uint32 // Bytes per row
+	Offset        uint32 // From the frame header to the frame buffer
+	Damage        []Rect // Empty when the whole frame changed
+	Flags         uint32
+}
+
+// Cursor is a cursor update. The shape fields are only meaningful when the update carries a shape.
+type Cursor struct {
+	X, Y     int16
+	Type     uint32 // 0 color, 1 monochrome, 2 masked color
+	HotX     int8
+	HotY     int8
+	Width    uint32
+	Height   uint32
+	Pitch    uint32
+	Shape    []byte // Pitch * Height bytes, nil without a shape
+	HasShape bool
+}
+
+// Open finds the KVMFR header in the region and parses it. Without the LGMP header it doesn't know where the user
+// data ends, so only the records up to the first empty one are read.
+func Open(mem []byte) (Header, error) {
+	window := mem
+	if len(window) > searchSize {
+		window = window[:searchSize]
+	}
+
+	off := bytes.Index(window, []byte(Magic))
+	if off < 0 {
+		return Header{}, ErrNotFound
+	}
+
+	return ParseHeader(mem[off:])
+}
+
+// ParseHeader parses the KVMFR header at the start of the memory, the user data of the LGMP header. The records are
+// parsed up to the end of the memory, pass exactly the user data to keep what follows it from being read as records.
+func ParseHeader(mem []byte) (Header, error) {
+	v := untrusted.New(mem)
+	magic, err := v.Bytes(hdrMagic, uint64(len(Magic)))
+	if err != nil {
+		return Header{}, err
+	}
+
+	if string(magic) != Magic {
+		return Header{}, fmt.Errorf("%w: magic %q", ErrNotFound, magic)
+	}
+
+	var h Header
+	if h.Version, err = v.Uint32(hdrVersion); err != nil {
+		return Header{}, err
+	}
+
+	if h.Version != Version {
+		return Header{}, fmt.Errorf("%w: %d, want %d", ErrUnsupportedVersion, h.Version, Version)
+	}
+
+	hostVer, err := v.Bytes(hdrHostVer, maxHostVersion)
+	if err != nil {
+		return Header{}, err
+	}
+
+	if end := bytes.IndexByte(hostVer, 0); end >= 0 {
+		hostVer = hostVer[:end]
+	}
+	h.HostVersion = string(hostVer)
+
+	if h.Features, err = v.Uint32(hdrFeatures); err != nil {
+		return Header{}, err
+	}
+
+	// The records are packed: type (uint8), size (uint32), data
+	for off := uint64(HeaderSize); len(h.Records) < maxRecords; {
+		typ, err := v.Uint8(off)
+		if err != nil || typ == 0 {
+			break
+		}
+
+		data, err := v.Prefixed(off+1, 4, 1<<16)
+		if err != nil {
+			break
+		}
+
+		h.Records = append(h.Records, Record{Type: typ, Data: data})
+		off += 5 + uint64(len(data))
+	}
+
+	return h, nil
+}
+
+// ParseFrame parses the frame header at the start of the memory of a frame message.
+func ParseFrame(msg []byte) (Frame, error) {
+	v := untrusted.New(msg)
+	var f Frame
+	for _, field := range []struct {
+		off uint64
+		dst *uint32
+	}{
+		{frmFormatVer, &f.FormatVersion},
+		{frmSerial, &f.Serial},
+		{frmType, (*uint32)(&f.Type)},
+		{frmScreenWidth, &f.ScreenWidth},
+		{frmScreenHeight, &f.ScreenHeight},
+		{frmDataWidth, &f.DataWidth},
+		{frmDataHeight, &f.DataHeight},
+		{frmFrameWidth, &f.FrameWidth},
+		{frmFrameHeight, &f.FrameHeight},
+		{frmRotation, (*uint32)(&f.Rotation)},
+		{frmStride, &f.Stride},
+		{frmPitch, &f.Pitch},
+		{frmOffset, &f.Offset},
+		{frmFlags, &f.Flags},
+	} {
+		val, err := v.Uint32(field.off)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		*field.dst = val
+	}
+
+	count, err := v.Uint32(frmDamageCount)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	rects, err := v.Array(frmDamageRects, uint64(count), 16, MaxDamageRects)
+	if err != nil {
+		return Frame{}, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+
+	rv := untrusted.New(rects)
+	for i := uint64(0); i < uint64(count); i++ {
+		var r Rect
+		r.X, _ = rv.Uint32(i * 16)
+		r.Y, _ = rv.Uint32(i*16 + 4)
+		r.Width, _ = rv.Uint32(i*16 + 8)
+		r.Height, _ = rv.Uint32(i*16 + 12)
+		f.Damage = append(f.Damage, r)
+	}
+
+	if f.Type.BytesPerPixel() == 0 {
+		return Frame{}, fmt.Errorf("%w: type %s", ErrInvalidFrame, f.Type)
+	}
+
+	if f.Offset < FrameHeaderSize || uint64(f.Pitch) < uint64(f.DataWidth)*uint64(f.Type.BytesPerPixel()) {
+		return Frame{}, fmt.Errorf("%w: %dx%d %s with pitch %d at offset %d", ErrInvalidFrame, f.DataWidth,
+			f.DataHeight, f.Type, f.Pitch, f.Offset)
+	}
+
+	return f, nil
+}
+
+// Size returns the bytes of pixel data of the frame.
+func (f Frame) Size() uint64 {
+	return uint64(f.Pitch) * uint64(f.DataHeight)
+}
+
+// Written returns how many bytes of the pixel data the host wrote so far, it writes the frame progressively after
+// publishing the message. The frame buffer at the offset is the write position (uint32) followed by the data.
+func (f Frame) Written(msg []byte) (uint64, error) {
+	wp, err := untrusted.New(msg).Uint32(uint64(f.Offset))
+	return uint64(wp), err
+}
+
+// Data returns a copy of the pixel data of the frame, ErrIncomplete if the host didn't finish writing it yet.
+func (f Frame) Data(msg []byte) ([]byte, error) {
+	written, err := f.Written(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if written < f.Size() {
+		return nil, fmt.Errorf("%w: %d of %d bytes", ErrIncomplete, written, f.Size())
+	}
+
+	return untrusted.New(msg).Bytes(uint64(f.Offset)+4, f.Size())
+}
+
+// ParseCursor parses a cursor message. Its LGMP user data carries the CURSOR_FLAG bits, hasShape is the shape bit
+// (0x4): only then the shape follows the header.
+func ParseCursor(msg []byte, hasShape bool) (Cursor, error) {
+	v := untrusted.New(msg)
+	var c Cursor
+	x, err := v.Uint16(curX)
+	if err != nil {
+		return Cursor{}, err
+	}
+
+	y, err := v.Uint16(curY)
+	if err != nil {
+		return Cursor{}, err
+	}
+	c.X, c.Y = int16(x), int16(y)
+
+	if !hasShape {
+		return c, nil
+	}
+
+	if c.Type, err = v.Uint32(curType); err != nil {
+		return Cursor{}, err
+	}
+
+	hx, err := v.Uint8(curHX)
+	if err != nil {
+		return Cursor{}, err
+	}
+
+	hy, err := v.Uint8(curHY)
+	if err != nil {
+		return Cursor{}, err
+	}
+	c.HotX, c.HotY = int8(hx), int8(hy)
+
+	for _, field := range []struct {
+		off uint64
+		dst *uint32
+	}{{curWidth, &c.Width}, {curHeight, &c.Height}, {curPitch, &c.Pitch}} {
+		if *field.dst, err = v.Uint32(field.off); err != nil {
+			return Cursor{}, err
+		}
+	}
+
+	if c.Shape, err = v.Array(CursorHeaderSize, uint64(c.Height), uint64(c.Pitch), 1024); err != nil {
+		return Cursor{}, err
+	}
+
+	c.HasShape = true
+	return c, nil
+}
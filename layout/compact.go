@@ -0,0 +1,82 @@
+package layout
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Compact moves the segments towards the start of the region, closing the gaps left behind by the segments removed
+// in migrations, so that a long running region doesn't fragment until new segments no longer fit. The spec must
+// match the current layout, it provides the alignments the moved segments keep. Segment contents move along.
+//
+// Compaction stops the world: the peers must stop using their segment memory before it starts. While it runs the
+// magic is replaced by the in-progress marker, afterwards the generation is bumped, so peers find out from
+// Layout.Stale that they have to reopen the layout.
+func Compact(mem []byte, spec Spec) (*Layout, error) {
+	old, err := Open(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+
+	if err := old.matches(spec.Version, specSegments(spec)); err != nil {
+		return nil, err
+	}
+
+	align := make(map[string]uint64, len(spec.Segments))
+	for _, s := range spec.Segments {
+		align[s.Name] = s.alignment()
+	}
+
+	// Placing the segments in ascending offset order only ever moves them down, past data already moved
+	order := make([]int, len(old.segments))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return old.segments[order[i]].Offset < old.segments[order[j]].Offset })
+
+	segments := old.Segments()
+	offset := uint64(HeaderSize + len(segments)*EntrySize)
+	for _, i := range order {
+		seg := &segments[i]
+		a := align[seg.Name]
+		offset = (offset + a - 1) &^ (a - 1)
+		if offset > seg.Offset {
+			return nil, fmt.Errorf("%w: segment %q at %#x is not aligned to %d", ErrLayoutMismatch, seg.Name, seg.Offset, a)
+		}
+
+		seg.Offset = offset
+		offset += seg.Size
+	}
+
+	if err := claim(mem, old); err != nil {
+		return nil, err
+	}
+
+	for _, i := range order {
+		from, to := old.segments[i], segments[i]
+		if from.Offset != to.Offset {
+			copy(mem[to.Offset:to.Offset+to.Size], mem[from.Offset:from.Offset+from.Size])
+		}
+	}
+
+	generation := old.generation + 1
+	if err := write(mem, old.version, generation, segments, 0); err != nil {
+		return nil, err
+	}
+
+	return &Layout{mem: mem, version: old.version, generation: generation, segments: segments}, nil
+}
+
+// specSegments returns the segments of the spec without placing them.
+func specSegments(spec Spec) []Segment {
+	segments := make([]Segment, len(spec.Segments))
+	for i, s := range spec.Segments {
+		segments[i] = Segment{Name: s.Name, Type: s.Type, Size: s.Size}
+	}
+
+	return segments
+}
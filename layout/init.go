@@ -0,0 +1,313 @@
+package layout
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+var ErrInvalidSpec = errors.New("invalid layout spec")
+var ErrLayoutMismatch = errors.New("layout mismatch")
+var ErrInitTimeout = errors.New("timed out waiting for the peer to initialize the layout")
+var ErrInitTakenOver = errors.New("the layout initialization was taken over by a peer")
+
+// DefaultAlign is the alignment of the segments which don't ask for one, a cache line.
+const DefaultAlign = 64
+
+// InitTimeout is how long Initialize waits for a peer which started initializing the region first, before presuming
+// it dead and taking the initialization over.
+var InitTimeout = 5 * time.Second
+
+// Spec describes the segments a region should be split into.
+type Spec struct {
+	Version  uint32        `json:"version"` // Application defined version of the layout
+	Segments []SegmentSpec `json:"segments"`
+
+	// Quotas caps the total segment size of the owners in bytes, owners missing here are not limited
+	Quotas map[string]uint64 `json:"quotas,omitempty"`
+}
+
+// SegmentSpec describes a single segment.
+type SegmentSpec struct {
+	Name  string `json:"name"`
+	Type  Type   `json:"type"`
+	Size  uint64 `json:"size"`
+	Align uint64 `json:"align,omitempty"` // Alignment of the segment offset, a power of two, zero means DefaultAlign
+	Owner string `json:"owner,omitempty"` // Component the segment belongs to, for the quotas
+}
+
+// Plan validates the spec and computes the segments for a region of the given size. The segments end before the
+// last ivshmem.MarkerSize bytes, which hold the marker of the device.
+func (s Spec) Plan(size uint64) ([]Segment, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+
+	offset := uint64(HeaderSize + len(s.Segments)*EntrySize)
+	segments := make([]Segment, 0, len(s.Segments))
+	for _, spec := range s.Segments {
+		align := spec.alignment()
+		offset = (offset + align - 1) &^ (align - 1)
+		segments = append(segments, Segment{Name: spec.Name, Type: spec.Type, Offset: offset, Size: spec.Size})
+		offset += spec.Size
+	}
+
+	if offset > usable(size) {
+		return nil, fmt.Errorf("%w: the layout needs %d bytes and the marker %d, the region has %d", ErrRegionTooSmall,
+			offset, ivshmem.MarkerSize, size)
+	}
+
+	return segments, nil
+}
+
+// usable returns the bytes of a region of the size the segments may take, everything but the marker at its end.
+func usable(size uint64) uint64 {
+	if size < ivshmem.MarkerSize {
+		return 0
+	}
+
+	return size - ivshmem.MarkerSize
+}
+
+// check validates the segment names, alignments and quotas.
+func (s Spec) check() error {
+	seen := make(map[string]bool, len(s.Segments))
+	for _, spec := range s.Segments {
+		if spec.Name == "" || len(spec.Name) > MaxNameLength {
+			return fmt.Errorf("%w: segment name %q must have 1 to %d bytes", ErrInvalidSpec, spec.Name, MaxNameLength)
+		}
+
+		if seen[spec.Name] {
+			return fmt.Errorf("%w: duplicate segment %q", ErrInvalidSpec, spec.Name)
+		}
+		seen[spec.Name] = true
+
+		if align := spec.alignment(); align&(align-1) != 0 {
+			return fmt.Errorf("%w: alignment %d of %q is not a power of two", ErrInvalidSpec, align, spec.Name)
+		}
+	}
+
+	return s.checkQuotas()
+}
+
+// alignment returns the alignment of the segment offset.
+func (s SegmentSpec) alignment() uint64 {
+	if s.Align == 0 {
+		return DefaultAlign
+	}
+
+	return s.Align
+}
+
+// Initialize lays out the region according to the spec exactly once. The first peer to swap the zero magic writes
+// the header and the segment table, every other call waits for it and checks that the existing layout matches the
+// spec, so either side may come up first and repeated calls are no-ops. The region must be zeroed on first use, as
+// a fresh ivshmem backing file is.
+//
+// The initializing peer records a random owner token in the header. A waiting peer which sees the same owner stall
+// for InitTimeout presumes it crashed, swaps in its own token, bumps the initialization epoch and writes the layout
+// itself. The stalled peer checks its token before writing and before publishing, so one which was merely slow
+// fails with ErrInitTakenOver instead of overwriting the new owner, and goes back to waiting.
+func Initialize(mem []byte, spec Spec) (*Layout, error) {
+	if len(mem) < HeaderSize {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	segments, err := spec.Plan(uint64(len(mem)))
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		fresh, err := begin(mem, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		if !fresh {
+			break
+		}
+
+		// Only fails if another peer took over in turn, it then publishes the layout
+		if err := write(mem, spec.Version, 0, segments, owner); err == nil {
+			return &Layout{mem: mem, version: spec.Version, segments: segments}, nil
+		}
+	}
+
+	l, err := Open(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.matches(spec.Version, segments); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Attach opens the layout another peer initializes, waiting up to InitTimeout for it to show up, and checks that it
+// matches the spec. It is for the sides which must never lay out the region themselves, like a guest attaching to
+// the layout of the host: a host and a guest built against different versions of the application fail here with
+// ErrLayoutMismatch instead of corrupting each other.
+func Attach(mem []byte, spec Spec) (*Layout, error) {
+	if len(mem) < HeaderSize {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(InitTimeout)
+	for {
+		if magic := atomic.LoadUint32(magicPtr(mem)); magic != 0 && magic != initializing {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrInitTimeout
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	l, err := Open(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.Check(spec); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Check returns ErrLayoutMismatch unless the layout has the version of the spec and its segments, with the same
+// names, types and sizes in the same order.
+func (l Layout) Check(spec Spec) error {
+	return l.matches(spec.Version, specSegments(spec))
+}
+
+// write fills in the header and the table, publishing them by storing the magic last. A non zero owner must still
+// own the initialization of the region, ErrInitTakenOver is returned otherwise and nothing is published.
+func write(mem []byte, version, generation uint32, segments []Segment, owner uint64) error {
+	if owner != 0 && atomic.LoadUint64(ownerPtr(mem)) != owner {
+		return takenOver(mem)
+	}
+
+	table := mem[HeaderSize : HeaderSize+len(segments)*EntrySize]
+	for i, seg := range segments {
+		encodeEntry(table[i*EntrySize:], seg)
+	}
+
+	binary.LittleEndian.PutUint16(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offLayoutVersion:], version)
+	binary.LittleEndian.PutUint32(mem[offCount:], uint32(len(segments)))
+	binary.LittleEndian.PutUint64(mem[offRegionSize:], uint64(len(mem)))
+	binary.LittleEndian.PutUint32(mem[offTableCRC:], crc32.ChecksumIEEE(table))
+	atomic.StoreUint32(generationPtr(mem), generation)
+	if owner != 0 && !atomic.CompareAndSwapUint64(ownerPtr(mem), owner, 0) {
+		return takenOver(mem)
+	}
+
+	atomic.StoreUint32(magicPtr(mem), Magic)
+	return nil
+}
+
+// takenOver returns ErrInitTakenOver with the current initialization epoch.
+func takenOver(mem []byte) error {
+	return fmt.Errorf("%w: initialization epoch %d", ErrInitTakenOver, atomic.LoadUint32(epochPtr(mem)))
+}
+
+// newOwner returns a random non zero token identifying an initialization.
+func newOwner() (uint64, error) {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, fmt.Errorf("generate owner token: %w", err)
+		}
+
+		if owner := binary.LittleEndian.Uint64(buf[:]); owner != 0 {
+			return owner, nil
+		}
+	}
+}
+
+// begin claims the initialization of a fresh region for the owner, or waits for the peer initializing it. It returns
+// true if the caller must write the layout, because it swapped the zero magic or took over a stalled peer.
+func begin(mem []byte, owner uint64) (bool, error) {
+	if atomic.CompareAndSwapUint32(magicPtr(mem), 0, initializing) {
+		if atomic.CompareAndSwapUint64(ownerPtr(mem), 0, owner) {
+			return true, nil
+		}
+	}
+
+	return waitInitialized(mem, owner)
+}
+
+// waitInitialized waits until the peer initializing the region is done. A peer holding a fresh region for
+// InitTimeout without progress is taken over for the owner, returning true, and so is a fresh region left without an
+// owner token by a peer which died between swapping the magic and recording its token. Migrations and compactions of
+// a live layout have no owner token either but keep the region size of the published header, they are never taken
+// over: their half moved segments can't be rebuilt from the spec.
+func waitInitialized(mem []byte, owner uint64) (bool, error) {
+	stalled := atomic.LoadUint64(ownerPtr(mem))
+	deadline := time.Now().Add(InitTimeout)
+	for atomic.LoadUint32(magicPtr(mem)) == initializing {
+		if current := atomic.LoadUint64(ownerPtr(mem)); current != stalled {
+			// Another peer took over, it gets its own time
+			stalled, deadline = current, time.Now().Add(InitTimeout)
+		}
+
+		if time.Now().After(deadline) {
+			if owner == 0 || stalled == 0 && binary.LittleEndian.Uint64(mem[offRegionSize:]) != 0 {
+				return false, ErrInitTimeout
+			}
+
+			if atomic.CompareAndSwapUint64(ownerPtr(mem), stalled, owner) {
+				atomic.AddUint32(epochPtr(mem), 1)
+				return true, nil
+			}
+
+			continue
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return false, nil
+}
+
+// matches checks that the layout has the version and the named segments of the given types and sizes.
+func (l Layout) matches(version uint32, segments []Segment) error {
+	if l.version != version {
+		return fmt.Errorf("%w: region has layout version %d, want %d", ErrLayoutMismatch, l.version, version)
+	}
+
+	if len(l.segments) != len(segments) {
+		return fmt.Errorf("%w: region has %d segments, want %d", ErrLayoutMismatch, len(l.segments), len(segments))
+	}
+
+	for i, seg := range segments {
+		// The offsets may differ after a migration, the peers look them up in the table anyway
+		got := l.segments[i]
+		if got.Name != seg.Name || got.Type != seg.Type || got.Size != seg.Size {
+			return fmt.Errorf("%w: region has segment %+v, want %+v", ErrLayoutMismatch, got, seg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package layout_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/layout"
+)
+
+func TestInitializeTakesOverStalledPeer(t *testing.T) {
+	defer func(timeout time.Duration) { layout.InitTimeout = timeout }(layout.InitTimeout)
+	layout.InitTimeout = 10 * time.Millisecond
+
+	// A peer swapped the magic for the in-progress marker, recorded its owner token and crashed
+	mem := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(mem[0:], 0x54494e49)
+	binary.LittleEndian.PutUint64(mem[32:], 0xdead)
+
+	spec := layout.Spec{Version: 3, Segments: []layout.SegmentSpec{{Name: "ring", Type: layout.TypeRing, Size: 1024}}}
+	l, err := layout.Initialize(mem, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Version() != 3 {
+		t.Errorf("want layout version 3, got %d", l.Version())
+	}
+
+	if owner, epoch := binary.LittleEndian.Uint64(mem[32:]), binary.LittleEndian.Uint32(mem[40:]); owner != 0 || epoch != 1 {
+		t.Errorf("want the owner cleared and epoch 1, got owner %#x and epoch %d", owner, epoch)
+	}
+
+	if _, err := layout.Open(mem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitializeTakesOverUnclaimedRegion(t *testing.T) {
+	defer func(timeout time.Duration) { layout.InitTimeout = timeout }(layout.InitTimeout)
+	layout.InitTimeout = 10 * time.Millisecond
+
+	// A peer swapped the magic for the in-progress marker and crashed before recording its owner token
+	mem := make([]byte, 4096)
+	binary.LittleEndian.PutUint32(mem[0:], 0x54494e49)
+
+	spec := layout.Spec{Version: 1, Segments: []layout.SegmentSpec{{Name: "ring", Type: layout.TypeRing, Size: 1024}}}
+	if _, err := layout.Initialize(mem, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if epoch := binary.LittleEndian.Uint32(mem[40:]); epoch != 1 {
+		t.Errorf("want epoch 1, got %d", epoch)
+	}
+
+	// A migration of the published layout has no owner token either, but must never be taken over
+	binary.LittleEndian.PutUint32(mem[0:], 0x54494e49)
+	if _, err := layout.Initialize(mem, spec); !errors.Is(err, layout.ErrInitTimeout) {
+		t.Errorf("stalled migration: want ErrInitTimeout, got %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+// Package layout splits the shared memory region into named segments. A header and a segment table at offset zero
+// describe the segments, so both sides resolve names to offsets from the region itself instead of agreeing on them
+// out of band.
+package layout
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrNoSegment = errors.New("no such segment")
+
+const (
+	Magic      uint32 = 0x594c5649 // "IVLY" when read as little endian bytes
+	Version    uint16 = 1
+	HeaderSize        = 64
+	EntrySize         = 64
+
+	// MaxNameLength is the longest segment name fitting into a table entry.
+	MaxNameLength = 40
+)
+
+// initializing is stored in place of the magic while a peer writes the header.
+const initializing uint32 = 0x54494e49 // "INIT"
+
+// Header field offsets, all the values are little endian.
+const (
+	offMagic         = 0
+	offVersion       = 4
+	offLayoutVersion = 8
+	offCount         = 12
+	offRegionSize    = 16
+	offTableCRC      = 24
+	offGeneration    = 28
+	offInitOwner     = 32 // Token of the peer initializing a fresh region (uint64), zero once published
+	offInitEpoch     = 40 // Number of stalled initializations taken over (uint32)
+)
+
+// Table entry field offsets.
+const (
+	entName   = 0
+	entType   = 40
+	entOffset = 48
+	entSize   = 56
+)
+
+// Segment is a named part of the region.
+type Segment struct {
+	Name   string
+	Type   Type
+	Offset uint64
+	Size   uint64
+}
+
+// Layout is a view of the segments of an initialized region.
+type Layout struct {
+	mem        []byte
+	version    uint32
+	generation uint32
+	segments   []Segment
+}
+
+// Open validates the header and the segment table written by Initialize and returns the layout.
+func Open(mem []byte) (*Layout, error) {
+	if len(mem) < HeaderSize {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	if magic := atomic.LoadUint32(magicPtr(mem)); magic != Magic {
+		return nil, fmt.Errorf("%w: %#x", ErrInvalidMagic, magic)
+	}
+
+	if version := binary.LittleEndian.Uint16(mem[offVersion:]); version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	if size := binary.LittleEndian.Uint64(mem[offRegionSize:]); size != uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: laid out for %d bytes, the region has %d", ErrInvalidHeader, size, len(mem))
+	}
+
+	count := uint64(binary.LittleEndian.Uint32(mem[offCount:]))
+	tableEnd := HeaderSize + count*EntrySize
+	if tableEnd > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: table of %d segments overflows the region", ErrInvalidHeader, count)
+	}
+
+	table := mem[HeaderSize:tableEnd]
+	if sum := crc32.ChecksumIEEE(table); sum != binary.LittleEndian.Uint32(mem[offTableCRC:]) {
+		return nil, fmt.Errorf("%w: segment table checksum mismatch", ErrInvalidHeader)
+	}
+
+	l := &Layout{
+		mem:        mem,
+		version:    binary.LittleEndian.Uint32(mem[offLayoutVersion:]),
+		generation: atomic.LoadUint32(generationPtr(mem)),
+	}
+	for i := uint64(0); i < count; i++ {
+		seg := decodeEntry(table[i*EntrySize:])
+		if seg.Offset < tableEnd || seg.Offset > uint64(len(mem)) || seg.Size > uint64(len(mem))-seg.Offset {
+			return nil, fmt.Errorf("%w: segment %q out of bounds", ErrInvalidHeader, seg.Name)
+		}
+
+		l.segments = append(l.segments, seg)
+	}
+
+	return l, nil
+}
+
+// Version returns the application defined version of the layout.
+func (l Layout) Version() uint32 {
+	return l.version
+}
+
+// Generation returns the number of times the segments were moved around by Migrate or Compact.
+func (l Layout) Generation() uint32 {
+	return l.generation
+}
+
+// Stale reports whether a peer moved the segments since the layout was opened, or is moving them right now. The
+// memory returned by Bytes must not be used anymore then, reopen the layout instead.
+func (l Layout) Stale() bool {
+	return atomic.LoadUint32(magicPtr(l.mem)) != Magic || atomic.LoadUint32(generationPtr(l.mem)) != l.generation
+}
+
+// Segments returns the segments in the table order.
+func (l Layout) Segments() []Segment {
+	return append([]Segment(nil), l.segments...)
+}
+
+// Lookup returns the segment with the name.
+func (l Layout) Lookup(name string) (Segment, error) {
+	for _, seg := range l.segments {
+		if seg.Name == name {
+			return seg, nil
+		}
+	}
+
+	return Segment{}, fmt.Errorf("%w: %q", ErrNoSegment, name)
+}
+
+// Bytes returns the memory of the segment with the name.
+func (l Layout) Bytes(name string) ([]byte, error) {
+	seg, err := l.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.mem[seg.Offset : seg.Offset+seg.Size : seg.Offset+seg.Size], nil
+}
+
+// encodeEntry writes the segment into the table entry.
+func encodeEntry(buf []byte, seg Segment) {
+	for i := range buf[:EntrySize] {
+		buf[i] = 0
+	}
+
+	copy(buf[entName:entName+MaxNameLength], seg.Name)
+	binary.LittleEndian.PutUint32(buf[entType:], uint32(seg.Type))
+	binary.LittleEndian.PutUint64(buf[entOffset:], seg.Offset)
+	binary.LittleEndian.PutUint64(buf[entSize:], seg.Size)
+}
+
+// decodeEntry reads the segment from the table entry.
+func decodeEntry(buf []byte) Segment {
+	name := buf[entName : entName+MaxNameLength]
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+
+	return Segment{
+		Name:   string(name),
+		Type:   Type(binary.LittleEndian.Uint32(buf[entType:])),
+		Offset: binary.LittleEndian.Uint64(buf[entOffset:]),
+		Size:   binary.LittleEndian.Uint64(buf[entSize:]),
+	}
+}
+
+// generationPtr returns the generation field for atomic access.
+func generationPtr(mem []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[offGeneration]))
+}
+
+// ownerPtr returns the initialization owner field for atomic access.
+func ownerPtr(mem []byte) *uint64 {
+	return (*uint64)(unsafe.Pointer(&mem[offInitOwner]))
+}
+
+// epochPtr returns the initialization epoch field for atomic access.
+func epochPtr(mem []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[offInitEpoch]))
+}
+
+// magicPtr returns the magic field for atomic access.
+func magicPtr(mem []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[offMagic]))
+}
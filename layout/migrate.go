@@ -0,0 +1,230 @@
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+var ErrUnsafeMigration = errors.New("unsafe layout migration")
+
+// Migration customizes Migrate, the hooks may be nil.
+type Migration struct {
+	// Init is called for every segment added by the migration, after its memory has been zeroed.
+	Init func(seg Segment, mem []byte) error
+
+	// Drop is called for every segment removed by the migration, before its memory may be reused.
+	Drop func(seg Segment, mem []byte) error
+}
+
+// Migrate moves the region to the layout of the spec, so that one side can be upgraded while the other keeps running.
+// Segments present in both layouts keep their place and contents, new segments are placed into the free space and
+// zeroed, removed segments are released. Changes which would corrupt the data of a live peer are refused with
+// ErrUnsafeMigration: going back to an older layout version, changing the type or the size of a kept segment, or
+// growing the table over a kept segment. A fresh region is initialized like Initialize does.
+//
+// The peers must not use the removed segments anymore. While the migration runs the magic is replaced by the
+// in-progress marker, so peers attaching in the meantime wait for it in Initialize.
+func Migrate(mem []byte, spec Spec, m Migration) (*Layout, error) {
+	if len(mem) < HeaderSize {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	if err := spec.check(); err != nil {
+		return nil, err
+	}
+
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	fresh, err := begin(mem, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var old *Layout
+	restore := uint32(0)
+	if !fresh {
+		owner = 0
+		if old, err = Open(mem); err != nil {
+			return nil, err
+		}
+
+		if planned, err := spec.Plan(uint64(len(mem))); err == nil && old.matches(spec.Version, planned) == nil {
+			return old, nil
+		}
+
+		if err := claim(mem, old); err != nil {
+			return nil, err
+		}
+		restore = Magic
+	}
+
+	segments, dropped, err := planMigration(old, spec, uint64(len(mem)))
+	if err == nil {
+		err = apply(mem, segments, dropped, old, m)
+	}
+
+	if err != nil {
+		if fresh {
+			atomic.StoreUint64(ownerPtr(mem), 0)
+		}
+
+		atomic.StoreUint32(magicPtr(mem), restore)
+		return nil, err
+	}
+
+	generation := uint32(0)
+	if old != nil {
+		generation = old.generation + 1
+	}
+
+	if err := write(mem, spec.Version, generation, segments, owner); err != nil {
+		return nil, err
+	}
+
+	return &Layout{mem: mem, version: spec.Version, generation: generation, segments: segments}, nil
+}
+
+// claim swaps the magic of the opened layout for the in-progress marker, failing if another peer changed or is
+// changing the layout in the meantime.
+func claim(mem []byte, l *Layout) error {
+	if !atomic.CompareAndSwapUint32(magicPtr(mem), Magic, initializing) {
+		return fmt.Errorf("%w: another peer is changing the layout", ErrUnsafeMigration)
+	}
+
+	if atomic.LoadUint32(generationPtr(mem)) != l.generation {
+		atomic.StoreUint32(magicPtr(mem), Magic)
+		return fmt.Errorf("%w: another peer changed the layout", ErrUnsafeMigration)
+	}
+
+	return nil
+}
+
+// planMigration places the segments of the spec around the kept segments of the old layout and returns the new
+// segments in the spec order, along with the dropped ones.
+func planMigration(old *Layout, spec Spec, size uint64) ([]Segment, []Segment, error) {
+	if old == nil {
+		segments, err := spec.Plan(size)
+		return segments, nil, err
+	}
+
+	if spec.Version < old.version {
+		return nil, nil, fmt.Errorf("%w: downgrade from version %d to %d", ErrUnsafeMigration, old.version, spec.Version)
+	}
+
+	tableEnd := uint64(HeaderSize + len(spec.Segments)*EntrySize)
+	segments := make([]Segment, len(spec.Segments))
+	placed := make([]bool, len(spec.Segments))
+	var used []Segment
+	for i, s := range spec.Segments {
+		prev, err := old.Lookup(s.Name)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case prev.Type != s.Type:
+			return nil, nil, fmt.Errorf("%w: segment %q changes type from %s to %s", ErrUnsafeMigration, s.Name, prev.Type, s.Type)
+		case prev.Size != s.Size:
+			return nil, nil, fmt.Errorf("%w: segment %q changes size from %d to %d", ErrUnsafeMigration, s.Name, prev.Size, s.Size)
+		case prev.Offset < tableEnd:
+			return nil, nil, fmt.Errorf("%w: the segment table grows over segment %q", ErrUnsafeMigration, s.Name)
+		case prev.Offset&(s.alignment()-1) != 0:
+			return nil, nil, fmt.Errorf("%w: segment %q at %#x is not aligned to %d", ErrUnsafeMigration, s.Name, prev.Offset, s.alignment())
+		}
+
+		segments[i], placed[i] = prev, true
+		used = append(used, prev)
+	}
+
+	for i, s := range spec.Segments {
+		if placed[i] {
+			continue
+		}
+
+		offset, ok := firstFit(used, tableEnd, usable(size), s.Size, s.alignment())
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no room for the new segment %q of %d bytes", ErrRegionTooSmall, s.Name, s.Size)
+		}
+
+		segments[i] = Segment{Name: s.Name, Type: s.Type, Offset: offset, Size: s.Size}
+		used = append(used, segments[i])
+	}
+
+	var dropped []Segment
+	for _, prev := range old.segments {
+		if !containsSegment(segments, prev.Name) {
+			dropped = append(dropped, prev)
+		}
+	}
+
+	return segments, dropped, nil
+}
+
+// apply runs the hooks of the dropped segments, then zeroes and initializes the new ones.
+func apply(mem []byte, segments, dropped []Segment, old *Layout, m Migration) error {
+	for _, seg := range dropped {
+		if m.Drop == nil {
+			continue
+		}
+
+		if err := m.Drop(seg, mem[seg.Offset:seg.Offset+seg.Size]); err != nil {
+			return fmt.Errorf("drop segment %q: %w", seg.Name, err)
+		}
+	}
+
+	for _, seg := range segments {
+		if old != nil && containsSegment(old.segments, seg.Name) {
+			continue
+		}
+
+		data := mem[seg.Offset : seg.Offset+seg.Size]
+		for i := range data {
+			data[i] = 0
+		}
+
+		if m.Init == nil {
+			continue
+		}
+
+		if err := m.Init(seg, data); err != nil {
+			return fmt.Errorf("init segment %q: %w", seg.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// firstFit returns the lowest aligned offset from start on where size bytes don't overlap the used segments.
+func firstFit(used []Segment, start, regionSize, size, align uint64) (uint64, bool) {
+	sorted := append([]Segment(nil), used...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	offset := (start + align - 1) &^ (align - 1)
+	for _, seg := range sorted {
+		if offset+size <= seg.Offset {
+			break
+		}
+
+		if end := seg.Offset + seg.Size; end > offset {
+			offset = (end + align - 1) &^ (align - 1)
+		}
+	}
+
+	return offset, offset <= regionSize && size <= regionSize-offset
+}
+
+// containsSegment reports whether a segment with the name is in the list.
+func containsSegment(segments []Segment, name string) bool {
+	for _, seg := range segments {
+		if seg.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quotas tracks the bytes held by every owner and caps them, so one misbehaving component sharing the region can't
+// exhaust it for the others. Owners without a quota are not limited. It is safe for concurrent use.
+type Quotas struct {
+	mu     sync.Mutex
+	limits map[string]uint64
+	usage  map[string]uint64
+}
+
+// NewQuotas returns a tracker enforcing the per owner limits in bytes.
+func NewQuotas(limits map[string]uint64) *Quotas {
+	q := &Quotas{limits: make(map[string]uint64, len(limits)), usage: make(map[string]uint64)}
+	for owner, limit := range limits {
+		q.limits[owner] = limit
+	}
+
+	return q
+}
+
+// Charge accounts size more bytes to the owner, it fails without charging anything if that exceeds the quota.
+func (q *Quotas) Charge(owner string, size uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	used := q.usage[owner]
+	if limit, ok := q.limits[owner]; ok && (used+size < used || used+size > limit) {
+		return fmt.Errorf("%w: owner %q holds %d bytes, %d more exceed the quota of %d: %w",
+			ErrQuotaExceeded, owner, used, size, limit, ivshmem.ErrResourceExhausted)
+	}
+
+	q.usage[owner] = used + size
+	return nil
+}
+
+// Release returns size bytes of the owner.
+func (q *Quotas) Release(owner string, size uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if used := q.usage[owner]; used > size {
+		q.usage[owner] = used - size
+	} else {
+		delete(q.usage, owner)
+	}
+}
+
+// Usage returns the bytes currently held by the owner.
+func (q *Quotas) Usage(owner string) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[owner]
+}
+
+// Limit returns the quota of the owner, false if it has none.
+func (q *Quotas) Limit(owner string) (uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit, ok := q.limits[owner]
+	return limit, ok
+}
+
+// checkQuotas charges the segments of the spec to their owners.
+func (s Spec) checkQuotas() error {
+	if len(s.Quotas) == 0 {
+		return nil
+	}
+
+	q := NewQuotas(s.Quotas)
+	for _, seg := range s.Segments {
+		if err := q.Charge(seg.Owner, seg.Size); err != nil {
+			return fmt.Errorf("segment %q: %w", seg.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package layout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type tells the peers what lives in a segment. The values from TypeUser up are free for the applications.
+type Type uint32
+
+const (
+	TypeRaw Type = iota
+	TypeRing
+	TypeMailbox
+	TypeKV
+	TypeFramebuffer
+	TypeErrorLog
+	TypePubSub
+	TypeJournal
+	TypeArena
+
+	TypeUser Type = 0x10000
+)
+
+var typeNames = map[Type]string{
+	TypeRaw:         "raw",
+	TypeRing:        "ring",
+	TypeMailbox:     "mailbox",
+	TypeKV:          "kv",
+	TypeFramebuffer: "framebuffer",
+	TypeErrorLog:    "errlog",
+	TypePubSub:      "pubsub",
+	TypeJournal:     "journal",
+	TypeArena:       "arena",
+}
+
+// String returns the name of the type.
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t Type) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, it accepts the type names and plain numbers.
+func (t *Type) UnmarshalText(text []byte) error {
+	for typ, name := range typeNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+
+	n, err := strconv.ParseUint(string(text), 0, 32)
+	if err != nil {
+		return fmt.Errorf("%w: unknown segment type %q", ErrInvalidSpec, text)
+	}
+
+	*t = Type(n)
+	return nil
+}
+
+// ParseSpec reads a JSON layout spec, for example:
+//
+//	{"version": 1, "segments": [{"name": "events", "type": "ring", "size": 65536, "align": 4096}]}
+func ParseSpec(r io.Reader) (Spec, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var spec Spec
+	if err := dec.Decode(&spec); err != nil {
+		return Spec{}, fmt.Errorf("%w: %w", ErrInvalidSpec, err)
+	}
+
+	return spec, nil
+}
+
+// Validate checks that the spec is well formed and fits into a region of the given size.
+func (s Spec) Validate(size uint64) error {
+	_, err := s.Plan(size)
+	return err
+}
+
+// WriteCHeader generates a C header describing the layout for a region of the given size, so C peers find the
+// segments without parsing the table. The macros are prefixed with the prefix, the segment names are converted to
+// upper case identifiers. Segment names converting to the same identifier, like "a-b" and "a_b", are rejected.
+func (s Spec) WriteCHeader(w io.Writer, prefix string, size uint64) error {
+	segments, err := s.Plan(size)
+	if err != nil {
+		return err
+	}
+
+	idents := make(map[string]string, len(segments))
+	for _, seg := range segments {
+		ident := cIdent(seg.Name)
+		if other, ok := idents[ident]; ok {
+			return fmt.Errorf("%w: segments %q and %q both define %s", ErrInvalidSpec, other, seg.Name, ident)
+		}
+
+		idents[ident] = seg.Name
+	}
+
+	prefix = cIdent(prefix)
+	guard := prefix + "_LAYOUT_H"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/* Generated by the ivshmem layout package, do not edit. */\n")
+	fmt.Fprintf(&b, "#ifndef %s\n#define %s\n\n", guard, guard)
+	fmt.Fprintf(&b, "#define %s_LAYOUT_MAGIC 0x%08xu\n", prefix, Magic)
+	fmt.Fprintf(&b, "#define %s_LAYOUT_FORMAT_VERSION %du\n", prefix, Version)
+	fmt.Fprintf(&b, "#define %s_LAYOUT_VERSION %du\n", prefix, s.Version)
+	fmt.Fprintf(&b, "#define %s_REGION_SIZE %dull\n", prefix, size)
+	for _, seg := range segments {
+		name := prefix + "_" + cIdent(seg.Name)
+		fmt.Fprintf(&b, "\n/* %s: %s */\n", seg.Name, seg.Type)
+		fmt.Fprintf(&b, "#define %s_TYPE %du\n", name, uint32(seg.Type))
+		fmt.Fprintf(&b, "#define %s_OFFSET %dull\n", name, seg.Offset)
+		fmt.Fprintf(&b, "#define %s_SIZE %dull\n", name, seg.Size)
+	}
+	fmt.Fprintf(&b, "\n#endif /* %s */\n", guard)
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// cIdent converts the name into an upper case C identifier.
+func cIdent(name string) string {
+	ident := []byte(strings.ToUpper(name))
+	for i, c := range ident {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			ident[i] = '_'
+		}
+	}
+
+	if len(ident) > 0 && ident[0] >= '0' && ident[0] <= '9' {
+		return "_" + string(ident)
+	}
+
+	return string(ident)
+}
@@ -0,0 +1,20 @@
+package layout_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/TypicalAM/ivshmem/layout"
+)
+
+func TestWriteCHeaderRejectsCollidingNames(t *testing.T) {
+	spec := layout.Spec{Version: 1, Segments: []layout.SegmentSpec{
+		{Name: "a-b", Type: layout.TypeRaw, Size: 64},
+		{Name: "a_b", Type: layout.TypeRaw, Size: 64},
+	}}
+
+	if err := spec.WriteCHeader(io.Discard, "shm", 4096); !errors.Is(err, layout.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LegacyNotifier delivers interrupts using the register model of the original ivshmem revision, for old images and
+// devices without MSI. The doorbell register rings the peers and the Interrupt Status register is polled for incoming
+// interrupts. The device then has a single interrupt, so every vector rung by a peer arrives on vector 0.
+//
+// The Interrupt Mask stays cleared: without a kernel driver handling the INTx line, unmasking it would only get the
+// interrupt disabled by the kernel.
+type LegacyNotifier struct {
+	regs     *registers
+	interval time.Duration
+
+	mu        sync.Mutex
+	listeners []chan struct{}
+	closed    bool
+	done      chan struct{}
+}
+
+// NewLegacyNotifier maps the registers of the device at the location and starts polling them at the given interval,
+// which must be positive.
+func NewLegacyNotifier(location PCILocation, interval time.Duration) (*LegacyNotifier, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%w: poll interval %s", ErrInvalidArgument, interval)
+	}
+
+	dev, err := findDevice(location)
+	if err != nil {
+		return nil, err
+	}
+
+	regs, err := mapRegisters(devicePath(dev.dir, "resource0"))
+	if err != nil {
+		return nil, fmt.Errorf("map registers: %w", err)
+	}
+
+	n := &LegacyNotifier{regs: regs, interval: interval, done: make(chan struct{})}
+	go n.poll()
+	return n, nil
+}
+
+// Notify rings the doorbell of the peer on the given vector.
+func (n *LegacyNotifier) Notify(peer, vector uint16) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrClosed
+	}
+
+	n.regs.write(regDoorbell, uint32(peer)<<16|uint32(vector))
+	return nil
+}
+
+// Listen returns a channel receiving the interrupts, only vector 0 exists in the legacy model.
+func (n *LegacyNotifier) Listen(vector uint16) (<-chan struct{}, error) {
+	if vector != 0 {
+		return nil, fmt.Errorf("%w: the legacy model only has vector 0, got %d", ErrInvalidVector, vector)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+
+	ch := make(chan struct{}, 1)
+	n.listeners = append(n.listeners, ch)
+	return ch, nil
+}
+
+// IVPosition returns the peer ID of this guest, it fails once the notifier is closed.
+func (n *LegacyNotifier) IVPosition() (uint16, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return 0, ErrClosed
+	}
+
+	return uint16(n.regs.read(regIVPosition)), nil
+}
+
+// Close stops the polling, closes the listener channels and unmaps the registers.
+func (n *LegacyNotifier) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+
+	n.closed = true
+	close(n.done)
+	for _, ch := range n.listeners {
+		close(ch)
+	}
+
+	n.listeners = nil
+	n.mu.Unlock()
+	return n.regs.unmap()
+}
+
+// poll reads the Interrupt Status register, which is cleared by the read, and wakes the listeners.
+func (n *LegacyNotifier) poll() {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if !n.closed && n.regs.read(regIntrStatus)&1 != 0 {
+			for _, ch := range n.listeners {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+		n.mu.Unlock()
+	}
+}
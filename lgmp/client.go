@@ -0,0 +1,249 @@
+package lgmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+// Client is the side consuming the queues of the host. The host is untrusted: everything it wrote is checked against
+// the bounds of the region before use.
+type Client struct {
+	mem     []byte
+	session uint32
+	id      uint32
+	udata   []byte
+	stamp   *uint64
+
+	lastStamp  uint64
+	lastChange time.Time
+}
+
+// Subscription is a subscription to a queue, used by one goroutine.
+type Subscription struct {
+	c        *Client
+	q        queue
+	id       uint
+	position uint32
+	current  bool
+}
+
+// NewClient validates the header written by the host and returns the client.
+func NewClient(mem []byte) (*Client, error) {
+	if err := checkRegion(mem); err != nil {
+		return nil, err
+	}
+
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	size := uint64(binary.LittleEndian.Uint32(mem[offUDataSize:]))
+	if offUData+size > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: %d bytes of user data", ErrInvalidHeader, size)
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("draw a client ID: %w", err)
+	}
+
+	c := &Client{
+		mem:     mem,
+		session: binary.LittleEndian.Uint32(mem[offSession:]),
+		id:      binary.LittleEndian.Uint32(id[:]) | 1,
+		udata:   append([]byte(nil), mem[offUData:offUData+size]...),
+		stamp:   (*uint64)(unsafe.Pointer(&mem[offTimestamp])),
+	}
+	c.lastStamp, c.lastChange = atomic.LoadUint64(c.stamp), time.Now()
+	return c, nil
+}
+
+// Session returns the session ID of the host the client was opened against.
+func (c *Client) Session() uint32 {
+	return c.session
+}
+
+// UData returns a copy of the user data of the host, taken by NewClient. Looking Glass hosts put their KVMFR header
+// there, for kvmfr.ParseHeader.
+func (c *Client) UData() []byte {
+	return append([]byte(nil), c.udata...)
+}
+
+// Valid reports whether the host the client was opened against is still alive: it fails with ErrSessionChanged once
+// another host took the region over and with ErrHostTimeout once the timestamp stood still for HostTimeout. The
+// client must be opened again after either.
+func (c *Client) Valid() error {
+	if atomic.LoadUint32((*uint32)(unsafe.Pointer(&c.mem[offMagic]))) != Magic ||
+		atomic.LoadUint32((*uint32)(unsafe.Pointer(&c.mem[offSession]))) != c.session {
+		return ErrSessionChanged
+	}
+
+	if stamp := atomic.LoadUint64(c.stamp); stamp != c.lastStamp {
+		c.lastStamp, c.lastChange = stamp, time.Now()
+	} else if time.Since(c.lastChange) > HostTimeout {
+		return ErrHostTimeout
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to the queue with the ID. The subscription receives the messages posted from now on.
+func (c *Client) Subscribe(queueID uint32) (*Subscription, error) {
+	if err := c.Valid(); err != nil {
+		return nil, err
+	}
+
+	q, err := c.queue(queueID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.lock(); err != nil {
+		return nil, err
+	}
+	defer q.unlock()
+
+	subs := atomic.LoadUint64(q.u64(qSubs))
+	taken := uint32(subs) | uint32(subs>>32)
+	for id := uint(0); id < MaxSubscribers; id++ {
+		bit := uint64(1) << id
+		if taken&uint32(bit) != 0 {
+			continue
+		}
+
+		atomic.StoreUint32(q.clientID(id), c.id)
+		atomic.StoreUint64(q.timeout(id), c.deadline())
+		atomic.StoreUint64(q.u64(qSubs), subs|bit)
+		atomic.AddUint32(q.u32(qNewSubs), 1)
+
+		position := atomic.LoadUint32(q.u32(qPosition)) % q.n
+		return &Subscription{c: c, q: q, id: id, position: position}, nil
+	}
+
+	return nil, fmt.Errorf("%w: queue %d", ErrTooManySubscribers, queueID)
+}
+
+// queue finds the queue with the ID and checks its header.
+func (c *Client) queue(id uint32) (queue, error) {
+	num := binary.LittleEndian.Uint32(c.mem[offNumQueues:])
+	if num > MaxQueues {
+		return queue{}, fmt.Errorf("%w: %d queues", ErrInvalidHeader, num)
+	}
+
+	for i := uint32(0); i < num; i++ {
+		q := queue{mem: c.mem, off: offQueues + uint64(i)*QueueHeaderSize}
+		if binary.LittleEndian.Uint32(c.mem[q.off+qID:]) != id {
+			continue
+		}
+
+		n := binary.LittleEndian.Uint32(c.mem[q.off+qNumMessages:])
+		ring := uint64(binary.LittleEndian.Uint32(c.mem[q.off+qMessages:]))
+		if n == 0 || ring%8 != 0 || ring+uint64(n)*MessageSize > uint64(len(c.mem)) {
+			return queue{}, fmt.Errorf("%w: queue %d has %d messages at %d", ErrInvalidHeader, id, n, ring)
+		}
+
+		q.ring, q.n = ring, n
+		return q, nil
+	}
+
+	return queue{}, fmt.Errorf("%w: %d", ErrNoQueue, id)
+}
+
+// deadline returns the heartbeat deadline of a subscriber processing now, on the clock of the host.
+func (c *Client) deadline() uint64 {
+	return atomic.LoadUint64(c.stamp) + uint64(SubscriberTimeout/time.Millisecond)
+}
+
+// Process returns the next message of the queue, or fails with ErrQueueEmpty when there is none. The message must be
+// finished with MessageDone before the next call; it fails with ErrTimedOut once the host gave up on the subscriber,
+// which must subscribe again.
+func (s *Subscription) Process() (Message, error) {
+	if err := s.check(); err != nil {
+		return Message{}, err
+	}
+
+	for {
+		if s.position == atomic.LoadUint32(s.q.u32(qPosition))%s.q.n {
+			return Message{}, ErrQueueEmpty
+		}
+
+		pending, msg := s.q.message(s.position)
+		if atomic.LoadUint32(pending)&(1<<s.id) == 0 {
+			// Posted before the subscription, or retired without it after a timeout
+			s.position = (s.position + 1) % s.q.n
+			continue
+		}
+
+		udata := binary.LittleEndian.Uint32(msg[msgUData:])
+		size := uint64(binary.LittleEndian.Uint32(msg[msgSize:]))
+		off := uint64(binary.LittleEndian.Uint32(msg[msgOffset:]))
+		if off+size > uint64(len(s.c.mem)) {
+			return Message{}, fmt.Errorf("%w: %d bytes at %d", ErrInvalidMessage, size, off)
+		}
+
+		s.current = true
+		return Message{UData: udata, Offset: uint32(off), Data: s.c.mem[off : off+size : off+size]}, nil
+	}
+}
+
+// MessageDone finishes the message returned by Process, letting the host retire it once every subscriber did.
+func (s *Subscription) MessageDone() error {
+	if !s.current {
+		return ErrNoMessage
+	}
+
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	pending, _ := s.q.message(s.position)
+	clearBits(pending, 1<<s.id)
+	s.position = (s.position + 1) % s.q.n
+	s.current = false
+	return nil
+}
+
+// Unsubscribe ends the subscription, the host stops posting to it.
+func (s *Subscription) Unsubscribe() error {
+	if err := s.c.Valid(); err != nil {
+		return err
+	}
+
+	if err := s.q.lock(); err != nil {
+		return err
+	}
+	defer s.q.unlock()
+
+	// The slot may already have been released and taken by another client
+	if atomic.LoadUint32(s.q.clientID(s.id)) != s.c.id {
+		return nil
+	}
+
+	bit := uint64(1) << s.id
+	subs := atomic.LoadUint64(s.q.u64(qSubs))
+	atomic.StoreUint64(s.q.u64(qSubs), subs&^(bit|bit<<32))
+	atomic.StoreUint32(s.q.clientID(s.id), 0)
+	s.current = false
+	return nil
+}
+
+// check checks the host and the subscription are alive and sends the heartbeat of the subscriber.
+func (s *Subscription) check() error {
+	if err := s.c.Valid(); err != nil {
+		return err
+	}
+
+	subs := atomic.LoadUint64(s.q.u64(qSubs))
+	if uint32(subs)&(1<<s.id) == 0 || atomic.LoadUint32(s.q.clientID(s.id)) != s.c.id {
+		return ErrTimedOut
+	}
+
+	atomic.StoreUint64(s.q.timeout(s.id), s.c.deadline())
+	return nil
+}
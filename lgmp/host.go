@@ -0,0 +1,284 @@
+package lgmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+// Host is the side owning the region: it allocates memory, adds queues and posts messages. Its methods must be called
+// by one goroutine.
+type Host struct {
+	mem     []byte
+	start   time.Time
+	next    uint64
+	queues  []*HostQueue
+	stamp   *uint64
+	session uint32
+}
+
+// HostQueue is a queue the host posts messages to.
+type HostQueue struct {
+	h *Host
+	q queue
+}
+
+// Memory is a piece of the region allocated by the host, posted as the payload of messages.
+type Memory struct {
+	Offset uint32
+	Data   []byte
+}
+
+// NewHost writes a fresh header with the user data into the region and returns the host. The header is only published
+// by the first call to Process, after the queues were added, so clients never see a header without them.
+func NewHost(mem []byte, udata []byte) (*Host, error) {
+	if err := checkRegion(mem); err != nil {
+		return nil, err
+	}
+
+	// The offsets are 32-bit, the memory behind them can't be handed out
+	if limit := uint64(math.MaxUint32); uint64(len(mem)) > limit {
+		mem = mem[:limit]
+	}
+
+	end := uint64(HeaderSize) + uint64(len(udata))
+	if end > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, end, len(mem))
+	}
+
+	var session [4]byte
+	if _, err := rand.Read(session[:]); err != nil {
+		return nil, fmt.Errorf("draw a session ID: %w", err)
+	}
+
+	// Clients may still hold a view of the last session, the magic goes away first
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mem[offMagic])), 0)
+	for i := range mem[offVersion:end] {
+		mem[offVersion+i] = 0
+	}
+
+	h := &Host{
+		mem:     mem,
+		start:   time.Now(),
+		next:    (end + Align - 1) &^ (Align - 1),
+		stamp:   (*uint64)(unsafe.Pointer(&mem[offTimestamp])),
+		session: binary.LittleEndian.Uint32(session[:]),
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offSession:], h.session)
+	binary.LittleEndian.PutUint32(mem[offUDataSize:], uint32(len(udata)))
+	copy(mem[offUData:], udata)
+	return h, nil
+}
+
+// Session returns the session ID of the host.
+func (h *Host) Session() uint32 {
+	return h.session
+}
+
+// Alloc allocates size bytes of the region, aligned to Align. The memory is never freed, allocate the buffers once
+// and post them over and over.
+func (h *Host) Alloc(size int) (Memory, error) {
+	return h.AllocAligned(size, Align)
+}
+
+// AllocAligned allocates size bytes of the region aligned to align, a power of two, like a page for frame buffers.
+func (h *Host) AllocAligned(size, align int) (Memory, error) {
+	if size <= 0 || align <= 0 || align&(align-1) != 0 {
+		return Memory{}, fmt.Errorf("%w: %d bytes aligned to %d", ErrNoMemory, size, align)
+	}
+
+	off := (h.next + uint64(align) - 1) &^ (uint64(align) - 1)
+	if off+uint64(size) > uint64(len(h.mem)) {
+		return Memory{}, fmt.Errorf("%w: %d bytes, %d available", ErrNoMemory, size, h.Available())
+	}
+
+	h.next = off + uint64(size)
+	return Memory{Offset: uint32(off), Data: h.mem[off : off+uint64(size) : off+uint64(size)]}, nil
+}
+
+// Available returns the bytes left to allocate.
+func (h *Host) Available() uint64 {
+	if h.next >= uint64(len(h.mem)) {
+		return 0
+	}
+
+	return uint64(len(h.mem)) - h.next
+}
+
+// AddQueue adds a queue with room for numMessages messages. A message not processed by all its subscribers within
+// maxTime marks the slow ones bad and is retired.
+func (h *Host) AddQueue(id uint32, numMessages int, maxTime time.Duration) (*HostQueue, error) {
+	if len(h.queues) == MaxQueues {
+		return nil, fmt.Errorf("%w: %d already added", ErrTooManyQueues, MaxQueues)
+	}
+
+	if numMessages <= 0 || numMessages > 1<<16 {
+		return nil, fmt.Errorf("%w: %d messages", ErrInvalidHeader, numMessages)
+	}
+
+	for _, q := range h.queues {
+		if atomic.LoadUint32(q.q.u32(qID)) == id {
+			return nil, fmt.Errorf("%w: queue %d added twice", ErrInvalidHeader, id)
+		}
+	}
+
+	// One slot stays free, so a subscriber tells a full ring from an empty one by the position alone
+	slots := numMessages + 1
+	ring, err := h.AllocAligned(slots*MessageSize, 8)
+	if err != nil {
+		return nil, fmt.Errorf("allocate the message ring: %w", err)
+	}
+
+	for i := range ring.Data {
+		ring.Data[i] = 0
+	}
+
+	q := queue{
+		mem:  h.mem,
+		off:  offQueues + uint64(len(h.queues))*QueueHeaderSize,
+		ring: uint64(ring.Offset),
+		n:    uint32(slots),
+	}
+	binary.LittleEndian.PutUint32(h.mem[q.off+qID:], id)
+	binary.LittleEndian.PutUint32(h.mem[q.off+qNumMessages:], uint32(slots))
+	binary.LittleEndian.PutUint32(h.mem[q.off+qMaxTime:], uint32(maxTime/time.Millisecond))
+	binary.LittleEndian.PutUint32(h.mem[q.off+qMessages:], ring.Offset)
+
+	hq := &HostQueue{h: h, q: q}
+	h.queues = append(h.queues, hq)
+	binary.LittleEndian.PutUint32(h.mem[offNumQueues:], uint32(len(h.queues)))
+	return hq, nil
+}
+
+// Process bumps the timestamp, retires the messages all their subscribers processed and marks the subscribers which
+// stopped processing bad. Call it every few milliseconds; the first call publishes the header.
+func (h *Host) Process() error {
+	now := h.now()
+	atomic.StoreUint64(h.stamp, now)
+
+	shmhdr.Publish(h.mem, Magic)
+
+	for _, q := range h.queues {
+		if err := q.process(now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// now returns the clock of the host in milliseconds.
+func (h *Host) now() uint64 {
+	// Zero means no deadline in the queue headers, start at one
+	return uint64(time.Since(h.start)/time.Millisecond) + 1
+}
+
+// process does the upkeep of the queue for Process.
+func (hq *HostQueue) process(now uint64) error {
+	q := hq.q
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
+
+	subs := atomic.LoadUint64(q.u64(qSubs))
+	active, bad := uint32(subs), uint32(subs>>32)
+
+	// A subscriber without a heartbeat is bad, a bad one is released once the clients had time to notice
+	for id := uint(0); id < MaxSubscribers; id++ {
+		bit := uint32(1) << id
+		switch {
+		case active&bit != 0 && now > atomic.LoadUint64(q.timeout(id)):
+			active &^= bit
+			bad |= bit
+			atomic.StoreUint64(q.timeout(id), now+uint64(SubscriberTimeout/time.Millisecond))
+		case bad&bit != 0 && now > atomic.LoadUint64(q.timeout(id)):
+			bad &^= bit
+			atomic.StoreUint32(q.clientID(id), 0)
+		}
+	}
+
+	maxTime := uint64(atomic.LoadUint32(q.u32(qMaxTime)))
+	for atomic.LoadUint32(q.u32(qCount)) > 0 {
+		start := atomic.LoadUint32(q.u32(qStart))
+		pending, _ := q.message(start)
+
+		// Subscribers which went away never clear their bit
+		clearBits(pending, ^active)
+		if left := atomic.LoadUint32(pending); left != 0 {
+			if now <= atomic.LoadUint64(q.u64(qMsgTimeout)) {
+				break
+			}
+
+			active &^= left
+			bad |= left
+			for id := uint(0); id < MaxSubscribers; id++ {
+				if left&(1<<id) != 0 {
+					atomic.StoreUint64(q.timeout(id), now+uint64(SubscriberTimeout/time.Millisecond))
+				}
+			}
+			clearBits(pending, left)
+		}
+
+		atomic.StoreUint32(q.u32(qStart), (start+1)%q.n)
+		atomic.AddUint32(q.u32(qCount), ^uint32(0))
+		atomic.StoreUint64(q.u64(qMsgTimeout), now+maxTime)
+	}
+
+	atomic.StoreUint64(q.u64(qSubs), uint64(bad)<<32|uint64(active))
+	return nil
+}
+
+// Post posts a message pointing at the memory to the queue, to be processed by every current subscriber.
+func (hq *HostQueue) Post(udata uint32, mem Memory) error {
+	q := hq.q
+	if err := q.lock(); err != nil {
+		return err
+	}
+	defer q.unlock()
+
+	count := atomic.LoadUint32(q.u32(qCount))
+	if count == q.n-1 {
+		return fmt.Errorf("%w: %d messages pending", ErrQueueFull, count)
+	}
+
+	position := atomic.LoadUint32(q.u32(qPosition))
+	pending, msg := q.message(position)
+	binary.LittleEndian.PutUint32(msg[msgUData:], udata)
+	binary.LittleEndian.PutUint32(msg[msgSize:], uint32(len(mem.Data)))
+	binary.LittleEndian.PutUint32(msg[msgOffset:], mem.Offset)
+	atomic.StoreUint32(pending, uint32(atomic.LoadUint64(q.u64(qSubs))))
+
+	if count == 0 {
+		atomic.StoreUint64(q.u64(qMsgTimeout), hq.h.now()+uint64(atomic.LoadUint32(q.u32(qMaxTime))))
+	}
+
+	atomic.AddUint32(q.u32(qCount), 1)
+	atomic.StoreUint32(q.u32(qPosition), (position+1)%q.n)
+	return nil
+}
+
+// Pending returns the number of messages posted and not yet retired.
+func (hq *HostQueue) Pending() int {
+	return int(atomic.LoadUint32(hq.q.u32(qCount)))
+}
+
+// Subscribers returns the number of subscribers of the queue.
+func (hq *HostQueue) Subscribers() int {
+	return bits.OnesCount32(uint32(atomic.LoadUint64(hq.q.u64(qSubs))))
+}
+
+// NewSubscribers returns the number of subscriptions since the last call, so the host can post the state a new client
+// needs, like the current cursor shape.
+func (hq *HostQueue) NewSubscribers() int {
+	return int(atomic.SwapUint32(hq.q.u32(qNewSubs), 0))
+}
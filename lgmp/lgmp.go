@@ -0,0 +1,230 @@
+// Package lgmp implements the Looking Glass Memory Protocol, the queues Looking Glass uses to carry frames and cursor
+// updates through the ivshmem region, so Go programs can take either side: Host posts messages like the capture
+// application in the guest, Client subscribes to queues and consumes them like the client application on the host.
+//
+// The host owns the region. It writes the header with its user data, allocates the message rings and payloads from
+// the memory behind it and posts messages, each one pointing at a piece of that memory. Every message carries a
+// bitmask of the subscribers yet to process it, and the host retires it once the mask is empty. Subscribers which
+// stop processing, or a message which outlives the queue's timeout, get the subscriber marked bad so a stuck client
+// never stalls the host. The host also bumps a timestamp on every Process call, clients treat a timestamp which stops
+// moving as a dead host.
+//
+// Layout, all the values are little endian:
+//
+//	   0 magic (uint32)
+//	   4 version (uint32)
+//	   8 session ID, drawn by every host (uint32)
+//	  16 timestamp, the host's clock in milliseconds (uint64)
+//	  24 number of queues (uint32)
+//	  32 queue headers, MaxQueues of QueueHeaderSize bytes
+//	2272 size of the user data (uint32)
+//	2276 user data, the KVMFR header for Looking Glass
+//
+// Queue header:
+//
+//	  0 queue ID (uint32)
+//	  4 number of message slots, one always kept free (uint32)
+//	  8 subscriptions since the host last checked (uint32)
+//	 12 message timeout in milliseconds (uint32)
+//	 16 lock (uint32)
+//	 20 position, the slot the next message is posted to (uint32)
+//	 24 subscribers (bits 0-31) and bad subscribers (bits 32-63) (uint64)
+//	 32 start, the oldest message (uint32)
+//	 40 time the oldest message times out (uint64)
+//	 48 count of messages posted and not retired (uint32)
+//	 56 subscriber heartbeat deadlines, MaxSubscribers of uint64
+//	312 subscriber client IDs, MaxSubscribers of uint32
+//	440 offset of the message ring (uint32)
+//
+// Message: user data (uint32), size (uint32), offset (uint32), pending subscribers (uint32).
+//
+// The structures follow our reading of the field order and widths of headers.h in the C implementation, with the
+// padding a C compiler puts before the 64-bit fields. They were not checked against a region written by a real LGMP
+// host, so interoperating with Looking Glass is untested; the conformance package pins this layout so it doesn't
+// drift unnoticed. LGMP changes its layout along with its version, so a peer built from another revision is refused
+// with ErrUnsupportedVersion rather than misread.
+package lgmp
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrUnaligned = errors.New("region not aligned")
+var ErrNoQueue = errors.New("no such queue")
+var ErrTooManyQueues = errors.New("too many queues")
+var ErrNoMemory = errors.New("out of memory")
+var ErrQueueFull = errors.New("queue full")
+var ErrQueueEmpty = errors.New("queue empty")
+var ErrNoMessage = errors.New("no message being processed")
+var ErrInvalidMessage = errors.New("invalid message")
+var ErrTooManySubscribers = errors.New("too many subscribers")
+var ErrTimedOut = errors.New("subscriber timed out")
+var ErrSessionChanged = errors.New("host session changed")
+var ErrHostTimeout = errors.New("host stopped responding")
+var ErrLockTimeout = errors.New("queue lock timeout")
+
+const (
+	Magic      uint32 = 0x504d474c // "LGMP" when read as little endian bytes
+	Version    uint32 = 10
+	HeaderSize        = offUData
+
+	// MaxQueues is the number of queue headers.
+	MaxQueues = 5
+
+	// MaxSubscribers is the number of subscribers a queue tracks, one bit each.
+	MaxSubscribers = 32
+
+	// QueueHeaderSize is the size of a queue header.
+	QueueHeaderSize = 448
+
+	// MessageSize is the size of a message in a queue's ring.
+	MessageSize = 16
+
+	// Align is the alignment of the memory Host.Alloc hands out.
+	Align = 64
+)
+
+// Header field offsets.
+const (
+	offMagic     = 0
+	offVersion   = 4
+	offSession   = 8
+	offTimestamp = 16
+	offNumQueues = 24
+	offQueues    = 32
+	offUDataSize = offQueues + MaxQueues*QueueHeaderSize
+	offUData     = offUDataSize + 4
+)
+
+// Queue header field offsets.
+const (
+	qID          = 0
+	qNumMessages = 4
+	qNewSubs     = 8
+	qMaxTime     = 12
+	qLock        = 16
+	qPosition    = 20
+	qSubs        = 24
+	qStart       = 32
+	qMsgTimeout  = 40
+	qCount       = 48
+	qTimeout     = 56
+	qClientID    = qTimeout + MaxSubscribers*8
+	qMessages    = qClientID + MaxSubscribers*4
+)
+
+// Message field offsets.
+const (
+	msgUData   = 0
+	msgSize    = 4
+	msgOffset  = 8
+	msgPending = 12
+)
+
+// SubscriberTimeout is how long a subscriber may go without processing its queue before the host marks it bad.
+var SubscriberTimeout = time.Second
+
+// HostTimeout is how long the host's timestamp may stand still before a client gives up on it.
+var HostTimeout = time.Second
+
+// LockTimeout is how long the sides wait for the lock of a queue, held only for a few stores by the other side.
+var LockTimeout = 5 * time.Second
+
+// Message is a message taken from a queue.
+type Message struct {
+	UData  uint32 // The value the host posted the message with, like the KVMFR message type
+	Offset uint32 // Offset of the memory in the region
+	Data   []byte // Aliases the region, valid until MessageDone
+}
+
+// queue is a view of a queue header. The offset of the message ring and the number of its slots are taken once the
+// header is checked, the peer may change them in the region afterwards.
+type queue struct {
+	mem  []byte
+	off  uint64
+	ring uint64
+	n    uint32
+}
+
+// u32 returns the 32-bit field of the queue header at the offset.
+func (q queue) u32(field uint64) *uint32 {
+	return (*uint32)(unsafe.Pointer(&q.mem[q.off+field]))
+}
+
+// u64 returns the 64-bit field of the queue header at the offset.
+func (q queue) u64(field uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&q.mem[q.off+field]))
+}
+
+// timeout returns the heartbeat deadline of the subscriber.
+func (q queue) timeout(id uint) *uint64 {
+	return q.u64(qTimeout + uint64(id)*8)
+}
+
+// clientID returns the client ID of the subscriber.
+func (q queue) clientID(id uint) *uint32 {
+	return q.u32(qClientID + uint64(id)*4)
+}
+
+// message returns the pending subscribers of the message in the slot and the message itself. The slot may come from
+// the region, it wraps around the ring.
+func (q queue) message(slot uint32) (*uint32, []byte) {
+	off := q.ring + uint64(slot%q.n)*MessageSize
+	msg := q.mem[off : off+MessageSize]
+	return (*uint32)(unsafe.Pointer(&msg[msgPending])), msg
+}
+
+// lock takes the spinlock of the queue, shared with the other side.
+func (q queue) lock() error {
+	lock := q.u32(qLock)
+	deadline := time.Now().Add(LockTimeout)
+	for !atomic.CompareAndSwapUint32(lock, 0, 1) {
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+
+		runtime.Gosched()
+	}
+
+	return nil
+}
+
+// unlock releases the spinlock of the queue.
+func (q queue) unlock() {
+	atomic.StoreUint32(q.u32(qLock), 0)
+}
+
+// clearBits atomically clears the bits in the word.
+func clearBits(p *uint32, bits uint32) {
+	for {
+		old := atomic.LoadUint32(p)
+		if old&bits == 0 || atomic.CompareAndSwapUint32(p, old, old&^bits) {
+			return
+		}
+	}
+}
+
+// checkRegion checks the region can hold the header and is aligned for the 64-bit atomics.
+func checkRegion(mem []byte) error {
+	if len(mem) < HeaderSize {
+		return fmt.Errorf("%w: need %d bytes for the header, have %d", ErrRegionTooSmall, HeaderSize, len(mem))
+	}
+
+	// 64-bit atomics need 8 byte alignment on 32-bit platforms, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return fmt.Errorf("%w: the region must be 8 byte aligned", ErrUnaligned)
+	}
+
+	return nil
+}
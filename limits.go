@@ -0,0 +1,48 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrResourceExhausted = errors.New("resource exhausted")
+
+// Limits caps the memory the library allocates on its own, mostly on behalf of the peer: reassembled messages,
+// queued messages and bookkeeping tables. Agents often run in memory constrained guests, so every component keeping
+// such buffers takes Limits and refuses to grow past them with ErrResourceExhausted. Zero fields mean no limit.
+type Limits struct {
+	MaxMessageSize  int // Largest message reassembled or copied out of the region
+	MaxPending      int // Messages queued per channel or stream
+	MaxTableEntries int // Entries of bookkeeping tables (deduplication, outstanding requests, ...)
+}
+
+// DefaultLimits are used by the components which weren't given explicit limits. Change them before creating any.
+var DefaultLimits = Limits{
+	MaxMessageSize:  16 << 20,
+	MaxPending:      1024,
+	MaxTableEntries: 65536,
+}
+
+// CheckMessageSize returns ErrResourceExhausted if a message of the given size exceeds the limit.
+func (l Limits) CheckMessageSize(size int) error {
+	return check("message size", size, l.MaxMessageSize)
+}
+
+// CheckPending returns ErrResourceExhausted if the given number of queued messages exceeds the limit.
+func (l Limits) CheckPending(pending int) error {
+	return check("pending messages", pending, l.MaxPending)
+}
+
+// CheckTableEntries returns ErrResourceExhausted if the given number of table entries exceeds the limit.
+func (l Limits) CheckTableEntries(entries int) error {
+	return check("table entries", entries, l.MaxTableEntries)
+}
+
+// check compares the value with the limit, zero meaning no limit.
+func check(what string, value, limit int) error {
+	if limit > 0 && value > limit {
+		return fmt.Errorf("%w: %s %d over the limit of %d", ErrResourceExhausted, what, value, limit)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package ivshmem
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/mux"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// dialers holds the client session of every region Dial was called on, keyed by the address of the memory, so the
+// connections dialed over one device share its channel.
+var (
+	dialersMu sync.Mutex
+	dialers   = make(map[uintptr]*mux.Session)
+)
+
+// Listen maps the mapper, if it isn't mapped yet, initializes a duplex channel over the whole region and returns a
+// listener accepting the connections the other side dials with Dial. Servers like net/http serve on it directly. The
+// listening side must be up before the other one dials.
+func Listen(m Mapper) (net.Listener, error) {
+	mem, err := MapMemory(m)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := ring.InitChannel(mem)
+	if err != nil {
+		return nil, fmt.Errorf("init channel: %w", err)
+	}
+
+	return mux.Server(ch, mux.Addr(m.DevPath())), nil
+}
+
+// Dial opens a connection to the listener on the other side of the region. The connections dialed over the same
+// region are multiplexed over a single channel.
+func Dial(m Mapper) (net.Conn, error) {
+	mem, err := MapMemory(m)
+	if err != nil {
+		return nil, err
+	}
+
+	key := uintptr(unsafe.Pointer(&mem[0]))
+	dialersMu.Lock()
+	s, ok := dialers[key]
+	if ok && s.Err() != nil {
+		ok = false
+	}
+
+	if !ok {
+		ch, err := ring.OpenChannel(mem)
+		if err != nil {
+			dialersMu.Unlock()
+			return nil, fmt.Errorf("open channel: %w", err)
+		}
+
+		s = mux.Client(ch, mux.Addr(m.DevPath()))
+		dialers[key] = s
+		go forgetDialer(key, s)
+	}
+	dialersMu.Unlock()
+
+	return s.Open()
+}
+
+// ContextDialer returns a dial function for the clients taking one, it ignores the address and dials the other side
+// of the region like Dial. With gRPC, serve on the listener of Listen and dial with
+// grpc.WithContextDialer(ivshmem.ContextDialer(m)) and any target, e.g. "passthrough:///ivshmem".
+func ContextDialer(m Mapper) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		return Dial(m)
+	}
+}
+
+// forgetDialer drops the session once it ends, the next Dial opens the channel again.
+func forgetDialer(key uintptr, s *mux.Session) {
+	<-s.Done()
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	if dialers[key] == s {
+		delete(dialers, key)
+	}
+}
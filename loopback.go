@@ -0,0 +1,102 @@
+package ivshmem
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Loopback is one end of a pair of fake mappers sharing the same memory, with doorbells delivered through channels.
+// The ends are peers 0 and 1, so ring buffers and channels can be tested in both directions without a hypervisor.
+type Loopback struct {
+	*Fake
+	id   uint16
+	bell *loopbackBell
+}
+
+// loopbackBell routes the doorbells between the two ends of a pair.
+type loopbackBell struct {
+	mu        sync.Mutex
+	listeners [2]map[uint16][]chan struct{}
+	closed    [2]bool
+}
+
+// NewLoopbackPair creates two unmapped fake mappers backed by the same memory of the given size, peers 0 and 1 of
+// each other.
+func NewLoopbackPair(size uint64) (*Loopback, *Loopback) {
+	mem := make([]byte, size)
+	bell := &loopbackBell{listeners: [2]map[uint16][]chan struct{}{{}, {}}}
+	return &Loopback{Fake: &Fake{mem: mem}, id: 0, bell: bell}, &Loopback{Fake: &Fake{mem: mem}, id: 1, bell: bell}
+}
+
+// PeerID returns the peer ID of this end, 0 or 1.
+func (l *Loopback) PeerID() uint16 {
+	return l.id
+}
+
+// Notify rings the doorbell of the peer on the given vector.
+func (l *Loopback) Notify(peer, vector uint16) error {
+	l.bell.mu.Lock()
+	defer l.bell.mu.Unlock()
+	if l.bell.closed[l.id] {
+		return ErrClosed
+	}
+
+	if peer > 1 || l.bell.closed[peer] {
+		return fmt.Errorf("%w: %d", ErrUnknownPeer, peer)
+	}
+
+	for _, ch := range l.bell.listeners[peer][vector] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Listen returns a channel receiving the interrupts sent to this end on the vector. The channel is closed when the
+// end is closed.
+func (l *Loopback) Listen(vector uint16) (<-chan struct{}, error) {
+	l.bell.mu.Lock()
+	defer l.bell.mu.Unlock()
+	if l.bell.closed[l.id] {
+		return nil, ErrClosed
+	}
+
+	ch := make(chan struct{}, 1)
+	l.bell.listeners[l.id][vector] = append(l.bell.listeners[l.id][vector], ch)
+	return ch, nil
+}
+
+// Capabilities returns the doorbell and the interrupts, on any vector.
+func (l *Loopback) Capabilities() Capabilities {
+	return Capabilities{Features: []Feature{FeatureDoorbell, FeatureInterrupts}}
+}
+
+// DevPath returns a placeholder path naming the end.
+func (l *Loopback) DevPath() string {
+	return fmt.Sprintf("loopback%d", l.id)
+}
+
+// Close unmaps the memory if it is mapped and closes the listener channels, the other end then sees this one as gone.
+func (l *Loopback) Close() error {
+	if err := l.Fake.Close(); err != nil {
+		return err
+	}
+
+	l.bell.mu.Lock()
+	defer l.bell.mu.Unlock()
+	l.bell.closed[l.id] = true
+	for _, chans := range l.bell.listeners[l.id] {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+
+	l.bell.listeners[l.id] = nil
+	return nil
+}
+
+var _ Mapper = (*Loopback)(nil)
+var _ Notifier = (*Loopback)(nil)
@@ -0,0 +1,110 @@
+//go:build linux || windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrMapStalled = errors.New("map stalled")
+
+// MapStep is a step of finding and mapping a device.
+type MapStep string
+
+const (
+	StepEnumerate MapStep = "enumerate" // Listing the PCI devices (SetupAPI, sysfs)
+	StepOpen      MapStep = "open"      // Opening the device
+	StepIoctl     MapStep = "ioctl"     // Asking the driver for the memory (windows)
+	StepMmap      MapStep = "mmap"      // Mapping the memory into the process
+)
+
+// StallError tells which step of MapGuest didn't finish in time.
+type StallError struct {
+	Step    MapStep
+	Detail  string        // What exactly the step was doing, e.g. the IOCTL
+	Elapsed time.Duration // Time spent in the step
+	Timeout time.Duration
+}
+
+// Error describes the stalled step.
+func (e *StallError) Error() string {
+	return fmt.Sprintf("%v: %s (%s) took %s, over the timeout of %s", ErrMapStalled, e.Step, e.Detail, e.Elapsed.Round(time.Millisecond), e.Timeout)
+}
+
+// Unwrap returns ErrMapStalled.
+func (e *StallError) Unwrap() error {
+	return ErrMapStalled
+}
+
+// mapProgress records the step a guest is in, a nil progress records nothing.
+type mapProgress struct {
+	mu     sync.Mutex
+	step   MapStep
+	detail string
+	since  time.Time
+}
+
+// enter records the start of the step.
+func (p *mapProgress) enter(step MapStep, detail string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.step, p.detail, p.since = step, detail, time.Now()
+}
+
+// stall returns the error describing the current step.
+func (p *mapProgress) stall(timeout time.Duration) *StallError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &StallError{Step: p.step, Detail: p.detail, Elapsed: time.Since(p.since), Timeout: timeout}
+}
+
+// MapGuest finds the device at the location and maps its memory like NewGuest followed by Map, but gives up after
+// the timeout with a *StallError telling which step hangs, instead of hanging with it. A hung system call can't be
+// interrupted, so the stalled attempt keeps a goroutine until it returns and then releases the device.
+func MapGuest(location PCILocation, timeout time.Duration) (*Guest, error) {
+	type result struct {
+		g   *Guest
+		err error
+	}
+
+	progress := &mapProgress{}
+	progress.enter(StepEnumerate, "find the device")
+	done := make(chan result, 1)
+	go func() {
+		g, err := newGuest(location, progress)
+		if err == nil {
+			if err = g.Map(); err != nil {
+				g.Close()
+			}
+		}
+
+		done <- result{g, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+
+		return res.g, nil
+	case <-timer.C:
+		err := progress.stall(timeout)
+		go func() {
+			if res := <-done; res.err == nil {
+				res.g.Close()
+			}
+		}()
+
+		return nil, err
+	}
+}
@@ -0,0 +1,60 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MarkerSize is the size of the identification marker, which takes up the last bytes of the shared memory. The end
+// of the region is used because the protocols running over the device start their headers at offset zero, the layout
+// and arena packages keep their segments and heap clear of it.
+const MarkerSize = 64
+
+// MaxMarkerLength is the longest tag fitting into the marker.
+const MaxMarkerLength = MarkerSize - len(markerMagic) - 1
+
+const markerMagic = "IVSHMTAG"
+
+var ErrMarkerTooLong = errors.New("marker too long")
+
+// WriteMarker tags the shared memory, so that guests with several identical devices can tell them apart with
+// FindByMarker. The host writes it before starting the guest.
+func WriteMarker(mem []byte, tag string) error {
+	if len(tag) > MaxMarkerLength {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d", ErrMarkerTooLong, len(tag), MaxMarkerLength)
+	}
+
+	if len(mem) < MarkerSize {
+		return fmt.Errorf("region of %d bytes cannot hold a marker", len(mem))
+	}
+
+	marker := mem[len(mem)-MarkerSize:]
+	for i := range marker {
+		marker[i] = 0
+	}
+
+	copy(marker, markerMagic)
+	marker[len(markerMagic)] = uint8(len(tag))
+	copy(marker[len(markerMagic)+1:], tag)
+	return nil
+}
+
+// ReadMarker returns the tag of the shared memory, false if it isn't tagged.
+func ReadMarker(mem []byte) (string, bool) {
+	if len(mem) < MarkerSize {
+		return "", false
+	}
+
+	marker := mem[len(mem)-MarkerSize:]
+	if string(marker[:len(markerMagic)]) != markerMagic {
+		return "", false
+	}
+
+	length := int(marker[len(markerMagic)])
+	if length > MaxMarkerLength {
+		return "", false
+	}
+
+	start := len(markerMagic) + 1
+	return string(marker[start : start+length]), true
+}
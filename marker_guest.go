@@ -0,0 +1,50 @@
+//go:build linux || windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FindByMarker returns the location of the device tagged with the tag by WriteMarker. Every device is mapped briefly
+// to read its marker.
+func FindByMarker(tag string) (PCILocation, error) {
+	devs, err := ListDevices()
+	if err != nil {
+		return PCILocation{}, err
+	}
+
+	var errs []error
+	for _, loc := range devs {
+		found, err := hasMarker(loc, tag)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", loc, err))
+			continue
+		}
+
+		if found {
+			return loc, nil
+		}
+	}
+
+	err = fmt.Errorf("%w: no device tagged %q", ErrCannotFindDevice, tag)
+	return PCILocation{}, errors.Join(append([]error{err}, errs...)...)
+}
+
+// hasMarker maps the device and checks its tag.
+func hasMarker(loc PCILocation, tag string) (bool, error) {
+	g, err := NewGuest(loc)
+	if err != nil {
+		return false, err
+	}
+	// Close unmaps as well, and releases the device handle even when mapping fails
+	defer g.Close()
+
+	if err := g.Map(); err != nil {
+		return false, err
+	}
+
+	got, ok := ReadMarker(g.SharedMem())
+	return ok && got == tag, nil
+}
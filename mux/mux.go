@@ -0,0 +1,331 @@
+// Package mux carries many independent streams over a single byte stream between the two sides, like the duplex
+// channel of the ring package. A session implements net.Listener and its streams implement net.Conn, so servers like
+// net/http accept connections over one shared memory device, and an application needing a control stream plus
+// several data streams opens them over one channel instead of partitioning the region. Every stream has its own flow
+// control window, so a slow reader only holds back its own stream.
+//
+// Frame format, all the values are little endian:
+//
+//	0 type (uint8)
+//	1 flags, zero (uint8)
+//	2 reserved, zero (uint16)
+//	4 stream ID (uint32), odd for the streams opened by the client, even for the server
+//	8 payload length (uint32)
+//	12 payload
+//
+// The frames open a stream, carry its data, grant the sender more window (the payload is the increment as an uint32)
+// or close the stream on both sides.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var ErrProtocol = errors.New("mux protocol error")
+var ErrSessionClosed = errors.New("session closed")
+var ErrStreamClosed = errors.New("stream closed")
+
+const (
+	HeaderSize = 12
+
+	// MaxFrameSize is the largest payload of a frame, writes are split into frames of this size.
+	MaxFrameSize = 64 << 10
+
+	// Window is how many bytes a side may send on a stream before the other side reads them.
+	Window = 256 << 10
+)
+
+// Frame types.
+const (
+	typeOpen   = 1
+	typeData   = 2
+	typeClose  = 3
+	typeWindow = 4
+)
+
+// Addr is the address of both ends of the streams of a session.
+type Addr string
+
+// Network returns "ivshmem".
+func (a Addr) Network() string {
+	return "ivshmem"
+}
+
+// String returns the name of the device carrying the session.
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Shaper paces the data of the streams, *ivshmem.Shaper implements it.
+type Shaper interface {
+	// Wait blocks until the stream may send n bytes.
+	Wait(stream uint32, n int)
+}
+
+// Session multiplexes the streams over the connection.
+type Session struct {
+	conn   io.ReadWriteCloser
+	addr   Addr
+	server bool
+
+	wmu    sync.Mutex // Serializes the frames
+	shaper Shaper     // Paces the data frames, nil for no shaping
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // Why the session ended, nil while it runs
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// Client starts the session of the side opening the streams over the connection.
+func Client(conn io.ReadWriteCloser, addr Addr) *Session {
+	return newSession(conn, addr, false)
+}
+
+// Server starts the session of the side accepting the streams over the connection.
+func Server(conn io.ReadWriteCloser, addr Addr) *Session {
+	return newSession(conn, addr, true)
+}
+
+// newSession starts receiving the frames.
+func newSession(conn io.ReadWriteCloser, addr Addr, server bool) *Session {
+	s := &Session{
+		conn:    conn,
+		addr:    addr,
+		server:  server,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		accept:  make(chan *Stream, 64),
+		done:    make(chan struct{}),
+	}
+
+	if server {
+		s.nextID = 2
+	}
+
+	go s.receive()
+	return s
+}
+
+// Open opens a new stream to the other side.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.write(typeOpen, id, nil); err != nil {
+		s.forget(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// SetShaper paces the data written to the streams with the shaper, keyed by the stream IDs, so a stream with a
+// reserved rate keeps its bandwidth however much the bulk streams send. It must be called before any stream writes,
+// a nil shaper turns the shaping off.
+func (s *Session) SetShaper(shaper Shaper) {
+	s.shaper = shaper
+}
+
+// AcceptStream waits for the other side to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Accept waits for the other side to open a stream, it implements net.Listener.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr returns the address of the session.
+func (s *Session) Addr() net.Addr {
+	return s.addr
+}
+
+// Done returns a channel which is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, nil while it runs.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close closes the streams and the connection.
+func (s *Session) Close() error {
+	if !s.shutdown(ErrSessionClosed) {
+		return ErrSessionClosed
+	}
+
+	return s.conn.Close()
+}
+
+// shutdown ends the session with the error, it returns false if it already ended.
+func (s *Session) shutdown(err error) bool {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return false
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = nil
+	close(s.done)
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		st.remoteClosed(err)
+	}
+
+	return true
+}
+
+// receive dispatches the frames until the connection fails.
+func (s *Session) receive() {
+	var hdr [HeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.fail(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+			return
+		}
+
+		typ := hdr[0]
+		id := binary.LittleEndian.Uint32(hdr[4:])
+		length := binary.LittleEndian.Uint32(hdr[8:])
+		if length > MaxFrameSize {
+			s.fail(fmt.Errorf("%w: frame of %d bytes", ErrProtocol, length))
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+			return
+		}
+
+		if err := s.dispatch(typ, id, payload); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// dispatch handles a frame.
+func (s *Session) dispatch(typ uint8, id uint32, payload []byte) error {
+	switch typ {
+	case typeOpen:
+		// The IDs of the other side have the other parity
+		if (id%2 == 0) == s.server {
+			return fmt.Errorf("%w: stream %d opened with our parity", ErrProtocol, id)
+		}
+
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok || s.err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: stream %d opened twice", ErrProtocol, id)
+		}
+
+		st := newStream(s, id)
+		s.streams[id] = st
+		s.mu.Unlock()
+
+		select {
+		case s.accept <- st:
+		default:
+			// Nobody accepts, refuse instead of blocking the other streams
+			s.forget(id)
+			return s.write(typeClose, id, nil)
+		}
+	case typeData:
+		if st := s.stream(id); st != nil {
+			return st.push(payload)
+		}
+	case typeWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: window update of %d bytes", ErrProtocol, len(payload))
+		}
+
+		if st := s.stream(id); st != nil {
+			return st.grant(binary.LittleEndian.Uint32(payload))
+		}
+	case typeClose:
+		if st := s.stream(id); st != nil {
+			st.remoteClosed(io.EOF)
+		}
+	default:
+		return fmt.Errorf("%w: frame type %d", ErrProtocol, typ)
+	}
+
+	return nil
+}
+
+// fail ends the session after a connection or protocol error.
+func (s *Session) fail(err error) {
+	if s.shutdown(err) {
+		s.conn.Close()
+	}
+}
+
+// stream returns the open stream with the ID, nil if there is none.
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// forget removes the stream from the session.
+func (s *Session) forget(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// write sends a frame, with a single write so the frames of the streams don't interleave.
+func (s *Session) write(typ uint8, id uint32, payload []byte) error {
+	buf := make([]byte, HeaderSize+len(payload))
+	buf[0] = typ
+	binary.LittleEndian.PutUint32(buf[4:], id)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[HeaderSize:], payload)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	if _, err := s.conn.Write(buf); err != nil {
+		s.fail(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+		return s.Err()
+	}
+
+	return nil
+}
+
+var _ net.Listener = (*Session)(nil)
@@ -0,0 +1,280 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection of a session, it implements net.Conn.
+//
+// Every stream has its own flow control window: a side sends at most Window bytes the other side hasn't read yet,
+// and the reader grants more as the application consumes the data. A stream nobody reads stalls its own writer
+// only, never the other streams of the session.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mu            sync.Mutex
+	buf           []byte
+	readErr       error // Returned once the buffer is drained, io.EOF after the other side closed
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	sendWindow    uint32        // Bytes the other side is ready to receive
+	consumed      uint32        // Bytes read since the last window update
+	readable      chan struct{} // Signaled when the buffer, the read error or the read deadline changes
+	writable      chan struct{} // Signaled when the send window, the read error or the write deadline changes
+}
+
+// newStream returns an open stream of the session.
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		session:    s,
+		id:         id,
+		sendWindow: Window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the ID of the stream in the session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads the data the other side wrote to the stream, it returns io.EOF once the other side closed it.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+
+		if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += uint32(n)
+
+			// Grant the consumed bytes back in batches, not a frame for every read
+			var grant uint32
+			if st.consumed >= Window/2 && st.readErr == nil {
+				grant, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				var payload [4]byte
+				binary.LittleEndian.PutUint32(payload[:], grant)
+				if err := st.session.write(typeWindow, st.id, payload[:]); err != nil {
+					return n, err
+				}
+			}
+
+			return n, nil
+		}
+
+		if st.readErr != nil {
+			err := st.readErr
+			st.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes the data to the stream, split into frames. It blocks while the send window is exhausted, until the
+// other side reads or the write deadline passes.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.closed || st.readErr != nil {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		deadline := st.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			if err := wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+
+			continue
+		}
+
+		n := uint32(len(p) - written)
+		if n > MaxFrameSize {
+			n = MaxFrameSize
+		}
+
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		// Wait for the budget outside of the write lock, so a throttled stream doesn't hold back the others
+		if st.session.shaper != nil {
+			st.session.shaper.Wait(st.id, int(n))
+		}
+
+		if err := st.session.write(typeData, st.id, p[written:written+int(n)]); err != nil {
+			return written, err
+		}
+
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// Close closes the stream on both sides.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return ErrStreamClosed
+	}
+
+	st.closed = true
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+
+	st.session.forget(st.id)
+	if st.session.Err() != nil {
+		return nil
+	}
+
+	return st.session.write(typeClose, st.id, nil)
+}
+
+// LocalAddr returns the address of the session.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.addr
+}
+
+// RemoteAddr returns the address of the session.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.addr
+}
+
+// SetDeadline sets the read and write deadlines.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	return nil
+}
+
+// SetReadDeadline sets the time after which the pending and future reads fail.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	signal(st.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the time after which the pending and future writes fail.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	signal(st.writable)
+	return nil
+}
+
+// push appends the data received from the other side, which must stay within the window it was granted.
+func (st *Stream) push(data []byte) error {
+	st.mu.Lock()
+	if uint64(len(st.buf))+uint64(st.consumed)+uint64(len(data)) > Window {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d overflowed its window", ErrProtocol, st.id)
+	}
+
+	if !st.closed && st.readErr == nil {
+		st.buf = append(st.buf, data...)
+	}
+	st.mu.Unlock()
+	signal(st.readable)
+	return nil
+}
+
+// grant adds to the send window after the other side read.
+func (st *Stream) grant(n uint32) error {
+	st.mu.Lock()
+	if uint64(st.sendWindow)+uint64(n) > Window {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d granted more than its window", ErrProtocol, st.id)
+	}
+
+	st.sendWindow += n
+	st.mu.Unlock()
+	signal(st.writable)
+	return nil
+}
+
+// remoteClosed makes the reads fail with the error once the buffer is drained, and the writes right away.
+func (st *Stream) remoteClosed(err error) {
+	st.mu.Lock()
+	if st.readErr == nil {
+		st.readErr = err
+	}
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	st.session.forget(st.id)
+}
+
+// wait blocks until the channel is signaled or the deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// signal wakes the goroutine waiting on the channel.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+var _ net.Conn = (*Stream)(nil)
@@ -0,0 +1,15 @@
+package ivshmem
+
+import "errors"
+
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// Notifier delivers doorbell interrupts between the peers sharing a device.
+type Notifier interface {
+	// Notify rings the doorbell of the peer on the given interrupt vector.
+	Notify(peer, vector uint16) error
+
+	// Listen returns a channel receiving a value for every interrupt on the vector. Interrupts arriving while a value
+	// is still pending are coalesced, like the hardware does. The channel is closed when the notifier shuts down.
+	Listen(vector uint16) (<-chan struct{}, error)
+}
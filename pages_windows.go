@@ -0,0 +1,70 @@
+//go:build windows
+
+package ivshmem
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// PageStats describes the pages backing the mapping of a guest.
+//
+// The driver maps the BAR into the process with MmMapLockedPagesSpecifyCache, which takes no page size, so whether a
+// view ends up on large pages is decided by the kernel: only physically contiguous, suitably aligned ranges can be,
+// and the request can't ask for it. PageStats tells what the kernel did, for deciding whether the TLB pressure of a
+// large region (1GB+ Looking Glass frames) is worth mitigating, e.g. by keeping the hot data in fewer pages.
+type PageStats struct {
+	LargePageMinimum uint64 // Size of a large page, zero if the system doesn't support them
+	Sampled          int    // Pages queried, spread evenly over the region
+	Resident         int    // Sampled pages the working set reported on, device memory is often not tracked
+	Large            int    // Resident sampled pages which are large pages
+}
+
+// PageStats samples the given number of pages of the mapping with QueryWorkingSetEx, at most every page once.
+func (g Guest) PageStats(samples int) (PageStats, error) {
+	if !g.mapped {
+		return PageStats{}, ErrNotMapped
+	}
+
+	stats := PageStats{LargePageMinimum: uint64(windows.GetLargePageMinimum())}
+	if samples <= 0 || g.size == 0 {
+		return stats, nil
+	}
+
+	// Sampling a page twice would count it twice, small regions get one sample per page
+	page := uint64(os.Getpagesize())
+	if pages := (g.size + page - 1) / page; uint64(samples) > pages {
+		samples = int(pages)
+	}
+
+	infos := make([]windows.PSAPI_WORKING_SET_EX_INFORMATION, samples)
+	step := g.size / uint64(samples)
+	if step < page {
+		step = page
+	}
+	for i := range infos {
+		infos[i].VirtualAddress = windows.Pointer(unsafe.Pointer(&g.sharedMem[uint64(i)*step]))
+	}
+
+	cb := uint32(uintptr(len(infos)) * unsafe.Sizeof(infos[0]))
+	if err := windows.QueryWorkingSetEx(windows.CurrentProcess(), uintptr(unsafe.Pointer(&infos[0])), cb); err != nil {
+		return stats, fmt.Errorf("query working set: %w", err)
+	}
+
+	stats.Sampled = samples
+	for _, info := range infos {
+		if !info.VirtualAttributes.Valid() {
+			continue
+		}
+
+		stats.Resident++
+		if info.VirtualAttributes.LargePage() {
+			stats.Large++
+		}
+	}
+
+	return stats, nil
+}
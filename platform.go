@@ -0,0 +1,113 @@
+package ivshmem
+
+import (
+	"runtime"
+
+	"github.com/TypicalAM/ivshmem/fastpath"
+)
+
+// Role is a side of the link a build can take.
+type Role string
+
+const (
+	RoleHost   Role = "host"   // Maps the shared memory file (Host)
+	RoleGuest  Role = "guest"  // Maps the PCI device (Guest)
+	RoleServer Role = "server" // Joins or runs an ivshmem-server for doorbells (Client, server package)
+)
+
+// Feature is an optional capability of a build.
+type Feature string
+
+const (
+	FeatureDoorbell   Feature = "doorbell"    // Ringing the doorbells of the peers
+	FeatureInterrupts Feature = "interrupts"  // Waiting for the doorbell interrupts of the device
+	FeatureRegisters  Feature = "registers"   // Mapping the device registers (BAR0)
+	FeatureCacheModes Feature = "cache-modes" // Choosing the cache mode of the mapping
+	FeaturePageStats  Feature = "page-stats"  // Reporting the page sizes backing the mapping
+	FeatureFastpath   Feature = "fastpath"    // The cgo fast paths, see the fastpath package
+	FeaturePartialMap Feature = "partial-map" // Mapping a part of the region, none of the mappers provide it yet
+)
+
+// Platform is what the build for an operating system and architecture provides. The portable parts of the module,
+// like the fake mappers and the protocols over a region, build everywhere and aren't listed.
+type Platform struct {
+	GOOS     string
+	GOARCH   string
+	Roles    []Role
+	Features []Feature
+}
+
+// Has reports whether the platform provides the feature.
+func (p Platform) Has(feature Feature) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// platformOS are the roles and features of every operating system, they don't depend on the architecture.
+var platformOS = []struct {
+	goos     string
+	goarch   []string
+	roles    []Role
+	features []Feature
+}{
+	{
+		goos:     "linux",
+		goarch:   []string{"386", "amd64", "arm", "arm64", "ppc64le", "riscv64", "s390x"},
+		roles:    []Role{RoleHost, RoleGuest, RoleServer},
+		features: []Feature{FeatureDoorbell, FeatureInterrupts, FeatureRegisters},
+	},
+	{
+		goos:     "windows",
+		goarch:   []string{"386", "amd64", "arm64"},
+		roles:    []Role{RoleGuest},
+		features: []Feature{FeatureDoorbell, FeatureInterrupts, FeatureCacheModes, FeaturePageStats},
+	},
+	{
+		goos:   "darwin",
+		goarch: []string{"amd64", "arm64"},
+	},
+	{
+		goos:   "freebsd",
+		goarch: []string{"386", "amd64", "arm64"},
+	},
+}
+
+// SupportedPlatforms returns the platforms the module builds for, with what each of them provides. The fastpath
+// feature depends on the build tags and is only reported by CurrentPlatform.
+func SupportedPlatforms() []Platform {
+	var platforms []Platform
+	for _, entry := range platformOS {
+		for _, arch := range entry.goarch {
+			platforms = append(platforms, Platform{
+				GOOS:     entry.goos,
+				GOARCH:   arch,
+				Roles:    append([]Role(nil), entry.roles...),
+				Features: append([]Feature(nil), entry.features...),
+			})
+		}
+	}
+
+	return platforms
+}
+
+// CurrentPlatform returns what the running build provides.
+func CurrentPlatform() Platform {
+	p := Platform{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	for _, entry := range platformOS {
+		if entry.goos == runtime.GOOS {
+			p.Roles = append(p.Roles, entry.roles...)
+			p.Features = append(p.Features, entry.features...)
+		}
+	}
+
+	if fastpath.Enabled {
+		p.Features = append(p.Features, FeatureFastpath)
+	}
+
+	return p
+}
@@ -0,0 +1,160 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+var minimalAccess atomic.Bool
+
+// AccessDeniedError reports the exact path the security policy (file permissions, SELinux or AppArmor) denied.
+type AccessDeniedError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+// Error returns the denied operation and path.
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("%s %s: %s, check the security policy (see AppArmorRules and SELinuxRules)", e.Op, e.Path, ErrAccessDenied)
+}
+
+// Unwrap allows matching the error with both ErrAccessDenied and the underlying error.
+func (e *AccessDeniedError) Unwrap() []error {
+	return []error{ErrAccessDenied, e.Err}
+}
+
+// SetMinimalAccess toggles the mode for hardened guests. When enabled, discovery doesn't scan PCI_PATH and reads no
+// id files, it only uses the device paths provided with AddDevicePath or IVSHMEM_DEVICE_PATHS and treats them as
+// QEMU ivshmem devices. The only file opened afterwards is the shared memory resource itself.
+func SetMinimalAccess(enabled bool) {
+	minimalAccess.Store(enabled)
+}
+
+// AccessRule is a path the guest needs access to.
+type AccessRule struct {
+	Path  string // Resolved path (policies match the symlink targets), may be an AppArmor glob
+	Dir   bool   // Directory listing
+	Write bool   // Opened for writing and mapped shared
+}
+
+// RequiredAccess returns the paths the guest opens when using the device at the location, in the current mode.
+func RequiredAccess(location PCILocation) ([]AccessRule, error) {
+	dev, err := findDevice(location)
+	if err != nil {
+		return nil, err
+	}
+
+	resource, err := filepath.EvalSymlinks(devicePath(dev.dir, fmt.Sprintf("resource%d", dev.profile.MemoryBAR)))
+	if err != nil {
+		return nil, fmt.Errorf("resolve resource path: %w", err)
+	}
+
+	rules := []AccessRule{{Path: resource, Write: true}}
+	if minimalAccess.Load() {
+		return rules, nil
+	}
+
+	return append(rules,
+		AccessRule{Path: PCI_PATH + "/", Dir: true},
+		AccessRule{Path: "/sys/devices/pci*/**/{vendor,device}"},
+	), nil
+}
+
+// AppArmorRules returns the rules to add to the AppArmor profile of the program.
+func AppArmorRules(rules []AccessRule) string {
+	var sb strings.Builder
+	for _, rule := range rules {
+		perms := "r"
+		if rule.Write {
+			perms = "rw"
+		}
+
+		fmt.Fprintf(&sb, "  %s %s,\n", rule.Path, perms)
+	}
+
+	return sb.String()
+}
+
+// SELinuxRules returns the allow rules for the SELinux domain of the program. The file types are read from the
+// labels of the paths, sysfs_t is assumed for globs and unlabeled paths.
+func SELinuxRules(domain string, rules []AccessRule) string {
+	perms := make(map[string]map[string]bool)
+	add := func(class, fileType string, names ...string) {
+		key := fileType + ":" + class
+		if perms[key] == nil {
+			perms[key] = make(map[string]bool)
+		}
+
+		for _, name := range names {
+			perms[key][name] = true
+		}
+	}
+
+	for _, rule := range rules {
+		fileType := selinuxType(rule.Path)
+		switch {
+		case rule.Dir:
+			add("dir", fileType, "open", "read", "search", "getattr")
+			add("lnk_file", fileType, "read", "getattr")
+		case rule.Write:
+			add("file", fileType, "open", "read", "write", "map", "getattr")
+		default:
+			add("file", fileType, "open", "read", "getattr")
+		}
+	}
+
+	keys := make([]string, 0, len(perms))
+	for key := range perms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, key := range keys {
+		names := make([]string, 0, len(perms[key]))
+		for name := range perms[key] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(&sb, "allow %s %s { %s };\n", domain, key, strings.Join(names, " "))
+	}
+
+	return sb.String()
+}
+
+// selinuxType returns the type from the SELinux label of the path, for example sysfs_t.
+func selinuxType(path string) string {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, "security.selinux", buf)
+	if err != nil {
+		return "sysfs_t"
+	}
+
+	// user:role:type:level
+	parts := strings.Split(strings.TrimRight(string(buf[:n]), "\x00"), ":")
+	if len(parts) < 3 {
+		return "sysfs_t"
+	}
+
+	return parts[2]
+}
+
+// checkDenied converts permission errors to an *AccessDeniedError carrying the path.
+func checkDenied(op, path string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return &AccessDeniedError{Op: op, Path: path, Err: err}
+	}
+
+	return err
+}
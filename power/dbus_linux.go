@@ -0,0 +1,409 @@
+//go:build linux
+
+package power
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// This is the smallest D-Bus client able to talk to systemd-logind: method calls with string arguments, their
+// replies, and signals with a boolean argument. It avoids pulling in a full D-Bus library for two calls.
+
+const systemBusSocket = "/run/dbus/system_bus_socket"
+
+// D-Bus message types.
+const (
+	msgMethodCall   = 1
+	msgMethodReturn = 2
+	msgError        = 3
+	msgSignal       = 4
+)
+
+// D-Bus header field codes.
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+	fieldUnixFDs     = 9
+)
+
+// message is a decoded D-Bus message, the body is only decoded for the few signatures used here.
+type message struct {
+	typ         byte
+	serial      uint32
+	replySerial uint32
+	iface       string
+	member      string
+	errName     string
+	sender      string
+	signature   string
+	body        []byte
+	fds         []int
+}
+
+// bus is a connection to the system bus.
+type bus struct {
+	conn    *net.UnixConn
+	r       *bufio.Reader
+	serial  uint32
+	fds     []int      // Descriptors received but not yet claimed by a message
+	signals []*message // Signals received while waiting for a method reply
+}
+
+// dialSystemBus connects and authenticates to the system bus, $DBUS_SYSTEM_BUS_ADDRESS overrides the socket.
+func dialSystemBus() (*bus, error) {
+	path := systemBusSocket
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); addr != "" {
+		var ok bool
+		if path, ok = strings.CutPrefix(addr, "unix:path="); !ok {
+			return nil, fmt.Errorf("unsupported bus address %q", addr)
+		}
+
+		path, _, _ = strings.Cut(path, ",")
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("connect to the system bus: %w", err)
+	}
+
+	b := &bus{conn: conn}
+	b.r = bufio.NewReader(fdReader{b})
+	if err := b.auth(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("authenticate to the system bus: %w", err)
+	}
+
+	if _, err := b.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// auth runs the EXTERNAL authentication with unix descriptor passing.
+func (b *bus) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := b.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return err
+	}
+
+	if line, err := b.r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("rejected: %q %v", line, err)
+	}
+
+	if _, err := b.conn.Write([]byte("NEGOTIATE_UNIX_FD\r\n")); err != nil {
+		return err
+	}
+
+	if line, err := b.r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "AGREE_UNIX_FD") {
+		return fmt.Errorf("descriptor passing refused: %q %v", line, err)
+	}
+
+	_, err := b.conn.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// call invokes a method with string arguments and waits for its reply, signals arriving in the meantime are queued
+// for next.
+func (b *bus) call(dest, path, iface, member string, args ...string) (*message, error) {
+	b.serial++
+	serial := b.serial
+
+	var body encoder
+	for _, arg := range args {
+		body.string(arg)
+	}
+
+	var e encoder
+	e.byte('l')
+	e.byte(msgMethodCall)
+	e.byte(0)
+	e.byte(1)
+	e.uint32(uint32(len(body.buf)))
+	e.uint32(serial)
+
+	var fields encoder
+	fields.offset = 16
+	fields.field(fieldPath, "o", path)
+	fields.field(fieldDestination, "s", dest)
+	fields.field(fieldInterface, "s", iface)
+	fields.field(fieldMember, "s", member)
+	if len(args) > 0 {
+		fields.field(fieldSignature, "g", strings.Repeat("s", len(args)))
+	}
+
+	e.uint32(uint32(len(fields.buf)))
+	e.buf = append(e.buf, fields.buf...)
+	e.align(8)
+	e.buf = append(e.buf, body.buf...)
+	if _, err := b.conn.Write(e.buf); err != nil {
+		return nil, fmt.Errorf("call %s.%s: %w", iface, member, err)
+	}
+
+	for {
+		msg, err := b.read()
+		if err != nil {
+			return nil, fmt.Errorf("call %s.%s: %w", iface, member, err)
+		}
+
+		if msg.typ == msgSignal {
+			b.signals = append(b.signals, msg)
+			continue
+		}
+
+		if msg.replySerial != serial {
+			closeFDs(msg.fds)
+			continue
+		}
+
+		if msg.typ == msgError {
+			return nil, fmt.Errorf("call %s.%s: %s", iface, member, msg.errName)
+		}
+
+		return msg, nil
+	}
+}
+
+// next returns the queued signals first, then the next incoming message.
+func (b *bus) next() (*message, error) {
+	if len(b.signals) > 0 {
+		msg := b.signals[0]
+		b.signals = b.signals[1:]
+		return msg, nil
+	}
+
+	return b.read()
+}
+
+// read decodes the next message.
+func (b *bus) read() (*message, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(b.r, head); err != nil {
+		return nil, err
+	}
+
+	if head[0] != 'l' {
+		return nil, errors.New("big endian messages are not supported")
+	}
+
+	bodyLen := binary.LittleEndian.Uint32(head[4:])
+	fieldsLen := binary.LittleEndian.Uint32(head[12:])
+	padded := (16 + fieldsLen + 7) &^ 7
+	if bodyLen > 1<<20 || fieldsLen > 1<<16 {
+		return nil, errors.New("message too large")
+	}
+
+	rest := make([]byte, padded-16+bodyLen)
+	if _, err := io.ReadFull(b.r, rest); err != nil {
+		return nil, err
+	}
+
+	msg := &message{typ: head[1], serial: binary.LittleEndian.Uint32(head[8:]), body: rest[padded-16:]}
+	d := decoder{buf: append(head, rest[:fieldsLen]...), pos: 16}
+	var nfds uint32
+	for d.pos < len(d.buf) {
+		d.align(8)
+		code := d.byte()
+		sig := d.signature()
+		switch sig {
+		case "s", "o":
+			value := d.string()
+			switch code {
+			case fieldInterface:
+				msg.iface = value
+			case fieldMember:
+				msg.member = value
+			case fieldErrorName:
+				msg.errName = value
+			case fieldSender:
+				msg.sender = value
+			}
+		case "g":
+			value := d.signature()
+			if code == fieldSignature {
+				msg.signature = value
+			}
+		case "u":
+			value := d.uint32()
+			switch code {
+			case fieldReplySerial:
+				msg.replySerial = value
+			case fieldUnixFDs:
+				nfds = value
+			}
+		default:
+			return nil, fmt.Errorf("unexpected header field signature %q", sig)
+		}
+
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+
+	if int(nfds) > len(b.fds) {
+		return nil, errors.New("missing unix descriptors")
+	}
+
+	msg.fds, b.fds = b.fds[:nfds:nfds], b.fds[nfds:]
+	return msg, nil
+}
+
+// close closes the connection and the unclaimed descriptors.
+func (b *bus) close() error {
+	closeFDs(b.fds)
+	b.fds = nil
+	return b.conn.Close()
+}
+
+// fdReader reads from the bus connection, collecting the passed descriptors.
+type fdReader struct {
+	b *bus
+}
+
+// Read implements io.Reader.
+func (r fdReader) Read(p []byte) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(4*16))
+	n, oobn, _, _, err := r.b.conn.ReadMsgUnix(p, oob)
+	if n < 0 {
+		n = 0
+	}
+
+	if oobn > 0 {
+		msgs, perr := unix.ParseSocketControlMessage(oob[:oobn])
+		if perr == nil {
+			for _, m := range msgs {
+				if fds, err := unix.ParseUnixRights(&m); err == nil {
+					r.b.fds = append(r.b.fds, fds...)
+				}
+			}
+		}
+	}
+
+	return n, err
+}
+
+// closeFDs closes the descriptors.
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// encoder marshals little endian D-Bus values, aligned relative to the message start.
+type encoder struct {
+	buf    []byte
+	offset int // Position of buf in the message
+}
+
+func (e *encoder) align(n int) {
+	for (e.offset+len(e.buf))%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) byte(v byte) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(append(e.buf, v...), 0)
+}
+
+func (e *encoder) signature(v string) {
+	e.buf = append(append(append(e.buf, byte(len(v))), v...), 0)
+}
+
+// field appends a header field, a (yv) struct holding a string like value.
+func (e *encoder) field(code byte, sig, value string) {
+	e.align(8)
+	e.byte(code)
+	e.signature(sig)
+	if sig == "g" {
+		e.signature(value)
+	} else {
+		e.string(value)
+	}
+}
+
+// decoder unmarshals little endian D-Bus values, the first error sticks.
+type decoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *decoder) need(n int) bool {
+	if d.err == nil && d.pos+n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	return d.err == nil
+}
+
+func (d *decoder) align(n int) {
+	d.pos = (d.pos + n - 1) &^ (n - 1)
+}
+
+func (d *decoder) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+
+	d.pos++
+	return d.buf[d.pos-1]
+}
+
+func (d *decoder) uint32() uint32 {
+	d.align(4)
+	if !d.need(4) {
+		return 0
+	}
+
+	d.pos += 4
+	return binary.LittleEndian.Uint32(d.buf[d.pos-4:])
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint32())
+	if !d.need(n + 1) {
+		return ""
+	}
+
+	d.pos += n + 1
+	return string(d.buf[d.pos-n-1 : d.pos-1])
+}
+
+func (d *decoder) signature() string {
+	n := int(d.byte())
+	if !d.need(n + 1) {
+		return ""
+	}
+
+	d.pos += n + 1
+	return string(d.buf[d.pos-n-1 : d.pos-1])
+}
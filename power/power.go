@@ -0,0 +1,118 @@
+// Package power hooks the guest power events, so an agent tells the host that it is about to suspend or shut down
+// before it happens. Without that the host can't tell a suspended guest from a crashed one.
+//
+// On linux Watch takes a delay inhibitor lock from systemd-logind and runs the hook before the lock is released. On
+// windows the agent runs as a service created with Service, which runs the hook on the power and shutdown controls.
+// AgentHook sends the events to the peer as agent messages, FlagHook marks them in shared memory flags.
+package power
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/TypicalAM/ivshmem/agent"
+	"github.com/TypicalAM/ivshmem/frame"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrUnsupported = errors.New("power events are not supported on this platform")
+var ErrUnknownEvent = errors.New("unknown power event")
+
+const (
+	// MessageType is the agent message type of the power events sent by AgentHook.
+	MessageType = "power"
+
+	// EventKey is the metadata key holding the name of the event.
+	EventKey = "event"
+)
+
+// Event is a guest power state change.
+type Event int
+
+const (
+	Suspend Event = iota + 1
+	Resume
+	Shutdown
+)
+
+// String returns the name of the event.
+func (e Event) String() string {
+	switch e {
+	case Suspend:
+		return "suspend"
+	case Resume:
+		return "resume"
+	case Shutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("Event(%d)", int(e))
+	}
+}
+
+// Hook is run on every power event. Suspend and shutdown wait for it to return (within the grace time the system
+// gives), so it should only publish the shutdown marker of the protocol and return. An error is passed to the error
+// callback of Watch or Service, the following events still run the hook.
+type Hook func(ctx context.Context, ev Event) error
+
+// ErrorFunc is called with the errors of the hook, it must not block.
+type ErrorFunc func(ev Event, err error)
+
+// Hooks returns a hook running all the hooks in order, joining their errors.
+func Hooks(hooks ...Hook) Hook {
+	return func(ctx context.Context, ev Event) error {
+		var errs []error
+		for _, hook := range hooks {
+			if err := hook(ctx, ev); err != nil {
+				errs = append(errs, err)
+			}
+		}
+
+		return errors.Join(errs...)
+	}
+}
+
+// AgentHook returns a hook sending every event over the connection of an agent, as a MessageType message with the
+// event name under EventKey and no payload. The peer handles it like any other agent message, e.g. to stop treating
+// the missing heartbeats of a suspended guest as a crash.
+func AgentHook(conn frame.Conn) Hook {
+	return func(ctx context.Context, ev Event) error {
+		f := frame.Frame{Metadata: frame.Metadata{agent.TypeKey: MessageType, EventKey: ev.String()}}
+		if err := conn.Send(ctx, f); err != nil {
+			return fmt.Errorf("send %s event: %w", ev, err)
+		}
+
+		return nil
+	}
+}
+
+// ParseEvent returns the event named by the EventKey metadata of a MessageType message.
+func ParseEvent(f frame.Frame) (Event, error) {
+	name := f.Metadata.Get(EventKey)
+	for _, ev := range []Event{Suspend, Resume, Shutdown} {
+		if ev.String() == name {
+			return ev, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownEvent, name)
+}
+
+// FlagHook returns a hook marking the power state in shared memory flags: suspending sets the suspend flag and
+// resuming resets it, shutting down sets the shutdown flag. Either flag may be nil. Combine it with AgentHook using
+// Hooks for peers which also watch the agent messages.
+func FlagHook(suspend, shutdown *shmsync.Flag) Hook {
+	return func(ctx context.Context, ev Event) error {
+		var err error
+		switch {
+		case ev == Suspend && suspend != nil:
+			_, err = suspend.Set()
+		case ev == Resume && suspend != nil:
+			suspend.Reset()
+		case ev == Shutdown && shutdown != nil:
+			_, err = shutdown.Set()
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package power
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	logindService   = "org.freedesktop.login1"
+	logindPath      = "/org/freedesktop/login1"
+	logindInterface = "org.freedesktop.login1.Manager"
+)
+
+// Watch runs the hook on every suspend, resume and shutdown of the guest until the context is done. It holds a delay
+// inhibitor lock of systemd-logind, so the system waits for the hook (up to InhibitDelayMaxSec) before going down.
+// If the lock can't be taken, e.g. because of the polkit policy, the hooks still run but may race the system. A hook
+// error is passed to onError, which may be nil, and the lock is released anyway, a failing hook must not keep the
+// guest from suspending.
+func Watch(ctx context.Context, who string, hook Hook, onError ErrorFunc) error {
+	b, err := dialSystemBus()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.conn.Close()
+		case <-done:
+		}
+	}()
+	defer b.close()
+
+	for _, member := range []string{"PrepareForSleep", "PrepareForShutdown"} {
+		rule := fmt.Sprintf("type='signal',sender='%s',interface='%s',member='%s'", logindService, logindInterface, member)
+		if _, err := b.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", rule); err != nil {
+			return err
+		}
+	}
+
+	lock := b.inhibit(who)
+	defer func() { closeFDs(lock) }()
+
+	for {
+		msg, err := b.next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("read from the system bus: %w", err)
+		}
+		closeFDs(msg.fds)
+
+		if msg.typ != msgSignal || msg.iface != logindInterface || msg.signature != "b" || len(msg.body) < 4 {
+			continue
+		}
+
+		active := binary.LittleEndian.Uint32(msg.body) != 0
+		var ev Event
+		switch {
+		case msg.member == "PrepareForSleep" && active:
+			ev = Suspend
+		case msg.member == "PrepareForSleep":
+			ev = Resume
+		case msg.member == "PrepareForShutdown" && active:
+			ev = Shutdown
+		case msg.member == "PrepareForShutdown":
+			// A cancelled shutdown has no hook, but the lock released for it is needed for the next one
+			if lock == nil {
+				lock = b.inhibit(who)
+			}
+			continue
+		default:
+			continue
+		}
+
+		if err := hook(ctx, ev); err != nil && onError != nil {
+			onError(ev, fmt.Errorf("%s hook: %w", ev, err))
+		}
+
+		// Releasing the lock lets the system go on, it is taken again after resuming
+		closeFDs(lock)
+		lock = nil
+		if ev == Resume {
+			lock = b.inhibit(who)
+		}
+	}
+}
+
+// inhibit takes a delay inhibitor lock for sleep and shutdown, nil if logind refused it.
+func (b *bus) inhibit(who string) []int {
+	msg, err := b.call(logindService, logindPath, logindInterface, "Inhibit",
+		"sleep:shutdown", who, "Notifying the ivshmem peer", "delay")
+	if err != nil {
+		return nil
+	}
+
+	return msg.fds
+}
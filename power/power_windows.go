@@ -0,0 +1,89 @@
+//go:build windows
+
+package power
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// Power broadcast event types delivered with svc.PowerEvent. Only the automatic resume is watched, it is broadcast on
+// every resume and followed by PBT_APMRESUMESUSPEND (0x7) when a user is present, which would fire the hook twice.
+const (
+	pbtAPMSuspend         = 0x4
+	pbtAPMResumeAutomatic = 0x12
+)
+
+// Watch is not available on windows, the power events only reach services. Use Service instead.
+func Watch(ctx context.Context, who string, hook Hook, onError ErrorFunc) error {
+	return fmt.Errorf("%w: run the agent as a service created with Service", ErrUnsupported)
+}
+
+// Service returns a service handler running the agent, pass it to svc.Run. The context of run is cancelled when the
+// service is stopped, the hook runs on suspend, resume and shutdown (pre-shutdown, so the system waits for it). Hook
+// errors are passed to onError, which may be nil.
+func Service(hook Hook, onError ErrorFunc, run func(ctx context.Context) error) svc.Handler {
+	return &service{hook: hook, onError: onError, run: run}
+}
+
+// service implements svc.Handler.
+type service struct {
+	hook    Hook
+	onError ErrorFunc
+	run     func(ctx context.Context) error
+}
+
+// Execute implements svc.Handler.
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown | svc.AcceptPowerEvent
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	shutdown := false
+	for {
+		select {
+		case err := <-done:
+			status <- svc.Status{State: svc.StopPending}
+			if err != nil {
+				return true, 1
+			}
+
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.PowerEvent:
+				switch req.EventType {
+				case pbtAPMSuspend:
+					s.fire(ctx, Suspend)
+				case pbtAPMResumeAutomatic:
+					s.fire(ctx, Resume)
+				}
+			case svc.PreShutdown, svc.Shutdown:
+				if !shutdown {
+					shutdown = true
+					s.fire(ctx, Shutdown)
+				}
+				cancel()
+			case svc.Stop:
+				cancel()
+			}
+		}
+	}
+}
+
+// fire runs the hook, passing its error to the error callback.
+func (s *service) fire(ctx context.Context, ev Event) {
+	if err := s.hook(ctx, ev); err != nil && s.onError != nil {
+		s.onError(ev, fmt.Errorf("%s hook: %w", ev, err))
+	}
+}
@@ -0,0 +1,117 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrInvalidProfile = errors.New("invalid profile")
+var ErrProfileExists = errors.New("profile already registered")
+
+// DeviceProfile describes how to recognize a shared memory PCI device and which BAR holds the shared memory.
+// Hypervisors other than QEMU expose similar devices under their own IDs, registering a profile for them lets the
+// guest discover them.
+type DeviceProfile struct {
+	Name      string
+	VendorID  uint16
+	DeviceID  uint16
+	MemoryBAR uint8 // Index of the BAR holding the shared memory
+}
+
+// String returns the profile name with its IDs, in the usual vendor:device notation.
+func (p DeviceProfile) String() string {
+	return fmt.Sprintf("%s (%04x:%04x)", p.Name, p.VendorID, p.DeviceID)
+}
+
+// Validate checks that the profile can describe a real PCI device.
+func (p DeviceProfile) Validate() error {
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidProfile)
+	case p.VendorID == 0 || p.VendorID == 0xffff:
+		return fmt.Errorf("%w: vendor id %#04x", ErrInvalidProfile, p.VendorID)
+	case p.MemoryBAR > 5:
+		return fmt.Errorf("%w: BAR %d, a PCI device has BARs 0 to 5", ErrInvalidProfile, p.MemoryBAR)
+	}
+
+	return nil
+}
+
+// QEMUProfile matches the ivshmem-plain and ivshmem-doorbell devices of QEMU.
+var QEMUProfile = DeviceProfile{Name: "qemu", VendorID: 0x1af4, DeviceID: 0x1110, MemoryBAR: 2}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = []DeviceProfile{QEMUProfile}
+)
+
+// RegisterProfile adds a profile to the registry, it is used from then on for device discovery (Linux) and for
+// validating the devices bound to the ivshmem driver (Windows). Names and ID pairs must be unique.
+func RegisterProfile(profile DeviceProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	for _, p := range profiles {
+		if p.Name == profile.Name {
+			return fmt.Errorf("%w: name %s", ErrProfileExists, profile.Name)
+		}
+
+		if p.VendorID == profile.VendorID && p.DeviceID == profile.DeviceID {
+			return fmt.Errorf("%w: ids taken by %s", ErrProfileExists, p)
+		}
+	}
+
+	profiles = append(profiles, profile)
+	return nil
+}
+
+// UnregisterProfile removes the profile with the given name, it returns false if there was no such profile.
+func UnregisterProfile(name string) bool {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	for i, p := range profiles {
+		if p.Name == name {
+			profiles = append(profiles[:i:i], profiles[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Profiles returns the registered profiles.
+func Profiles() []DeviceProfile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	return append([]DeviceProfile(nil), profiles...)
+}
+
+// LookupProfile returns the registered profile with the given name.
+func LookupProfile(name string) (DeviceProfile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return DeviceProfile{}, false
+}
+
+// matchProfile returns the profile matching the vendor and device IDs.
+func matchProfile(vendorID, deviceID uint16) (DeviceProfile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	for _, profile := range profiles {
+		if profile.VendorID == vendorID && profile.DeviceID == deviceID {
+			return profile, true
+		}
+	}
+
+	return DeviceProfile{}, false
+}
@@ -0,0 +1,485 @@
+// Package pubsub is a topic bus in the shared memory region: publishers on either side post messages to named
+// topics and any number of subscribers on either side read them, like telemetry fanned out from a guest to several
+// host collectors.
+//
+// Every topic is a ring of fixed size message slots overwritten oldest first, so publishers never wait for slow
+// subscribers. Subscribers keep their cursor on their own side and don't register anywhere; one falling more than a
+// ring behind skips to the oldest message still stored and is told how many it missed. A publisher claims a slot by
+// incrementing the counter of the topic and publishes it by storing its sequence number last, readers check the
+// sequence before and after copying the message out. Like any seqlock, that copy races with a publisher reusing the
+// slot by design, the race detector reports it when both sides run in one process.
+//
+// A topic lives in the entry its name hashes to, or the next free one after it. Sides creating the same topic at once
+// probe the same entries, so the loser of the claim waits for the winner to write the name and then shares its entry.
+//
+// Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a peer initialized the bus
+// again, the counters of its topics restart then.
+//
+// Reserve a segment of type layout.TypePubSub for the bus so both sides find it.
+//
+// Layout, all the values are little endian:
+//
+//	0 magic (uint32)
+//	4 version (uint32)
+//	8 topics (uint32)
+//	12 slots per topic (uint32)
+//	16 slot size (uint32)
+//	44 session ID (16 bytes)
+//	60 epoch (uint32)
+//	64 topic table: name (48 bytes), state (uint32), reserved (uint32), publish counter (uint64)
+//	   slots of the topics: sequence (uint64), length (uint32), reserved (uint32), data
+package pubsub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrInvalidTopic = errors.New("invalid topic name")
+var ErrNoTopic = errors.New("no such topic")
+var ErrTooManyTopics = errors.New("no free topic entry")
+var ErrMessageTooLarge = errors.New("message too large")
+var ErrClaimTimeout = errors.New("topic entry claimed but never named")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x53505649 // "IVPS" when read as little endian bytes
+	Version    uint32 = 3
+	HeaderSize        = 64
+	EntrySize         = 64
+
+	// SlotHeaderSize is the size of the bookkeeping in front of every message slot.
+	SlotHeaderSize = 16
+
+	// MaxTopicLength is the longest topic name fitting into a table entry.
+	MaxTopicLength = 48
+)
+
+// PollInterval is how often a waiting subscriber checks for new messages.
+var PollInterval = time.Millisecond
+
+// ClaimTimeout is how long Topic and Lookup wait for a side which claimed a table entry to write the name of its
+// topic, a side which crashed in between leaves the entry claimed for good.
+var ClaimTimeout = time.Second
+
+// Header field offsets.
+const (
+	offMagic    = 0
+	offVersion  = 4
+	offTopics   = 8
+	offSlots    = 12
+	offSlotSize = 16
+	offSession  = 44
+	offEpoch    = 60
+)
+
+// Topic table entry field offsets.
+const (
+	entName    = 0
+	entState   = 48
+	entCounter = 56
+)
+
+// Topic entry states.
+const (
+	stateFree = iota
+	stateClaimed
+	stateReady
+)
+
+// Slot header field offsets.
+const (
+	slotSequence = 0
+	slotLength   = 8
+)
+
+// Options size a bus.
+type Options struct {
+	Topics   int // Entries of the topic table
+	Slots    int // Messages kept per topic
+	SlotSize int // Largest message
+}
+
+// Bus is a view of the topic bus stored in the region.
+type Bus struct {
+	mem      []byte
+	topics   uint32
+	slots    uint32
+	slotSize uint32
+	stamp    shmhdr.Stamp
+}
+
+// Init writes a fresh bus into the region. Only one side should call Init, before the others call Open.
+func Init(mem []byte, opts Options) (*Bus, error) {
+	if opts.Topics <= 0 || opts.Slots <= 0 || opts.SlotSize <= 0 ||
+		uint64(opts.Topics) > 0xffffffff || uint64(opts.Slots) > 0xffffffff || uint64(opts.SlotSize) > 0xffffffff-7 {
+		return nil, fmt.Errorf("%w: %d topics of %d slots of %d bytes", ErrInvalidHeader, opts.Topics, opts.Slots, opts.SlotSize)
+	}
+
+	b := &Bus{mem: mem, topics: uint32(opts.Topics), slots: uint32(opts.Slots), slotSize: (uint32(opts.SlotSize) + 7) &^ 7}
+	if need, ok := b.size(); !ok || need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	var err error
+	if b.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < b.topics; i++ {
+		for j := range b.entry(i) {
+			b.entry(i)[j] = 0
+		}
+
+		for s := uint32(0); s < b.slots; s++ {
+			atomic.StoreUint64(b.sequence(i, s), 0)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint32(mem[offTopics:], b.topics)
+	binary.LittleEndian.PutUint32(mem[offSlots:], b.slots)
+	binary.LittleEndian.PutUint32(mem[offSlotSize:], b.slotSize)
+
+	shmhdr.Publish(mem, Magic)
+	return b, nil
+}
+
+// Open validates the header written by Init and returns the bus.
+func Open(mem []byte) (*Bus, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	b := &Bus{
+		mem:      mem,
+		topics:   binary.LittleEndian.Uint32(mem[offTopics:]),
+		slots:    binary.LittleEndian.Uint32(mem[offSlots:]),
+		slotSize: binary.LittleEndian.Uint32(mem[offSlotSize:]),
+		stamp:    shmhdr.LoadStamp(mem, offSession, offEpoch),
+	}
+
+	if b.topics == 0 || b.slots == 0 || b.slotSize == 0 || b.slotSize%8 != 0 {
+		return nil, fmt.Errorf("%w: %d topics of %d slots of %d bytes", ErrInvalidHeader, b.topics, b.slots, b.slotSize)
+	}
+
+	if need, ok := b.size(); !ok {
+		return nil, fmt.Errorf("%w: %d topics of %d slots of %d bytes overflow", ErrInvalidHeader, b.topics, b.slots,
+			b.slotSize)
+	} else if need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	return b, nil
+}
+
+// Session returns the ID of the initialization the bus was opened with.
+func (b *Bus) Session() shmhdr.Session {
+	return b.stamp.Session()
+}
+
+// Epoch returns the number of times the bus was initialized, when it was opened.
+func (b *Bus) Epoch() uint32 {
+	return b.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the bus again since it was opened, the view must be reopened then.
+func (b *Bus) Stale() bool {
+	return b.stamp.Check() != nil
+}
+
+// Topics returns the names of the topics created so far.
+func (b *Bus) Topics() []string {
+	var names []string
+	for i := uint32(0); i < b.topics; i++ {
+		if atomic.LoadUint32(b.state(i)) == stateReady {
+			names = append(names, b.name(i))
+		}
+	}
+
+	return names
+}
+
+// Topic returns the topic with the name, creating it if it doesn't exist yet. Sides creating the same topic at once
+// get the same one.
+func (b *Bus) Topic(name string) (*Topic, error) {
+	return b.find(name, true)
+}
+
+// Lookup returns the existing topic with the name.
+func (b *Bus) Lookup(name string) (*Topic, error) {
+	return b.find(name, false)
+}
+
+// find probes the table for the topic starting at the entry its name hashes to, claiming the first free entry for it
+// if create is set. Entries are never freed, so every side probing for a name passes the same entries: an entry
+// claimed by another side is waited for until it is named, it may be claimed for the same topic.
+func (b *Bus) find(name string, create bool) (*Topic, error) {
+	if name == "" || len(name) > MaxTopicLength {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTopic, name)
+	}
+
+	if err := b.stamp.Check(); err != nil {
+		return nil, err
+	}
+
+	start := b.hash(name)
+	for i := uint32(0); i < b.topics; i++ {
+		index := (start + i) % b.topics
+		state := atomic.LoadUint32(b.state(index))
+		if state == stateFree {
+			if !create {
+				return nil, fmt.Errorf("%w: %q", ErrNoTopic, name)
+			}
+
+			if atomic.CompareAndSwapUint32(b.state(index), stateFree, stateClaimed) {
+				entry := b.entry(index)
+				copy(entry[entName:entName+MaxTopicLength], name)
+				atomic.StoreUint32(b.state(index), stateReady)
+				return &Topic{bus: b, index: index, name: name}, nil
+			}
+
+			state = atomic.LoadUint32(b.state(index))
+		}
+
+		if state == stateClaimed {
+			if err := b.named(index); err != nil {
+				return nil, err
+			}
+		}
+
+		if b.name(index) == name {
+			return &Topic{bus: b, index: index, name: name}, nil
+		}
+	}
+
+	if create {
+		return nil, fmt.Errorf("%w: %d topics", ErrTooManyTopics, b.topics)
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrNoTopic, name)
+}
+
+// named waits for the side which claimed the entry to write the name of its topic.
+func (b *Bus) named(index uint32) error {
+	deadline := time.Now().Add(ClaimTimeout)
+	var backoff shmsync.Backoff
+	for atomic.LoadUint32(b.state(index)) != stateReady {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: entry %d", ErrClaimTimeout, index)
+		}
+
+		backoff.Wait()
+	}
+
+	return nil
+}
+
+// hash returns the first table entry to probe for the topic.
+func (b *Bus) hash(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32() % b.topics
+}
+
+// size returns the bytes the bus needs, false if they don't fit into an uint64.
+func (b *Bus) size() (uint64, bool) {
+	hi, slots := bits.Mul64(uint64(b.slots), b.stride())
+	if hi != 0 || slots > ^uint64(0)-EntrySize {
+		return 0, false
+	}
+
+	hi, total := bits.Mul64(uint64(b.topics), EntrySize+slots)
+	if hi != 0 || total > ^uint64(0)-HeaderSize {
+		return 0, false
+	}
+
+	return HeaderSize + total, true
+}
+
+// stride returns the distance between two slots.
+func (b *Bus) stride() uint64 {
+	return SlotHeaderSize + uint64(b.slotSize)
+}
+
+// entry returns the table entry of the topic.
+func (b *Bus) entry(topic uint32) []byte {
+	off := HeaderSize + uint64(topic)*EntrySize
+	return b.mem[off : off+EntrySize]
+}
+
+// name returns the name stored in the table entry.
+func (b *Bus) name(topic uint32) string {
+	name := b.entry(topic)[entName : entName+MaxTopicLength]
+	for i, c := range name {
+		if c == 0 {
+			return string(name[:i])
+		}
+	}
+
+	return string(name)
+}
+
+// state returns the state of the table entry for atomic access.
+func (b *Bus) state(topic uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b.entry(topic)[entState]))
+}
+
+// counter returns the publish counter of the topic for atomic access.
+func (b *Bus) counter(topic uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(&b.entry(topic)[entCounter]))
+}
+
+// slot returns the memory of the slot of the topic.
+func (b *Bus) slot(topic, slot uint32) []byte {
+	off := HeaderSize + uint64(b.topics)*EntrySize + (uint64(topic)*uint64(b.slots)+uint64(slot))*b.stride()
+	return b.mem[off : off+b.stride()]
+}
+
+// sequence returns the sequence number of the slot for atomic access.
+func (b *Bus) sequence(topic, slot uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(&b.slot(topic, slot)[slotSequence]))
+}
+
+// Topic is a named stream of messages.
+type Topic struct {
+	bus   *Bus
+	index uint32
+	name  string
+}
+
+// Name returns the name of the topic.
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Published returns the number of messages published on the topic so far.
+func (t *Topic) Published() uint64 {
+	return atomic.LoadUint64(t.bus.counter(t.index))
+}
+
+// Publish posts the message, overwriting the oldest one if the topic is full.
+func (t *Topic) Publish(msg []byte) error {
+	b := t.bus
+	if uint64(len(msg)) > uint64(b.slotSize) {
+		return fmt.Errorf("%w: %d bytes, a slot holds %d", ErrMessageTooLarge, len(msg), b.slotSize)
+	}
+
+	if err := b.stamp.Check(); err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint64(b.counter(t.index), 1)
+	slot := uint32((seq - 1) % uint64(b.slots))
+	mem := b.slot(t.index, slot)
+
+	// Readers skip the slot until its sequence is published again
+	atomic.StoreUint64(b.sequence(t.index, slot), 0)
+	binary.LittleEndian.PutUint32(mem[slotLength:], uint32(len(msg)))
+	copy(mem[SlotHeaderSize:], msg)
+	atomic.StoreUint64(b.sequence(t.index, slot), seq)
+	return nil
+}
+
+// Subscribe returns a subscription receiving the messages published from now on.
+func (t *Topic) Subscribe() *Subscription {
+	return &Subscription{topic: t, next: t.Published() + 1}
+}
+
+// Subscription reads the messages of a topic, it is used by a single goroutine.
+type Subscription struct {
+	topic   *Topic
+	next    uint64 // Sequence number of the next message
+	dropped uint64
+}
+
+// Dropped returns the number of messages overwritten before the subscription read them.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped
+}
+
+// Poll appends the next message to dst, it returns false if there is no new message or the bus is stale.
+func (s *Subscription) Poll(dst []byte) ([]byte, bool) {
+	b := s.topic.bus
+	for {
+		if b.Stale() {
+			return dst, false
+		}
+
+		published := atomic.LoadUint64(b.counter(s.topic.index))
+		if s.next > published {
+			return dst, false
+		}
+
+		// Fell more than a ring behind, skip to the oldest message still stored
+		if oldest := published - uint64(b.slots) + 1; published >= uint64(b.slots) && s.next < oldest {
+			s.dropped += oldest - s.next
+			s.next = oldest
+		}
+
+		slot := uint32((s.next - 1) % uint64(b.slots))
+		seq := atomic.LoadUint64(b.sequence(s.topic.index, slot))
+		switch {
+		case seq < s.next:
+			// Claimed but not written yet
+			return dst, false
+		case seq > s.next:
+			// Overwritten since the counter was read
+			continue
+		}
+
+		mem := b.slot(s.topic.index, slot)
+		length := binary.LittleEndian.Uint32(mem[slotLength:])
+		if length > b.slotSize {
+			length = b.slotSize
+		}
+
+		start := len(dst)
+		dst = append(dst, mem[SlotHeaderSize:SlotHeaderSize+uint64(length)]...)
+		if atomic.LoadUint64(b.sequence(s.topic.index, slot)) != seq {
+			dst = dst[:start]
+			continue
+		}
+
+		s.next++
+		return dst, true
+	}
+}
+
+// Next waits for the next message, or until the context is done, and appends it to dst. It fails with ErrStale once a
+// peer initialized the bus again.
+func (s *Subscription) Next(ctx context.Context, dst []byte) ([]byte, error) {
+	for {
+		if msg, ok := s.Poll(dst); ok {
+			return msg, nil
+		}
+
+		if err := s.topic.bus.stamp.Check(); err != nil {
+			return dst, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return dst, ctx.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+}
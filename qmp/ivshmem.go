@@ -0,0 +1,218 @@
+package qmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrMismatch = errors.New("host mapping doesn't match the device")
+
+// PCI IDs of the ivshmem device.
+const (
+	ivshmemVendor = 0x1af4
+	ivshmemDevice = 0x1110
+)
+
+// Device describes an ivshmem device of the VM as QEMU sees it.
+type Device struct {
+	ID       string // The -device id, empty for anonymous devices
+	Path     string // QOM path of the device
+	Type     string // ivshmem-plain, ivshmem-doorbell or the legacy ivshmem
+	Memdev   string // QOM path of the memory backend, empty for doorbell devices which get it from the server
+	MemPath  string // Host file backing the memory, empty unless it is a memory-backend-file
+	Size     uint64 // Size of the shared memory (BAR 2) in bytes
+	Bus      uint8
+	Slot     uint8
+	Function uint8
+}
+
+// qomProperty is an entry of the qom-list result.
+type qomProperty struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// pciDevice is a device of the query-pci result.
+type pciDevice struct {
+	Bus      uint8  `json:"bus"`
+	Slot     uint8  `json:"slot"`
+	Function uint8  `json:"function"`
+	QdevID   string `json:"qdev_id"`
+	ID       struct {
+		Vendor uint16 `json:"vendor"`
+		Device uint16 `json:"device"`
+	} `json:"id"`
+	Regions []struct {
+		Bar  int    `json:"bar"`
+		Size uint64 `json:"size"`
+	} `json:"regions"`
+	Bridge *struct {
+		Devices []pciDevice `json:"devices"`
+	} `json:"pci_bridge"`
+}
+
+// IvshmemDevices returns the ivshmem devices plugged into the VM.
+func (c *Client) IvshmemDevices(ctx context.Context) ([]Device, error) {
+	var buses []struct {
+		Devices []pciDevice `json:"devices"`
+	}
+	if err := c.Execute(ctx, "query-pci", nil, &buses); err != nil {
+		return nil, fmt.Errorf("query pci: %w", err)
+	}
+
+	var pci []pciDevice
+	for _, bus := range buses {
+		pci = appendIvshmem(pci, bus.Devices)
+	}
+
+	var devices []Device
+	for _, parent := range []string{"/machine/peripheral", "/machine/peripheral-anon"} {
+		var props []qomProperty
+		if err := c.Execute(ctx, "qom-list", map[string]string{"path": parent}, &props); err != nil {
+			return nil, fmt.Errorf("list %s: %w", parent, err)
+		}
+
+		for _, prop := range props {
+			typ, ok := strings.CutPrefix(prop.Type, "child<")
+			typ = strings.TrimSuffix(typ, ">")
+			if !ok || (typ != "ivshmem-plain" && typ != "ivshmem-doorbell" && typ != "ivshmem") {
+				continue
+			}
+
+			dev := Device{Path: parent + "/" + prop.Name, Type: typ}
+			if parent == "/machine/peripheral" {
+				dev.ID = prop.Name
+			}
+
+			if err := c.describe(ctx, &dev, pci); err != nil {
+				return nil, err
+			}
+
+			devices = append(devices, dev)
+		}
+	}
+
+	return devices, nil
+}
+
+// IvshmemDevice returns the ivshmem device with the -device id.
+func (c *Client) IvshmemDevice(ctx context.Context, id string) (Device, error) {
+	devices, err := c.IvshmemDevices(ctx)
+	if err != nil {
+		return Device{}, err
+	}
+
+	for _, dev := range devices {
+		if dev.ID == id {
+			return dev, nil
+		}
+	}
+
+	return Device{}, fmt.Errorf("no ivshmem device with id %q", id)
+}
+
+// describe fills in the PCI address, the memory backend and the size of the device.
+func (c *Client) describe(ctx context.Context, dev *Device, pci []pciDevice) error {
+	var devfn int
+	if err := c.qomGet(ctx, dev.Path, "addr", &devfn); err != nil {
+		return err
+	}
+
+	dev.Slot, dev.Function = uint8(devfn>>3), uint8(devfn&7)
+	for _, p := range pci {
+		if (dev.ID != "" && p.QdevID == dev.ID) || (dev.ID == "" && p.QdevID == "" && p.Slot == dev.Slot && p.Function == dev.Function) {
+			dev.Bus = p.Bus
+			for _, region := range p.Regions {
+				if region.Bar == 2 {
+					dev.Size = region.Size
+				}
+			}
+			break
+		}
+	}
+
+	// Doorbell devices get the memory from the server, so they have no backend
+	if dev.Type == "ivshmem-doorbell" {
+		return nil
+	}
+
+	if err := c.qomGet(ctx, dev.Path, "memdev", &dev.Memdev); err != nil {
+		var qerr *Error
+		if errors.As(err, &qerr) {
+			return nil
+		}
+
+		return err
+	}
+
+	if dev.Memdev == "" {
+		return nil
+	}
+
+	if err := c.qomGet(ctx, dev.Memdev, "size", &dev.Size); err != nil {
+		return err
+	}
+
+	// Only file backends have a path, memfd and ram backends can't be opened by name
+	var qerr *Error
+	if err := c.qomGet(ctx, dev.Memdev, "mem-path", &dev.MemPath); err != nil && !errors.As(err, &qerr) {
+		return err
+	}
+
+	return nil
+}
+
+// qomGet reads a property of a QOM object.
+func (c *Client) qomGet(ctx context.Context, path, property string, result any) error {
+	args := map[string]string{"path": path, "property": property}
+	if err := c.Execute(ctx, "qom-get", args, result); err != nil {
+		return fmt.Errorf("get %s of %s: %w", property, path, err)
+	}
+
+	return nil
+}
+
+// appendIvshmem collects the ivshmem devices, including the ones behind bridges.
+func appendIvshmem(dst, devices []pciDevice) []pciDevice {
+	for _, dev := range devices {
+		if dev.ID.Vendor == ivshmemVendor && dev.ID.Device == ivshmemDevice {
+			dst = append(dst, dev)
+		}
+
+		if dev.Bridge != nil {
+			dst = appendIvshmem(dst, dev.Bridge.Devices)
+		}
+	}
+
+	return dst
+}
+
+// Check makes sure the host mapping of the file with the size is the memory the guest sees through the device.
+func (d Device) Check(path string, size uint64) error {
+	if d.Size != size {
+		return fmt.Errorf("%w: the host maps %d bytes, the device has %d", ErrMismatch, size, d.Size)
+	}
+
+	if d.MemPath == "" {
+		return nil
+	}
+
+	host, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat host file: %w", err)
+	}
+
+	backing, err := os.Stat(d.MemPath)
+	if err != nil {
+		return fmt.Errorf("stat backing file: %w", err)
+	}
+
+	if !os.SameFile(host, backing) {
+		return fmt.Errorf("%w: the host maps %s, the device is backed by %s", ErrMismatch, path, d.MemPath)
+	}
+
+	return nil
+}
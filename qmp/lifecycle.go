@@ -0,0 +1,148 @@
+package qmp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RequeryTimeout bounds the query-status command the monitor runs after missing events.
+var RequeryTimeout = 5 * time.Second
+
+// PeerState is the run state of the VM on the other side of the shared memory.
+type PeerState int
+
+const (
+	PeerUnknown   PeerState = iota
+	PeerRunning             // The vCPUs run, so the guest agent should be alive
+	PeerPaused              // Stopped by the monitor, migrating or in an error state, the agent is frozen
+	PeerSuspended           // Suspended by the guest (S3), the agent is frozen until the wakeup
+	PeerShutOff             // Shut down or QEMU exited
+)
+
+// String returns the name of the state.
+func (s PeerState) String() string {
+	switch s {
+	case PeerRunning:
+		return "running"
+	case PeerPaused:
+		return "paused"
+	case PeerSuspended:
+		return "suspended"
+	case PeerShutOff:
+		return "shut off"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is the result of the query-status command.
+type Status struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// State maps the QEMU run state to the peer state.
+func (s Status) State() PeerState {
+	switch s.Status {
+	case "running":
+		return PeerRunning
+	case "suspended":
+		return PeerSuspended
+	case "shutdown", "guest-panicked":
+		return PeerShutOff
+	case "":
+		return PeerUnknown
+	default:
+		return PeerPaused
+	}
+}
+
+// QueryStatus returns the run state of the VM.
+func (c *Client) QueryStatus(ctx context.Context) (Status, error) {
+	var status Status
+	if err := c.Execute(ctx, "query-status", nil, &status); err != nil {
+		return Status{}, fmt.Errorf("query status: %w", err)
+	}
+
+	return status, nil
+}
+
+// Monitor follows the lifecycle events of the VM, so a host agent tells a paused VM from a crashed guest agent.
+type Monitor struct {
+	mu    sync.Mutex
+	state PeerState
+}
+
+// NewMonitor queries the current state and keeps it up to date from the events until the client is closed. When it
+// misses events it queries the state again, the state is unknown until that succeeds.
+func NewMonitor(ctx context.Context, c *Client) (*Monitor, error) {
+	events := c.Subscribe()
+	status, err := c.QueryStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Monitor{state: status.State()}
+	go m.follow(c, events)
+	return m, nil
+}
+
+// PeerState returns the last known state of the VM.
+func (m *Monitor) PeerState() PeerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// AgentDown tells whether a lost heartbeat means the guest agent itself is down: only a running VM is expected to
+// keep beating, a paused, suspended or stopped one can't.
+func (m *Monitor) AgentDown(heartbeatLost bool) bool {
+	return heartbeatLost && m.PeerState() == PeerRunning
+}
+
+// follow applies the lifecycle events.
+func (m *Monitor) follow(c *Client, events <-chan Event) {
+	for ev := range events {
+		var state PeerState
+		switch ev.Name {
+		case EventsDropped:
+			state = m.requery(c)
+		case "STOP":
+			state = PeerPaused
+		case "RESUME", "WAKEUP":
+			state = PeerRunning
+		case "SUSPEND", "SUSPEND_DISK":
+			state = PeerSuspended
+		case "SHUTDOWN":
+			state = PeerShutOff
+		default:
+			continue
+		}
+
+		m.mu.Lock()
+		// With -no-shutdown QEMU stops the vCPUs of a shut down VM, the STOP following SHUTDOWN doesn't pause it
+		if ev.Name != "STOP" || m.state != PeerShutOff {
+			m.state = state
+		}
+		m.mu.Unlock()
+	}
+
+	// The events end with the connection, which QEMU closes when it exits
+	m.mu.Lock()
+	m.state = PeerShutOff
+	m.mu.Unlock()
+}
+
+// requery returns the current state of the VM, unknown if it can't be queried.
+func (m *Monitor) requery(c *Client) PeerState {
+	ctx, cancel := context.WithTimeout(context.Background(), RequeryTimeout)
+	defer cancel()
+	status, err := c.QueryStatus(ctx)
+	if err != nil {
+		return PeerUnknown
+	}
+
+	return status.State()
+}
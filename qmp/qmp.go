@@ -0,0 +1,259 @@
+// Package qmp is a minimal client of the QEMU Machine Protocol, the JSON protocol of the QEMU monitor socket
+// (-qmp unix:/path,server=on,wait=off). Host agents use it to learn what happens to the VM on the other side of the
+// shared memory.
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("qmp connection closed")
+
+// EventsDropped is the name of the event the client sends to a subscriber which missed events because it didn't keep
+// up, ahead of the next event it receives. QEMU never sends it, a subscriber tracking the VM state re-queries it.
+const EventsDropped = "EVENTS_DROPPED"
+
+// Error is an error returned by QEMU for a command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("qmp %s: %s", e.Class, e.Desc)
+}
+
+// Event is an asynchronous event sent by QEMU.
+type Event struct {
+	Name string
+	Data json.RawMessage
+	Time time.Time
+}
+
+// message is anything QEMU sends: the greeting, a command response or an event.
+type message struct {
+	ID        *uint64         `json:"id,omitempty"`
+	Return    json.RawMessage `json:"return,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// command is a command sent to QEMU.
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+	ID        uint64 `json:"id"`
+}
+
+// Client is a connection to a QMP socket, it is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+
+	mu          sync.Mutex
+	nextID      uint64
+	pending     map[uint64]chan message
+	subscribers []*subscriber
+	closed      bool
+	done        chan struct{}
+}
+
+// Dial connects to the QMP unix socket and negotiates the capabilities.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("dial qmp: %w", err)
+	}
+
+	return NewClient(ctx, conn)
+}
+
+// NewClient runs the QMP handshake over the connection.
+func NewClient(ctx context.Context, conn net.Conn) (*Client, error) {
+	r := bufio.NewReader(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	// The greeting is the first line, it only carries the version and the capabilities
+	if _, err := r.ReadBytes('\n'); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read qmp greeting: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &Client{conn: conn, pending: make(map[uint64]chan message), done: make(chan struct{})}
+	go c.receive(r)
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Execute runs the command with the arguments (nil for none) and decodes its return value into the result (nil to
+// discard it).
+func (c *Client) Execute(ctx context.Context, cmd string, args, result any) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+
+	c.nextID++
+	id := c.nextID
+	reply := make(chan message, 1)
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	data, err := json.Marshal(command{Execute: cmd, Arguments: args, ID: id})
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", cmd, err)
+	}
+
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("send %s: %w", cmd, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	case msg := <-reply:
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if result == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(msg.Return, result); err != nil {
+			return fmt.Errorf("decode %s: %w", cmd, err)
+		}
+
+		return nil
+	}
+}
+
+// subscriber is a channel receiving the events.
+type subscriber struct {
+	ch      chan Event
+	dropped bool // Events were dropped since the last EventsDropped event was delivered
+}
+
+// Subscribe returns a channel receiving the events, it is closed along with the client. Events are dropped for
+// subscribers which don't keep up, they then receive an EventsDropped event before the next one.
+func (c *Client) Subscribe() <-chan Event {
+	ch := make(chan Event, 16)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(ch)
+		return ch
+	}
+
+	c.subscribers = append(c.subscribers, &subscriber{ch: ch})
+	return ch
+}
+
+// Done returns a channel which is closed when the connection is gone, e.g. because QEMU exited.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.shutdown()
+	return err
+}
+
+// receive dispatches the responses and the events until the connection fails.
+func (c *Client) receive(r *bufio.Reader) {
+	defer c.shutdown()
+
+	dec := json.NewDecoder(r)
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		switch {
+		case msg.Event != "":
+			ev := Event{
+				Name: msg.Event,
+				Data: msg.Data,
+				Time: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*int64(time.Microsecond)),
+			}
+
+			for _, sub := range c.subscribers {
+				sub.send(ev)
+			}
+		case msg.ID != nil:
+			if reply, ok := c.pending[*msg.ID]; ok {
+				reply <- msg
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// shutdown marks the client closed and releases the waiters.
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	close(c.done)
+	for _, sub := range c.subscribers {
+		close(sub.ch)
+	}
+
+	c.subscribers = nil
+}
+
+// send delivers the event without blocking, preceded by an EventsDropped event if earlier ones were dropped.
+func (s *subscriber) send(ev Event) {
+	if s.dropped {
+		select {
+		case s.ch <- Event{Name: EventsDropped, Time: ev.Time}:
+			s.dropped = false
+		default:
+			return
+		}
+	}
+
+	select {
+	case s.ch <- ev:
+	default:
+		s.dropped = true
+	}
+}
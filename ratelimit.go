@@ -0,0 +1,196 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrOverbooked = errors.New("reserved rates exceed the total rate")
+
+// RateLimitedWriter throttles the writes to the underlying writer, so bulk transfers don't saturate the memory
+// bandwidth and starve latency critical users of the same region.
+type RateLimitedWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+}
+
+// NewRateLimitedWriter returns a writer passing at most bytesPerSec bytes per second to w, with bursts of up to
+// a tenth of a second worth of data. A non-positive rate disables the limit.
+func NewRateLimitedWriter(w io.Writer, bytesPerSec int64) *RateLimitedWriter {
+	return &RateLimitedWriter{w: w, bucket: newTokenBucket(bytesPerSec, bytesPerSec/10)}
+}
+
+// Write writes the data in chunks no larger than the burst size, waiting for the budget before every chunk.
+func (r *RateLimitedWriter) Write(p []byte) (int, error) {
+	return r.bucket.write(r.w, p)
+}
+
+// Shaper splits a total byte rate between logical streams. Streams with a reserved rate get their own token bucket,
+// so they keep their bandwidth no matter how much the others send. The remaining streams share what is left.
+// It shapes the streams of a mux session once passed to mux.Session.SetShaper. It is safe for concurrent use.
+type Shaper struct {
+	mu       sync.Mutex
+	total    int64
+	reserved int64
+	streams  map[uint32]*tokenBucket
+	shared   *tokenBucket
+}
+
+// NewShaper returns a shaper distributing bytesPerSec between the streams, all of which start out sharing it.
+func NewShaper(bytesPerSec int64) *Shaper {
+	return &Shaper{
+		total:   bytesPerSec,
+		streams: make(map[uint32]*tokenBucket),
+		shared:  newTokenBucket(bytesPerSec, bytesPerSec/10),
+	}
+}
+
+// SetStreamRate reserves bytesPerSec for the stream, with bursts up to burst bytes. The reservations must leave some
+// bandwidth for the shared streams, ErrOverbooked is returned otherwise. A zero rate removes the reservation, a
+// negative one is refused with ErrInvalidArgument.
+func (s *Shaper) SetStreamRate(stream uint32, bytesPerSec, burst int64) error {
+	if bytesPerSec < 0 {
+		return fmt.Errorf("%w: negative rate %d bytes/s for stream %d", ErrInvalidArgument, bytesPerSec, stream)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reserved := s.reserved + bytesPerSec
+	if bucket, ok := s.streams[stream]; ok {
+		reserved -= int64(bucket.rate)
+	}
+
+	if reserved >= s.total {
+		return fmt.Errorf("%w: %d of %d bytes/s", ErrOverbooked, reserved, s.total)
+	}
+
+	if bytesPerSec == 0 {
+		delete(s.streams, stream)
+	} else if bucket, ok := s.streams[stream]; ok {
+		bucket.setRate(bytesPerSec, burst)
+	} else {
+		s.streams[stream] = newTokenBucket(bytesPerSec, burst)
+	}
+
+	s.reserved = reserved
+	s.shared.setRate(s.total-reserved, (s.total-reserved)/10)
+	return nil
+}
+
+// Wait blocks until the stream may send n bytes.
+func (s *Shaper) Wait(stream uint32, n int) {
+	s.bucket(stream).take(int64(n))
+}
+
+// Writer returns a writer shaped as the stream.
+func (s *Shaper) Writer(stream uint32, w io.Writer) io.Writer {
+	return &shapedWriter{shaper: s, stream: stream, w: w}
+}
+
+// bucket returns the bucket currently used by the stream.
+func (s *Shaper) bucket(stream uint32) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bucket, ok := s.streams[stream]; ok {
+		return bucket
+	}
+
+	return s.shared
+}
+
+// shapedWriter is a writer limited by the rate of its stream, which may change between the writes.
+type shapedWriter struct {
+	shaper *Shaper
+	stream uint32
+	w      io.Writer
+}
+
+// Write writes the data within the current budget of the stream.
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	return w.shaper.bucket(w.stream).write(w.w, p)
+}
+
+// tokenBucket hands out byte budget at a fixed rate, it is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  int64   // Bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, the burst is at least one token.
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// setRate changes the rate and the capacity of the bucket.
+func (b *tokenBucket) setRate(rate, burst int64) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+	b.burst = burst
+}
+
+// write writes the data to w in chunks no larger than the burst size, waiting for the budget before every chunk.
+// A non-positive rate means no limit.
+func (b *tokenBucket) write(w io.Writer, p []byte) (int, error) {
+	b.mu.Lock()
+	rate, burst := b.rate, b.burst
+	b.mu.Unlock()
+
+	if rate <= 0 {
+		return w.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > burst {
+			chunk = chunk[:burst]
+		}
+
+		b.take(int64(len(chunk)))
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// take removes n tokens from the bucket, sleeping until they are available. Requests larger than the burst size
+// are served as well, they just leave the bucket in debt.
+func (b *tokenBucket) take(n int64) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+
+	b.last = now
+	b.tokens -= float64(n)
+	debt, rate := b.tokens, b.rate
+	b.mu.Unlock()
+
+	if debt < 0 && rate > 0 {
+		time.Sleep(time.Duration(-debt / rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,163 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Mapper is the lifecycle shared by Host, Guest and Client: the memory is mapped by Map, used through SharedMem and
+// released by Unmap. Mapped tells whether SharedMem may be called. Close releases everything, unmapping the memory if
+// needed, so protocol code written against Mapper works with either side of the link.
+type Mapper interface {
+	Map() error
+	Unmap() error
+	Mapped() bool
+	Size() uint64
+	SharedMem() []byte
+	Sync() error
+	DevPath() string
+	io.Closer
+}
+
+// MapMemory maps the mapper unless it already is and returns its memory, an empty region fails with
+// ErrRegionTooSmall.
+func MapMemory(m Mapper) ([]byte, error) {
+	if err := m.Map(); err != nil && !errors.Is(err, ErrAlreadyMapped) {
+		return nil, fmt.Errorf("map: %w", err)
+	}
+
+	mem := m.SharedMem()
+	if len(mem) == 0 {
+		return nil, fmt.Errorf("%w: empty region", ErrRegionTooSmall)
+	}
+
+	return mem, nil
+}
+
+// Region is the v2 API of a shared memory region. Unlike a Mapper it is mapped as soon as it exists and released by
+// Close, so there is no unmapped state to get wrong and no panicking accessor. New code should use Region, the Mapper
+// based types keep working and convert with NewRegion.
+type Region interface {
+	Bytes() []byte // The mapped memory, nil once the region is closed
+	Size() uint64
+	Sync() error
+	Close() error
+}
+
+// RegionOptions customize a region opened by the v2 constructors.
+type RegionOptions struct {
+	// Notifier rings and listens to the doorbells of the region, by default the one of the device if it has any.
+	Notifier Notifier
+
+	// MinSize fails the open if the region is smaller, protocols use it to check their layout fits.
+	MinSize uint64
+
+	// SelfTest measures the copy bandwidth of the region once it is mapped, nil skips it.
+	SelfTest *SelfTest
+}
+
+// NewRegion maps the mapper, if it isn't mapped yet, and returns it as a Region. It is the migration shim from the
+// v1 types: Close closes the mapper.
+func NewRegion(m Mapper, opts RegionOptions) (Region, error) {
+	if err := m.Map(); err != nil && !errors.Is(err, ErrAlreadyMapped) {
+		return nil, fmt.Errorf("map: %w", err)
+	}
+
+	if m.Size() < opts.MinSize {
+		err := fmt.Errorf("%w: region of %d bytes, need %d", ErrRegionTooSmall, m.Size(), opts.MinSize)
+		return nil, errors.Join(err, m.Close())
+	}
+
+	r := &mapperRegion{mapper: m, notifier: opts.Notifier, mem: m.SharedMem()}
+	if r.notifier == nil {
+		r.notifier, _ = m.(Notifier)
+	}
+
+	if opts.SelfTest != nil {
+		bw, err := opts.SelfTest.run(r.mem)
+		if err != nil {
+			return nil, errors.Join(err, m.Close())
+		}
+
+		r.bandwidth = &bw
+	}
+
+	return r, nil
+}
+
+// RegionNotifier returns the notifier of the region, false if it can't ring doorbells.
+func RegionNotifier(r Region) (Notifier, bool) {
+	if mr, ok := r.(*mapperRegion); ok {
+		return mr.notifier, mr.notifier != nil
+	}
+
+	n, ok := r.(Notifier)
+	return n, ok
+}
+
+// RegionMapper returns the v1 mapper behind a region created by NewRegion, for code which isn't migrated yet.
+func RegionMapper(r Region) (Mapper, bool) {
+	mr, ok := r.(*mapperRegion)
+	if !ok {
+		return nil, false
+	}
+
+	return mr.mapper, true
+}
+
+// RegionBandwidth returns the bandwidth measured by the self-test when the region was opened, false if it didn't run.
+func RegionBandwidth(r Region) (Bandwidth, bool) {
+	mr, ok := r.(*mapperRegion)
+	if !ok || mr.bandwidth == nil {
+		return Bandwidth{}, false
+	}
+
+	return *mr.bandwidth, true
+}
+
+// mapperRegion is a Region over a mapped Mapper.
+type mapperRegion struct {
+	mapper    Mapper
+	notifier  Notifier
+	bandwidth *Bandwidth
+
+	mu  sync.Mutex
+	mem []byte
+}
+
+// Bytes returns the mapped memory.
+func (r *mapperRegion) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mem
+}
+
+// Size returns the size of the region.
+func (r *mapperRegion) Size() uint64 {
+	return r.mapper.Size()
+}
+
+// Sync flushes the changes made to the memory.
+func (r *mapperRegion) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mem == nil {
+		return ErrClosed
+	}
+
+	return r.mapper.Sync()
+}
+
+// Close unmaps the memory, closing twice returns ErrClosed.
+func (r *mapperRegion) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mem == nil {
+		return ErrClosed
+	}
+
+	r.mem = nil
+	return r.mapper.Close()
+}
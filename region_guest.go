@@ -0,0 +1,15 @@
+//go:build linux || windows
+
+package ivshmem
+
+var _ Mapper = (*Guest)(nil)
+
+// OpenGuest maps the memory of the device at the location as a Region, the v2 equivalent of NewGuest followed by Map.
+func OpenGuest(location PCILocation, opts RegionOptions) (Region, error) {
+	g, err := NewGuest(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRegion(g, opts)
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package ivshmem
+
+var _ Mapper = (*Host)(nil)
+
+// OpenHost maps the shared memory file as a Region, the v2 equivalent of NewHost followed by Map.
+func OpenHost(shmPath string, opts RegionOptions) (Region, error) {
+	h, err := NewHost(shmPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRegion(h, opts)
+}
@@ -0,0 +1,169 @@
+package ivshmem
+
+import (
+	"fmt"
+	"io"
+)
+
+// ReaderAt returns an io.ReaderAt over the shared memory of the mapper, so the region works with io.SectionReader,
+// io.Copy and the rest of the standard library without handing out the raw slice. Reads are bounds checked and fail
+// with ErrNotMapped while the mapper is unmapped.
+func ReaderAt(m Mapper) io.ReaderAt {
+	return regionIO{m}
+}
+
+// WriterAt returns an io.WriterAt over the shared memory of the mapper. Writes are bounds checked, a write past the
+// end of the region writes nothing and fails with io.ErrShortWrite.
+func WriterAt(m Mapper) io.WriterAt {
+	return regionIO{m}
+}
+
+// regionIO reads and writes the shared memory at offsets.
+type regionIO struct {
+	mapper Mapper
+}
+
+// ReadAt implements io.ReaderAt.
+func (r regionIO) ReadAt(p []byte, off int64) (int, error) {
+	mem, err := sharedMem(r.mapper)
+	if err != nil {
+		return 0, err
+	}
+
+	if off < 0 {
+		return 0, fmt.Errorf("read at %d: negative offset", off)
+	}
+
+	if off >= int64(len(mem)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (r regionIO) WriteAt(p []byte, off int64) (int, error) {
+	mem, err := sharedMem(r.mapper)
+	if err != nil {
+		return 0, err
+	}
+
+	if off < 0 {
+		return 0, fmt.Errorf("write at %d: negative offset", off)
+	}
+
+	if off > int64(len(mem)) || int64(len(p)) > int64(len(mem))-off {
+		return 0, fmt.Errorf("write %d bytes at %d of a %d byte region: %w", len(p), off, len(mem), io.ErrShortWrite)
+	}
+
+	return copy(mem[off:], p), nil
+}
+
+// sharedMem returns the shared memory of the mapper, ErrNotMapped while it is unmapped.
+func sharedMem(m Mapper) ([]byte, error) {
+	if !m.Mapped() {
+		return nil, ErrNotMapped
+	}
+
+	return m.SharedMem(), nil
+}
+
+// RegionFile is a file-like view of the shared memory of a mapper, for encoders, archivers and other code expecting
+// an io.ReadWriteSeeker. The file has the size of the region and can't grow. It is used by a single goroutine.
+type RegionFile struct {
+	mapper Mapper
+	offset int64
+	closed bool
+}
+
+// NewRegionFile returns a file over the shared memory of the mapper, positioned at its start.
+func NewRegionFile(m Mapper) *RegionFile {
+	return &RegionFile{mapper: m}
+}
+
+// Read implements io.Reader, it returns io.EOF at the end of the region.
+func (f *RegionFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+
+	n, err := regionIO{f.mapper}.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Write implements io.Writer. A write past the end of the region writes what fits and fails with io.ErrShortWrite.
+func (f *RegionFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+
+	mem, err := sharedMem(f.mapper)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.offset >= int64(len(mem)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		return 0, io.ErrShortWrite
+	}
+
+	n := copy(mem[f.offset:], p)
+	f.offset += int64(n)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// Seek implements io.Seeker. Seeking past the end is allowed, reading there returns io.EOF.
+func (f *RegionFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		mem, err := sharedMem(f.mapper)
+		if err != nil {
+			return 0, err
+		}
+
+		offset += int64(len(mem))
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to %d: negative offset", offset)
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// Close implements io.Closer. It only closes the file, the mapper stays mapped and open.
+func (f *RegionFile) Close() error {
+	if f.closed {
+		return ErrClosed
+	}
+
+	f.closed = true
+	return nil
+}
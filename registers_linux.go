@@ -0,0 +1,62 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offsets of the BAR0 registers, as described in docs/specs/ivshmem-spec.txt of qemu. The registers must only be
+// accessed as 32-bit words.
+const (
+	regIntrMask   = 0
+	regIntrStatus = 4
+	regIVPosition = 8
+	regDoorbell   = 12
+	registersSize = 256
+)
+
+// registers is the mapped register BAR (resource0) of the device.
+type registers struct {
+	mem []byte
+}
+
+// mapRegisters maps the register BAR found at the given sysfs resource path.
+func mapRegisters(path string) (*registers, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open register file: %w", checkDenied("open", path, err))
+	}
+	defer file.Close()
+
+	mem, err := unix.Mmap(int(file.Fd()), 0, registersSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap registers: %w", err)
+	}
+
+	return &registers{mem: mem}, nil
+}
+
+// read returns the value of the register at the offset.
+func (r *registers) read(offset int) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mem[offset])))
+}
+
+// write sets the register at the offset.
+func (r *registers) write(offset int, value uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&r.mem[offset])), value)
+}
+
+// unmap unmaps the registers.
+func (r *registers) unmap() error {
+	if err := unix.Munmap(r.mem); err != nil {
+		return fmt.Errorf("munmap registers: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package ring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/TypicalAM/ivshmem/internal/spin"
+)
+
+var ErrClosed = errors.New("channel closed")
+
+// Channel is a duplex byte stream between the two sides of the region. The region is split in two halves, each
+// holding a ring for one direction: the side calling InitChannel (by convention the host) writes into the first half
+// and reads the second, the side calling OpenChannel does the opposite. Read and Write block like a pipe, a channel
+// is an io.ReadWriteCloser and plugs into frame.NewConn.
+type Channel struct {
+	in  *Ring
+	out *Ring
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	rmu    sync.Mutex // Serializes the readers, a ring has a single consumer
+	wmu    sync.Mutex // Serializes the writers, a ring has a single producer
+}
+
+// InitChannel writes fresh rings into both halves of the region and returns the initializing end.
+func InitChannel(mem []byte) (*Channel, error) {
+	first, second := halves(mem)
+	out, err := Init(first)
+	if err != nil {
+		return nil, fmt.Errorf("first ring: %w", err)
+	}
+
+	in, err := Init(second)
+	if err != nil {
+		return nil, fmt.Errorf("second ring: %w", err)
+	}
+
+	return newChannel(in, out), nil
+}
+
+// OpenChannel opens the rings written by InitChannel and returns the other end.
+func OpenChannel(mem []byte) (*Channel, error) {
+	first, second := halves(mem)
+	in, err := Open(first)
+	if err != nil {
+		return nil, fmt.Errorf("first ring: %w", err)
+	}
+
+	out, err := Open(second)
+	if err != nil {
+		return nil, fmt.Errorf("second ring: %w", err)
+	}
+
+	return newChannel(in, out), nil
+}
+
+// newChannel returns a channel reading and writing the rings.
+func newChannel(in, out *Ring) *Channel {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Channel{in: in, out: out, ctx: ctx, cancel: cancel}
+}
+
+// SetStrict turns the verification of the peer on or off for both rings, see Ring.SetStrict. Call it before reading or
+// writing.
+func (c *Channel) SetStrict(strict bool) {
+	c.rmu.Lock()
+	c.wmu.Lock()
+	defer c.rmu.Unlock()
+	defer c.wmu.Unlock()
+	c.in.SetStrict(strict)
+	c.out.SetStrict(strict)
+}
+
+// halves splits the region in two, keeping the second half 8 byte aligned.
+func halves(mem []byte) ([]byte, []byte) {
+	half := len(mem) / 2 &^ 7
+	return mem[:half], mem[half : 2*half]
+}
+
+// Read reads the bytes the other side wrote, blocking until at least one is available or the channel is closed. It
+// returns io.EOF once the other side closed its end and everything it wrote was read.
+func (c *Channel) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, err := c.in.Read(c.ctx, p)
+	if err != nil && c.ctx.Err() != nil {
+		return n, ErrClosed
+	}
+
+	return n, err
+}
+
+// Write writes all of p, blocking while the other side hasn't made room or until the channel is closed.
+func (c *Channel) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var b spin.Backoff
+	written := 0
+	for written < len(p) {
+		n, err := c.out.TryWrite(p[written:])
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+		if n > 0 {
+			b = spin.Backoff{}
+			continue
+		}
+
+		if c.ctx.Err() != nil {
+			return written, ErrClosed
+		}
+
+		b.Wait()
+	}
+
+	return written, nil
+}
+
+// Stale reports whether the other side initialized the rings again since the channel was opened, the peer restarted.
+func (c *Channel) Stale() bool {
+	return c.in.Stale() || c.out.Stale()
+}
+
+// Buffered returns the number of bytes waiting to be read.
+func (c *Channel) Buffered() int {
+	return c.in.Len()
+}
+
+// Close unblocks the pending reads and writes, the channel can't be used afterwards. The other side reads io.EOF
+// after the bytes written so far. The rings stay in the region.
+func (c *Channel) Close() error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	c.cancel()
+
+	// The writer is done once the pending write noticed the cancellation, the close must come after its bytes
+	c.wmu.Lock()
+	c.out.CloseWrite()
+	c.wmu.Unlock()
+	return nil
+}
+
+var _ io.ReadWriteCloser = (*Channel)(nil)
@@ -0,0 +1,296 @@
+package ring
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/internal/spin"
+)
+
+const (
+	QueueMagic      uint32 = 0x51525649 // "IVRQ" when read as little endian bytes
+	QueueVersion    uint32 = 2
+	QueueHeaderSize        = 192
+
+	// SlotHeaderSize is the size of the bookkeeping in front of every queue slot.
+	SlotHeaderSize = 16
+)
+
+// Queue header field offsets.
+const (
+	offQueueMagic    = 0
+	offQueueVersion  = 4
+	offQueueSlots    = 8
+	offQueueSlotSize = 12
+	offEnqueue       = 64
+	offDequeue       = 128
+)
+
+// Slot header field offsets.
+const (
+	slotSequence = 0
+	slotLength   = 8
+)
+
+// Queue is a bounded multi-producer multi-consumer queue of messages stored in the region, for when several
+// goroutines or processes on either side share it. Every slot carries a sequence number which tells the producers
+// and the consumers whose turn it is, the positions are claimed with compare-and-swap. A producer or consumer dying
+// between claiming a slot and releasing it stalls the queue at that slot, the queue can't tell a slow peer from a dead
+// one. Like a ring, a queue carries a session ID and an epoch and its views fail with ErrStale once a peer
+// initialized it again.
+//
+// Layout, all the values are little endian:
+//
+//	  0 magic (uint32)
+//	  4 version (uint32)
+//	  8 slots, a power of two (uint32)
+//	 12 slot size (uint32)
+//	 16 session ID (16 bytes)
+//	 32 epoch (uint32)
+//	 64 enqueue position (uint64)
+//	128 dequeue position (uint64)
+//	192 slots: sequence (uint64), length (uint32), reserved (uint32), data
+type Queue struct {
+	mem      []byte
+	mask     uint64
+	slotSize uint32
+	enqueue  *uint64
+	dequeue  *uint64
+
+	stamp shmhdr.Stamp
+}
+
+// InitQueue writes a fresh header into the region, splitting it into the largest power of two of slots holding
+// messages of up to slotSize bytes. Only one side should call InitQueue, before the others call OpenQueue.
+func InitQueue(mem []byte, slotSize uint32) (*Queue, error) {
+	slotSize = (slotSize + 7) &^ 7
+	stride := uint64(SlotHeaderSize) + uint64(slotSize)
+	if slotSize == 0 || uint64(len(mem)) < QueueHeaderSize+stride {
+		return nil, fmt.Errorf("%w: need %d bytes for a single slot, have %d", ErrRegionTooSmall, QueueHeaderSize+stride, len(mem))
+	}
+
+	slots := uint64(1)
+	for slots*2*stride <= uint64(len(mem))-QueueHeaderSize && slots*2 <= 1<<31 {
+		slots *= 2
+	}
+
+	q, err := viewQueue(mem, slots, slotSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.stamp, err = shmhdr.NewStamp(mem, QueueMagic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < slots; i++ {
+		atomic.StoreUint64(q.sequence(i), i)
+	}
+
+	atomic.StoreUint64(q.enqueue, 0)
+	atomic.StoreUint64(q.dequeue, 0)
+	binary.LittleEndian.PutUint32(mem[offQueueVersion:], QueueVersion)
+	binary.LittleEndian.PutUint32(mem[offQueueSlots:], uint32(slots))
+	binary.LittleEndian.PutUint32(mem[offQueueSlotSize:], slotSize)
+
+	shmhdr.Publish(mem, QueueMagic)
+	return q, nil
+}
+
+// OpenQueue validates the header written by InitQueue and returns the queue.
+func OpenQueue(mem []byte) (*Queue, error) {
+	if err := shmhdr.Check(mem, QueueHeaderSize, QueueMagic, QueueVersion); err != nil {
+		return nil, err
+	}
+
+	slots := uint64(binary.LittleEndian.Uint32(mem[offQueueSlots:]))
+	slotSize := binary.LittleEndian.Uint32(mem[offQueueSlotSize:])
+	if slots == 0 || slots&(slots-1) != 0 || slotSize%8 != 0 {
+		return nil, fmt.Errorf("%w: %d slots of %d bytes", ErrCorrupted, slots, slotSize)
+	}
+
+	if need := QueueHeaderSize + slots*(SlotHeaderSize+uint64(slotSize)); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	q, err := viewQueue(mem, slots, slotSize)
+	if err != nil {
+		return nil, err
+	}
+
+	q.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return q, nil
+}
+
+// viewQueue returns the queue over the region.
+func viewQueue(mem []byte, slots uint64, slotSize uint32) (*Queue, error) {
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrUnaligned)
+	}
+
+	return &Queue{
+		mem:      mem,
+		mask:     slots - 1,
+		slotSize: slotSize,
+		enqueue:  (*uint64)(unsafe.Pointer(&mem[offEnqueue])),
+		dequeue:  (*uint64)(unsafe.Pointer(&mem[offDequeue])),
+	}, nil
+}
+
+// Session returns the ID of the initialization the queue was opened with.
+func (q *Queue) Session() Session {
+	return q.stamp.Session()
+}
+
+// Epoch returns the number of times the queue was initialized, when it was opened.
+func (q *Queue) Epoch() uint32 {
+	return q.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the queue again since it was opened, the view must be reopened then.
+func (q *Queue) Stale() bool {
+	return q.stamp.Check() != nil
+}
+
+// Slots returns the number of messages the queue holds.
+func (q *Queue) Slots() int {
+	return int(q.mask + 1)
+}
+
+// SlotSize returns the largest message a slot holds.
+func (q *Queue) SlotSize() int {
+	return int(q.slotSize)
+}
+
+// Len returns the number of messages claimed by producers and not yet claimed by consumers, it is only a snapshot.
+func (q *Queue) Len() int {
+	deq := atomic.LoadUint64(q.dequeue)
+	enq := atomic.LoadUint64(q.enqueue)
+	if enq < deq {
+		return 0
+	}
+
+	return int(enq - deq)
+}
+
+// TryPush copies the message into a free slot, it returns false if the queue is full.
+func (q *Queue) TryPush(msg []byte) (bool, error) {
+	if uint64(len(msg)) > uint64(q.slotSize) {
+		return false, fmt.Errorf("%w: %d bytes, a slot holds %d", ErrMessageTooLarge, len(msg), q.slotSize)
+	}
+
+	pos := atomic.LoadUint64(q.enqueue)
+	for {
+		slot := pos & q.mask
+		seq := atomic.LoadUint64(q.sequence(slot))
+		if err := q.stamp.Check(); err != nil {
+			return false, err
+		}
+
+		switch diff := int64(seq - pos); {
+		case diff == 0:
+			if !atomic.CompareAndSwapUint64(q.enqueue, pos, pos+1) {
+				pos = atomic.LoadUint64(q.enqueue)
+				continue
+			}
+
+			copy(q.data(slot), msg)
+			binary.LittleEndian.PutUint32(q.header(slot)[slotLength:], uint32(len(msg)))
+			atomic.StoreUint64(q.sequence(slot), pos+1)
+			return true, nil
+		case diff < 0:
+			// The slot still holds the message of the previous lap
+			return false, nil
+		default:
+			pos = atomic.LoadUint64(q.enqueue)
+		}
+	}
+}
+
+// TryPop appends the oldest message to dst, it returns false if the queue is empty.
+func (q *Queue) TryPop(dst []byte) ([]byte, bool, error) {
+	pos := atomic.LoadUint64(q.dequeue)
+	for {
+		slot := pos & q.mask
+		seq := atomic.LoadUint64(q.sequence(slot))
+		if err := q.stamp.Check(); err != nil {
+			return dst, false, err
+		}
+
+		switch diff := int64(seq - (pos + 1)); {
+		case diff == 0:
+			if !atomic.CompareAndSwapUint64(q.dequeue, pos, pos+1) {
+				pos = atomic.LoadUint64(q.dequeue)
+				continue
+			}
+
+			length := binary.LittleEndian.Uint32(q.header(slot)[slotLength:])
+			if length > q.slotSize {
+				length = q.slotSize
+			}
+
+			dst = append(dst, q.data(slot)[:length]...)
+			atomic.StoreUint64(q.sequence(slot), pos+q.mask+1)
+			return dst, true, nil
+		case diff < 0:
+			return dst, false, nil
+		default:
+			pos = atomic.LoadUint64(q.dequeue)
+		}
+	}
+}
+
+// Push copies the message into the queue, waiting for a free slot until the context is done.
+func (q *Queue) Push(ctx context.Context, msg []byte) error {
+	var b spin.Backoff
+	for {
+		ok, err := q.TryPush(msg)
+		if ok || err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b.Wait()
+	}
+}
+
+// Pop waits for a message, or until the context is done, and appends it to dst.
+func (q *Queue) Pop(ctx context.Context, dst []byte) ([]byte, error) {
+	var b spin.Backoff
+	for {
+		msg, ok, err := q.TryPop(dst)
+		if ok || err != nil {
+			return msg, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return dst, err
+		}
+
+		b.Wait()
+	}
+}
+
+// header returns the bookkeeping of the slot.
+func (q *Queue) header(slot uint64) []byte {
+	off := QueueHeaderSize + slot*(SlotHeaderSize+uint64(q.slotSize))
+	return q.mem[off : off+SlotHeaderSize]
+}
+
+// data returns the message area of the slot.
+func (q *Queue) data(slot uint64) []byte {
+	off := QueueHeaderSize + slot*(SlotHeaderSize+uint64(q.slotSize)) + SlotHeaderSize
+	return q.mem[off : off+uint64(q.slotSize)]
+}
+
+// sequence returns the sequence number of the slot for atomic access.
+func (q *Queue) sequence(slot uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&q.header(slot)[slotSequence]))
+}
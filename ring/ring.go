@@ -0,0 +1,426 @@
+// Package ring implements a single-producer single-consumer ring buffer laid out in the shared memory region, for
+// streaming bytes or messages from one side of the link to the other. Queue is its multi-producer multi-consumer
+// counterpart for messages.
+//
+// The producer and the consumer each own one counter: the producer advances the tail after copying the data in, the
+// consumer advances the head after copying it out. The counters grow forever and are masked into the power of two
+// sized data area, so a full ring is told apart from an empty one without wasting a byte. They are updated with
+// sync/atomic, whose sequentially consistent operations order the copies before the counter stores, and they sit on
+// separate cache lines so the two sides don't contend.
+//
+// Every initialization draws a new session ID and increments the epoch of the header. The views check both before
+// trusting the counters and fail with ErrStale once a restarted peer initialized the ring again, instead of reading
+// reset counters as garbage. A strict ring, see OpenStrict, also verifies the cursors of the peer on every access.
+//
+// Layout, all the values are little endian:
+//
+//	  0 magic (uint32)
+//	  4 version (uint32)
+//	  8 capacity of the data area (uint64)
+//	 16 session ID (16 bytes)
+//	 32 epoch (uint32)
+//	 64 head, bytes consumed (uint64)
+//	128 tail, bytes produced (uint64)
+//	136 closed by the producer, 1 once it won't write anymore (uint32)
+//	192 data
+package ring
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/internal/spin"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrUnaligned = errors.New("region not aligned")
+var ErrMessageTooLarge = errors.New("message too large")
+var ErrCorrupted = errors.New("ring corrupted")
+
+const (
+	Magic      uint32 = 0x47525649 // "IVRG" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 192
+
+	// MessageHeaderSize is the length prefix in front of every message.
+	MessageHeaderSize = 4
+)
+
+// Header field offsets.
+const (
+	offMagic    = 0
+	offVersion  = 4
+	offCapacity = 8
+	offHead     = 64
+	offTail     = 128
+	offClosed   = 136
+)
+
+// Ring is a view of the ring buffer stored in the region. A ring has a single producer and a single consumer: the
+// write methods must only be called by one goroutine of one side and the read methods by one goroutine of the other.
+type Ring struct {
+	mem  []byte
+	data []byte
+	mask uint64
+	head *uint64
+	tail *uint64
+
+	stamp shmhdr.Stamp
+
+	strict   bool
+	lastHead uint64
+	lastTail uint64
+}
+
+// Init writes a fresh header into the region and returns the ring, the data area is the largest power of two fitting
+// after the header. Only one side should call Init, before the other one calls Open.
+func Init(mem []byte) (*Ring, error) {
+	if len(mem) < HeaderSize+1 {
+		return nil, fmt.Errorf("%w: need %d bytes for the header and data, have %d", ErrRegionTooSmall, HeaderSize+1, len(mem))
+	}
+
+	capacity := uint64(1)
+	for capacity*2 <= uint64(len(mem)-HeaderSize) {
+		capacity *= 2
+	}
+
+	r, err := view(mem, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	atomic.StoreUint64(r.head, 0)
+	atomic.StoreUint64(r.tail, 0)
+	atomic.StoreUint32(r.closedPtr(), 0)
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint64(mem[offCapacity:], capacity)
+
+	shmhdr.Publish(mem, Magic)
+	return r, nil
+}
+
+// Open validates the header written by Init and returns the ring.
+func Open(mem []byte) (*Ring, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	capacity := binary.LittleEndian.Uint64(mem[offCapacity:])
+	if capacity == 0 || capacity&(capacity-1) != 0 {
+		return nil, fmt.Errorf("%w: capacity %d is not a power of two", ErrCorrupted, capacity)
+	}
+
+	if capacity > uint64(len(mem)-HeaderSize) {
+		return nil, fmt.Errorf("%w: the header describes %d bytes, have %d", ErrRegionTooSmall, HeaderSize+capacity, len(mem))
+	}
+
+	r, err := view(mem, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	r.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return r, nil
+}
+
+// view returns the ring over the region with the given data capacity.
+func view(mem []byte, capacity uint64) (*Ring, error) {
+	// 64-bit atomics need 8 byte alignment on 32-bit platforms, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrUnaligned)
+	}
+
+	return &Ring{
+		mem:  mem,
+		data: mem[HeaderSize : HeaderSize+capacity],
+		mask: capacity - 1,
+		head: (*uint64)(unsafe.Pointer(&mem[offHead])),
+		tail: (*uint64)(unsafe.Pointer(&mem[offTail])),
+	}, nil
+}
+
+// Session returns the ID of the initialization the ring was opened with.
+func (r *Ring) Session() Session {
+	return r.stamp.Session()
+}
+
+// Epoch returns the number of times the ring was initialized, when it was opened.
+func (r *Ring) Epoch() uint32 {
+	return r.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the ring again since it was opened, the view must be reopened then.
+func (r *Ring) Stale() bool {
+	return r.stamp.Check() != nil
+}
+
+// Capacity returns the size of the data area.
+func (r *Ring) Capacity() int {
+	return len(r.data)
+}
+
+// Len returns the number of bytes waiting to be read.
+func (r *Ring) Len() int {
+	return int(atomic.LoadUint64(r.tail) - atomic.LoadUint64(r.head))
+}
+
+// Produced returns the number of bytes written since the ring was initialized, including the message headers.
+func (r *Ring) Produced() uint64 {
+	return atomic.LoadUint64(r.tail)
+}
+
+// Consumed returns the number of bytes read since the ring was initialized, including the message headers.
+func (r *Ring) Consumed() uint64 {
+	return atomic.LoadUint64(r.head)
+}
+
+// Free returns the number of bytes which can be written without waiting.
+func (r *Ring) Free() int {
+	return r.Capacity() - r.Len()
+}
+
+// TryWrite copies as much of p as fits into the ring and returns the number of bytes written, without waiting.
+func (r *Ring) TryWrite(p []byte) (int, error) {
+	tail, head, err := r.cursors()
+	if err != nil {
+		return 0, err
+	}
+
+	free := uint64(len(r.data)) - (tail - head)
+	n := uint64(len(p))
+	if n > free {
+		n = free
+	}
+
+	r.copyIn(tail, p[:n])
+	atomic.StoreUint64(r.tail, tail+n)
+	return int(n), nil
+}
+
+// TryRead copies as many waiting bytes as fit into p and returns their number, without waiting.
+func (r *Ring) TryRead(p []byte) (int, error) {
+	tail, head, err := r.cursors()
+	if err != nil {
+		return 0, err
+	}
+
+	n := tail - head
+	if n > uint64(len(p)) {
+		n = uint64(len(p))
+	}
+
+	r.copyOut(head, p[:n])
+	atomic.StoreUint64(r.head, head+n)
+	return int(n), nil
+}
+
+// Write writes all of p, waiting for the consumer to make room, until the context is done.
+func (r *Ring) Write(ctx context.Context, p []byte) error {
+	var b spin.Backoff
+	for len(p) > 0 {
+		n, err := r.TryWrite(p)
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		if n > 0 {
+			b = spin.Backoff{}
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b.Wait()
+	}
+
+	return nil
+}
+
+// Read waits until at least one byte is available, or the context is done, and reads into p like TryRead. It returns
+// io.EOF once the producer closed the ring and everything was read.
+func (r *Ring) Read(ctx context.Context, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var b spin.Backoff
+	for {
+		// Loaded first, the bytes written before closing are then all visible to the read
+		closed := r.WriteClosed()
+		if n, err := r.TryRead(p); n > 0 || err != nil {
+			return n, err
+		}
+
+		if closed {
+			return 0, io.EOF
+		}
+
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		b.Wait()
+	}
+}
+
+// TrySend writes the message with its length prefix as a whole, the consumer never sees part of it. It returns false
+// if there is no room for it yet.
+func (r *Ring) TrySend(msg []byte) (bool, error) {
+	size := uint64(MessageHeaderSize + len(msg))
+	if uint64(len(msg)) > 0xffffffff || size > uint64(len(r.data)) {
+		return false, fmt.Errorf("%w: %d bytes, the ring holds %d", ErrMessageTooLarge, len(msg), len(r.data))
+	}
+
+	tail, head, err := r.cursors()
+	if err != nil {
+		return false, err
+	}
+
+	if uint64(len(r.data))-(tail-head) < size {
+		return false, nil
+	}
+
+	var hdr [MessageHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(msg)))
+	r.copyIn(tail, hdr[:])
+	r.copyIn(tail+MessageHeaderSize, msg)
+	atomic.StoreUint64(r.tail, tail+size)
+	return true, nil
+}
+
+// TryRecv appends the next message to dst, it returns false if no message is waiting.
+func (r *Ring) TryRecv(dst []byte) ([]byte, bool, error) {
+	tail, head, err := r.cursors()
+	if err != nil {
+		return dst, false, err
+	}
+
+	waiting := tail - head
+	if waiting == 0 {
+		return dst, false, nil
+	}
+
+	var hdr [MessageHeaderSize]byte
+	if waiting < MessageHeaderSize {
+		return dst, false, fmt.Errorf("%w: %d bytes waiting, less than a message header", ErrCorrupted, waiting)
+	}
+
+	r.copyOut(head, hdr[:])
+	length := uint64(binary.LittleEndian.Uint32(hdr[:]))
+	if length > waiting-MessageHeaderSize {
+		return dst, false, fmt.Errorf("%w: message of %d bytes, %d waiting", ErrCorrupted, length, waiting-MessageHeaderSize)
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, length)...)
+	r.copyOut(head+MessageHeaderSize, dst[start:])
+	atomic.StoreUint64(r.head, head+MessageHeaderSize+length)
+	return dst, true, nil
+}
+
+// Send writes the message, waiting for the consumer to make room, until the context is done.
+func (r *Ring) Send(ctx context.Context, msg []byte) error {
+	var b spin.Backoff
+	for {
+		ok, err := r.TrySend(msg)
+		if ok || err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b.Wait()
+	}
+}
+
+// Recv waits for the next message, or until the context is done, and appends it to dst. It returns io.EOF once the
+// producer closed the ring and every message was received.
+func (r *Ring) Recv(ctx context.Context, dst []byte) ([]byte, error) {
+	var b spin.Backoff
+	for {
+		closed := r.WriteClosed()
+		msg, ok, err := r.TryRecv(dst)
+		if ok || err != nil {
+			return msg, err
+		}
+
+		if closed {
+			return dst, io.EOF
+		}
+
+		if err := ctx.Err(); err != nil {
+			return dst, err
+		}
+
+		b.Wait()
+	}
+}
+
+// CloseWrite tells the consumer no more data follows, its Read and Recv return io.EOF once it consumed the data
+// written before. Only the producer may call it, a closed ring stays closed until it is initialized again.
+func (r *Ring) CloseWrite() {
+	atomic.StoreUint32(r.closedPtr(), 1)
+}
+
+// WriteClosed reports whether the producer closed the ring with CloseWrite.
+func (r *Ring) WriteClosed() bool {
+	return atomic.LoadUint32(r.closedPtr()) != 0
+}
+
+// closedPtr returns the closed field for atomic access.
+func (r *Ring) closedPtr() *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.mem[offClosed]))
+}
+
+// cursors loads the tail and the head, and checks the ring wasn't initialized again before they are trusted.
+func (r *Ring) cursors() (uint64, uint64, error) {
+	tail := atomic.LoadUint64(r.tail)
+	head := atomic.LoadUint64(r.head)
+	if err := r.stamp.Check(); err != nil {
+		return 0, 0, err
+	}
+
+	if r.strict {
+		if err := r.verify(tail, head); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Checked even when not strict, the copies and the free space are computed from the difference
+	if tail-head > uint64(len(r.data)) {
+		return 0, 0, fmt.Errorf("%w: %d bytes waiting, the capacity is %d", ErrCorrupted, tail-head, len(r.data))
+	}
+
+	return tail, head, nil
+}
+
+// copyIn copies p into the data area starting at the counter, wrapping around the end.
+func (r *Ring) copyIn(pos uint64, p []byte) {
+	off := pos & r.mask
+	n := copy(r.data[off:], p)
+	copy(r.data, p[n:])
+}
+
+// copyOut copies the data area starting at the counter into p, wrapping around the end.
+func (r *Ring) copyOut(pos uint64, p []byte) {
+	off := pos & r.mask
+	n := copy(p, r.data[off:])
+	copy(p[n:], r.data)
+}
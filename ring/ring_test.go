@@ -0,0 +1,376 @@
+package ring_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+// newPair returns the producer and the consumer view of a ring with the given data capacity.
+func newPair(t *testing.T, capacity int) (*ring.Ring, *ring.Ring) {
+	t.Helper()
+	mem := make([]byte, ring.HeaderSize+capacity)
+	producer, err := ring.Init(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := ring.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return producer, consumer
+}
+
+// testContext returns a context bounding a test which would otherwise hang on a bug.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestInitCapacity(t *testing.T) {
+	for size, want := range map[int]int{ring.HeaderSize + 1: 1, ring.HeaderSize + 100: 64, ring.HeaderSize + 4096: 4096} {
+		r, err := ring.Init(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Capacity() != want {
+			t.Errorf("region of %d bytes: want capacity %d, got %d", size, want, r.Capacity())
+		}
+	}
+
+	if _, err := ring.Init(make([]byte, ring.HeaderSize)); !errors.Is(err, ring.ErrRegionTooSmall) {
+		t.Errorf("want ErrRegionTooSmall, got %v", err)
+	}
+}
+
+func TestBytesRoundTrip(t *testing.T) {
+	producer, consumer := newPair(t, 64)
+	ctx := testContext(t)
+
+	// Odd sized writes and reads wrap around the small data area many times
+	want := make([]byte, 10000)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for p := want; len(p) > 0; {
+			n := 13
+			if n > len(p) {
+				n = len(p)
+			}
+
+			if err := producer.Write(ctx, p[:n]); err != nil {
+				errs <- err
+				return
+			}
+
+			p = p[n:]
+		}
+
+		errs <- nil
+	}()
+
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, 29)
+	for len(got) < len(want) {
+		n, err := consumer.Read(ctx, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, buf[:n]...)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatal("the bytes read differ from the bytes written")
+	}
+
+	if producer.Produced() != uint64(len(want)) || consumer.Consumed() != uint64(len(want)) {
+		t.Errorf("want %d bytes produced and consumed, got %d and %d", len(want), producer.Produced(), consumer.Consumed())
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	producer, consumer := newPair(t, 256)
+	ctx := testContext(t)
+
+	msgs := make([][]byte, 500)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte(i)}, i%100)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := producer.Send(ctx, msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+
+		errs <- nil
+	}()
+
+	for i, want := range msgs {
+		got, err := consumer.Recv(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: want %d bytes of %d, got %x", i, len(want), i, got)
+		}
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrySendFull(t *testing.T) {
+	producer, consumer := newPair(t, 16)
+	if ok, err := producer.TrySend([]byte("12345678")); !ok || err != nil {
+		t.Fatalf("first message: %v, %v", ok, err)
+	}
+
+	if ok, err := producer.TrySend([]byte("12345678")); ok || err != nil {
+		t.Fatalf("message into a full ring: want false, got %v, %v", ok, err)
+	}
+
+	if _, err := producer.TrySend(make([]byte, 13)); !errors.Is(err, ring.ErrMessageTooLarge) {
+		t.Fatalf("want ErrMessageTooLarge, got %v", err)
+	}
+
+	if _, ok, err := consumer.TryRecv(nil); !ok || err != nil {
+		t.Fatalf("receive: %v, %v", ok, err)
+	}
+
+	if _, ok, err := consumer.TryRecv(nil); ok || err != nil {
+		t.Fatalf("receive from an empty ring: want false, got %v, %v", ok, err)
+	}
+}
+
+func TestStale(t *testing.T) {
+	mem := make([]byte, ring.HeaderSize+64)
+	if _, err := ring.Init(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := ring.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer, err := ring.Init(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if producer.Epoch() != consumer.Epoch()+1 || producer.Session() == consumer.Session() {
+		t.Errorf("reinitialization kept epoch %d and session %s", producer.Epoch(), producer.Session())
+	}
+
+	if !consumer.Stale() {
+		t.Error("the view of the previous initialization isn't stale")
+	}
+
+	if _, _, err := consumer.TryRecv(nil); !errors.Is(err, ring.ErrStale) {
+		t.Errorf("want ErrStale, got %v", err)
+	}
+}
+
+func TestChannelRoundTrip(t *testing.T) {
+	mem := make([]byte, 2*(ring.HeaderSize+256))
+	a, err := ring.InitChannel(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ring.OpenChannel(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both directions at once, each one more than the capacity of a ring
+	errs := make(chan error, 2)
+	for i, w := range []io.Writer{a, b} {
+		w, payload := w, bytes.Repeat([]byte{byte('a' + i)}, 5000)
+		go func() {
+			_, err := w.Write(payload)
+			errs <- err
+		}()
+	}
+
+	for i, r := range []io.Reader{b, a} {
+		got := make([]byte, 5000)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := bytes.Repeat([]byte{byte('a' + i)}, 5000); !bytes.Equal(got, want) {
+			t.Errorf("direction %d: the bytes read differ from the bytes written", i)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChannelEOF(t *testing.T) {
+	mem := make([]byte, 2*(ring.HeaderSize+256))
+	a, err := ring.InitChannel(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ring.OpenChannel(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bytes written before closing come first, then the end of the stream
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "bye" {
+		t.Errorf("want %q, got %q", "bye", got)
+	}
+}
+
+func TestQueueRoundTrip(t *testing.T) {
+	mem := make([]byte, 4096)
+	q, err := ring.InitQueue(mem, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ring.OpenQueue(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := testContext(t)
+	const producers, perProducer = 4, 200
+	errs := make(chan error, producers)
+	for p := 0; p < producers; p++ {
+		p := p
+		go func() {
+			for i := 0; i < perProducer; i++ {
+				if err := q.Push(ctx, []byte(fmt.Sprintf("%d/%d", p, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+
+			errs <- nil
+		}()
+	}
+
+	// Every producer's messages come out in its order
+	next := make([]int, producers)
+	for n := 0; n < producers*perProducer; n++ {
+		msg, err := other.Pop(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var p, i int
+		if _, err := fmt.Sscanf(string(msg), "%d/%d", &p, &i); err != nil {
+			t.Fatalf("message %q: %v", msg, err)
+		}
+
+		if i != next[p] {
+			t.Fatalf("producer %d: want message %d, got %d", p, next[p], i)
+		}
+
+		next[p]++
+	}
+
+	for p := 0; p < producers; p++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	mem := make([]byte, ring.HeaderSize+64)
+	producer, err := ring.Init(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := ring.OpenStrict(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := producer.TrySend([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := consumer.TryRecv(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer moving its cursor backwards, and one claiming more data than the ring holds
+	for name, tail := range map[string]uint64{"backwards": 4, "overfull": 9 + 65} {
+		binary.LittleEndian.PutUint64(mem[128:], tail)
+		var violation *ring.ViolationError
+		if _, _, err := consumer.TryRecv(nil); !errors.As(err, &violation) || violation.Field != "tail" {
+			t.Errorf("%s tail: want a violation of the tail, got %v", name, err)
+		}
+	}
+}
+
+func TestOverfull(t *testing.T) {
+	mem := make([]byte, ring.HeaderSize+64)
+	if _, err := ring.Init(mem); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := ring.Open(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tail more than the capacity ahead of the head, which zeroed data would decode as empty messages
+	binary.LittleEndian.PutUint64(mem[128:], 65)
+	if _, _, err := consumer.TryRecv(nil); !errors.Is(err, ring.ErrCorrupted) {
+		t.Errorf("TryRecv: want ErrCorrupted, got %v", err)
+	}
+
+	if _, err := consumer.TryRead(make([]byte, 8)); !errors.Is(err, ring.ErrCorrupted) {
+		t.Errorf("TryRead: want ErrCorrupted, got %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package ring
+
+import "github.com/TypicalAM/ivshmem/internal/shmhdr"
+
+var ErrStale = shmhdr.ErrStale
+
+// Stamp field offsets, shared by the ring and the queue headers.
+const (
+	offSession = 16
+	offEpoch   = 32
+)
+
+// Session identifies one initialization of a ring or a queue, it is a random UUID.
+type Session = shmhdr.Session
@@ -0,0 +1,105 @@
+package ring
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+var ErrProtocolViolation = errors.New("protocol violation")
+
+// ViolationError describes a header invariant broken by the peer.
+type ViolationError struct {
+	Field  string // Name of the offending header field
+	Offset int    // Offset of the field in the region
+	Detail string // What exactly went wrong
+}
+
+// Error returns the diagnostic message.
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("%s: header field %s at offset %d %s", ErrProtocolViolation, e.Field, e.Offset, e.Detail)
+}
+
+// Unwrap allows matching the error with ErrProtocolViolation.
+func (e *ViolationError) Unwrap() error {
+	return ErrProtocolViolation
+}
+
+// OpenStrict is like Open, but the ring keeps verifying the header and the cursors written by the peer, see
+// SetStrict.
+func OpenStrict(mem []byte) (*Ring, error) {
+	r, err := Open(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetStrict(true)
+	return r, nil
+}
+
+// SetStrict turns the verification of the peer on or off. A strict ring checks before every read and write that the
+// header still describes the ring it was opened with, that neither cursor ever goes backwards and that the head never
+// passes the tail or falls more than the capacity behind it, and fails with a *ViolationError instead of copying
+// garbage once the peer breaks the protocol.
+func (r *Ring) SetStrict(strict bool) {
+	r.strict = strict
+	r.lastHead = atomic.LoadUint64(r.head)
+	r.lastTail = atomic.LoadUint64(r.tail)
+}
+
+// verify checks the header and the cursors loaded by cursors against the ones seen before.
+func (r *Ring) verify(tail, head uint64) error {
+	fields := []struct {
+		name   string
+		offset int
+		got    uint64
+		want   uint64
+	}{
+		{"magic", offMagic, uint64(atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.mem[offMagic])))), uint64(Magic)},
+		{"version", offVersion, uint64(binary.LittleEndian.Uint32(r.mem[offVersion:])), uint64(Version)},
+		{"capacity", offCapacity, binary.LittleEndian.Uint64(r.mem[offCapacity:]), uint64(len(r.data))},
+	}
+
+	for _, field := range fields {
+		if field.got != field.want {
+			return &ViolationError{
+				Field:  field.name,
+				Offset: field.offset,
+				Detail: fmt.Sprintf("changed from %d to %d after attach", field.want, field.got),
+			}
+		}
+	}
+
+	if tail < r.lastTail {
+		return &ViolationError{
+			Field:  "tail",
+			Offset: offTail,
+			Detail: fmt.Sprintf("went backwards from %d to %d", r.lastTail, tail),
+		}
+	}
+
+	if head < r.lastHead {
+		return &ViolationError{
+			Field:  "head",
+			Offset: offHead,
+			Detail: fmt.Sprintf("went backwards from %d to %d", r.lastHead, head),
+		}
+	}
+
+	if head > tail {
+		return &ViolationError{Field: "head", Offset: offHead, Detail: fmt.Sprintf("%d passed the tail %d", head, tail)}
+	}
+
+	if tail-head > uint64(len(r.data)) {
+		return &ViolationError{
+			Field:  "tail",
+			Offset: offTail,
+			Detail: fmt.Sprintf("%d is %d bytes ahead of the head, the ring holds %d", tail, tail-head, len(r.data)),
+		}
+	}
+
+	r.lastHead, r.lastTail = head, tail
+	return nil
+}
@@ -0,0 +1,202 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+var ErrClientClosed = errors.New("rpc client closed")
+
+// Client calls the handlers of the server on the other side.
+type Client struct {
+	conn   frame.Conn
+	limits ivshmem.Limits
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan frame.Frame // Calls waiting for their response
+	codec   ivshmem.Codec               // Picked by the handshake, nil before
+	err     error                       // Why the client stopped, nil while it runs
+	done    chan struct{}
+}
+
+// NewClient starts receiving the responses on the connection. The limits bound the calls in flight with
+// MaxTableEntries, the zero value means ivshmem.DefaultLimits. The client stops when receiving fails, close the
+// underlying stream to stop it.
+func NewClient(conn frame.Conn, limits ivshmem.Limits) *Client {
+	if limits == (ivshmem.Limits{}) {
+		limits = ivshmem.DefaultLimits
+	}
+
+	c := &Client{conn: conn, limits: limits, pending: make(map[uint64]chan frame.Frame), done: make(chan struct{})}
+	go c.receive()
+	return c
+}
+
+// Call calls the method with the request and waits for the response, until the context is done. The deadline of the
+// context is passed to the handler. Errors of the handler are returned as a *RemoteError, an unknown method as
+// ErrUnknownMethod and a deadline which passed on the other side as context.DeadlineExceeded.
+func (c *Client) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f := frame.Frame{Payload: req}
+	f.Metadata.Set(KeyMethod, method)
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+
+		f.Metadata.Set(KeyTimeout, strconv.FormatInt(int64(timeout), 10))
+	}
+
+	id, resp, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.forget(id)
+
+	f.Metadata.Set(KeyID, strconv.FormatUint(id, 10))
+	if err := c.conn.Send(ctx, f); err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	select {
+	case f := <-resp:
+		return result(method, f)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// Handshake agrees on the codec of the bodies with the server, which picks the first of the preferences it has
+// registered as well. Without preferences, all the codecs registered here are offered.
+func (c *Client) Handshake(ctx context.Context, preferences ...string) (ivshmem.Codec, error) {
+	if len(preferences) == 0 {
+		preferences = ivshmem.Codecs()
+	}
+
+	resp, err := c.Call(ctx, MethodHandshake, []byte(strings.Join(preferences, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	name := string(resp)
+	offered := false
+	for _, preference := range preferences {
+		offered = offered || preference == name
+	}
+
+	if !offered {
+		return nil, fmt.Errorf("%w: the server picked codec %q, which wasn't offered", ErrMalformed, name)
+	}
+
+	codec, err := ivshmem.LookupCodec(name)
+	if err != nil {
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	c.mu.Lock()
+	c.codec = codec
+	c.mu.Unlock()
+	return codec, nil
+}
+
+// Codec returns the codec picked by the handshake, nil before it.
+func (c *Client) Codec() ivshmem.Codec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.codec
+}
+
+// Done returns a channel which is closed when the client stops.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the client stopped, nil while it runs.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// register reserves a call ID and the channel receiving its response.
+func (c *Client) register() (uint64, chan frame.Frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+
+	if err := c.limits.CheckTableEntries(len(c.pending) + 1); err != nil {
+		return 0, nil, fmt.Errorf("calls in flight: %w", err)
+	}
+
+	c.nextID++
+	resp := make(chan frame.Frame, 1)
+	c.pending[c.nextID] = resp
+	return c.nextID, resp, nil
+}
+
+// forget drops the call, a late response is then ignored.
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// receive hands the responses to the waiting calls until receiving fails.
+func (c *Client) receive() {
+	for {
+		f, err := c.conn.Recv(context.Background())
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("%w: %v", ErrClientClosed, err)
+			c.pending = nil
+			c.mu.Unlock()
+			close(c.done)
+			return
+		}
+
+		id, err := strconv.ParseUint(f.Metadata.Get(KeyID), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if resp, ok := c.pending[id]; ok {
+			resp <- f
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// result turns the response into the return values of Call.
+func result(method string, f frame.Frame) ([]byte, error) {
+	switch code := f.Metadata.Get(KeyCode); code {
+	case "":
+		return f.Payload, nil
+	case codeUnknownMethod:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, method)
+	case codeDeadline:
+		return nil, fmt.Errorf("rpc %s: %w", method, context.DeadlineExceeded)
+	case codeError:
+		return nil, &RemoteError{Method: method, Message: f.Metadata.Get(KeyError)}
+	default:
+		return nil, fmt.Errorf("%w: error code %q", ErrMalformed, code)
+	}
+}
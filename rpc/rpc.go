@@ -0,0 +1,249 @@
+// Package rpc calls functions on the other side of the link by name. The server registers handlers, the client calls
+// them and waits for the response; both run over a frame.Conn, e.g. a duplex channel of the ring package or a stream
+// of ivshmem.Dial, and any number of calls are in flight at once.
+//
+// Requests and responses are frames whose payload is the request or response body. The metadata carries the call ID,
+// the method and the time left until the deadline of the caller's context on requests, and the error of the handler
+// on responses. Sending the time left instead of the deadline itself keeps the deadlines right when the clocks of the
+// sides differ, like gRPC does:
+//
+//	rpc-id        decimal call ID, chosen by the client and echoed by the response
+//	rpc-method    name of the handler (requests)
+//	rpc-timeout   time left in decimal nanoseconds, absent without a deadline (requests)
+//	rpc-code      "unknown-method", "deadline" or "error" when the call failed (responses)
+//	rpc-error     error message of the handler, cut to 255 bytes (responses)
+//
+// The bodies are opaque to the package. The sides agree on a codec of the ivshmem registry for them with
+// Client.Handshake, a call of the rpc-handshake method whose request lists the codec names the client accepts,
+// separated by commas and by preference, and whose response names the one the server picked.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+var ErrUnknownMethod = errors.New("unknown method")
+var ErrMalformed = errors.New("malformed rpc message")
+
+// Metadata keys.
+const (
+	KeyID      = "rpc-id"
+	KeyMethod  = "rpc-method"
+	KeyTimeout = "rpc-timeout"
+	KeyCode    = "rpc-code"
+	KeyError   = "rpc-error"
+)
+
+// MethodHandshake is the method of the codec negotiation, the server handles it on its own.
+const MethodHandshake = "rpc-handshake"
+
+// Error codes of the responses.
+const (
+	codeUnknownMethod = "unknown-method"
+	codeDeadline      = "deadline"
+	codeError         = "error"
+)
+
+// maxErrorLength is the longest metadata value, longer error messages are cut.
+const maxErrorLength = 255
+
+// Handler handles a call. The context is done when the caller's deadline passes or the server stops, a returned
+// error is passed to the caller as a RemoteError.
+type Handler func(ctx context.Context, req []byte) ([]byte, error)
+
+// RemoteError is an error returned by the handler on the other side.
+type RemoteError struct {
+	Method  string
+	Message string
+}
+
+// Error returns the message of the handler.
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Method, e.Message)
+}
+
+// Server runs the handlers for the calls it receives.
+type Server struct {
+	limits ivshmem.Limits
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServer returns a server without handlers. The limits bound the calls handled at once on a connection with
+// MaxPending, the zero value means ivshmem.DefaultLimits.
+func NewServer(limits ivshmem.Limits) *Server {
+	if limits == (ivshmem.Limits{}) {
+		limits = ivshmem.DefaultLimits
+	}
+
+	return &Server{limits: limits, handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for the method, replacing the previous one.
+func (s *Server) Handle(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// Serve receives the calls on the connection and runs every one of them in its own goroutine, until receiving or
+// sending a response fails. At most MaxPending of the limits run at once, receiving waits for a running call to finish
+// beyond that. Close the underlying stream to stop it. It returns the first send error, or else the receive error, once
+// the running calls are cancelled and done. The handlers find the codec negotiated on the connection with
+// CodecFromContext.
+func (s *Server) Serve(ctx context.Context, conn frame.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, codecKey{}, &negotiated{})
+
+	var wg sync.WaitGroup
+	var sendOnce sync.Once
+	var sendErr error
+	stop := func(err error) error {
+		cancel()
+		wg.Wait()
+		if sendErr != nil {
+			return sendErr
+		}
+
+		return err
+	}
+
+	var slots chan struct{}
+	if s.limits.MaxPending > 0 {
+		slots = make(chan struct{}, s.limits.MaxPending)
+	}
+
+	for {
+		f, err := conn.Recv(ctx)
+		if err != nil {
+			return stop(err)
+		}
+
+		id := f.Metadata.Get(KeyID)
+		if id == "" {
+			continue
+		}
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return stop(ctx.Err())
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.call(ctx, f)
+			resp.Metadata.Set(KeyID, id)
+			err := conn.Send(ctx, resp)
+			if slots != nil {
+				<-slots
+			}
+
+			// The connection is broken, stop receiving calls whose responses can't be sent either
+			if err != nil && ctx.Err() == nil {
+				sendOnce.Do(func() {
+					sendErr = fmt.Errorf("send response to call %s: %w", id, err)
+					cancel()
+				})
+			}
+		}()
+	}
+}
+
+// call runs the handler of the request and returns the response.
+func (s *Server) call(ctx context.Context, f frame.Frame) frame.Frame {
+	method := f.Metadata.Get(KeyMethod)
+	if method == MethodHandshake {
+		return handshake(ctx, f)
+	}
+
+	s.mu.RLock()
+	h, ok := s.handlers[method]
+	s.mu.RUnlock()
+	if !ok {
+		return failure(codeUnknownMethod, method)
+	}
+
+	if timeout := f.Metadata.Get(KeyTimeout); timeout != "" {
+		nanos, err := strconv.ParseInt(timeout, 10, 64)
+		if err != nil {
+			return failure(codeError, fmt.Sprintf("%v: timeout %q", ErrMalformed, timeout))
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(nanos))
+		defer cancel()
+	}
+
+	resp, err := h(ctx, f.Payload)
+	switch {
+	case err == nil:
+		return frame.Frame{Payload: resp}
+	case errors.Is(err, context.DeadlineExceeded):
+		return failure(codeDeadline, err.Error())
+	default:
+		return failure(codeError, err.Error())
+	}
+}
+
+// failure returns a response carrying the error.
+func failure(code, msg string) frame.Frame {
+	if len(msg) > maxErrorLength {
+		msg = msg[:maxErrorLength]
+	}
+
+	f := frame.Frame{}
+	f.Metadata.Set(KeyCode, code)
+	f.Metadata.Set(KeyError, msg)
+	return f
+}
+
+// codecKey is the context key of the codec negotiated on the connection.
+type codecKey struct{}
+
+// negotiated holds the codec picked by the handshake of a connection, it may run again while calls are handled.
+type negotiated struct {
+	mu    sync.Mutex
+	codec ivshmem.Codec
+}
+
+// CodecFromContext returns the codec negotiated on the connection of the call, nil before the client's handshake.
+func CodecFromContext(ctx context.Context) ivshmem.Codec {
+	n, ok := ctx.Value(codecKey{}).(*negotiated)
+	if !ok {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.codec
+}
+
+// handshake picks the first codec of the client's preferences which is registered here.
+func handshake(ctx context.Context, f frame.Frame) frame.Frame {
+	name, codec, err := ivshmem.NegotiateCodec(strings.Split(string(f.Payload), ","), ivshmem.Codecs())
+	if err != nil {
+		return failure(codeError, err.Error())
+	}
+
+	if n, ok := ctx.Value(codecKey{}).(*negotiated); ok {
+		n.mu.Lock()
+		n.codec = codec
+		n.mu.Unlock()
+	}
+
+	return frame.Frame{Payload: []byte(name)}
+}
@@ -0,0 +1,299 @@
+// Package scream reads the audio the Scream virtual sound card driver writes into the ivshmem region from a Windows
+// guest. The driver keeps a ring of fixed size chunks of interleaved PCM behind a small header describing the format
+// and the chunk it wrote last; Reader follows the write index and hands the chunks out as a stream of samples.
+//
+// Layout of the header, packed, all the values are little endian:
+//
+//	 0 magic (uint64)
+//	 8 write index, the chunk written last (uint16)
+//	10 offset of the first chunk from the start of the region (uint8)
+//	11 number of chunks (uint16)
+//	13 chunk size (uint32)
+//	17 sample rate: 44100 Hz multiples with bit 7 set, 48000 Hz multiples without (uint8)
+//	18 sample size in bits (uint8)
+//	19 channels (uint8)
+//	20 channel mask, the dwChannelMask of WAVEFORMATEXTENSIBLE (uint16)
+//
+// The driver is a guest component, so the header is read through the untrusted package and checked before use.
+package scream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+	"github.com/TypicalAM/ivshmem/untrusted"
+)
+
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrInvalidHeader = errors.New("invalid scream header")
+var ErrFormatChanged = errors.New("audio format changed")
+
+const (
+	// Magic is the magic the driver writes at the start of the header.
+	Magic uint64 = 0x11112222
+
+	// HeaderSize is the size of the packed header.
+	HeaderSize = 22
+
+	// maxChannels caps the channels of a frame, Scream sends up to 7.1.
+	maxChannels = 8
+)
+
+// Header field offsets.
+const (
+	offMagic      = 0
+	offWriteIndex = 8
+	offOffset     = 10
+	offMaxChunks  = 11
+	offChunkSize  = 13
+	offSampleRate = 17
+	offSampleSize = 18
+	offChannels   = 19
+	offChannelMap = 20
+)
+
+// PollInterval is how often Read checks for a new chunk. A chunk holds a few milliseconds of audio, keep it below that.
+var PollInterval = time.Millisecond
+
+// Format describes the PCM samples.
+type Format struct {
+	SampleRate int    // Frames per second
+	SampleSize int    // Bits per sample, 16, 24 or 32
+	Channels   int    // Samples per frame, interleaved
+	ChannelMap uint16 // Speaker positions of the channels, as in WAVEFORMATEXTENSIBLE
+}
+
+// FrameSize returns the bytes of one frame, a sample for every channel.
+func (f Format) FrameSize() int {
+	return f.SampleSize / 8 * f.Channels
+}
+
+// String returns the format like "48000 Hz, 16 bit, 2 channels".
+func (f Format) String() string {
+	return fmt.Sprintf("%d Hz, %d bit, %d channels", f.SampleRate, f.SampleSize, f.Channels)
+}
+
+// Header is the header written by the driver.
+type Header struct {
+	Magic      uint64
+	WriteIndex uint16
+	Offset     uint8
+	MaxChunks  uint16
+	ChunkSize  uint32
+	Format     Format
+}
+
+// ParseHeader parses and checks the header at the start of the region, including its magic and that the chunks fit
+// into it.
+func ParseHeader(mem []byte) (Header, error) {
+	v := untrusted.New(mem)
+	var h Header
+	var err error
+	if h.Magic, err = v.Uint64(offMagic); err != nil {
+		return Header{}, err
+	}
+
+	if h.Magic != Magic {
+		return Header{}, fmt.Errorf("%w: %#x", ErrInvalidMagic, h.Magic)
+	}
+
+	if h.WriteIndex, err = v.Uint16(offWriteIndex); err != nil {
+		return Header{}, err
+	}
+
+	if h.Offset, err = v.Uint8(offOffset); err != nil {
+		return Header{}, err
+	}
+
+	if h.MaxChunks, err = v.Uint16(offMaxChunks); err != nil {
+		return Header{}, err
+	}
+
+	if h.ChunkSize, err = v.Uint32(offChunkSize); err != nil {
+		return Header{}, err
+	}
+
+	if h.Format, err = parseFormat(v); err != nil {
+		return Header{}, err
+	}
+
+	if h.MaxChunks == 0 || h.ChunkSize == 0 || h.WriteIndex >= h.MaxChunks {
+		return Header{}, fmt.Errorf("%w: chunk %d of %d", ErrInvalidHeader, h.WriteIndex, h.MaxChunks)
+	}
+
+	if h.Offset < HeaderSize {
+		return Header{}, fmt.Errorf("%w: chunks at %d overlap the header", ErrInvalidHeader, h.Offset)
+	}
+
+	if end := uint64(h.Offset) + uint64(h.MaxChunks)*uint64(h.ChunkSize); end > uint64(len(mem)) {
+		return Header{}, fmt.Errorf("%w: %d chunks of %d bytes past the end of the region", ErrInvalidHeader, h.MaxChunks,
+			h.ChunkSize)
+	}
+
+	return h, nil
+}
+
+// parseFormat parses the format fields of the header.
+func parseFormat(v untrusted.View) (Format, error) {
+	rate, err := v.Uint8(offSampleRate)
+	if err != nil {
+		return Format{}, err
+	}
+
+	size, err := v.Uint8(offSampleSize)
+	if err != nil {
+		return Format{}, err
+	}
+
+	channels, err := v.Uint8(offChannels)
+	if err != nil {
+		return Format{}, err
+	}
+
+	channelMap, err := v.Uint16(offChannelMap)
+	if err != nil {
+		return Format{}, err
+	}
+
+	f := Format{SampleSize: int(size), Channels: int(channels), ChannelMap: channelMap}
+	if f.SampleRate, err = SampleRate(rate); err != nil {
+		return Format{}, err
+	}
+
+	if size != 16 && size != 24 && size != 32 {
+		return Format{}, fmt.Errorf("%w: %d bit samples", ErrInvalidHeader, size)
+	}
+
+	if channels == 0 || channels > maxChannels {
+		return Format{}, fmt.Errorf("%w: %d channels", ErrInvalidHeader, channels)
+	}
+
+	return f, nil
+}
+
+// SampleRate decodes the sample rate byte of Scream: a multiplier of 44100 Hz with bit 7 set, of 48000 Hz without.
+func SampleRate(b uint8) (int, error) {
+	base := 48000
+	if b&0x80 != 0 {
+		base = 44100
+	}
+
+	if b&0x7f == 0 {
+		return 0, fmt.Errorf("%w: sample rate %#x", ErrInvalidHeader, b)
+	}
+
+	return base * int(b&0x7f), nil
+}
+
+// Reader streams the PCM samples written by the driver. It starts at the chunk written last, so it only returns audio
+// played after it was created, and a reader falling a whole ring behind the driver gets the audio which replaced the
+// chunks it missed.
+type Reader struct {
+	mem    []byte
+	read   uint16
+	format Format
+	buf    []byte
+	chunks uint64
+}
+
+// NewReader returns a reader of the audio in the region.
+func NewReader(mem []byte) (*Reader, error) {
+	h, err := ParseHeader(mem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{mem: mem, read: h.WriteIndex, format: h.Format}, nil
+}
+
+// Format returns the format of the samples Read returns.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Chunks returns the number of chunks read so far.
+func (r *Reader) Chunks() uint64 {
+	return r.chunks
+}
+
+// Read reads PCM samples into p, waiting for the driver to write a chunk when none is buffered. It returns whole frames
+// whenever p holds one. When the driver switches formats Read returns ErrFormatChanged once and Format reports the new
+// one; the reader stays usable.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext is Read, failing when the context is done before a chunk arrives. Reading into an empty p returns right
+// away, without waiting for a chunk.
+func (r *Reader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for len(r.buf) == 0 {
+		ok, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+
+	// Hand out whole frames only, a chunk always holds a whole number of them
+	n := len(p)
+	if n > len(r.buf) {
+		n = len(r.buf)
+	}
+
+	if frame := r.format.FrameSize(); n >= frame {
+		n -= n % frame
+	}
+
+	copy(p, r.buf[:n])
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next buffers the chunk after the last one read, it returns false when the driver didn't write one yet.
+func (r *Reader) next() (bool, error) {
+	h, err := ParseHeader(r.mem)
+	if err != nil {
+		return false, err
+	}
+
+	if h.Format != r.format {
+		r.format = h.Format
+		r.read = h.WriteIndex
+		return false, fmt.Errorf("%w: %s", ErrFormatChanged, h.Format)
+	}
+
+	if h.WriteIndex == r.read%h.MaxChunks {
+		return false, nil
+	}
+
+	r.read = (r.read + 1) % h.MaxChunks
+	chunk, err := untrusted.New(r.mem).Bytes(uint64(h.Offset)+uint64(r.read)*uint64(h.ChunkSize), uint64(h.ChunkSize))
+	if err != nil {
+		return false, err
+	}
+
+	// A partial frame at the end of the chunk can't be played
+	if frame := h.Format.FrameSize(); len(chunk)%frame != 0 {
+		chunk = chunk[:len(chunk)-len(chunk)%frame]
+	}
+
+	r.buf = chunk
+	r.chunks++
+	return true, nil
+}
@@ -0,0 +1,69 @@
+//go:build windows
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// GrantDeviceAccess lets the account (for example `NT SERVICE\MyAgent` or `.\agent`) open the ivshmem device at the
+// location without administrator rights. It replaces the device security descriptor with one allowing SYSTEM,
+// the administrators and the account, then restarts the device for it to apply. It has to be run once as an administrator.
+func GrantDeviceAccess(location PCILocation, account string) error {
+	sid, _, _, err := windows.LookupSID("", account)
+	if err != nil {
+		return fmt.Errorf("lookup account: %w", err)
+	}
+
+	devInfoSet, err := windows.SetupDiGetClassDevsEx(&interfaceGUID, "", 0, windows.DIGCF_PRESENT|windows.DIGCF_DEVICEINTERFACE, 0, "")
+	if err != nil {
+		return fmt.Errorf("device info set: %w", err)
+	}
+	defer windows.SetupDiDestroyDeviceInfoList(devInfoSet)
+
+	ivshmemDevices, err := getIvshmemDevices(devInfoSet)
+	if err != nil {
+		return fmt.Errorf("get ivshmem devs: %w", err)
+	}
+
+	var device *deviceData
+	for i := range ivshmemDevices {
+		if ivshmemDevices[i].loc == location {
+			device = &ivshmemDevices[i]
+		}
+	}
+
+	if device == nil {
+		return ErrCannotFindDevice
+	}
+
+	sddl := fmt.Sprintf("D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;%s)", sid.String())
+	err = devInfoSet.SetDeviceRegistryPropertyString(&device.devInfo, windows.SPDRP_SECURITY_SDS, sddl)
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return fmt.Errorf("%w: changing the device security needs administrator rights: %w", ErrAccessDenied, err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("set security descriptor: %w", err)
+	}
+
+	params := windows.PropChangeParams{
+		ClassInstallHeader: *windows.MakeClassInstallHeader(windows.DIF_PROPERTYCHANGE),
+		StateChange:        windows.DICS_PROPCHANGE,
+		Scope:              windows.DICS_FLAG_GLOBAL,
+	}
+
+	if err := devInfoSet.SetClassInstallParams(&device.devInfo, &params.ClassInstallHeader, uint32(unsafe.Sizeof(params))); err != nil {
+		return fmt.Errorf("set property change params: %w", err)
+	}
+
+	if err := devInfoSet.CallClassInstaller(windows.DIF_PROPERTYCHANGE, &device.devInfo); err != nil {
+		return fmt.Errorf("restart device: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+//go:build linux
+
+// Package server implements the QEMU ivshmem-server, which doorbell mode devices (-device ivshmem-doorbell) connect
+// to through a chardev. It owns the shared memory and one eventfd per peer and vector, and hands them out over a unix
+// socket, so every peer can ring every other one. Running it in-process saves shipping the C binary.
+//
+// The protocol, from docs/specs/ivshmem-spec.txt of qemu: every message is a little endian int64, optionally carrying
+// a file descriptor. A new peer gets the protocol version, its ID, then -1 with the shared memory fd. After that it
+// gets the ID of every existing peer once per vector, with the eventfd of that vector, and finally its own ID with
+// its own eventfds. Existing peers get the ID of the new one with its eventfds, and a departing peer is announced by
+// its ID without a descriptor.
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProtocolVersion is the version of the ivshmem-server protocol sent to the peers.
+const ProtocolVersion = 0
+
+// MaxVectors is the largest number of vectors per peer, like the C server.
+const MaxVectors = 64
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+var ErrTooManyPeers = errors.New("no peer id left")
+
+// Config describes the server.
+type Config struct {
+	SocketPath string // Unix socket the devices connect to, chardev socket,path=...
+	ShmPath    string // Shared memory file, created if needed, usually under /dev/shm
+	Size       uint64 // Size of the shared memory, a power of two
+	Vectors    int    // Interrupt vectors per peer, the vectors property of the device
+}
+
+// peer is a connected device.
+type peer struct {
+	id      uint16
+	conn    *net.UnixConn
+	vectors []int // Eventfd of every vector
+}
+
+// Server hands out the shared memory and the eventfds to the peers.
+type Server struct {
+	cfg Config
+	shm *os.File
+	ln  *net.UnixListener
+
+	mu    sync.Mutex
+	peers map[uint16]*peer
+	next  uint16
+	wg    sync.WaitGroup
+}
+
+// New creates the shared memory file and starts listening on the socket, a stale socket is replaced.
+func New(cfg Config) (*Server, error) {
+	if cfg.Size == 0 || cfg.Size&(cfg.Size-1) != 0 {
+		return nil, fmt.Errorf("%w: size %d is not a power of two", ErrInvalidConfig, cfg.Size)
+	}
+
+	if cfg.Vectors < 1 || cfg.Vectors > MaxVectors {
+		return nil, fmt.Errorf("%w: %d vectors, expected 1 to %d", ErrInvalidConfig, cfg.Vectors, MaxVectors)
+	}
+
+	shm, err := os.OpenFile(cfg.ShmPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open shared memory file: %w", err)
+	}
+
+	if err := shm.Truncate(int64(cfg.Size)); err != nil {
+		shm.Close()
+		return nil, fmt.Errorf("resize shared memory file: %w", err)
+	}
+
+	if err := os.Remove(cfg.SocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		shm.Close()
+		return nil, fmt.Errorf("remove stale socket: %w", err)
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: cfg.SocketPath, Net: "unix"})
+	if err != nil {
+		shm.Close()
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	return &Server{cfg: cfg, shm: shm, ln: ln, peers: make(map[uint16]*peer)}, nil
+}
+
+// Serve accepts the peers until the context is done or the server is closed.
+func (s *Server) Serve(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.ln.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := s.ln.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		if err := s.add(conn); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// Peers returns the sorted IDs of the connected peers.
+func (s *Server) Peers() []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint16, 0, len(s.peers))
+	for id := range s.peers {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Close disconnects the peers and releases the socket and the shared memory file, which is left in place.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for _, p := range s.peers {
+		p.conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return errors.Join(err, s.shm.Close())
+}
+
+// add sets up the new peer and introduces it to the others.
+func (s *Server) add(conn *net.UnixConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := s.allocate()
+	if err != nil {
+		return err
+	}
+
+	p := &peer{id: id, conn: conn}
+	for i := 0; i < s.cfg.Vectors; i++ {
+		fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			closeAll(p.vectors)
+			return fmt.Errorf("create eventfd: %w", err)
+		}
+
+		p.vectors = append(p.vectors, fd)
+	}
+
+	err = errors.Join(send(conn, ProtocolVersion, -1), send(conn, int64(id), -1), send(conn, -1, int(s.shm.Fd())))
+	if err != nil {
+		closeAll(p.vectors)
+		return err
+	}
+
+	// A peer failing here is dropped by its own receive loop
+	for _, other := range s.peers {
+		for _, fd := range p.vectors {
+			send(other.conn, int64(id), fd)
+		}
+	}
+
+	for _, other := range s.peers {
+		for _, fd := range other.vectors {
+			send(conn, int64(other.id), fd)
+		}
+	}
+
+	for _, fd := range p.vectors {
+		send(conn, int64(id), fd)
+	}
+
+	s.peers[id] = p
+	s.next = id + 1
+	s.wg.Add(1)
+	go s.watch(p)
+	return nil
+}
+
+// allocate returns the lowest free peer ID starting from the one after the last allocated one, like the C server.
+func (s *Server) allocate() (uint16, error) {
+	for i := 0; i <= 0xffff; i++ {
+		id := s.next + uint16(i)
+		if _, ok := s.peers[id]; !ok {
+			return id, nil
+		}
+	}
+
+	return 0, ErrTooManyPeers
+}
+
+// watch waits for the peer to disconnect, peers never send anything.
+func (s *Server) watch(p *peer) {
+	defer s.wg.Done()
+	var buf [8]byte
+	for {
+		if _, err := p.conn.Read(buf[:]); err != nil {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p.id)
+	p.conn.Close()
+	closeAll(p.vectors)
+	for _, other := range s.peers {
+		send(other.conn, int64(p.id), -1)
+	}
+}
+
+// send writes the message, passing the file descriptor unless it is negative.
+func send(conn *net.UnixConn, value int64, fd int) error {
+	msg := binary.LittleEndian.AppendUint64(nil, uint64(value))
+	var oob []byte
+	if fd >= 0 {
+		oob = unix.UnixRights(fd)
+	}
+
+	if _, _, err := conn.WriteMsgUnix(msg, oob, nil); err != nil {
+		return fmt.Errorf("send to peer: %w", err)
+	}
+
+	return nil
+}
+
+// closeAll closes the file descriptors.
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
@@ -0,0 +1,84 @@
+package shmsync
+
+import (
+	"sync/atomic"
+)
+
+// The accessors below update the words at offsets of the region with sync/atomic, for the flags and counters the
+// sides share directly. Plain writes into the slice may be reordered or torn; these are sequentially consistent like
+// the rest of the package. Like indexing the slice, they panic when the word is out of bounds or not aligned to its
+// size, which is a bug of the layout rather than a runtime condition.
+
+// LoadUint32At atomically loads the 32 bit word at the offset.
+func LoadUint32At(mem []byte, off int) uint32 {
+	return atomic.LoadUint32(mustWord32(mem, off))
+}
+
+// StoreUint32At atomically stores the 32 bit word at the offset.
+func StoreUint32At(mem []byte, off int, v uint32) {
+	atomic.StoreUint32(mustWord32(mem, off), v)
+}
+
+// AddUint32At atomically adds delta to the 32 bit word at the offset and returns the new value.
+func AddUint32At(mem []byte, off int, delta uint32) uint32 {
+	return atomic.AddUint32(mustWord32(mem, off), delta)
+}
+
+// CompareAndSwapUint32At atomically replaces the 32 bit word at the offset with new if it is old, and reports whether
+// it did.
+func CompareAndSwapUint32At(mem []byte, off int, old, new uint32) bool {
+	return atomic.CompareAndSwapUint32(mustWord32(mem, off), old, new)
+}
+
+// LoadUint64At atomically loads the 64 bit word at the offset.
+func LoadUint64At(mem []byte, off int) uint64 {
+	return atomic.LoadUint64(mustWord64(mem, off))
+}
+
+// StoreUint64At atomically stores the 64 bit word at the offset.
+func StoreUint64At(mem []byte, off int, v uint64) {
+	atomic.StoreUint64(mustWord64(mem, off), v)
+}
+
+// AddUint64At atomically adds delta to the 64 bit word at the offset and returns the new value.
+func AddUint64At(mem []byte, off int, delta uint64) uint64 {
+	return atomic.AddUint64(mustWord64(mem, off), delta)
+}
+
+// CompareAndSwapUint64At atomically replaces the 64 bit word at the offset with new if it is old, and reports whether
+// it did.
+func CompareAndSwapUint64At(mem []byte, off int, old, new uint64) bool {
+	return atomic.CompareAndSwapUint64(mustWord64(mem, off), old, new)
+}
+
+// fence is the word the fences update.
+var fence uint32
+
+// Fence is a full memory barrier: the loads and stores before it are visible to the other side before the ones after
+// it. The accessors above already order themselves, Fence is for plain writes into the slice, like a payload copied
+// with fastpath.Copy whose non-temporal stores must land before the flag announcing it.
+func Fence() {
+	// Atomic read-modify-writes are full barriers on every platform Go supports, a locked instruction on x86 and
+	// acquire-release on arm64
+	atomic.AddUint32(&fence, 0)
+}
+
+// mustWord32 returns the 32 bit word at the offset, it panics if it can't be accessed atomically.
+func mustWord32(mem []byte, off int) *uint32 {
+	w, err := word32(mem, off)
+	if err != nil {
+		panic(err)
+	}
+
+	return w
+}
+
+// mustWord64 returns the 64 bit word at the offset, it panics if it can't be accessed atomically.
+func mustWord64(mem []byte, off int) *uint64 {
+	w, err := word64(mem, off)
+	if err != nil {
+		panic(err)
+	}
+
+	return w
+}
@@ -0,0 +1,109 @@
+package shmsync
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Cond is a condition variable across the VM boundary, for request and response patterns over state guarded by a
+// Mutex: a side waits for the state to change with Wait and the side changing it calls Signal or Broadcast. It is
+// three 32 bit words of the region: the number of waiters, the signals not taken yet and the broadcast sequence.
+//
+// Like sync.Cond, waiters may wake up without the condition being true, when a signal was left over by a waiter
+// which returned because of a broadcast, so they check it in a loop:
+//
+//	if err := mu.Lock(ctx); err != nil {
+//		return err
+//	}
+//	for !ready() {
+//		if err := cond.Wait(ctx); err != nil {
+//			return err
+//		}
+//	}
+//	defer mu.Unlock()
+type Cond struct {
+	L *Mutex
+
+	waiters *uint32
+	signals *uint32
+	seq     *uint32
+	bell    doorbell
+}
+
+// CondAt returns the condition variable stored in the 12 bytes at the offset, which must be 4 byte aligned, over the
+// state guarded by the mutex. The zero value of the words is a condition variable nobody waits on.
+func CondAt(mem []byte, off int, l *Mutex) (*Cond, error) {
+	c := &Cond{L: l}
+	for i, w := range []**uint32{&c.waiters, &c.signals, &c.seq} {
+		word, err := word32(mem, off+4*i)
+		if err != nil {
+			return nil, err
+		}
+
+		*w = word
+	}
+
+	return c, nil
+}
+
+// WithNotifier makes Signal and Broadcast ring the doorbell of the peer on the vector and Wait listen to it, so
+// waiting doesn't need to poll. Both sides should configure it for the same vector.
+func (c *Cond) WithNotifier(n ivshmem.Notifier, peer, vector uint16) *Cond {
+	c.bell = doorbell{notifier: n, peer: peer, vector: vector}
+	return c
+}
+
+// Wait unlocks c.L, waits for a signal or a broadcast and locks c.L again before returning. The caller must hold
+// c.L. When the context is done first it returns its error without holding c.L.
+func (c *Cond) Wait(ctx context.Context) error {
+	atomic.AddUint32(c.waiters, 1)
+	seq := atomic.LoadUint32(c.seq)
+	if err := c.L.Unlock(); err != nil {
+		atomic.AddUint32(c.waiters, ^uint32(0))
+		return err
+	}
+
+	err := c.bell.wait(ctx, func() bool { return atomic.LoadUint32(c.seq) != seq || c.take() })
+	atomic.AddUint32(c.waiters, ^uint32(0))
+	if err != nil {
+		return err
+	}
+
+	return c.L.Lock(ctx)
+}
+
+// Signal wakes one waiter, if there is any.
+func (c *Cond) Signal() error {
+	for {
+		signals := atomic.LoadUint32(c.signals)
+		if signals >= atomic.LoadUint32(c.waiters) {
+			return nil
+		}
+
+		if atomic.CompareAndSwapUint32(c.signals, signals, signals+1) {
+			return c.bell.ring()
+		}
+	}
+}
+
+// Broadcast wakes all the waiters.
+func (c *Cond) Broadcast() error {
+	atomic.AddUint32(c.seq, 1)
+	return c.bell.ring()
+}
+
+// take takes a signal, it reports whether there was one.
+func (c *Cond) take() bool {
+	for {
+		signals := atomic.LoadUint32(c.signals)
+		if signals == 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapUint32(c.signals, signals, signals-1) {
+			return true
+		}
+	}
+}
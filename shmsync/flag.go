@@ -0,0 +1,57 @@
+package shmsync
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Flag tells the other side that something happened. It is a single 32 bit word of the region: zero when clear, one
+// when set. Everything written before Set is visible to the side returning from IsSet or Wait with the flag set.
+type Flag struct {
+	word *uint32
+	bell doorbell
+}
+
+// FlagAt returns the flag stored in the 4 byte aligned word at the offset.
+func FlagAt(mem []byte, off int) (*Flag, error) {
+	word, err := word32(mem, off)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Flag{word: word}, nil
+}
+
+// WithNotifier makes Set ring the doorbell of the peer on the vector and Wait listen to it, so waiting doesn't need to
+// poll. Both sides should configure it for the same vector.
+func (f *Flag) WithNotifier(n ivshmem.Notifier, peer, vector uint16) *Flag {
+	f.bell = doorbell{notifier: n, peer: peer, vector: vector}
+	return f
+}
+
+// Set sets the flag with release semantics. It returns false if the flag was already set, so a set-once event is
+// signalled by exactly one caller.
+func (f *Flag) Set() (bool, error) {
+	if !atomic.CompareAndSwapUint32(f.word, 0, 1) {
+		return false, nil
+	}
+
+	return true, f.bell.ring()
+}
+
+// IsSet reports with acquire semantics whether the flag is set.
+func (f *Flag) IsSet() bool {
+	return atomic.LoadUint32(f.word) != 0
+}
+
+// Reset clears the flag, it returns false if it wasn't set.
+func (f *Flag) Reset() bool {
+	return atomic.CompareAndSwapUint32(f.word, 1, 0)
+}
+
+// Wait blocks until the flag is set or the context is done.
+func (f *Flag) Wait(ctx context.Context) error {
+	return f.bell.wait(ctx, f.IsSet)
+}
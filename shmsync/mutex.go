@@ -0,0 +1,133 @@
+package shmsync
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Mutex is a ticket lock guarding shared state against both sides and any number of goroutines. It is two 32 bit
+// words of the region: the next ticket to hand out and the ticket being served. Lock draws a ticket and waits for its
+// turn, so the lock is fair and a busy side can't starve the other one; Unlock serves the next ticket.
+//
+// A side dying while it holds the lock leaves it held for good, reinitialize the words once both sides agree on
+// starting over. The zero value of the words is an unlocked mutex.
+type Mutex struct {
+	next    *uint32
+	serving *uint32
+	bell    doorbell
+	local   localBell // Wakes the waiters of this side, the doorbell only reaches the peer
+
+	mu        sync.Mutex
+	abandoned map[uint32]struct{} // Tickets of this side whose Lock gave up, their turns are passed on
+	passing   bool                // Whether a goroutine passes on the turns of the abandoned tickets
+}
+
+// MutexAt returns the mutex stored in the 8 bytes at the offset, which must be 4 byte aligned.
+func MutexAt(mem []byte, off int) (*Mutex, error) {
+	next, err := word32(mem, off)
+	if err != nil {
+		return nil, err
+	}
+
+	serving, err := word32(mem, off+4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mutex{next: next, serving: serving}, nil
+}
+
+// WithNotifier makes Unlock ring the doorbell of the peer on the vector and Lock sleep on it once spinning for a
+// while didn't get the lock, for locks held long enough that polling wastes the CPU. Both sides should configure it
+// for the same vector.
+func (m *Mutex) WithNotifier(n ivshmem.Notifier, peer, vector uint16) *Mutex {
+	m.bell = doorbell{notifier: n, peer: peer, vector: vector}
+	return m
+}
+
+// Lock waits for the lock, or until the context is done. When the context is done first, the ticket is given back if
+// nobody drew one after it, and otherwise abandoned: its turn is passed on when it comes, by Unlock on this side or by
+// a single goroutine per mutex, which exits once every abandoned turn was passed on.
+func (m *Mutex) Lock(ctx context.Context) error {
+	ticket := atomic.AddUint32(m.next, 1) - 1
+	err := m.bell.waitLocal(ctx, func() bool { return atomic.LoadUint32(m.serving) == ticket }, &m.local)
+	if err == nil {
+		return nil
+	}
+
+	if atomic.CompareAndSwapUint32(m.next, ticket+1, ticket) {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.abandoned == nil {
+		m.abandoned = make(map[uint32]struct{})
+	}
+
+	m.abandoned[ticket] = struct{}{}
+	if m.pass() && !m.passing {
+		m.passing = true
+		go m.passAbandoned()
+	}
+
+	return err
+}
+
+// pass serves the turns of the abandoned tickets which came, it reports whether any are left. The caller holds mu.
+func (m *Mutex) pass() bool {
+	for len(m.abandoned) > 0 {
+		serving := atomic.LoadUint32(m.serving)
+		if _, ok := m.abandoned[serving]; !ok {
+			return true
+		}
+
+		// Nobody holds the lock during the turn of an abandoned ticket, so only the other passers race for it
+		if atomic.CompareAndSwapUint32(m.serving, serving, serving+1) {
+			delete(m.abandoned, serving)
+			m.local.ring()
+			m.bell.ring()
+		}
+	}
+
+	return false
+}
+
+// passAbandoned waits for the turns of the abandoned tickets and passes them on.
+func (m *Mutex) passAbandoned() {
+	m.bell.waitLocal(context.Background(), func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.pass() {
+			m.passing = false
+			return true
+		}
+
+		return false
+	}, &m.local)
+}
+
+// TryLock takes the lock if nobody holds it or waits for it, without waiting. It reports whether it did.
+func (m *Mutex) TryLock() bool {
+	serving := atomic.LoadUint32(m.serving)
+	return atomic.CompareAndSwapUint32(m.next, serving, serving+1)
+}
+
+// Unlock releases the lock held by the caller, everything written while holding it is visible to the next holder.
+func (m *Mutex) Unlock() error {
+	atomic.AddUint32(m.serving, 1)
+	m.mu.Lock()
+	m.pass()
+	m.mu.Unlock()
+
+	m.local.ring()
+	return m.bell.ring()
+}
+
+// Locked reports whether anyone holds the lock or waits for it, for diagnostics.
+func (m *Mutex) Locked() bool {
+	return atomic.LoadUint32(m.next) != atomic.LoadUint32(m.serving)
+}
@@ -0,0 +1,189 @@
+package shmsync_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+// mutexes returns two views of the same mutex, like the two sides of the region.
+func mutexes(t *testing.T) (*shmsync.Mutex, *shmsync.Mutex, []byte) {
+	t.Helper()
+	mem := make([]byte, 16)
+	a, err := shmsync.MutexAt(mem, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := shmsync.MutexAt(mem, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b, mem
+}
+
+// lockWithin locks the mutex, giving up after the timeout.
+func lockWithin(m *shmsync.Mutex, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.Lock(ctx)
+}
+
+func TestMutex(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, a, b *shmsync.Mutex, mem []byte)
+	}{
+		{
+			name: "lock and unlock",
+			run: func(t *testing.T, a, b *shmsync.Mutex, mem []byte) {
+				if err := lockWithin(a, time.Second); err != nil {
+					t.Fatal(err)
+				}
+
+				if !b.Locked() || b.TryLock() {
+					t.Fatal("the other side got a held lock")
+				}
+
+				if err := a.Unlock(); err != nil {
+					t.Fatal(err)
+				}
+
+				if b.Locked() || !b.TryLock() {
+					t.Fatal("the other side didn't get the released lock")
+				}
+			},
+		},
+		{
+			name: "timeout gives the ticket back",
+			run: func(t *testing.T, a, b *shmsync.Mutex, mem []byte) {
+				if err := lockWithin(a, time.Second); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := lockWithin(b, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("want DeadlineExceeded, got %v", err)
+				}
+
+				if err := a.Unlock(); err != nil {
+					t.Fatal(err)
+				}
+
+				if b.Locked() {
+					t.Fatal("the ticket given back is still waiting")
+				}
+			},
+		},
+		{
+			name: "timeout passes an abandoned turn on",
+			run: func(t *testing.T, a, b *shmsync.Mutex, mem []byte) {
+				if err := lockWithin(a, time.Second); err != nil {
+					t.Fatal(err)
+				}
+
+				// The ticket drawn after the one timing out keeps it from being given back
+				done := make(chan error)
+				go func() {
+					if err := lockWithin(b, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+						done <- err
+						return
+					}
+
+					done <- nil
+				}()
+
+				for shmsync.LoadUint32At(mem, 8) != 2 {
+					time.Sleep(time.Millisecond)
+				}
+
+				go func() { done <- lockWithin(a, time.Second) }()
+				if err := <-done; err != nil {
+					t.Fatal(err)
+				}
+
+				if err := a.Unlock(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := <-done; err != nil {
+					t.Fatalf("the ticket after the abandoned one: %v", err)
+				}
+			},
+		},
+		{
+			name: "dead holder is taken over after a reset",
+			run: func(t *testing.T, a, b *shmsync.Mutex, mem []byte) {
+				// The holder dies without unlocking, the lock stays held for good
+				if err := lockWithin(a, time.Second); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := lockWithin(b, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("want DeadlineExceeded, got %v", err)
+				}
+
+				// Both sides agree on starting over and zero the words, the survivor takes the lock
+				for i := range mem {
+					mem[i] = 0
+				}
+
+				if err := lockWithin(b, time.Second); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := b.Unlock(); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, mem := mutexes(t)
+			tt.run(t, a, b, mem)
+		})
+	}
+}
+
+// TestMutexConcurrent counts under the lock from both sides, run it with -race.
+func TestMutexConcurrent(t *testing.T) {
+	const workers, rounds = 8, 500
+	a, b, _ := mutexes(t)
+
+	var wg sync.WaitGroup
+	count := 0
+	for i := 0; i < workers; i++ {
+		m := a
+		if i%2 == 1 {
+			m = b
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				if err := lockWithin(m, 10*time.Second); err != nil {
+					t.Error(err)
+					return
+				}
+
+				count++
+				if err := m.Unlock(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	if count != workers*rounds {
+		t.Errorf("want %d, got %d", workers*rounds, count)
+	}
+}
@@ -0,0 +1,68 @@
+package shmsync
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Semaphore counts the items available to the consumers, like the slots a producer filled for the other side. It is
+// a single 32 bit word of the region holding the count: Release adds to it and Acquire waits until it can take one.
+// With a notifier the consumers sleep on the doorbell instead of spinning.
+type Semaphore struct {
+	word *uint32
+	bell doorbell
+}
+
+// SemaphoreAt returns the semaphore stored in the 4 byte aligned word at the offset. The zero value of the word is a
+// semaphore with nothing available.
+func SemaphoreAt(mem []byte, off int) (*Semaphore, error) {
+	word, err := word32(mem, off)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Semaphore{word: word}, nil
+}
+
+// WithNotifier makes Release ring the doorbell of the peer on the vector and Acquire listen to it, so waiting doesn't
+// need to poll. Both sides should configure it for the same vector.
+func (s *Semaphore) WithNotifier(n ivshmem.Notifier, peer, vector uint16) *Semaphore {
+	s.bell = doorbell{notifier: n, peer: peer, vector: vector}
+	return s
+}
+
+// Count returns the number of items available right now.
+func (s *Semaphore) Count() uint32 {
+	return atomic.LoadUint32(s.word)
+}
+
+// Release makes n more items available, everything written before is visible to the side acquiring them.
+func (s *Semaphore) Release(n uint32) error {
+	if n == 0 {
+		return nil
+	}
+
+	atomic.AddUint32(s.word, n)
+	return s.bell.ring()
+}
+
+// TryAcquire takes an item if one is available, without waiting. It reports whether it did.
+func (s *Semaphore) TryAcquire() bool {
+	for {
+		count := atomic.LoadUint32(s.word)
+		if count == 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapUint32(s.word, count, count-1) {
+			return true
+		}
+	}
+}
+
+// Acquire waits until it takes an item, or the context is done.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	return s.bell.wait(ctx, s.TryAcquire)
+}
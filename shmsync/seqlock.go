@@ -0,0 +1,145 @@
+package shmsync
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// SeqLock publishes a block of data, like telemetry or the metadata of a frame, from a single writer to any number of
+// readers on both sides, without the readers ever blocking the writer. It is a 32 bit sequence word of the region
+// followed by the data, 8 bytes after it. The writer makes the sequence odd, copies the data in and makes it even
+// again; readers copy the data out and retry when the sequence was odd or moved meanwhile, so they never return a torn
+// copy.
+//
+// The data is copied in and out with atomic stores and loads of whole 32 bit words, so the writer and the readers run
+// clean under the race detector even with both sides in one process. Only the bytes past the last whole word of data
+// whose size isn't a multiple of 4 race by design, like any seqlock.
+type SeqLock struct {
+	seq     *uint32
+	data    []byte
+	words   []uint32 // The whole words of the data
+	scratch []byte   // The copy Update lets the writer change
+}
+
+// SeqLockAt returns the seqlock stored at the offset, the sequence in the 4 byte aligned word there and size bytes of
+// data from offset+8.
+func SeqLockAt(mem []byte, off, size int) (*SeqLock, error) {
+	seq, err := word32(mem, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < 0 || off+8+size > len(mem) {
+		return nil, fmt.Errorf("%w: %d bytes of data at offset %d of %d", ErrOutOfBounds, size, off+8, len(mem))
+	}
+
+	s := &SeqLock{seq: seq, data: mem[off+8 : off+8+size : off+8+size]}
+	if size >= 4 {
+		s.words = unsafe.Slice((*uint32)(unsafe.Pointer(&s.data[0])), size/4)
+	}
+
+	return s, nil
+}
+
+// Size returns the size of the data.
+func (s *SeqLock) Size() int {
+	return len(s.data)
+}
+
+// Generation returns the number of completed writes, wrapping around.
+func (s *SeqLock) Generation() uint32 {
+	return atomic.LoadUint32(s.seq) / 2
+}
+
+// Write publishes p, which must not be longer than the data, and zeroes the rest of the data. Only one goroutine of
+// one side may write.
+func (s *SeqLock) Write(p []byte) error {
+	if len(p) > len(s.data) {
+		return fmt.Errorf("%w: %d bytes into %d", ErrOutOfBounds, len(p), len(s.data))
+	}
+
+	s.Update(func(data []byte) {
+		n := copy(data, p)
+		for i := range data[n:] {
+			data[n+i] = 0
+		}
+	})
+	return nil
+}
+
+// Update publishes the changes made by the function to a copy of the data, for writers updating a few fields only.
+// The copy must not be kept after the function returns.
+func (s *SeqLock) Update(write func(data []byte)) {
+	if s.scratch == nil {
+		s.scratch = make([]byte, len(s.data))
+	}
+
+	s.load(s.scratch)
+	write(s.scratch)
+	atomic.AddUint32(s.seq, 1)
+
+	// The store above only keeps the earlier writes from moving after it, the data must not move before it either
+	Fence()
+	s.store(s.scratch)
+	atomic.AddUint32(s.seq, 1)
+}
+
+// TryRead copies a consistent snapshot of the data into dst, which must be as long as the data, and returns its
+// generation. It returns false when a write was in progress or completed during the copy.
+func (s *SeqLock) TryRead(dst []byte) (uint32, bool) {
+	seq := atomic.LoadUint32(s.seq)
+	if seq%2 != 0 {
+		return 0, false
+	}
+
+	s.load(dst)
+
+	// The copy must be finished before the sequence is checked again
+	Fence()
+	return seq / 2, atomic.LoadUint32(s.seq) == seq
+}
+
+// Read copies a consistent snapshot of the data into dst, which must be as long as the data, retrying while the
+// writer is busy, and returns its generation. It fails only when the context is done, which takes a writer updating
+// the data in a tight loop or dying halfway through a write.
+func (s *SeqLock) Read(ctx context.Context, dst []byte) (uint32, error) {
+	if len(dst) < len(s.data) {
+		return 0, fmt.Errorf("%w: %d bytes of data into %d", ErrOutOfBounds, len(s.data), len(dst))
+	}
+
+	var b Backoff
+	for {
+		if gen, ok := s.TryRead(dst); ok {
+			return gen, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		b.Wait()
+	}
+}
+
+// load copies the data into dst, the whole words with atomic loads.
+func (s *SeqLock) load(dst []byte) {
+	for i := range s.words {
+		w := atomic.LoadUint32(&s.words[i])
+		copy(dst[4*i:], (*[4]byte)(unsafe.Pointer(&w))[:])
+	}
+
+	copy(dst[4*len(s.words):], s.data[4*len(s.words):])
+}
+
+// store copies src into the data, the whole words with atomic stores.
+func (s *SeqLock) store(src []byte) {
+	for i := range s.words {
+		var w uint32
+		copy((*[4]byte)(unsafe.Pointer(&w))[:], src[4*i:])
+		atomic.StoreUint32(&s.words[i], w)
+	}
+
+	copy(s.data[4*len(s.words):], src[4*len(s.words):])
+}
@@ -0,0 +1,116 @@
+package shmsync_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TypicalAM/ivshmem/shmsync"
+)
+
+func TestSeqLockWrite(t *testing.T) {
+	mem := make([]byte, 8+16)
+	s, err := shmsync.SeqLockAt(mem, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Write(make([]byte, 17)); !errors.Is(err, shmsync.ErrOutOfBounds) {
+		t.Fatalf("want ErrOutOfBounds, got %v", err)
+	}
+
+	for i, data := range []string{"a longer payload", "short"} {
+		if err := s.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]byte, s.Size())
+		gen, err := s.Read(context.Background(), got)
+		if err != nil || gen != uint32(i+1) {
+			t.Fatalf("write %d: want generation %d, got %d, %v", i, i+1, gen, err)
+		}
+
+		// The rest of the data is zeroed
+		want := make([]byte, s.Size())
+		copy(want, data)
+		if !bytes.Equal(got, want) {
+			t.Errorf("write %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+// TestSeqLockConcurrent reads the data while the writer updates it in place, run it with -race.
+func TestSeqLockConcurrent(t *testing.T) {
+	const size, updates, readers = 256, 2000, 4
+	mem := make([]byte, 8+size)
+	writer, err := shmsync.SeqLockAt(mem, 0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	errs := make(chan error, readers)
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		reader, err := shmsync.SeqLockAt(mem, 0, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, size)
+			var last uint32
+			for {
+				gen, err := reader.Read(ctx, data)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				// Every update stores its generation into every word, a torn copy mixes two of them
+				for off := 0; off < size; off += 4 {
+					if binary.LittleEndian.Uint32(data[off:]) != gen {
+						errs <- errors.New("torn read")
+						return
+					}
+				}
+
+				if gen < last {
+					errs <- errors.New("generation went backwards")
+					return
+				}
+
+				last = gen
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	for i := uint32(1); i <= updates; i++ {
+		writer.Update(func(data []byte) {
+			for off := 0; off < size; off += 4 {
+				binary.LittleEndian.PutUint32(data[off:], i)
+			}
+		})
+	}
+
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
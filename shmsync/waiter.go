@@ -0,0 +1,66 @@
+package shmsync
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/TypicalAM/ivshmem"
+)
+
+// Waiter lets a side wait for an arbitrary condition over the shared state, like sync.Cond without the lock. It is a
+// single 32 bit sequence word of the region: whoever changes the state calls Broadcast afterwards, which bumps the
+// sequence, and the waiters evaluate their condition again only when the sequence moved. Conditions reading a lot of
+// the region are therefore not evaluated in a busy loop.
+type Waiter struct {
+	word *uint32
+	bell doorbell
+}
+
+// WaiterAt returns the waiter stored in the 4 byte aligned word at the offset.
+func WaiterAt(mem []byte, off int) (*Waiter, error) {
+	word, err := word32(mem, off)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Waiter{word: word}, nil
+}
+
+// WithNotifier makes Broadcast ring the doorbell of the peer on the vector and Wait listen to it, so waiting doesn't
+// need to poll. Both sides should configure it for the same vector.
+func (w *Waiter) WithNotifier(n ivshmem.Notifier, peer, vector uint16) *Waiter {
+	w.bell = doorbell{notifier: n, peer: peer, vector: vector}
+	return w
+}
+
+// Sequence returns the number of broadcasts so far, wrapping around.
+func (w *Waiter) Sequence() uint32 {
+	return atomic.LoadUint32(w.word)
+}
+
+// Broadcast wakes the waiters on both sides after the state changed, everything written before is visible to them.
+func (w *Waiter) Broadcast() error {
+	atomic.AddUint32(w.word, 1)
+	return w.bell.ring()
+}
+
+// Wait blocks until the condition returns true or the context is done. The condition is evaluated right away and
+// again after every broadcast.
+func (w *Waiter) Wait(ctx context.Context, cond func() bool) error {
+	for {
+		seq := w.Sequence()
+		if cond() {
+			return nil
+		}
+
+		if err := w.WaitChange(ctx, seq); err != nil {
+			return err
+		}
+	}
+}
+
+// WaitChange blocks until the sequence differs from the given one or the context is done, for waiters keeping track
+// of the sequence themselves.
+func (w *Waiter) WaitChange(ctx context.Context, seq uint32) error {
+	return w.bell.wait(ctx, func() bool { return w.Sequence() != seq })
+}
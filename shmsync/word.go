@@ -0,0 +1,163 @@
+// Package shmsync provides synchronization primitives living in the shared memory region, so they work between the
+// host and the guest just like between goroutines. All of them are built on words of the region updated with
+// sync/atomic, whose operations are sequentially consistent: a store publishing a state has release semantics and the
+// load observing it has acquire semantics, so everything written before the store is visible after the load.
+package shmsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/internal/spin"
+)
+
+var ErrOutOfBounds = errors.New("word out of bounds")
+var ErrUnaligned = errors.New("word not aligned")
+
+// word32 returns the 32 bit word at the offset for atomic access.
+func word32(mem []byte, off int) (*uint32, error) {
+	if off < 0 || off+4 > len(mem) {
+		return nil, fmt.Errorf("%w: 4 bytes at offset %d of %d", ErrOutOfBounds, off, len(mem))
+	}
+
+	ptr := unsafe.Pointer(&mem[off])
+	if uintptr(ptr)%4 != 0 {
+		return nil, fmt.Errorf("%w: offset %d is not 4 byte aligned", ErrUnaligned, off)
+	}
+
+	return (*uint32)(ptr), nil
+}
+
+// word64 returns the 64 bit word at the offset for atomic access. It must be 8 byte aligned for the 64-bit atomics
+// of 32-bit platforms.
+func word64(mem []byte, off int) (*uint64, error) {
+	if off < 0 || off+8 > len(mem) {
+		return nil, fmt.Errorf("%w: 8 bytes at offset %d of %d", ErrOutOfBounds, off, len(mem))
+	}
+
+	ptr := unsafe.Pointer(&mem[off])
+	if uintptr(ptr)%8 != 0 {
+		return nil, fmt.Errorf("%w: offset %d is not 8 byte aligned", ErrUnaligned, off)
+	}
+
+	return (*uint64)(ptr), nil
+}
+
+// Backoff spins for a while, then yields and finally sleeps with a growing delay, for waiting on the peer which can't
+// wake us any other way. The zero value starts spinning, reset it to the zero value once the peer made progress.
+type Backoff = spin.Backoff
+
+// timer returns a channel firing after a delay growing with the attempts, for waits which are also woken by a doorbell.
+func timer(attempt *int) <-chan time.Time {
+	*attempt++
+	delay := time.Duration(*attempt) * time.Millisecond
+	if delay > 100*time.Millisecond {
+		delay = 100 * time.Millisecond
+	}
+
+	return time.After(delay)
+}
+
+// doorbell optionally wakes the waiters of a primitive with an interrupt instead of letting them poll.
+type doorbell struct {
+	notifier ivshmem.Notifier
+	peer     uint16
+	vector   uint16
+
+	listen  sync.Once
+	wake    <-chan struct{}
+	wakeErr error
+}
+
+// ring rings the doorbell of the peer, if there is one.
+func (d *doorbell) ring() error {
+	if d.notifier == nil {
+		return nil
+	}
+
+	return d.notifier.Notify(d.peer, d.vector)
+}
+
+// wait blocks until done returns true or the context is done, polling with a backoff unless the doorbell wakes it.
+func (d *doorbell) wait(ctx context.Context, done func() bool) error {
+	return d.waitLocal(ctx, done, nil)
+}
+
+// waitLocal is wait also woken by the local bell, which the doorbell can't do: it only reaches the peer.
+func (d *doorbell) waitLocal(ctx context.Context, done func() bool, local *localBell) error {
+	var wake <-chan struct{}
+	if d.notifier != nil {
+		d.listen.Do(func() { d.wake, d.wakeErr = d.notifier.Listen(d.vector) })
+		if d.wakeErr != nil {
+			return d.wakeErr
+		}
+
+		wake = d.wake
+	}
+
+	var b Backoff
+	var polls int
+	for {
+		// Taken before checking, so a ring in between isn't missed
+		var rung <-chan struct{}
+		if local != nil && wake != nil {
+			rung = local.wait()
+		}
+
+		if done() {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if wake == nil {
+			b.Wait()
+			continue
+		}
+
+		// The doorbell may have been rung before we started listening, so keep polling slowly as well
+		select {
+		case <-ctx.Done():
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+			}
+		case <-rung:
+		case <-timer(&polls):
+		}
+	}
+}
+
+// localBell wakes the goroutines of this side waiting on a primitive.
+type localBell struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel closed by the next ring.
+func (l *localBell) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ch == nil {
+		l.ch = make(chan struct{})
+	}
+
+	return l.ch
+}
+
+// ring wakes every goroutine waiting since before the call.
+func (l *localBell) ring() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ch != nil {
+		close(l.ch)
+		l.ch = nil
+	}
+}
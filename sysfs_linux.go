@@ -0,0 +1,58 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrInvalidAttribute = errors.New("invalid attribute name")
+
+// ReadAttribute reads a raw sysfs attribute of the device, like "config" or "msi_bus", for device features the library
+// doesn't model yet.
+func (g Guest) ReadAttribute(name string) ([]byte, error) {
+	path, err := g.attributePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read attribute: %w", checkDenied("read", path, err))
+	}
+
+	return data, nil
+}
+
+// WriteAttribute writes a raw sysfs attribute of the device, which usually needs root.
+func (g Guest) WriteAttribute(name string, data []byte) error {
+	path, err := g.attributePath(name)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open attribute: %w", checkDenied("open", path, err))
+	}
+	defer file.Close()
+
+	// sysfs takes the whole value in a single write
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("write attribute: %w", err)
+	}
+
+	return nil
+}
+
+// attributePath returns the path of the attribute, the name must not leave the device directory.
+func (g Guest) attributePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("%w: %q", ErrInvalidAttribute, name)
+	}
+
+	return devicePath(g.devDir, name), nil
+}
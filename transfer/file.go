@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TypicalAM/ivshmem"
+	"github.com/TypicalAM/ivshmem/frame"
+	"github.com/TypicalAM/ivshmem/ring"
+)
+
+var ErrInvalidName = errors.New("invalid file name")
+
+// PartialSuffix is appended to the name of a file while it is being received, after a dot and the first 8 bytes of its
+// hex SHA-256.
+const PartialSuffix = ".part"
+
+// OpenInterval is how often SendFile checks whether the receiver set up the channel yet.
+var OpenInterval = 10 * time.Millisecond
+
+// FileDestination stores a transfer as a file in a directory. The data goes into a partial file named after the
+// transfer and its hash first, which is renamed once the transfer is committed and its hash checked; the partial file
+// left by an interrupted attempt of the same content is where the next one resumes.
+type FileDestination struct {
+	dir     string
+	path    string
+	partial string
+	sum     Sum
+	f       *os.File
+}
+
+// NewFileDestination returns a destination storing the transfer in the directory.
+func NewFileDestination(dir string) *FileDestination {
+	return &FileDestination{dir: dir}
+}
+
+// Open opens the partial file of the transfer and returns its size. The name is the sender's, only its last element
+// is used so a file never lands outside the directory.
+func (d *FileDestination) Open(name string, size int64, sum Sum) (int64, error) {
+	base := filepath.Base(filepath.FromSlash(name))
+	if base == "." || base == ".." || base == string(filepath.Separator) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	d.path = filepath.Join(d.dir, base)
+	d.partial = d.path + "." + hex.EncodeToString(sum[:8]) + PartialSuffix
+	d.sum = sum
+	f, err := os.OpenFile(d.partial, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	// A partial file longer than the transfer belongs to another one
+	stored := info.Size()
+	if stored > size {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return 0, err
+		}
+
+		stored = 0
+	}
+
+	d.f = f
+	return stored, nil
+}
+
+// WriteAt writes into the partial file.
+func (d *FileDestination) WriteAt(p []byte, off int64) (int, error) {
+	if d.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	return d.f.WriteAt(p, off)
+}
+
+// Commit flushes the partial file, checks its hash and renames it to the name of the transfer. A partial file which
+// doesn't match the hash is removed, so the next attempt starts over.
+func (d *FileDestination) Commit() error {
+	if d.f == nil {
+		return os.ErrClosed
+	}
+
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(d.f, 0, 1<<63-1)); err != nil {
+		return fmt.Errorf("hash %s: %w", d.partial, err)
+	}
+
+	if err := d.Close(); err != nil {
+		return err
+	}
+
+	var sum Sum
+	if h.Sum(sum[:0]); sum != d.sum {
+		err := fmt.Errorf("%w: %s hashes to %x, want %x", ErrChecksum, d.partial, sum, d.sum)
+		return errors.Join(err, os.Remove(d.partial))
+	}
+
+	return os.Rename(d.partial, d.path)
+}
+
+// Close closes the partial file without committing it, it is kept for the next attempt.
+func (d *FileDestination) Close() error {
+	if d.f == nil {
+		return nil
+	}
+
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+// Path returns where the file is stored once committed, empty before Open.
+func (d *FileDestination) Path() string {
+	return d.path
+}
+
+// SendFile sends the file to the ReceiveFile on the other side of the region, waiting for the receiver to set up the
+// channel until the context is done. Sending a file again after an interrupted attempt resumes it.
+func SendFile(ctx context.Context, m ivshmem.Mapper, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s is not a regular file", ErrInvalidName, path)
+	}
+
+	mem, err := ivshmem.MapMemory(m)
+	if err != nil {
+		return err
+	}
+
+	var ch *ring.Channel
+	for {
+		if ch, err = ring.OpenChannel(mem); err == nil {
+			break
+		} else if !errors.Is(err, ring.ErrInvalidMagic) {
+			return fmt.Errorf("open channel: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(OpenInterval):
+		}
+	}
+
+	stop := closeOnDone(ctx, ch)
+	defer stop()
+	err = Send(ctx, frame.NewConn(ch, ivshmem.DefaultLimits), filepath.Base(path), f, info.Size(), Options{})
+	if err != nil && ctx.Err() != nil {
+		// The reads and writes failed because closeOnDone closed the channel
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// ReceiveFile sets up a channel over the region, receives a single file from SendFile into the directory and returns
+// its path. The receiver must be up before the sender.
+func ReceiveFile(ctx context.Context, m ivshmem.Mapper, dir string) (string, error) {
+	mem, err := ivshmem.MapMemory(m)
+	if err != nil {
+		return "", err
+	}
+
+	ch, err := ring.InitChannel(mem)
+	if err != nil {
+		return "", fmt.Errorf("init channel: %w", err)
+	}
+
+	stop := closeOnDone(ctx, ch)
+	defer stop()
+
+	dst := NewFileDestination(dir)
+	defer dst.Close()
+	if _, err := Receive(ctx, frame.NewConn(ch, ivshmem.DefaultLimits), dst); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		return "", err
+	}
+
+	return dst.Path(), nil
+}
+
+// closeOnDone closes the channel once the context is done, unblocking its reads and writes, and returns the function
+// closing it when the transfer is over.
+func closeOnDone(ctx context.Context, ch *ring.Channel) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		ch.Close()
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,333 @@
+// Package transfer streams files or buffers larger than the region through a frame.Conn in chunks, so payloads of
+// gigabytes cross a region of a few megabytes. The receiver acknowledges every chunk and the sender keeps a window of
+// chunks in flight. An interrupted transfer is resumed by sending it again: the receiver tells how much it already
+// stored and the sender continues from there. The offer carries the SHA-256 of the whole payload, the destination only
+// resumes data stored for the same hash and checks the result against it before committing.
+//
+// The messages are frames with a checksum, their metadata carries:
+//
+//	xfer-type    offer, accept, chunk, ack, done, complete or error
+//	xfer-name    name of the transfer (offer)
+//	xfer-size    total size in bytes (offer)
+//	xfer-sha256  hex SHA-256 of the whole payload (offer)
+//	xfer-offset  where the receiver resumes (accept), where the chunk goes (chunk), bytes stored so far (ack)
+//	xfer-seq     sequence number of the chunk, counted from the resume offset (chunk, ack)
+//	xfer-error   why the receiver gave up (error)
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/TypicalAM/ivshmem/frame"
+)
+
+var ErrProtocol = errors.New("transfer protocol error")
+var ErrRejected = errors.New("transfer rejected")
+var ErrChecksum = errors.New("transfer checksum mismatch")
+
+// Message types.
+const (
+	typeOffer    = "offer"
+	typeAccept   = "accept"
+	typeChunk    = "chunk"
+	typeAck      = "ack"
+	typeDone     = "done"
+	typeComplete = "complete"
+	typeError    = "error"
+)
+
+// Metadata keys.
+const (
+	keyType   = "xfer-type"
+	keyName   = "xfer-name"
+	keySize   = "xfer-size"
+	keySum    = "xfer-sha256"
+	keyOffset = "xfer-offset"
+	keySeq    = "xfer-seq"
+	keyError  = "xfer-error"
+)
+
+// Default options.
+const (
+	DefaultChunkSize = 1 << 20
+	DefaultWindow    = 4
+)
+
+// maxErrorLength is the longest metadata value, longer error messages are cut.
+const maxErrorLength = 255
+
+// Options tune the sender, the zero value sends chunks of DefaultChunkSize with DefaultWindow of them in flight.
+type Options struct {
+	ChunkSize int
+	Window    int
+
+	// Progress is called after every acknowledged chunk with the bytes stored by the receiver so far.
+	Progress func(done, total int64)
+}
+
+// Sum is the SHA-256 of the payload of a transfer.
+type Sum [sha256.Size]byte
+
+// Destination stores the received data, like a partially written file.
+type Destination interface {
+	// Open prepares storing the named transfer of the size and returns how many bytes of it are already stored from
+	// an interrupted attempt, the transfer resumes there. Only bytes stored for a transfer with the same sum may be
+	// resumed.
+	Open(name string, size int64, sum Sum) (int64, error)
+
+	io.WriterAt
+
+	// Commit is called once all the bytes are stored. It must fail with ErrChecksum, and drop the stored bytes, when
+	// they don't hash to the sum given to Open.
+	Commit() error
+}
+
+// Send sends size bytes of src under the name and waits until the receiver committed them, or the context is done.
+// The whole source is read once to hash it before the offer. The context is checked between the messages, close the
+// underlying stream to interrupt a blocked one.
+func Send(ctx context.Context, conn frame.Conn, name string, src io.ReaderAt, size int64, opts Options) error {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = DefaultWindow
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(src, 0, size)); err != nil {
+		return fmt.Errorf("hash %s: %w", name, err)
+	}
+
+	offer := message(typeOffer)
+	offer.Metadata.Set(keyName, name)
+	offer.Metadata.Set(keySize, strconv.FormatInt(size, 10))
+	offer.Metadata.Set(keySum, hex.EncodeToString(h.Sum(nil)))
+	if err := conn.Send(ctx, offer); err != nil {
+		return fmt.Errorf("send offer: %w", err)
+	}
+
+	accept, err := expect(ctx, conn, typeAccept)
+	if err != nil {
+		return err
+	}
+
+	offset, err := intValue(accept, keyOffset)
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 || offset > size {
+		return fmt.Errorf("%w: resume at %d of %d bytes", ErrProtocol, offset, size)
+	}
+
+	buf := make([]byte, opts.ChunkSize)
+	sent, acked := offset, offset
+	var seq, inFlight int64
+	for acked < size {
+		if sent < size && inFlight < int64(opts.Window) {
+			n := int64(opts.ChunkSize)
+			if size-sent < n {
+				n = size - sent
+			}
+
+			if read, err := src.ReadAt(buf[:n], sent); err != nil && !(errors.Is(err, io.EOF) && int64(read) == n) {
+				return fmt.Errorf("read at %d: %w", sent, err)
+			}
+
+			chunk := message(typeChunk)
+			chunk.Payload = buf[:n]
+			chunk.Metadata.Set(keyOffset, strconv.FormatInt(sent, 10))
+			chunk.Metadata.Set(keySeq, strconv.FormatInt(seq, 10))
+			if err := conn.Send(ctx, chunk); err != nil {
+				return fmt.Errorf("send chunk %d: %w", seq, err)
+			}
+
+			sent += n
+			seq++
+			inFlight++
+			continue
+		}
+
+		ack, err := expect(ctx, conn, typeAck)
+		if err != nil {
+			return err
+		}
+
+		stored, err := intValue(ack, keyOffset)
+		if err != nil {
+			return err
+		}
+
+		if stored <= acked || stored > sent {
+			return fmt.Errorf("%w: acknowledged %d bytes, %d were acknowledged and %d sent", ErrProtocol, stored, acked, sent)
+		}
+
+		acked = stored
+		inFlight--
+		if opts.Progress != nil {
+			opts.Progress(acked, size)
+		}
+	}
+
+	if err := conn.Send(ctx, message(typeDone)); err != nil {
+		return fmt.Errorf("send done: %w", err)
+	}
+
+	_, err = expect(ctx, conn, typeComplete)
+	return err
+}
+
+// Receive receives a single transfer into the destination and returns its name once it is committed. The errors of
+// the destination are reported to the sender before they are returned.
+func Receive(ctx context.Context, conn frame.Conn, dst Destination) (string, error) {
+	offer, err := expect(ctx, conn, typeOffer)
+	if err != nil {
+		return "", err
+	}
+
+	name := offer.Metadata.Get(keyName)
+	size, err := intValue(offer, keySize)
+	if err != nil {
+		return name, err
+	}
+
+	var sum Sum
+	if n, err := hex.Decode(sum[:], []byte(offer.Metadata.Get(keySum))); err != nil || n != len(sum) {
+		return name, reject(ctx, conn, fmt.Errorf("%w: %s %q", ErrProtocol, keySum, offer.Metadata.Get(keySum)))
+	}
+
+	offset, err := dst.Open(name, size, sum)
+	if err != nil {
+		return name, reject(ctx, conn, fmt.Errorf("open %s: %w", name, err))
+	}
+
+	if offset < 0 || offset > size {
+		offset = 0
+	}
+
+	accept := message(typeAccept)
+	accept.Metadata.Set(keyOffset, strconv.FormatInt(offset, 10))
+	if err := conn.Send(ctx, accept); err != nil {
+		return name, fmt.Errorf("send accept: %w", err)
+	}
+
+	var seq int64
+	for {
+		f, err := recv(ctx, conn)
+		if err != nil {
+			return name, err
+		}
+
+		switch typ := f.Metadata.Get(keyType); typ {
+		case typeChunk:
+			chunkOffset, err := intValue(f, keyOffset)
+			if err != nil {
+				return name, reject(ctx, conn, err)
+			}
+
+			chunkSeq, err := intValue(f, keySeq)
+			if err != nil {
+				return name, reject(ctx, conn, err)
+			}
+
+			if chunkSeq != seq || chunkOffset != offset || offset+int64(len(f.Payload)) > size {
+				return name, reject(ctx, conn, fmt.Errorf("%w: chunk %d at %d, expected chunk %d at %d", ErrProtocol, chunkSeq, chunkOffset, seq, offset))
+			}
+
+			if _, err := dst.WriteAt(f.Payload, offset); err != nil {
+				return name, reject(ctx, conn, fmt.Errorf("write at %d: %w", offset, err))
+			}
+
+			offset += int64(len(f.Payload))
+			ack := message(typeAck)
+			ack.Metadata.Set(keyOffset, strconv.FormatInt(offset, 10))
+			ack.Metadata.Set(keySeq, strconv.FormatInt(seq, 10))
+			if err := conn.Send(ctx, ack); err != nil {
+				return name, fmt.Errorf("send ack: %w", err)
+			}
+
+			seq++
+		case typeDone:
+			if offset != size {
+				return name, reject(ctx, conn, fmt.Errorf("%w: done after %d of %d bytes", ErrProtocol, offset, size))
+			}
+
+			if err := dst.Commit(); err != nil {
+				return name, reject(ctx, conn, fmt.Errorf("commit %s: %w", name, err))
+			}
+
+			if err := conn.Send(ctx, message(typeComplete)); err != nil {
+				return name, fmt.Errorf("send complete: %w", err)
+			}
+
+			return name, nil
+		default:
+			return name, reject(ctx, conn, fmt.Errorf("%w: unexpected %q message", ErrProtocol, typ))
+		}
+	}
+}
+
+// message returns an empty message of the type.
+func message(typ string) frame.Frame {
+	f := frame.Frame{Checked: true}
+	f.Metadata.Set(keyType, typ)
+	return f
+}
+
+// recv receives the next message, turning an error message of the other side into ErrRejected.
+func recv(ctx context.Context, conn frame.Conn) (frame.Frame, error) {
+	f, err := conn.Recv(ctx)
+	if err != nil {
+		return f, fmt.Errorf("receive: %w", err)
+	}
+
+	if f.Metadata.Get(keyType) == typeError {
+		return f, fmt.Errorf("%w: %s", ErrRejected, f.Metadata.Get(keyError))
+	}
+
+	return f, nil
+}
+
+// expect receives the next message, which must be of the type.
+func expect(ctx context.Context, conn frame.Conn, typ string) (frame.Frame, error) {
+	f, err := recv(ctx, conn)
+	if err != nil {
+		return f, err
+	}
+
+	if got := f.Metadata.Get(keyType); got != typ {
+		return f, fmt.Errorf("%w: expected %q, got %q", ErrProtocol, typ, got)
+	}
+
+	return f, nil
+}
+
+// reject tells the sender why the transfer failed and returns the error.
+func reject(ctx context.Context, conn frame.Conn, err error) error {
+	msg := err.Error()
+	if len(msg) > maxErrorLength {
+		msg = msg[:maxErrorLength]
+	}
+
+	f := message(typeError)
+	f.Metadata.Set(keyError, msg)
+	conn.Send(ctx, f)
+	return err
+}
+
+// intValue parses the integer metadata value.
+func intValue(f frame.Frame, key string) (int64, error) {
+	v, err := strconv.ParseInt(f.Metadata.Get(key), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s %q", ErrProtocol, key, f.Metadata.Get(key))
+	}
+
+	return v, nil
+}
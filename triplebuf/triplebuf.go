@@ -0,0 +1,349 @@
+// Package triplebuf streams frames, like captured screens or rendered output, through three slots in the shared
+// memory region so neither side ever waits for the other. The producer renders into its back slot, the consumer reads
+// its front slot, and the third slot sits in between: publishing swaps the back slot with the middle one and sets the
+// dirty flag, taking a frame swaps the middle slot with the front one and clears it. The swaps are a compare and swap
+// of a single word, so the consumer never sees a partially written frame and a slow consumer only skips frames.
+//
+// Every Init draws a new session and bumps the epoch, the views fail with ErrStale once a peer initialized the buffer
+// again, their slot indices no longer mean anything then.
+//
+// Layout, all the values are little endian:
+//
+//	 0 magic (uint32)
+//	 4 version (uint32)
+//	 8 state: middle slot (bits 0-1), dirty flag (bit 2) (uint32)
+//	12 back slot, owned by the producer (uint32)
+//	16 front slot, owned by the consumer (uint32)
+//	20 epoch (uint32)
+//	24 frame size (uint64)
+//	32 frames published (uint64)
+//	40 frames skipped, published over before the consumer took them (uint64)
+//	48 session ID (16 bytes)
+//	64 slot headers: sequence number (uint64), length (uint64), padded to 64 bytes
+//	   slots, page aligned
+package triplebuf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/TypicalAM/ivshmem/internal/shmhdr"
+)
+
+var ErrRegionTooSmall = shmhdr.ErrRegionTooSmall
+var ErrInvalidMagic = shmhdr.ErrInvalidMagic
+var ErrUnsupportedVersion = shmhdr.ErrUnsupportedVersion
+var ErrInvalidHeader = errors.New("invalid header")
+var ErrTooLarge = errors.New("frame too large")
+var ErrCorrupted = errors.New("triple buffer corrupted")
+var ErrStale = shmhdr.ErrStale
+
+const (
+	Magic      uint32 = 0x42545649 // "IVTB" when read as little endian bytes
+	Version    uint32 = 2
+	HeaderSize        = 64
+
+	// SlotHeaderSize is the size of the header of every slot.
+	SlotHeaderSize = 64
+
+	// PageSize is the alignment of the slots relative to the start of the region.
+	PageSize = 4096
+)
+
+// Header field offsets.
+const (
+	offMagic     = 0
+	offVersion   = 4
+	offState     = 8
+	offBack      = 12
+	offFront     = 16
+	offEpoch     = 20
+	offFrameSize = 24
+	offPublished = 32
+	offSkipped   = 40
+	offSession   = 48
+)
+
+// Slot header field offsets.
+const (
+	slotSequence = 0
+	slotLength   = 8
+)
+
+const (
+	slots     = 3
+	slotMask  = 3
+	dirtyFlag = 4
+)
+
+// PollInterval is how often Next checks for a new frame.
+var PollInterval = time.Millisecond
+
+// Frame is a frame taken by the consumer.
+type Frame struct {
+	Seq  uint64 // Number of the frame, counted from 1
+	Data []byte // Aliases the front slot, valid until the next Take
+}
+
+// Buffer is a view of the triple buffer stored in the region. There is a single producer and a single consumer,
+// each used by one goroutine.
+type Buffer struct {
+	mem       []byte
+	frameSize uint64
+	state     *uint32
+	back      *uint32
+	front     *uint32
+	published *uint64
+	skipped   *uint64
+	stamp     shmhdr.Stamp
+}
+
+// Size returns the bytes the triple buffer needs for frames of the size.
+func Size(frameSize int) uint64 {
+	return dataOffset() + slots*stride(uint64(frameSize))
+}
+
+// Init writes a fresh header into the region and returns the triple buffer. It is called by the producer.
+func Init(mem []byte, frameSize int) (*Buffer, error) {
+	if frameSize <= 0 {
+		return nil, fmt.Errorf("%w: frames of %d bytes", ErrInvalidHeader, frameSize)
+	}
+
+	b, err := view(mem, uint64(frameSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.stamp, err = shmhdr.NewStamp(mem, Magic, offSession, offEpoch); err != nil {
+		return nil, err
+	}
+
+	for i := range mem[HeaderSize:dataOffset()] {
+		mem[HeaderSize+i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(mem[offVersion:], Version)
+	binary.LittleEndian.PutUint64(mem[offFrameSize:], b.frameSize)
+	atomic.StoreUint32(b.back, 0)
+	atomic.StoreUint32(b.state, 1)
+	atomic.StoreUint32(b.front, 2)
+	atomic.StoreUint64(b.published, 0)
+	atomic.StoreUint64(b.skipped, 0)
+
+	shmhdr.Publish(mem, Magic)
+	return b, nil
+}
+
+// Open validates the header written by Init and returns the triple buffer. It is called by the consumer.
+func Open(mem []byte) (*Buffer, error) {
+	if err := shmhdr.Check(mem, HeaderSize, Magic, Version); err != nil {
+		return nil, err
+	}
+
+	frameSize := binary.LittleEndian.Uint64(mem[offFrameSize:])
+	if frameSize == 0 || frameSize > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: frames of %d bytes", ErrInvalidHeader, frameSize)
+	}
+
+	b, err := view(mem, frameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// The three slots must be distinct, or the sides would write into the slot being read
+	back, middle, front := atomic.LoadUint32(b.back), atomic.LoadUint32(b.state)&slotMask, atomic.LoadUint32(b.front)
+	if back >= slots || middle >= slots || front >= slots || back == middle || middle == front || front == back {
+		return nil, fmt.Errorf("%w: slots %d, %d and %d", ErrInvalidHeader, back, middle, front)
+	}
+
+	b.stamp = shmhdr.LoadStamp(mem, offSession, offEpoch)
+	return b, nil
+}
+
+// view returns the triple buffer over the region.
+func view(mem []byte, frameSize uint64) (*Buffer, error) {
+	if need := dataOffset() + slots*stride(frameSize); need > uint64(len(mem)) {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d", ErrRegionTooSmall, need, len(mem))
+	}
+
+	// 64-bit atomics need 8 byte alignment on 32-bit platforms, mapped regions are page aligned
+	if uintptr(unsafe.Pointer(&mem[0]))%8 != 0 {
+		return nil, fmt.Errorf("%w: the region must be 8 byte aligned", ErrInvalidHeader)
+	}
+
+	return &Buffer{
+		mem:       mem,
+		frameSize: frameSize,
+		state:     (*uint32)(unsafe.Pointer(&mem[offState])),
+		back:      (*uint32)(unsafe.Pointer(&mem[offBack])),
+		front:     (*uint32)(unsafe.Pointer(&mem[offFront])),
+		published: (*uint64)(unsafe.Pointer(&mem[offPublished])),
+		skipped:   (*uint64)(unsafe.Pointer(&mem[offSkipped])),
+	}, nil
+}
+
+// Session returns the ID of the initialization the buffer was opened with.
+func (b *Buffer) Session() shmhdr.Session {
+	return b.stamp.Session()
+}
+
+// Epoch returns the number of times the buffer was initialized, when it was opened.
+func (b *Buffer) Epoch() uint32 {
+	return b.stamp.Epoch()
+}
+
+// Stale reports whether a peer initialized the buffer again since it was opened, the view must be reopened then.
+func (b *Buffer) Stale() bool {
+	return b.stamp.Check() != nil
+}
+
+// FrameSize returns the size of the slots.
+func (b *Buffer) FrameSize() int {
+	return int(b.frameSize)
+}
+
+// Published returns the number of frames published so far.
+func (b *Buffer) Published() uint64 {
+	return atomic.LoadUint64(b.published)
+}
+
+// Skipped returns the number of frames the consumer never took, because newer ones were published first.
+func (b *Buffer) Skipped() uint64 {
+	return atomic.LoadUint64(b.skipped)
+}
+
+// Back returns the slot the producer renders the next frame into. It is only touched by the producer, but holds an
+// older frame, so render the whole frame or the parts which changed since two frames ago.
+func (b *Buffer) Back() []byte {
+	return b.slot(atomic.LoadUint32(b.back))
+}
+
+// Publish publishes the first length bytes of the back slot as the next frame, swapping it with the middle slot, and
+// returns its sequence number. It never waits for the consumer.
+func (b *Buffer) Publish(length int) (uint64, error) {
+	if length < 0 || uint64(length) > b.frameSize {
+		return 0, fmt.Errorf("%w: %d bytes into %d", ErrTooLarge, length, b.frameSize)
+	}
+
+	if err := b.stamp.Check(); err != nil {
+		return 0, err
+	}
+
+	back := atomic.LoadUint32(b.back)
+	seq := atomic.LoadUint64(b.published) + 1
+	header := b.slotHeader(back)
+	binary.LittleEndian.PutUint64(header[slotLength:], uint64(length))
+	binary.LittleEndian.PutUint64(header[slotSequence:], seq)
+
+	for {
+		old := atomic.LoadUint32(b.state)
+		if err := checkSlots(back, old&slotMask); err != nil {
+			return 0, err
+		}
+
+		if atomic.CompareAndSwapUint32(b.state, old, back|dirtyFlag) {
+			if old&dirtyFlag != 0 {
+				atomic.AddUint64(b.skipped, 1)
+			}
+
+			atomic.StoreUint32(b.back, old&slotMask)
+			atomic.StoreUint64(b.published, seq)
+			return seq, nil
+		}
+	}
+}
+
+// Dirty reports whether a frame newer than the front one is waiting.
+func (b *Buffer) Dirty() bool {
+	return atomic.LoadUint32(b.state)&dirtyFlag != 0
+}
+
+// Take takes the latest published frame, swapping the front slot with the middle one. It returns false when no frame
+// was published since the last Take, the front slot then still holds the frame taken before. It never waits for the
+// producer, and fails with ErrStale once a peer initialized the buffer again or with ErrCorrupted when the slot
+// indices it finds aren't three distinct slots.
+func (b *Buffer) Take() (Frame, bool, error) {
+	if err := b.stamp.Check(); err != nil {
+		return Frame{}, false, err
+	}
+
+	for {
+		old := atomic.LoadUint32(b.state)
+		front := atomic.LoadUint32(b.front)
+		if err := checkSlots(front, old&slotMask); err != nil {
+			return Frame{}, false, err
+		}
+
+		if old&dirtyFlag == 0 {
+			return b.frame(front), false, nil
+		}
+
+		if atomic.CompareAndSwapUint32(b.state, old, front) {
+			atomic.StoreUint32(b.front, old&slotMask)
+			return b.frame(old & slotMask), true, nil
+		}
+	}
+}
+
+// Next waits for a frame newer than the front one and takes it, or until the context is done. It fails like Take
+// when the buffer is stale or corrupted.
+func (b *Buffer) Next(ctx context.Context) (Frame, error) {
+	for {
+		if f, ok, err := b.Take(); ok || err != nil {
+			return f, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Frame{}, ctx.Err()
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// checkSlots checks the slot owned by this side and the middle slot, which the peer swaps, are distinct slots.
+func checkSlots(own, middle uint32) error {
+	if own >= slots || middle >= slots || own == middle {
+		return fmt.Errorf("%w: slot %d and middle slot %d", ErrCorrupted, own, middle)
+	}
+
+	return nil
+}
+
+// frame returns the frame stored in the slot.
+func (b *Buffer) frame(slot uint32) Frame {
+	header := b.slotHeader(slot)
+	length := binary.LittleEndian.Uint64(header[slotLength:])
+	if length > b.frameSize {
+		length = b.frameSize
+	}
+
+	return Frame{Seq: binary.LittleEndian.Uint64(header[slotSequence:]), Data: b.slot(slot)[:length]}
+}
+
+// slotHeader returns the header of the slot.
+func (b *Buffer) slotHeader(slot uint32) []byte {
+	off := HeaderSize + uint64(slot)*SlotHeaderSize
+	return b.mem[off : off+SlotHeaderSize]
+}
+
+// slot returns the data of the slot.
+func (b *Buffer) slot(slot uint32) []byte {
+	off := dataOffset() + uint64(slot)*stride(b.frameSize)
+	return b.mem[off : off+b.frameSize : off+b.frameSize]
+}
+
+// dataOffset returns the offset of the first slot.
+func dataOffset() uint64 {
+	return (HeaderSize + slots*SlotHeaderSize + PageSize - 1) &^ (PageSize - 1)
+}
+
+// stride returns the size of a slot with its padding.
+func stride(frameSize uint64) uint64 {
+	return (frameSize + PageSize - 1) &^ (PageSize - 1)
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package ivshmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var ErrNoUIO = errors.New("device not bound to a uio driver")
+
+// uio is the /dev/uioX file of a device bound to uio_ivshmem (or uio_pci_generic), opened on the first wait. It is
+// shared by the copies of the Guest value.
+type uio struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// WaitInterrupt blocks until a peer rings the doorbell of this guest and returns the total number of interrupts the
+// device got so far, which tells the caller how many it missed. The device has to be bound to a uio driver, all the
+// vectors are then delivered as one.
+func (g Guest) WaitInterrupt(ctx context.Context) (uint32, error) {
+	file, err := g.irq.open(g.devDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// The uio file is pollable, so a past deadline wakes the blocked read
+	file.SetReadDeadline(time.Time{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			file.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	// The count is a native endian 32-bit word
+	var count uint32
+	if _, err := file.Read(unsafe.Slice((*byte)(unsafe.Pointer(&count)), 4)); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		return 0, fmt.Errorf("wait for interrupt: %w", err)
+	}
+
+	// uio_pci_generic masks the legacy interrupt after every delivery, unmask it again. MSI based drivers like
+	// uio_ivshmem don't implement the write, which is fine.
+	unmask := uint32(1)
+	file.Write(unsafe.Slice((*byte)(unsafe.Pointer(&unmask)), 4))
+	return count, nil
+}
+
+// open opens the uio file of the device unless it is already open.
+func (u *uio) open(devDir string) (*os.File, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file != nil {
+		return u.file, nil
+	}
+
+	// A device bound to a uio driver has a uio/uioX directory in sysfs
+	matches, err := filepath.Glob(devicePath(devDir, "uio/uio*"))
+	if err != nil || len(matches) == 0 {
+		return nil, ErrNoUIO
+	}
+
+	path := filepath.Join("/dev", filepath.Base(matches[0]))
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open uio device: %w", checkDenied("open", path, err))
+	}
+
+	u.file = file
+	return file, nil
+}
+
+// close closes the uio file if it was opened.
+func (u *uio) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.file == nil {
+		return nil
+	}
+
+	err := u.file.Close()
+	u.file = nil
+	return err
+}
@@ -0,0 +1,169 @@
+// Package untrusted reads values from memory laid out by a peer which isn't trusted, like a third-party guest driver
+// or a compromised VM. Every offset and length coming from the memory is checked against the bounds of the view and
+// a maximum length before use, overflowing arithmetic included, so a malicious layout can't make the reader panic,
+// read past the region or allocate without limit.
+//
+// The values are copied out: the peer can change the memory at any time, so anything validated must not be read from
+// the region again.
+package untrusted
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrOutOfBounds = errors.New("out of bounds")
+var ErrTooLong = errors.New("longer than allowed")
+var ErrUnterminated = errors.New("string not terminated")
+
+// View is a bounds-checked view of the memory, all the integers are little endian.
+type View struct {
+	mem []byte
+}
+
+// New returns a view of the memory.
+func New(mem []byte) View {
+	return View{mem: mem}
+}
+
+// Len returns the size of the view.
+func (v View) Len() uint64 {
+	return uint64(len(v.mem))
+}
+
+// Sub returns the view of n bytes at the offset, for parsing a nested structure relative to its own start.
+func (v View) Sub(off, n uint64) (View, error) {
+	if err := v.check(off, n); err != nil {
+		return View{}, err
+	}
+
+	return View{mem: v.mem[off : off+n : off+n]}, nil
+}
+
+// Bytes returns a copy of the n bytes at the offset.
+func (v View) Bytes(off, n uint64) ([]byte, error) {
+	if err := v.check(off, n); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), v.mem[off:off+n]...), nil
+}
+
+// Uint8 returns the byte at the offset.
+func (v View) Uint8(off uint64) (uint8, error) {
+	if err := v.check(off, 1); err != nil {
+		return 0, err
+	}
+
+	return v.mem[off], nil
+}
+
+// Uint16 returns the 16-bit integer at the offset.
+func (v View) Uint16(off uint64) (uint16, error) {
+	if err := v.check(off, 2); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(v.mem[off:]), nil
+}
+
+// Uint32 returns the 32-bit integer at the offset.
+func (v View) Uint32(off uint64) (uint32, error) {
+	if err := v.check(off, 4); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(v.mem[off:]), nil
+}
+
+// Uint64 returns the 64-bit integer at the offset.
+func (v View) Uint64(off uint64) (uint64, error) {
+	if err := v.check(off, 8); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(v.mem[off:]), nil
+}
+
+// CString returns the NUL-terminated string at the offset. The terminator must be found within max bytes, the
+// terminator included, and within the view.
+func (v View) CString(off, max uint64) (string, error) {
+	if off > v.Len() {
+		return "", fmt.Errorf("%w: offset %d of %d", ErrOutOfBounds, off, v.Len())
+	}
+
+	window := v.mem[off:]
+	if uint64(len(window)) > max {
+		window = window[:max]
+	}
+
+	end := bytes.IndexByte(window, 0)
+	if end < 0 {
+		if uint64(len(window)) == max {
+			return "", fmt.Errorf("%w: string at offset %d longer than %d bytes", ErrTooLong, off, max)
+		}
+
+		return "", fmt.Errorf("%w: at offset %d", ErrUnterminated, off)
+	}
+
+	return string(window[:end]), nil
+}
+
+// Prefixed returns a copy of the bytes at the offset preceded by their length, an unsigned integer of the given width
+// in bytes (1, 2, 4 or 8). Lengths above max are refused before anything is allocated.
+func (v View) Prefixed(off uint64, width int, max uint64) ([]byte, error) {
+	var length uint64
+	var err error
+	switch width {
+	case 1:
+		var n uint8
+		n, err = v.Uint8(off)
+		length = uint64(n)
+	case 2:
+		var n uint16
+		n, err = v.Uint16(off)
+		length = uint64(n)
+	case 4:
+		var n uint32
+		n, err = v.Uint32(off)
+		length = uint64(n)
+	case 8:
+		length, err = v.Uint64(off)
+	default:
+		return nil, fmt.Errorf("invalid length width %d", width)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if length > max {
+		return nil, fmt.Errorf("%w: %d bytes at offset %d, at most %d", ErrTooLong, length, off, max)
+	}
+
+	return v.Bytes(off+uint64(width), length)
+}
+
+// Array returns a copy of count elements of size bytes each at the offset, refusing more than max elements.
+func (v View) Array(off, count, size, max uint64) ([]byte, error) {
+	if count > max {
+		return nil, fmt.Errorf("%w: %d elements at offset %d, at most %d", ErrTooLong, count, off, max)
+	}
+
+	if size != 0 && count > ^uint64(0)/size {
+		return nil, fmt.Errorf("%w: %d elements of %d bytes", ErrOutOfBounds, count, size)
+	}
+
+	return v.Bytes(off, count*size)
+}
+
+// check validates that the n bytes at the offset are within the view.
+func (v View) check(off, n uint64) error {
+	if off > v.Len() || n > v.Len()-off {
+		return fmt.Errorf("%w: %d bytes at offset %d of %d", ErrOutOfBounds, n, off, v.Len())
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package ivshmem
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+var ErrOutOfBounds = errors.New("out of bounds")
+var ErrUnaligned = errors.New("unaligned")
+var ErrInvalidType = errors.New("invalid type")
+
+// View returns the value of type T stored at the offset of the shared memory, so a C compatible struct shared with
+// the guest is read and written as a Go struct instead of going through binary.Read and binary.Write. The offset must
+// be aligned for T and T must fit into the region. T must be made of fixed size numbers, bools, arrays and structs of
+// them: pointers, slices, strings, maps and the like point outside the region and are rejected.
+//
+// The fields have the byte order of the machine and the padding of Go, which matches C on the platforms Go and QEMU
+// share as long as the struct mirrors the C one field by field; add explicit padding fields where C packs the struct.
+// The pointer is valid while the mapper stays mapped. Concurrent access of both sides needs the atomic accessors or a
+// lock like any other shared memory.
+func View[T any](m Mapper, offset uint64) (*T, error) {
+	mem, err := sharedMem(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var zero T
+	typ := reflect.TypeOf(&zero).Elem()
+	if err := checkPlain(typ); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidType, typ, err)
+	}
+
+	size := uint64(unsafe.Sizeof(zero))
+	if offset > uint64(len(mem)) || size > uint64(len(mem))-offset {
+		return nil, fmt.Errorf("%w: %d bytes of %s at %d of a %d byte region", ErrOutOfBounds, size, typ, offset, len(mem))
+	}
+
+	if size == 0 {
+		return &zero, nil
+	}
+
+	p := unsafe.Pointer(&mem[offset])
+	if align := uintptr(unsafe.Alignof(zero)); uintptr(p)%align != 0 {
+		return nil, fmt.Errorf("%w: %s at %d needs %d byte alignment", ErrUnaligned, typ, offset, align)
+	}
+
+	return (*T)(p), nil
+}
+
+// checkPlain reports why the type can't live in the shared memory, nil if it can.
+func checkPlain(typ reflect.Type) error {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return nil
+	case reflect.Array:
+		return checkPlain(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if err := checkPlain(typ.Field(i).Type); err != nil {
+				return fmt.Errorf("field %s: %w", typ.Field(i).Name, err)
+			}
+		}
+
+		return nil
+	default:
+		// int, uint and uintptr change size with the platform, the rest points outside the region
+		return fmt.Errorf("%s is not a fixed size plain value", typ.Kind())
+	}
+}